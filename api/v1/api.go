@@ -14,6 +14,7 @@ package v1
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -118,6 +119,7 @@ func (api *API) Register(r *route.Router) {
 
 	r.Get("/status", wrap("api/v1/status", api.status))
 	r.Get("/metrics", wrap("api/v1/metrics", api.metrics))
+	r.Del("/metrics", wrap("api/v1/delete_metrics", api.deleteMetrics))
 }
 
 type metrics struct {
@@ -150,6 +152,47 @@ func (api *API) metrics(w http.ResponseWriter, r *http.Request) {
 	api.respond(w, res)
 }
 
+// deleteMetrics deletes all groups matching any of the selectors given as
+// match[] parameters.
+func (api *API) deleteMetrics(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		api.respondError(w, apiError{typ: errorBadData, err: err}, nil)
+		return
+	}
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		api.respondError(w, apiError{
+			typ: errorBadData,
+			err: errors.New("no match[] parameter provided"),
+		}, nil)
+		return
+	}
+	matcherSets := make([][]*storage.Matcher, 0, len(selectors))
+	for _, s := range selectors {
+		matchers, err := storage.ParseMatchers(s)
+		if err != nil {
+			api.respondError(w, apiError{typ: errorBadData, err: err}, nil)
+			return
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+
+	errCh := make(chan error, 1)
+	result := &storage.WriteResult{}
+	api.MetricStore.SubmitWriteRequest(storage.WriteRequest{
+		Timestamp:   time.Now(),
+		MatcherSets: matcherSets,
+		Done:        errCh,
+		Result:      result,
+	})
+	for err := range errCh {
+		api.respondError(w, apiError{typ: errorInternal, err: err}, nil)
+		return
+	}
+
+	api.respond(w, map[string]interface{}{"deleted_groups": result.DeletedGroups})
+}
+
 func (api *API) status(w http.ResponseWriter, r *http.Request) {
 	res := map[string]interface{}{}
 	res["flags"] = api.Flags
@@ -234,6 +277,12 @@ func makeEncodableMetrics(metrics []*dto.Metric, metricsType dto.MetricType) []e
 			metric["buckets"] = makeBuckets(m)
 			metric["count"] = fmt.Sprint(m.GetHistogram().GetSampleCount())
 			metric["sum"] = fmt.Sprint(m.GetHistogram().GetSampleSum())
+			if nh, err := storage.GetNativeHistogram(m.GetHistogram()); err == nil && nh != nil {
+				metric["native"] = makeNativeHistogram(nh)
+				if nh.IsFloat() {
+					metric["count"] = fmt.Sprint(nh.SampleCountFloat)
+				}
+			}
 		default:
 			metric["value"] = fmt.Sprint(getValue(m))
 		}
@@ -266,6 +315,47 @@ func makeBuckets(m *dto.Metric) map[string]string {
 	return result
 }
 
+// makeNativeHistogram renders the native histogram fields with the absolute
+// counts of the buckets and their boundaries.
+func makeNativeHistogram(nh *storage.NativeHistogram) map[string]interface{} {
+	zeroCount := fmt.Sprint(nh.ZeroCount)
+	if nh.IsFloat() {
+		zeroCount = fmt.Sprint(nh.ZeroCountFloat)
+	}
+	return map[string]interface{}{
+		"schema":           fmt.Sprint(nh.Schema),
+		"zero_threshold":   fmt.Sprint(nh.ZeroThreshold),
+		"zero_count":       zeroCount,
+		"negative_spans":   makeSpans(nh.NegativeSpans),
+		"positive_spans":   makeSpans(nh.PositiveSpans),
+		"negative_buckets": makeNativeBuckets(nh.NegativeBuckets()),
+		"positive_buckets": makeNativeBuckets(nh.PositiveBuckets()),
+	}
+}
+
+func makeSpans(spans []storage.BucketSpan) []map[string]string {
+	result := make([]map[string]string, len(spans))
+	for i, s := range spans {
+		result[i] = map[string]string{
+			"offset": fmt.Sprint(s.Offset),
+			"length": fmt.Sprint(s.Length),
+		}
+	}
+	return result
+}
+
+func makeNativeBuckets(buckets []storage.NativeBucket) []map[string]string {
+	result := make([]map[string]string, len(buckets))
+	for i, b := range buckets {
+		result[i] = map[string]string{
+			"lower": fmt.Sprint(b.Lower),
+			"upper": fmt.Sprint(b.Upper),
+			"count": fmt.Sprint(b.Count),
+		}
+	}
+	return result
+}
+
 func getValue(m *dto.Metric) float64 {
 	switch {
 	case m.Gauge != nil:
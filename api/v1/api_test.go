@@ -17,6 +17,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"testing"
 	"time"
@@ -219,3 +220,147 @@ func TestMetricsAPI(t *testing.T) {
 		t.Errorf("Wanted response %q, got %q.", expected, got)
 	}
 }
+
+func TestDeleteMetricsAPI(t *testing.T) {
+	dms := storage.NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	testAPI := New(logger, dms, testFlags, testBuildInfo)
+
+	grouping2 := map[string]string{"job": "Björn", "instance": "instance2"}
+	grouping3 := map[string]string{"job": "other", "instance": "instance3"}
+	for _, grouping := range []map[string]string{grouping1, grouping2, grouping3} {
+		errCh := make(chan error, 1)
+		dms.SubmitWriteRequest(storage.WriteRequest{
+			Labels:         grouping,
+			Timestamp:      time.Now(),
+			MetricFamilies: testutil.MetricFamiliesMap(proto.Clone(mf1).(*dto.MetricFamily)),
+			Done:           errCh,
+		})
+		for err := range errCh {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+
+	for _, s := range []struct {
+		query    string
+		code     int
+		response string
+		groups   int
+	}{
+		{
+			query:    "",
+			code:     http.StatusBadRequest,
+			response: `{"status":"error","errorType":"bad_data","error":"no match[] parameter provided"}`,
+			groups:   3,
+		},
+		{
+			query:    "match[]=" + url.QueryEscape(`{job=~".*"}`),
+			code:     http.StatusBadRequest,
+			response: `{"status":"error","errorType":"bad_data","error":"selector \"{job=~\\\".*\\\"}\": at least one matcher must not match the empty string"}`,
+			groups:   3,
+		},
+		{
+			query:    "match[]=" + url.QueryEscape(`{job="nonexistent"}`),
+			code:     http.StatusOK,
+			response: `{"status":"success","data":{"deleted_groups":0}}`,
+			groups:   3,
+		},
+		{
+			query: "match[]=" + url.QueryEscape(`{job="Björn",instance!="instance2"}`) +
+				"&match[]=" + url.QueryEscape(`{instance=~"instance[3-9]"}`),
+			code:     http.StatusOK,
+			response: `{"status":"success","data":{"deleted_groups":2}}`,
+			groups:   1,
+		},
+	} {
+		req, err := http.NewRequest("DELETE", "http://example.org/api/v1/metrics?"+s.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		testAPI.deleteMetrics(w, req)
+
+		if expected, got := s.code, w.Code; expected != got {
+			t.Errorf("%q: Wanted status code %v, got %v.", s.query, expected, got)
+		}
+		if expected, got := s.response, w.Body.String(); expected != got {
+			t.Errorf("%q: Wanted response %q, got %q.", s.query, expected, got)
+		}
+		if expected, got := s.groups, len(dms.GetMetricFamiliesMap()); expected != got {
+			t.Errorf("%q: Wanted %d groups, got %d.", s.query, expected, got)
+		}
+	}
+	for _, group := range dms.GetMetricFamiliesMap() {
+		if !reflect.DeepEqual(grouping2, group.Labels) {
+			t.Errorf("Wanted group %v to remain, got %v.", grouping2, group.Labels)
+		}
+	}
+}
+
+func TestNativeHistogramEncoding(t *testing.T) {
+	h := &dto.Histogram{
+		SampleCount: proto.Uint64(6),
+		SampleSum:   proto.Float64(7.5),
+	}
+	storage.SetNativeHistogram(h, &storage.NativeHistogram{
+		Schema:         0,
+		ZeroThreshold:  0.001,
+		ZeroCount:      1,
+		NegativeSpans:  []storage.BucketSpan{{Offset: 1, Length: 1}},
+		NegativeDeltas: []int64{2},
+		PositiveSpans:  []storage.BucketSpan{{Offset: 0, Length: 2}},
+		PositiveDeltas: []int64{1, 1},
+	})
+	metrics := makeEncodableMetrics([]*dto.Metric{{Histogram: h}}, dto.MetricType_HISTOGRAM)
+
+	b, err := json.MarshalIndent(metrics, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requiredResponse := `[
+	{
+		"buckets": {},
+		"count": "6",
+		"labels": {},
+		"native": {
+			"negative_buckets": [
+				{
+					"count": "2",
+					"lower": "-2",
+					"upper": "-1"
+				}
+			],
+			"negative_spans": [
+				{
+					"length": "1",
+					"offset": "1"
+				}
+			],
+			"positive_buckets": [
+				{
+					"count": "1",
+					"lower": "0.5",
+					"upper": "1"
+				},
+				{
+					"count": "2",
+					"lower": "1",
+					"upper": "2"
+				}
+			],
+			"positive_spans": [
+				{
+					"length": "2",
+					"offset": "0"
+				}
+			],
+			"schema": "0",
+			"zero_count": "1",
+			"zero_threshold": "0.001"
+		},
+		"sum": "7.5"
+	}
+]`
+	if expected, got := requiredResponse, string(b); expected != got {
+		t.Errorf("Wanted response %s, got %s.", expected, got)
+	}
+}
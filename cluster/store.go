@@ -0,0 +1,768 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cluster replicates a MetricStore between Pushgateways.
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	uuid "github.com/satori/go.uuid"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+const (
+	// StreamPath is the path (after the route prefix) under which the
+	// replication stream is served.
+	StreamPath = "/cluster/stream"
+
+	contentType = `application/vnd.google.protobuf; proto=cluster.Message; encoding=delimited`
+
+	// logSize is the number of entries kept for followers to catch up
+	// without a snapshot. It has to be larger than the capacity of the
+	// write queue of the wrapped MetricStore so that entries only drop
+	// out of the log once they have been applied locally.
+	logSize           = 4096
+	heartbeatInterval = time.Second
+	retryInterval     = time.Second
+
+	// The push timestamp metrics are created by the MetricStore upon
+	// applying an entry, so they are not part of snapshots.
+	pushMetricName       = "push_time_seconds"
+	pushFailedMetricName = "push_failure_time_seconds"
+)
+
+// errResync is returned by stream if a new snapshot is needed.
+var errResync = errors.New("new snapshot needed")
+
+var (
+	replicationLag = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pushgateway_replication_lag_seconds",
+			Help: "Time between accepting the last write request replicated from the peer there and applying it here. 0 if nothing is pending.",
+		},
+		[]string{"peer"},
+	)
+	peerUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pushgateway_replication_peer_up",
+			Help: "Whether the replication stream from the peer is established.",
+		},
+		[]string{"peer"},
+	)
+	entriesReplicated = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushgateway_replication_entries_total",
+			Help: "Total number of write requests (including snapshot entries) replicated from the peer.",
+		},
+		[]string{"peer"},
+	)
+)
+
+// Store is a MetricStore that replicates all WriteRequests submitted to it to
+// peers, and that applies the WriteRequests submitted to its peers. It wraps
+// another MetricStore, which keeps the metrics.
+//
+// Every Store keeps a log of the WriteRequests submitted to it. Peers follow
+// that log with a stream from ServeHTTP, which starts with a snapshot of the
+// wrapped MetricStore if the peer cannot continue where it left off. The
+// entries of one log are applied in order. All WriteRequests are submitted as
+// conditional WriteRequests to the wrapped MetricStore, so that applying them
+// is idempotent and WriteRequests accepted by different Stores are resolved by
+// their Timestamp (last write wins). Thus, clocks of the peers have to be
+// synchronized reasonably well.
+//
+// Groups deleted by TTL expiry are not replicated, as every Store deletes them
+// on its own.
+//
+// Deletes a Store has missed, e.g. while it was down, cannot be told apart from
+// pushes its peers have missed by looking at a snapshot alone. Thus, only the
+// groups last updated before the Store has been created are reconciled against
+// the snapshot of a peer, i.e. deleted if missing there, and only once the peer
+// reports to have applied a snapshot of this Store, which contained them.
+type Store struct {
+	storage.MetricStore
+
+	id      string
+	peers   []string
+	client  *http.Client
+	logger  log.Logger
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	stop    chan struct{}
+	started time.Time
+
+	mtx     sync.Mutex // Protects all of the following.
+	log     []*logEntry
+	seq     uint64            // The seq of the latest entry.
+	head    uint64            // The seq up to which all entries are decided.
+	updated chan struct{}     // Closed (and replaced) once head advances.
+	synced  map[string]string // Peer -> ID of the node whose snapshot has been applied completely.
+}
+
+type logEntry struct {
+	entry    *Entry
+	pending  bool // Whether the wrapped MetricStore has not yet accepted or rejected it.
+	rejected bool
+}
+
+// NewStore returns a Store wrapping ms that follows the logs of the provided
+// peers, given as base URL of their web endpoints. To cleanly shut it down,
+// the Shutdown() method has to be called, which also shuts down ms.
+func NewStore(ms storage.MetricStore, peers []string, logger log.Logger) *Store {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Store{
+		MetricStore: ms,
+		id:          uuid.NewV4().String(),
+		peers:       peers,
+		client:      &http.Client{},
+		logger:      logger,
+		cancel:      cancel,
+		stop:        make(chan struct{}),
+		started:     time.Now(),
+		updated:     make(chan struct{}),
+		synced:      map[string]string{},
+	}
+	for _, peer := range peers {
+		s.wg.Add(1)
+		go s.follow(ctx, peer)
+	}
+	return s
+}
+
+// ID returns the random ID the Store has chosen upon creation.
+func (s *Store) ID() string {
+	return s.id
+}
+
+// SubmitWriteRequest implements the MetricStore interface. The WriteRequest is
+// replicated once the wrapped MetricStore has accepted it.
+func (s *Store) SubmitWriteRequest(wr storage.WriteRequest) {
+	entry, err := newEntry(wr)
+	if err != nil {
+		if wr.Done != nil {
+			wr.Done <- err
+			close(wr.Done)
+		}
+		return
+	}
+	wr.Conditional = true
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.seq++
+	entry.Seq = proto.Uint64(s.seq)
+	le := &logEntry{entry: entry}
+	s.log = append(s.log, le)
+	// Aggregated metric families are only known once the request has been
+	// processed, so wait for that even without a Done channel.
+	aggregated := isAggregated(wr)
+	for _, b := range wr.Batch {
+		aggregated = aggregated || isAggregated(b)
+	}
+	if wr.Done != nil || aggregated || wr.Batch != nil {
+		// Only with a Done channel (or as a batch, which is always
+		// checked), the request might be rejected because of
+		// inconsistencies. Wait for the outcome.
+		le.pending = true
+		done := wr.Done
+		result := make(chan error, 1)
+		wr.Done = result
+		go func() {
+			rejected := false
+			for err := range result {
+				rejected = true
+				if done != nil {
+					done <- err
+				}
+			}
+			if aggregated && !rejected {
+				// Followers get the aggregated values. Nobody
+				// reads the entry while it is pending.
+				if err := updateMetricFamilies(entry, wr); err != nil {
+					level.Error(s.logger).Log("msg", "error marshaling aggregated metric families", "err", err)
+					rejected = true
+				}
+			}
+			if done != nil {
+				close(done)
+			}
+			s.decide(le, rejected)
+		}()
+	}
+	// Submitting while holding the lock keeps the order of the log.
+	s.MetricStore.SubmitWriteRequest(wr)
+	s.advance()
+}
+
+func (s *Store) decide(le *logEntry, rejected bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	le.pending = false
+	le.rejected = rejected
+	s.advance()
+}
+
+// advance moves head past all decided entries and trims the log. It must be
+// called with mtx locked.
+func (s *Store) advance() {
+	head := s.head
+	for _, le := range s.log[s.index(head+1):] {
+		if le.pending {
+			break
+		}
+		head = le.entry.GetSeq()
+	}
+	if head != s.head {
+		s.head = head
+		close(s.updated)
+		s.updated = make(chan struct{})
+	}
+	for len(s.log) > logSize && s.log[0].entry.GetSeq() <= s.head {
+		s.log[0] = nil
+		s.log = s.log[1:]
+	}
+}
+
+// index returns the position of the entry with the provided seq in the log. It
+// must be called with mtx locked.
+func (s *Store) index(seq uint64) int {
+	if len(s.log) == 0 {
+		return 0
+	}
+	return int(seq - s.log[0].entry.GetSeq())
+}
+
+// first returns the seq of the oldest entry in the log. It must be called with
+// mtx locked.
+func (s *Store) first() uint64 {
+	if len(s.log) == 0 {
+		return s.seq + 1
+	}
+	return s.log[0].entry.GetSeq()
+}
+
+// Shutdown implements the MetricStore interface. It stops replication and shuts
+// down the wrapped MetricStore.
+func (s *Store) Shutdown() error {
+	s.cancel()
+	close(s.stop)
+	s.wg.Wait()
+	return s.MetricStore.Shutdown()
+}
+
+// ServeHTTP serves the replication stream to a peer. The query parameters node
+// and since are the ID of this Store and the last seq the peer has received
+// from it in a previous stream (if any).
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		since = 0
+	}
+
+	s.mtx.Lock()
+	snapshot := r.URL.Query().Get("node") != s.id || since > s.head || since+1 < s.first()
+	if snapshot {
+		// Everything still in the log is sent after the snapshot, as it
+		// might not have been applied yet when the snapshot is taken.
+		since = s.first() - 1
+	}
+	head := s.head
+	s.mtx.Unlock()
+
+	w.Header().Set("Content-Type", contentType)
+	// What has been synced has to be determined before taking the
+	// snapshot, which then contains the synced snapshots.
+	if err := s.send(w, &Message{
+		NodeId:   proto.String(s.id),
+		Snapshot: proto.Bool(snapshot),
+		Head:     proto.Uint64(head),
+		Synced:   s.syncedNodes(),
+	}); err != nil {
+		return
+	}
+	if snapshot {
+		for _, group := range s.MetricStore.GetMetricFamiliesMap() {
+			entries, err := snapshotEntries(group)
+			if err != nil {
+				level.Error(s.logger).Log("msg", "error creating replication snapshot", "err", err)
+				return
+			}
+			for _, entry := range entries {
+				if err := s.send(w, &Message{Entry: entry}); err != nil {
+					return
+				}
+			}
+		}
+		if err := s.send(w, &Message{SnapshotDone: proto.Bool(true)}); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		s.mtx.Lock()
+		if since+1 < s.first() {
+			// The peer is too slow. It will have to reconnect.
+			s.mtx.Unlock()
+			level.Warn(s.logger).Log("msg", "replication stream fell behind", "remote", r.RemoteAddr)
+			return
+		}
+		var entries []*Entry
+		for _, le := range s.log[s.index(since+1):s.index(s.head+1)] {
+			if !le.rejected {
+				entries = append(entries, le.entry)
+			}
+		}
+		since = s.head
+		updated := s.updated
+		s.mtx.Unlock()
+
+		for _, entry := range entries {
+			if err := s.send(w, &Message{Entry: entry}); err != nil {
+				return
+			}
+		}
+		if len(entries) > 0 {
+			flusher.Flush()
+		}
+
+		select {
+		case <-updated:
+		case <-heartbeat.C:
+			if err := s.send(w, &Message{Head: proto.Uint64(since), Synced: s.syncedNodes()}); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Store) send(w http.ResponseWriter, msg *Message) error {
+	_, err := pbutil.WriteDelimited(w, msg)
+	return err
+}
+
+// syncedNodes returns the IDs of the nodes whose snapshot has been applied
+// completely.
+func (s *Store) syncedNodes() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	nodes := make([]string, 0, len(s.synced))
+	for _, node := range s.synced {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// follow follows the log of the provided peer until ctx is canceled.
+func (s *Store) follow(ctx context.Context, peer string) {
+	defer s.wg.Done()
+	var (
+		peerID  string
+		applied uint64
+	)
+	for {
+		err := s.stream(ctx, peer, &peerID, &applied)
+		peerUp.WithLabelValues(peer).Set(0)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errResync {
+			level.Info(s.logger).Log("msg", "requesting a new snapshot from peer to reconcile with", "peer", peer)
+			continue
+		}
+		level.Warn(s.logger).Log("msg", "replication stream from peer failed, retrying", "peer", peer, "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// stream follows one replication stream of the provided peer. peerID and
+// applied track the position in the log of the peer across streams.
+func (s *Store) stream(ctx context.Context, peer string, peerID *string, applied *uint64) error {
+	u := strings.TrimSuffix(peer, "/") + StreamPath + "?" + url.Values{
+		"node":  {*peerID},
+		"since": {strconv.FormatUint(*applied, 10)},
+	}.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	r := bufio.NewReader(resp.Body)
+
+	msg := &Message{}
+	if _, err := pbutil.ReadDelimited(r, msg); err != nil {
+		return err
+	}
+	if msg.GetNodeId() == s.id {
+		return fmt.Errorf("peer %s is this Pushgateway itself", peer)
+	}
+	// With a snapshot, the position is only valid once the snapshot is
+	// complete.
+	inSnapshot := msg.GetSnapshot()
+	if inSnapshot {
+		*peerID = ""
+		*applied = 0
+	} else {
+		*peerID = msg.GetNodeId()
+	}
+	nodeID := msg.GetNodeId()
+	synced := msg.GetSynced()
+	peerUp.WithLabelValues(peer).Set(1)
+	level.Info(s.logger).Log("msg", "replication stream from peer established", "peer", peer, "node", nodeID, "snapshot", inSnapshot)
+
+	var (
+		// Signatures of the grouping labels of the groups in the
+		// snapshot.
+		snapshotGroups = map[uint64]struct{}{}
+		// The last entry of the snapshot is held back until it is
+		// known to be the last one, see applySnapshot.
+		last         *storage.WriteRequest
+		unreconciled = inSnapshot
+	)
+	for {
+		msg.Reset()
+		if _, err := pbutil.ReadDelimited(r, msg); err != nil {
+			return err
+		}
+		if msg.GetSnapshotDone() {
+			s.applySnapshot(peer, nodeID, last)
+			inSnapshot = false
+			*peerID = nodeID
+			if contains(synced, s.id) {
+				s.reconcile(peer, snapshotGroups)
+				unreconciled = false
+			}
+		}
+		if entry := msg.GetEntry(); entry != nil {
+			seq := entry.GetSeq()
+			if seq != 0 && seq <= *applied {
+				continue // Already applied.
+			}
+			wr, err := entry.writeRequest()
+			if err != nil {
+				return err
+			}
+			if inSnapshot {
+				snapshotGroups[model.LabelsToSignature(wr.Labels)] = struct{}{}
+				if last != nil {
+					s.MetricStore.SubmitWriteRequest(*last)
+				}
+				last = &wr
+			} else {
+				s.MetricStore.SubmitWriteRequest(wr)
+			}
+			entriesReplicated.WithLabelValues(peer).Inc()
+			if seq != 0 {
+				*applied = seq
+				replicationLag.WithLabelValues(peer).Set(time.Since(wr.Timestamp).Seconds())
+			}
+		}
+		if msg.Head != nil && !inSnapshot && msg.GetHead() <= *applied {
+			replicationLag.WithLabelValues(peer).Set(0)
+		}
+		if unreconciled && contains(msg.GetSynced(), s.id) {
+			// The peer has applied a snapshot of this Store only
+			// after sending its own one, which is thus useless to
+			// reconcile with.
+			*peerID = ""
+			return errResync
+		}
+	}
+}
+
+// applySnapshot submits the last entry of a snapshot of the node with the
+// provided ID, which has been held back, and waits until the wrapped
+// MetricStore has processed it and thus the whole snapshot. Only then, the node
+// is reported as synced to peers.
+func (s *Store) applySnapshot(peer, nodeID string, last *storage.WriteRequest) {
+	if last != nil {
+		done := make(chan error, 1)
+		last.Done = done
+		s.MetricStore.SubmitWriteRequest(*last)
+		rejected := false
+		for range done {
+			rejected = true
+		}
+		if rejected {
+			// With a Done channel, the entry has been checked for
+			// consistency, which replicated entries are not.
+			last.Done = nil
+			s.MetricStore.SubmitWriteRequest(*last)
+			level.Warn(s.logger).Log("msg", "cannot confirm that the snapshot of peer has been applied", "peer", peer)
+			return
+		}
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.synced[peer] = nodeID
+}
+
+// reconcile deletes the groups last updated before the Store has been created
+// that are missing from the snapshot of the provided peer, given by the
+// signatures of their grouping labels. The peer must have applied a snapshot of
+// this Store before taking its own one, so that a missing group has been
+// deleted there.
+func (s *Store) reconcile(peer string, snapshotGroups map[uint64]struct{}) {
+	deleted := 0
+	for _, group := range s.MetricStore.GetMetricFamiliesMap() {
+		if _, ok := snapshotGroups[model.LabelsToSignature(group.Labels)]; ok || !group.LastUpdate().Before(s.started) {
+			continue
+		}
+		// Being conditional, the delete keeps whatever has been pushed
+		// since the Store has been created.
+		s.MetricStore.SubmitWriteRequest(storage.WriteRequest{
+			Labels:      group.Labels,
+			Timestamp:   s.started,
+			Conditional: true,
+		})
+		deleted++
+	}
+	if deleted > 0 {
+		level.Info(s.logger).Log("msg", "deleted groups missing from the snapshot of peer", "peer", peer, "groups", deleted)
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isAggregated returns whether the provided WriteRequest is a push to be
+// aggregated.
+func isAggregated(wr storage.WriteRequest) bool {
+	return wr.MetricFamilies != nil && wr.Aggregation.Enabled()
+}
+
+// newEntry converts a WriteRequest into an Entry without seq.
+func newEntry(wr storage.WriteRequest) (*Entry, error) {
+	entry := &Entry{
+		Labels:      wr.Labels,
+		TimestampNs: proto.Int64(wr.Timestamp.UnixNano()),
+	}
+	if wr.Batch != nil {
+		for _, b := range wr.Batch {
+			e, err := newEntry(b)
+			if err != nil {
+				return nil, err
+			}
+			entry.Batch = append(entry.Batch, e)
+		}
+		return entry, nil
+	}
+	if wr.Replace {
+		entry.Replace = proto.Bool(true)
+	}
+	if wr.TTL != 0 {
+		entry.TtlNs = proto.Int64(int64(wr.TTL))
+	}
+	if wr.Tenant != "" {
+		entry.Tenant = proto.String(wr.Tenant)
+	}
+	for _, matchers := range wr.MatcherSets {
+		set := &MatcherSet{}
+		for _, m := range matchers {
+			set.Matchers = append(set.Matchers, &Matcher{
+				Type:  proto.Int32(int32(m.Type)),
+				Name:  proto.String(m.Name),
+				Value: proto.String(m.Value),
+			})
+		}
+		entry.MatcherSets = append(entry.MatcherSets, set)
+	}
+	if wr.MetricFamilies == nil {
+		entry.Delete = proto.Bool(true)
+		entry.DeleteFamilies = wr.DeleteFamilies
+		return entry, nil
+	}
+	mfs, err := marshalMetricFamilies(wr.MetricFamilies)
+	if err != nil {
+		return nil, err
+	}
+	entry.MetricFamilies = mfs
+	return entry, nil
+}
+
+// updateMetricFamilies replaces the metric families of the provided Entry (or
+// of the entries in its batch) by the ones of the corresponding processed
+// WriteRequest.
+func updateMetricFamilies(entry *Entry, wr storage.WriteRequest) error {
+	for i, b := range wr.Batch {
+		if err := updateMetricFamilies(entry.Batch[i], b); err != nil {
+			return err
+		}
+	}
+	if wr.MetricFamilies == nil {
+		return nil
+	}
+	mfs, err := marshalMetricFamilies(wr.MetricFamilies)
+	if err != nil {
+		return err
+	}
+	entry.MetricFamilies = mfs
+	return nil
+}
+
+// marshalMetricFamilies marshals the provided metric families for an Entry,
+// leaving out the push timestamps, which every MetricStore adds itself.
+func marshalMetricFamilies(mfs map[string]*dto.MetricFamily) ([][]byte, error) {
+	var result [][]byte
+	for name, mf := range mfs {
+		if name == pushMetricName || name == pushFailedMetricName {
+			continue
+		}
+		b, err := proto.Marshal(mf)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, b)
+	}
+	return result, nil
+}
+
+// writeRequest converts the Entry into a conditional WriteRequest.
+func (e *Entry) writeRequest() (storage.WriteRequest, error) {
+	labels := e.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	wr := storage.WriteRequest{
+		Labels:      labels,
+		Timestamp:   time.Unix(0, e.GetTimestampNs()),
+		Replace:     e.GetReplace(),
+		TTL:         time.Duration(e.GetTtlNs()),
+		Tenant:      e.GetTenant(),
+		Conditional: true,
+	}
+	if len(e.GetBatch()) > 0 {
+		for _, entry := range e.GetBatch() {
+			b, err := entry.writeRequest()
+			if err != nil {
+				return storage.WriteRequest{}, err
+			}
+			wr.Batch = append(wr.Batch, b)
+		}
+		return wr, nil
+	}
+	for _, set := range e.GetMatcherSets() {
+		var matchers []*storage.Matcher
+		for _, m := range set.GetMatchers() {
+			matcher, err := storage.NewMatcher(storage.MatchType(m.GetType()), m.GetName(), m.GetValue())
+			if err != nil {
+				return storage.WriteRequest{}, err
+			}
+			matchers = append(matchers, matcher)
+		}
+		wr.MatcherSets = append(wr.MatcherSets, matchers)
+	}
+	if e.GetDelete() {
+		wr.DeleteFamilies = e.GetDeleteFamilies()
+		return wr, nil
+	}
+	wr.MetricFamilies = make(map[string]*dto.MetricFamily, len(e.GetMetricFamilies()))
+	for _, b := range e.GetMetricFamilies() {
+		mf := &dto.MetricFamily{}
+		if err := proto.Unmarshal(b, mf); err != nil {
+			return storage.WriteRequest{}, err
+		}
+		wr.MetricFamilies[mf.GetName()] = mf
+	}
+	return wr, nil
+}
+
+// snapshotEntries converts a MetricGroup into entries, one per distinct
+// timestamp of its metric families, so that the timestamps are retained.
+func snapshotEntries(group storage.MetricGroup) ([]*Entry, error) {
+	byTimestamp := map[int64]*Entry{}
+	entryFor := func(t time.Time) *Entry {
+		entry, ok := byTimestamp[t.UnixNano()]
+		if !ok {
+			entry = &Entry{
+				Labels:      group.Labels,
+				TimestampNs: proto.Int64(t.UnixNano()),
+			}
+			if group.TTL != 0 {
+				entry.TtlNs = proto.Int64(int64(group.TTL))
+			}
+			byTimestamp[t.UnixNano()] = entry
+		}
+		return entry
+	}
+	for name, tmf := range group.Metrics {
+		switch name {
+		case pushMetricName:
+			// Make sure there is an entry for the last push, even
+			// if it did not contain any metric families.
+			entryFor(tmf.Timestamp)
+		case pushFailedMetricName:
+		default:
+			b, err := proto.Marshal(tmf.GetMetricFamily())
+			if err != nil {
+				return nil, err
+			}
+			entry := entryFor(tmf.Timestamp)
+			entry.MetricFamilies = append(entry.MetricFamilies, b)
+		}
+	}
+	entries := make([]*Entry, 0, len(byTimestamp))
+	for _, entry := range byTimestamp {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,489 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/protobuf/proto"
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+var (
+	logger = log.NewNopLogger()
+
+	mf1 = &dto.MetricFamily{
+		Name: proto.String("mf1"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{Untyped: &dto.Untyped{Value: proto.Float64(1)}},
+		},
+	}
+	mf2 = &dto.MetricFamily{
+		Name: proto.String("mf2"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{Gauge: &dto.Gauge{Value: proto.Float64(2)}},
+		},
+	}
+	mf1Timestamped = &dto.MetricFamily{
+		Name: proto.String("mf1"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{Untyped: &dto.Untyped{Value: proto.Float64(1)}, TimestampMs: proto.Int64(1)},
+		},
+	}
+)
+
+type node struct {
+	*Store
+	url string
+	srv *http.Server
+}
+
+// startNodes starts a node listening on loopback for every element of peers,
+// which lists the indices of the nodes it follows.
+func startNodes(t *testing.T, peers ...[]int) []*node {
+	listeners := make([]net.Listener, len(peers))
+	nodes := make([]*node, len(peers))
+	for i := range peers {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = l
+		nodes[i] = &node{url: "http://" + l.Addr().String()}
+	}
+	for i, n := range nodes {
+		var urls []string
+		for _, j := range peers[i] {
+			urls = append(urls, nodes[j].url)
+		}
+		n.start(listeners[i], "", urls)
+	}
+	return nodes
+}
+
+// start starts the Store of n, persisting to persistenceFile, and serves it on
+// l.
+func (n *node) start(l net.Listener, persistenceFile string, peers []string) {
+	n.Store = NewStore(storage.NewDiskMetricStore(persistenceFile, time.Hour, nil, logger), peers, logger)
+	mux := http.NewServeMux()
+	mux.Handle(StreamPath, n.Store)
+	n.srv = &http.Server{Handler: mux}
+	go n.srv.Serve(l)
+}
+
+func stopNodes(t *testing.T, nodes []*node) {
+	for _, n := range nodes {
+		if err := n.Shutdown(); err != nil {
+			t.Error(err)
+		}
+		n.srv.Close()
+	}
+}
+
+func submit(ms storage.MetricStore, wr storage.WriteRequest) error {
+	errCh := make(chan error, 1)
+	wr.Done = errCh
+	ms.SubmitWriteRequest(wr)
+	var err error
+	for err = range errCh {
+	}
+	return err
+}
+
+// state returns the metric families of ms in a comparable form.
+func state(ms storage.MetricStore) string {
+	var mfs []string
+	for _, mf := range ms.GetMetricFamilies() {
+		var metrics []string
+		for _, m := range mf.GetMetric() {
+			metrics = append(metrics, m.String())
+		}
+		sort.Strings(metrics)
+		mfs = append(mfs, mf.GetName()+": "+strings.Join(metrics, ", "))
+	}
+	sort.Strings(mfs)
+	return strings.Join(mfs, "\n")
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s.", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitForSameState(t *testing.T, nodes ...*node) {
+	t.Helper()
+	waitFor(t, "same state on all nodes", func() bool {
+		for _, n := range nodes[1:] {
+			if state(n) != state(nodes[0]) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestReplication(t *testing.T) {
+	nodes := startNodes(t, []int{1}, []int{0})
+	defer stopNodes(t, nodes)
+	a, b := nodes[0], nodes[1]
+
+	grouping1 := map[string]string{"job": "job1", "instance": "instance1"}
+	grouping2 := map[string]string{"job": "job1", "instance": "instance2"}
+	ts := time.Now()
+
+	// Push to a.
+	if err := submit(a, storage.WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": proto.Clone(mf1).(*dto.MetricFamily)},
+	}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	waitForSameState(t, a, b)
+	if _, ok := group(b, grouping1); !ok {
+		t.Fatal("Group has not been replicated.")
+	}
+
+	// Replace on b.
+	if err := submit(b, storage.WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts.Add(time.Second),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf2": proto.Clone(mf2).(*dto.MetricFamily)},
+		Replace:        true,
+	}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	waitFor(t, "replace to be replicated", func() bool {
+		g, _ := group(a, grouping1)
+		metrics := g.Metrics
+		_, ok1 := metrics["mf1"]
+		_, ok2 := metrics["mf2"]
+		return !ok1 && ok2
+	})
+	waitForSameState(t, a, b)
+
+	// An older push to b arriving after the replace loses.
+	if err := submit(b, storage.WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts.Add(time.Millisecond),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": proto.Clone(mf1).(*dto.MetricFamily)},
+	}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// A rejected push is not replicated.
+	if err := submit(a, storage.WriteRequest{
+		Labels:         grouping2,
+		Timestamp:      ts.Add(2 * time.Second),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": proto.Clone(mf1Timestamped).(*dto.MetricFamily)},
+	}); err == nil {
+		t.Fatal("Expected error on push with timestamps.")
+	}
+	// Delete on a.
+	if err := submit(a, storage.WriteRequest{
+		Labels:    grouping1,
+		Timestamp: ts.Add(3 * time.Second),
+	}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	waitFor(t, "delete to be replicated", func() bool {
+		_, ok := group(b, grouping1)
+		return !ok
+	})
+	if _, ok := group(b, grouping2); ok {
+		t.Error("Rejected push has been replicated.")
+	}
+	if _, ok := group(a, grouping1); ok {
+		t.Error("Older push has been applied after the replace.")
+	}
+
+	// Delete by matchers on b.
+	if err := submit(a, storage.WriteRequest{
+		Labels:         grouping2,
+		Timestamp:      ts.Add(4 * time.Second),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": proto.Clone(mf1).(*dto.MetricFamily)},
+	}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	waitFor(t, "push to be replicated", func() bool {
+		_, ok := group(b, grouping2)
+		return ok
+	})
+	matchers, err := storage.ParseMatchers(`{instance=~".*2"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := submit(b, storage.WriteRequest{
+		Timestamp:   ts.Add(5 * time.Second),
+		MatcherSets: [][]*storage.Matcher{matchers},
+	}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	waitFor(t, "delete by matchers to be replicated", func() bool {
+		_, ok := group(a, grouping2)
+		return !ok
+	})
+
+	// Aggregated values are replicated, not the pushed ones, even without
+	// a Done channel.
+	grouping3 := map[string]string{"job": "job2", "instance": "instance1"}
+	if err := submit(a, storage.WriteRequest{
+		Labels:         grouping3,
+		Timestamp:      ts.Add(6 * time.Second),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": proto.Clone(mf1).(*dto.MetricFamily)},
+		Aggregation:    storage.AggregationSum,
+	}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	a.SubmitWriteRequest(storage.WriteRequest{
+		Labels:         grouping3,
+		Timestamp:      ts.Add(7 * time.Second),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": proto.Clone(mf1).(*dto.MetricFamily)},
+		Aggregation:    storage.AggregationSum,
+	})
+	waitFor(t, "aggregated push to be replicated", func() bool {
+		for _, n := range []*node{a, b} {
+			g, _ := group(n, grouping3)
+			metrics := g.Metrics["mf1"].GetMetricFamily().GetMetric()
+			if len(metrics) != 1 || metrics[0].GetUntyped().GetValue() != 2 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// A batch is replicated as a whole, a rejected one not at all.
+	grouping4 := map[string]string{"job": "job3", "instance": "instance1"}
+	grouping5 := map[string]string{"job": "job3", "instance": "instance2"}
+	if err := submit(b, storage.WriteRequest{
+		Timestamp: ts.Add(8 * time.Second),
+		Batch: []storage.WriteRequest{
+			{
+				Labels:         grouping4,
+				Timestamp:      ts.Add(8 * time.Second),
+				MetricFamilies: map[string]*dto.MetricFamily{"mf2": proto.Clone(mf2).(*dto.MetricFamily)},
+			},
+			{
+				Labels:         grouping5,
+				Timestamp:      ts.Add(8 * time.Second),
+				MetricFamilies: map[string]*dto.MetricFamily{"mf1": proto.Clone(mf1Timestamped).(*dto.MetricFamily)},
+			},
+		},
+	}); err == nil {
+		t.Fatal("Expected error on batch with timestamps.")
+	}
+	if err := submit(b, storage.WriteRequest{
+		Timestamp: ts.Add(9 * time.Second),
+		Batch: []storage.WriteRequest{
+			{
+				Labels:         grouping4,
+				Timestamp:      ts.Add(9 * time.Second),
+				MetricFamilies: map[string]*dto.MetricFamily{"mf1": proto.Clone(mf1).(*dto.MetricFamily)},
+			},
+			{
+				Labels:         grouping5,
+				Timestamp:      ts.Add(9 * time.Second),
+				MetricFamilies: map[string]*dto.MetricFamily{"mf2": proto.Clone(mf2).(*dto.MetricFamily)},
+				Replace:        true,
+			},
+		},
+	}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	waitFor(t, "batch to be replicated", func() bool {
+		g4, _ := group(a, grouping4)
+		g5, _ := group(a, grouping5)
+		return g4.Metrics["mf1"].GetMetricFamily() != nil && g5.Metrics["mf2"].GetMetricFamily() != nil
+	})
+	if g, _ := group(a, grouping4); g.Metrics["mf2"].GetMetricFamily() != nil {
+		t.Error("Rejected batch has been replicated.")
+	}
+
+	// The lag is 0 once the heartbeat has confirmed that nothing is
+	// pending.
+	waitFor(t, "replication lag to be 0", func() bool {
+		return promtestutil.ToFloat64(replicationLag.WithLabelValues(a.url)) == 0 &&
+			promtestutil.ToFloat64(peerUp.WithLabelValues(a.url)) == 1
+	})
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	nodes := startNodes(t, []int{}, []int{0})
+	defer stopNodes(t, nodes)
+	a := nodes[0]
+
+	ts := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := submit(a, storage.WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": fmt.Sprint(i)},
+			Timestamp:      ts.Add(time.Duration(i) * time.Second),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf1": proto.Clone(mf1).(*dto.MetricFamily)},
+			TTL:            time.Hour,
+		}); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+	// A node joining late catches up.
+	c := NewStore(storage.NewDiskMetricStore("", time.Hour, nil, logger), []string{a.url}, logger)
+	defer c.Shutdown()
+	waitFor(t, "snapshot to be replicated", func() bool { return state(c) == state(a) })
+	for key, g := range c.GetMetricFamiliesMap() {
+		if expected, got := time.Hour, g.TTL; expected != got {
+			t.Errorf("Group %q: Wanted TTL %v, got %v.", key, expected, got)
+		}
+		if expected, got := a.GetMetricFamiliesMap()[key].LastUpdate(), g.LastUpdate(); !expected.Equal(got) {
+			t.Errorf("Group %q: Wanted last update %v, got %v.", key, expected, got)
+		}
+	}
+
+	// A stream continuing where the previous one left off needs no
+	// snapshot.
+	a.mtx.Lock()
+	head := a.head
+	a.mtx.Unlock()
+	for _, tc := range []struct {
+		node     string
+		since    uint64
+		snapshot bool
+	}{
+		{a.ID(), head, false},
+		{a.ID(), 0, false}, // All entries are still in the log.
+		{a.ID(), head + 1, true},
+		{"unknown", head, true},
+	} {
+		resp, err := http.Get(fmt.Sprintf("%s%s?node=%s&since=%d", a.url, StreamPath, tc.node, tc.since))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := &Message{}
+		if _, err := pbutil.ReadDelimited(bufio.NewReader(resp.Body), msg); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if expected, got := tc.snapshot, msg.GetSnapshot(); expected != got {
+			t.Errorf("node=%s since=%d: Wanted snapshot %t, got %t.", tc.node, tc.since, expected, got)
+		}
+		if expected, got := a.ID(), msg.GetNodeId(); expected != got {
+			t.Errorf("Wanted node ID %q, got %q.", expected, got)
+		}
+	}
+}
+
+func TestReconcileAfterRestart(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "cluster.TestReconcileAfterRestart.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+
+	nodes := startNodes(t, []int{1}, []int{0})
+	a, b := nodes[0], nodes[1]
+	defer stopNodes(t, []*node{a})
+
+	// Restart b with persistence right away.
+	stopNodes(t, []*node{b})
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", strings.TrimPrefix(b.url, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	b.start(listen(), fileName, []string{a.url})
+
+	grouping1 := map[string]string{"job": "job1", "instance": "instance1"}
+	grouping2 := map[string]string{"job": "job1", "instance": "instance2"}
+	ts := time.Now().Add(-time.Minute)
+	for _, grouping := range []map[string]string{grouping1, grouping2} {
+		if err := submit(a, storage.WriteRequest{
+			Labels:         grouping,
+			Timestamp:      ts,
+			MetricFamilies: map[string]*dto.MetricFamily{"mf1": proto.Clone(mf1).(*dto.MetricFamily)},
+		}); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+	waitFor(t, "pushes to be replicated", func() bool {
+		_, ok1 := group(b, grouping1)
+		_, ok2 := group(b, grouping2)
+		return ok1 && ok2
+	})
+
+	// Delete on a while b is down.
+	stopNodes(t, []*node{b})
+	if err := submit(a, storage.WriteRequest{
+		Labels:    grouping1,
+		Timestamp: ts.Add(time.Second),
+	}); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	// Let the delete drop out of the log of a, as it would after logSize
+	// further entries.
+	a.mtx.Lock()
+	a.log = nil
+	a.mtx.Unlock()
+	b.start(listen(), fileName, []string{a.url})
+	defer stopNodes(t, []*node{b})
+
+	// b deletes what it has restored but a has deleted, and a does not
+	// get it back from the snapshot of b.
+	waitFor(t, "delete to be reconciled", func() bool {
+		_, ok := group(b, grouping1)
+		return !ok
+	})
+	waitForSameState(t, a, b)
+	if _, ok := group(a, grouping1); ok {
+		t.Error("Deleted group has been restored from the snapshot.")
+	}
+	if _, ok := group(b, grouping2); !ok {
+		t.Error("Group missing after reconciling.")
+	}
+}
+
+// group returns the group with the provided grouping labels, if any.
+func group(ms storage.MetricStore, labels map[string]string) (storage.MetricGroup, bool) {
+	for _, g := range ms.GetMetricFamiliesMap() {
+		if reflect.DeepEqual(g.Labels, labels) {
+			return g, true
+		}
+	}
+	return storage.MetricGroup{}, false
+}
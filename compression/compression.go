@@ -0,0 +1,192 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package compression decompresses the bodies of pushes, which clients may
+// compress with gzip, zstd, or snappy, both over HTTP (as announced by the
+// Content-Encoding header) and over TCP (as negotiated for the connection).
+// The size of the decompressed body is always limited, so that a small
+// compressed body cannot make the Pushgateway allocate huge amounts of memory.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The supported compressions. Their names are also the values of the HTTP
+// Content-Encoding header.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+	// Snappy is the snappy block format (not the framing format), as
+	// used by the remote write protocol of Prometheus.
+	Snappy = "snappy"
+)
+
+// minZstdWindow is the largest window a zstd compressed body may always
+// request, see NewReader.
+const minZstdWindow = 8 << 20
+
+// Supported returns the supported compressions.
+func Supported() []string {
+	return []string{Zstd, Snappy, Gzip}
+}
+
+// IsSupported returns whether the named compression is supported.
+func IsSupported(compression string) bool {
+	for _, c := range Supported() {
+		if c == compression {
+			return true
+		}
+	}
+	return false
+}
+
+// TooLargeError is returned if a decompressed body would be larger than the
+// allowed limit.
+type TooLargeError struct {
+	Limit int64
+}
+
+func (e TooLargeError) Error() string {
+	return fmt.Sprintf("decompressed body exceeds the limit of %d bytes", e.Limit)
+}
+
+// NewReader returns a ReadCloser decompressing r with the named compression.
+// Reading fails with a TooLargeError once more than limit bytes have been
+// decompressed. Closing the returned ReadCloser does not close r.
+func NewReader(r io.Reader, compression string, limit int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	switch compression {
+	case Gzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		rc = gr
+	case Zstd:
+		// A body may request a window larger than what it decompresses
+		// to, but not larger than the limit or the default window of
+		// common encoders, whatever is larger. Otherwise, a small body
+		// could make the decoder allocate a huge window. For streams,
+		// the maximum memory is the maximum window.
+		maxWindow := uint64(limit)
+		if maxWindow < minZstdWindow {
+			maxWindow = minZstdWindow
+		}
+		zr, err := zstd.NewReader(
+			r,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxMemory(maxWindow),
+		)
+		if err != nil {
+			return nil, err
+		}
+		rc = zr.IOReadCloser()
+	case Snappy:
+		// The block format can only be decoded as a whole. At least,
+		// it starts with the decoded length, so that we can check it
+		// before decoding anything.
+		compressed, err := ioutil.ReadAll(io.LimitReader(r, int64(s2.MaxEncodedLen(int(limit)))+1))
+		if err != nil {
+			return nil, err
+		}
+		n, err := s2.DecodedLen(compressed)
+		if err != nil {
+			return nil, err
+		}
+		if int64(n) > limit {
+			return nil, TooLargeError{Limit: limit}
+		}
+		decompressed, err := s2.Decode(nil, compressed)
+		if err != nil {
+			return nil, err
+		}
+		rc = ioutil.NopCloser(bytes.NewReader(decompressed))
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+	return &limitedReader{rc: rc, n: limit, limit: limit}, nil
+}
+
+// Decompress decompresses data with the named compression. If the result would
+// be larger than limit bytes, a TooLargeError is returned.
+func Decompress(data []byte, compression string, limit int64) ([]byte, error) {
+	rc, err := NewReader(bytes.NewReader(data), compression, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// Compress compresses data with the named compression.
+func Compress(data []byte, compression string) ([]byte, error) {
+	switch compression {
+	case Gzip:
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		zw, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zw.Close()
+		return zw.EncodeAll(data, nil), nil
+	case Snappy:
+		return s2.EncodeSnappy(nil, data), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+// limitedReader reads from rc until more than n bytes have been read, which is
+// an error.
+type limitedReader struct {
+	rc    io.ReadCloser
+	n     int64 // Bytes still allowed to be read.
+	limit int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.n < 0 {
+		return 0, TooLargeError{Limit: lr.limit}
+	}
+	if int64(len(p)) > lr.n+1 {
+		p = p[:lr.n+1]
+	}
+	n, err := lr.rc.Read(p)
+	lr.n -= int64(n)
+	if lr.n < 0 {
+		return n + int(lr.n), TooLargeError{Limit: lr.limit}
+	}
+	return n, err
+}
+
+func (lr *limitedReader) Close() error {
+	return lr.rc.Close()
+}
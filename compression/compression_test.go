@@ -0,0 +1,75 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compression
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("some_metric{label=\"value\"} 42\n", 100))
+	for _, c := range Supported() {
+		t.Run(c, func(t *testing.T) {
+			compressed, err := Compress(data, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(compressed) >= len(data) {
+				t.Errorf("Wanted compressed size below %d, got %d.", len(data), len(compressed))
+			}
+			got, err := Decompress(compressed, c, int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, got) {
+				t.Errorf("Wanted %q, got %q.", data, got)
+			}
+		})
+	}
+}
+
+func TestLimit(t *testing.T) {
+	// Compresses to a few hundred bytes at most.
+	data := make([]byte, 1<<20)
+	for _, c := range Supported() {
+		t.Run(c, func(t *testing.T) {
+			compressed, err := Compress(data, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Decompress(compressed, c, 1<<20-1)
+			if expected, ok := err.(TooLargeError); !ok || expected.Limit != 1<<20-1 {
+				t.Errorf("Wanted TooLargeError with limit %d, got %v.", 1<<20-1, err)
+			}
+		})
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, c := range Supported() {
+		t.Run(c, func(t *testing.T) {
+			if _, err := Decompress([]byte("not compressed at all"), c, 1000); err == nil {
+				t.Error("Expected error, got none.")
+			}
+		})
+	}
+	if IsSupported("br") {
+		t.Error("Wanted br to be unsupported.")
+	}
+	if _, err := Decompress(nil, "br", 1000); err == nil {
+		t.Error("Expected error, got none.")
+	}
+}
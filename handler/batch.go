@@ -0,0 +1,298 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/compression"
+	"github.com/prometheus/pushgateway/openmetrics"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// The formats of the metrics of a BatchGroup.
+const (
+	// BatchFormatText is the text exposition format 0.0.4, the default.
+	BatchFormatText = "text"
+	// BatchFormatOpenMetrics is the OpenMetrics text format, including
+	// the final "# EOF" line.
+	BatchFormatOpenMetrics = "openmetrics"
+)
+
+// BatchRequest is the JSON body of a batch push, see PushBatch.
+type BatchRequest struct {
+	Groups []BatchGroup `json:"groups"`
+}
+
+// BatchGroup is a push to a single group as part of a BatchRequest. Labels are
+// the grouping labels, including the job. TTL and Aggregation work like the
+// TTLHeader and AggregationHeader of a single push. Metrics are in the
+// BatchFormat given by Format.
+type BatchGroup struct {
+	Labels      map[string]string `json:"labels"`
+	Replace     bool              `json:"replace,omitempty"`
+	TTL         string            `json:"ttl,omitempty"`
+	Aggregation string            `json:"aggregation,omitempty"`
+	Format      string            `json:"format,omitempty"`
+	Metrics     string            `json:"metrics"`
+}
+
+// BatchResponse is the JSON body of the response to a batch push. Groups holds
+// the outcome of each BatchGroup of the request, in the same order. Error is
+// set if the batch as a whole has failed.
+type BatchResponse struct {
+	Applied bool               `json:"applied"`
+	Error   string             `json:"error,omitempty"`
+	Groups  []BatchGroupResult `json:"groups"`
+}
+
+// BatchGroupResult is the outcome of a BatchGroup. Error is set if the group is
+// invalid. Valid groups are not applied either if any other group of the batch
+// is invalid.
+type BatchGroupResult struct {
+	Labels map[string]string `json:"labels"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// PushBatch returns an http.Handler which accepts a BatchRequest and pushes all
+// its groups at once: Either all of them are applied, or, if any of them is
+// invalid, none of them. A batch is always checked for consistency, and the
+// request is only answered once it has been processed, with http.StatusOK or,
+// if it has not been applied, http.StatusBadRequest. Either way, the response
+// is a BatchResponse with the outcome of each group. SyncHeader works as for
+// single pushes.
+//
+// The body may be compressed as described for Push.
+//
+// The returned handler is already instrumented for Prometheus.
+func PushBatch(ms storage.MetricStore, maxDecompressedSize int64, logger log.Logger) http.Handler {
+	return InstrumentWithCounter(
+		"push_batch",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var syncTimeout time.Duration
+			v := r.Header.Get(SyncHeader)
+			if v == "" && r.URL != nil {
+				v = r.URL.Query().Get("sync")
+			}
+			if v != "" {
+				var err error
+				if syncTimeout, err = parseSync(v); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					level.Debug(logger).Log("msg", "invalid sync parameter", "sync", v)
+					return
+				}
+			}
+
+			encoding := r.Header.Get("Content-Encoding")
+			body, wire, err := readBody(r, maxDecompressedSize)
+			if err != nil {
+				writeDecompressionError(w, err, encoding, logger)
+				return
+			}
+			defer body.Close()
+
+			var req BatchRequest
+			if err := json.NewDecoder(body).Decode(&req); err != nil {
+				if _, ok := body.err.(compression.TooLargeError); ok {
+					writeDecompressionError(w, body.err, encoding, logger)
+					return
+				}
+				http.Error(w, fmt.Sprintf("invalid batch: %v", err), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "failed to parse batch", "err", err.Error())
+				return
+			}
+			if len(req.Groups) == 0 {
+				http.Error(w, "no groups in batch", http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "no groups in batch")
+				return
+			}
+			observeCompressionRatio(r, body, wire)
+
+			now := time.Now()
+			resp := BatchResponse{Groups: make([]BatchGroupResult, len(req.Groups))}
+			batch := make([]storage.WriteRequest, len(req.Groups))
+			invalid := false
+			for i, g := range req.Groups {
+				resp.Groups[i].Labels = g.Labels
+				if batch[i], err = g.writeRequest(now); err != nil {
+					resp.Groups[i].Error = err.Error()
+					invalid = true
+				}
+			}
+			if invalid {
+				level.Debug(logger).Log("msg", "invalid groups in batch")
+				writeBatchResponse(w, http.StatusBadRequest, resp, logger)
+				return
+			}
+
+			errCh := make(chan error, 1)
+			result := &storage.WriteResult{}
+			ms.SubmitWriteRequest(storage.WriteRequest{
+				Timestamp: now,
+				Batch:     batch,
+				Sync:      syncTimeout > 0,
+				Done:      errCh,
+				Result:    result,
+			})
+			var timeout <-chan time.Time // Never fires for asynchronous pushes.
+			if syncTimeout > 0 {
+				timer := time.NewTimer(syncTimeout)
+				defer timer.Stop()
+				timeout = timer.C
+			}
+			var firstErr error
+		wait:
+			for {
+				select {
+				case err, ok := <-errCh:
+					if !ok {
+						break wait
+					}
+					if firstErr == nil {
+						firstErr = err
+					}
+					level.Error(logger).Log(
+						"msg", "batch push failed",
+						"source", r.RemoteAddr,
+						"err", err.Error(),
+					)
+				case <-timeout:
+					http.Error(
+						w,
+						fmt.Sprintf("push not acknowledged within %s, it might still be applied", syncTimeout),
+						http.StatusServiceUnavailable,
+					)
+					level.Warn(logger).Log(
+						"msg", "synchronous batch push timed out",
+						"source", r.RemoteAddr,
+						"timeout", syncTimeout,
+					)
+					return
+				}
+			}
+
+			for i, err := range result.BatchErrors {
+				if err != nil {
+					resp.Groups[i].Error = err.Error()
+				}
+			}
+			code := http.StatusOK
+			switch firstErr.(type) {
+			case nil:
+				resp.Applied = true
+			case storage.DurabilityError:
+				resp.Applied = true
+				resp.Error = fmt.Sprintf("pushed metrics could not be persisted: %v", firstErr)
+				code = http.StatusInternalServerError
+			default:
+				resp.Error = fmt.Sprintf("pushed metrics are invalid or inconsistent with existing metrics: %v", firstErr)
+				code = http.StatusBadRequest
+			}
+			writeBatchResponse(w, code, resp, logger)
+		}),
+	)
+}
+
+// writeRequest returns the WriteRequest for the group, or an error if the group
+// is invalid.
+func (g BatchGroup) writeRequest(now time.Time) (storage.WriteRequest, error) {
+	if err := checkGroupingLabels(g.Labels); err != nil {
+		return storage.WriteRequest{}, err
+	}
+
+	var ttl time.Duration
+	if g.TTL != "" {
+		d, err := model.ParseDuration(g.TTL)
+		if err != nil || d <= 0 {
+			return storage.WriteRequest{}, fmt.Errorf("invalid TTL %q", g.TTL)
+		}
+		ttl = time.Duration(d)
+	}
+
+	var aggregation storage.Aggregation
+	if g.Aggregation != "" {
+		var err error
+		if aggregation, err = storage.ParseAggregation(g.Aggregation); err != nil {
+			return storage.WriteRequest{}, err
+		}
+	}
+
+	var (
+		metricFamilies map[string]*dto.MetricFamily
+		err            error
+	)
+	switch g.Format {
+	case "", BatchFormatText:
+		var parser expfmt.TextParser
+		metricFamilies, err = parser.TextToMetricFamilies(strings.NewReader(g.Metrics))
+	case BatchFormatOpenMetrics:
+		metricFamilies, err = openmetrics.Parse(strings.NewReader(g.Metrics))
+	default:
+		err = fmt.Errorf("unknown format %q", g.Format)
+	}
+	if err != nil {
+		return storage.WriteRequest{}, err
+	}
+
+	return storage.WriteRequest{
+		Labels:         g.Labels,
+		Timestamp:      now,
+		MetricFamilies: metricFamilies,
+		Replace:        g.Replace,
+		TTL:            ttl,
+		Aggregation:    aggregation,
+		BodySize:       int64(len(g.Metrics)),
+	}, nil
+}
+
+// checkGroupingLabels returns an error if the provided grouping labels lack a
+// job or contain an improper label name.
+func checkGroupingLabels(labels map[string]string) error {
+	if labels[string(model.JobLabel)] == "" {
+		return errors.New("job name is required")
+	}
+	for name := range labels {
+		if !model.LabelNameRE.MatchString(name) ||
+			strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("improper label name %q", name)
+		}
+	}
+	return nil
+}
+
+func writeBatchResponse(w http.ResponseWriter, code int, resp BatchResponse, logger log.Logger) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		level.Error(logger).Log("msg", "error marshaling JSON", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(b); err != nil {
+		level.Error(logger).Log("msg", "failed to write data to connection", "err", err)
+	}
+}
@@ -21,12 +21,15 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/route"
 
 	"github.com/prometheus/pushgateway/storage"
 )
 
-// Delete returns a handler that accepts delete requests.
+// Delete returns a handler that accepts delete requests. Requests with family
+// query parameters only delete the metric families of those names from the
+// group.
 //
 // The returned handler is already instrumented for Prometheus.
 func Delete(ms storage.MetricStore, jobBase64Encoded bool, logger log.Logger) func(http.ResponseWriter, *http.Request) {
@@ -59,9 +62,25 @@ func Delete(ms storage.MetricStore, jobBase64Encoded bool, logger log.Logger) fu
 				return
 			}
 			labels["job"] = job
+			// The family parameters restrict the delete to metric
+			// families of those names.
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "failed to parse query", "err", err.Error())
+				return
+			}
+			families := r.Form["family"]
+			for _, name := range families {
+				if !model.IsValidMetricName(model.LabelValue(name)) {
+					http.Error(w, fmt.Sprintf("invalid metric family name %q", name), http.StatusBadRequest)
+					level.Debug(logger).Log("msg", "invalid metric family name", "family", name)
+					return
+				}
+			}
 			ms.SubmitWriteRequest(storage.WriteRequest{
-				Labels:    labels,
-				Timestamp: time.Now(),
+				Labels:         labels,
+				Timestamp:      time.Now(),
+				DeleteFamilies: families,
 			})
 			w.WriteHeader(http.StatusAccepted)
 		}),
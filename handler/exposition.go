@@ -0,0 +1,108 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/openmetrics"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Metrics returns a handler exposing the metrics gathered by g, which has to
+// include the metrics of ms. If the request asks for the OpenMetrics text
+// format, the metrics are exposed in it, including the units and created
+// timestamps of the pushed metrics. Otherwise, the handler behaves like
+// promhttp.HandlerFor(g, opts).
+func Metrics(g prometheus.Gatherer, ms storage.MetricStore, opts promhttp.HandlerOpts) http.Handler {
+	h := promhttp.HandlerFor(g, opts)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if expfmt.NegotiateIncludingOpenMetrics(r.Header) != expfmt.FmtOpenMetrics {
+			h.ServeHTTP(w, r)
+			return
+		}
+		mfs, err := g.Gather()
+		if err != nil {
+			if opts.ErrorLog != nil {
+				opts.ErrorLog.Println("error gathering metrics:", err)
+			}
+			switch opts.ErrorHandling {
+			case promhttp.PanicOnError:
+				panic(err)
+			case promhttp.ContinueOnError:
+				if len(mfs) == 0 {
+					http.Error(w, "No metrics gathered, last error:\n\n"+err.Error(), http.StatusInternalServerError)
+					return
+				}
+			default:
+				http.Error(w, "An error has occurred while gathering metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Gathering drops the units of the metric families, so look
+		// them up in the metric store again.
+		units := map[string]string{}
+		for _, mf := range ms.GetMetricFamilies() {
+			if unit := openmetrics.Unit(mf); unit != "" {
+				units[mf.GetName()] = unit
+			}
+		}
+		var buf bytes.Buffer
+		for _, mf := range mfs {
+			if unit, ok := units[mf.GetName()]; ok && openmetrics.Unit(mf) == "" {
+				mf = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: mf.Metric}
+				openmetrics.SetUnit(mf, unit)
+			}
+			if err := openmetrics.MetricFamilyToOpenMetrics(&buf, mf); err != nil {
+				if opts.ErrorLog != nil {
+					opts.ErrorLog.Println("error encoding and sending metric family:", err)
+				}
+				http.Error(w, "An error has occurred while encoding metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		openmetrics.FinalizeOpenMetrics(&buf)
+
+		w.Header().Set("Content-Type", string(expfmt.FmtOpenMetrics))
+		var out io.Writer = w
+		if !opts.DisableCompression && gzipAccepted(r.Header) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+		out.Write(buf.Bytes())
+	})
+}
+
+func gzipAccepted(header http.Header) bool {
+	for _, part := range strings.Split(header.Get("Accept-Encoding"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "gzip" || strings.HasPrefix(part, "gzip;") {
+			return true
+		}
+	}
+	return false
+}
@@ -16,20 +16,28 @@ package handler
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/route"
 
 	dto "github.com/prometheus/client_model/go"
 
+	"github.com/prometheus/pushgateway/compression"
+	"github.com/prometheus/pushgateway/openmetrics"
 	"github.com/prometheus/pushgateway/storage"
 )
 
@@ -43,13 +51,18 @@ type MockMetricStore struct {
 	lastWriteRequest storage.WriteRequest
 	metricGroups     storage.GroupingKeyToMetricGroup
 	writeRequests    []storage.WriteRequest
-	err              error // If non-nil, will be sent to Done channel in request.
+	err              error   // If non-nil, will be sent to Done channel in request.
+	hang             bool    // If true, the Done channel is never closed.
+	batchErrors      []error // Stored in the Result of a request, if any.
 }
 
 func (m *MockMetricStore) SubmitWriteRequest(req storage.WriteRequest) {
 	m.writeRequests = append(m.writeRequests, req)
 	m.lastWriteRequest = req
-	if req.Done != nil {
+	if req.Result != nil {
+		req.Result.BatchErrors = m.batchErrors
+	}
+	if req.Done != nil && !m.hang {
 		if m.err != nil {
 			req.Done <- m.err
 		}
@@ -58,7 +71,13 @@ func (m *MockMetricStore) SubmitWriteRequest(req storage.WriteRequest) {
 }
 
 func (m *MockMetricStore) GetMetricFamilies() []*dto.MetricFamily {
-	panic("not implemented")
+	var result []*dto.MetricFamily
+	for _, group := range m.metricGroups {
+		for _, tmf := range group.Metrics {
+			result = append(result, tmf.GetMetricFamily())
+		}
+	}
+	return result
 }
 
 func (m *MockMetricStore) GetMetricFamiliesMap() storage.GroupingKeyToMetricGroup {
@@ -113,9 +132,9 @@ func TestPush(t *testing.T) {
 	mms := MockMetricStore{}
 	mmsWithErr := MockMetricStore{err: errors.New("testerror")}
 	// false, true, false → no replace, check consistency, no base64 encoding.
-	handler := Push(&mms, false, true, false, logger)
-	handlerWithErr := Push(&mmsWithErr, false, true, false, logger)
-	handlerBase64 := Push(&mms, false, true, true, logger)
+	handler := Push(&mms, false, true, false, 1<<20, logger)
+	handlerWithErr := Push(&mmsWithErr, false, true, false, 1<<20, logger)
+	handlerBase64 := Push(&mms, false, true, true, 1<<20, logger)
 	req, err := http.NewRequest("POST", "http://example.org/", &bytes.Buffer{})
 	if err != nil {
 		t.Fatal(err)
@@ -414,6 +433,466 @@ func TestPush(t *testing.T) {
 	}
 }
 
+func TestPushTTL(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, false, false, 1<<20, logger)
+	params := map[string]string{"job": "testjob"}
+
+	scenarios := []struct {
+		header string
+		code   int
+		ttl    time.Duration
+	}{
+		{"", http.StatusAccepted, 0},
+		{"90s", http.StatusAccepted, 90 * time.Second},
+		{"1h", http.StatusAccepted, time.Hour},
+		{"0s", http.StatusBadRequest, 0},
+		{"forever", http.StatusBadRequest, 0},
+	}
+	for _, s := range scenarios {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString("some_metric 3.14\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.header != "" {
+			req.Header.Set(TTLHeader, s.header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		if expected, got := s.code, w.Code; expected != got {
+			t.Errorf("TTL header %q: Wanted status code %v, got %v.", s.header, expected, got)
+		}
+		if expected, got := s.ttl, mms.lastWriteRequest.TTL; expected != got {
+			t.Errorf("TTL header %q: Wanted TTL %v, got %v.", s.header, expected, got)
+		}
+	}
+}
+
+func TestPushAggregation(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, false, false, 1<<20, logger)
+	params := map[string]string{"job": "testjob"}
+
+	scenarios := []struct {
+		header      string
+		code        int
+		aggregation storage.Aggregation
+	}{
+		{"", http.StatusAccepted, ""},
+		{"sum", http.StatusAccepted, storage.AggregationSum},
+		{"max", http.StatusAccepted, storage.AggregationMax},
+		{"none", http.StatusAccepted, storage.AggregationNone},
+		{"average", http.StatusBadRequest, ""},
+	}
+	for _, s := range scenarios {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString("some_metric 3.14\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.header != "" {
+			req.Header.Set(AggregationHeader, s.header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		if expected, got := s.code, w.Code; expected != got {
+			t.Errorf("Aggregation header %q: Wanted status code %v, got %v.", s.header, expected, got)
+		}
+		if expected, got := s.aggregation, mms.lastWriteRequest.Aggregation; expected != got {
+			t.Errorf("Aggregation header %q: Wanted aggregation %q, got %q.", s.header, expected, got)
+		}
+	}
+}
+
+func TestPushBodySize(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, false, false, 1<<20, logger)
+	params := map[string]string{"job": "testjob"}
+
+	body := "some_metric 3.14\nanother_metric 42\n"
+	req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req.WithContext(ctxWithParams(params, req)))
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := int64(len(body)), mms.lastWriteRequest.BodySize; expected != got {
+		t.Errorf("Wanted body size %d, got %d.", expected, got)
+	}
+}
+
+func TestPushOpenMetrics(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, false, false, 1<<20, logger)
+	params := map[string]string{"job": "testjob"}
+
+	scenarios := []struct {
+		contentType string
+		body        string
+		code        int
+	}{
+		{
+			"application/openmetrics-text; version=0.0.1; charset=utf-8",
+			"# TYPE requests counter\nrequests_total 3 # {trace_id=\"abc\"} 1\nrequests_created 1520872607\n# EOF\n",
+			http.StatusAccepted,
+		},
+		{
+			"application/openmetrics-text",
+			"# TYPE requests counter\nrequests_total 3\n",
+			http.StatusBadRequest, // Missing # EOF.
+		},
+		{
+			"text/plain; version=0.0.4",
+			"# TYPE requests counter\nrequests_total 3\n# EOF\n",
+			http.StatusAccepted, // # EOF is just a comment.
+		},
+	}
+	for _, s := range scenarios {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", s.contentType)
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		if expected, got := s.code, w.Code; expected != got {
+			t.Errorf("Content-Type %q: Wanted status code %v, got %v.", s.contentType, expected, got)
+		}
+		if s.code != http.StatusAccepted {
+			continue
+		}
+		if _, ok := mms.lastWriteRequest.MetricFamilies["requests_total"]; !ok {
+			t.Errorf("Content-Type %q: Wanted metric family requests_total, got %v.", s.contentType, mms.lastWriteRequest.MetricFamilies)
+		}
+	}
+	m := mms.writeRequests[0].MetricFamilies["requests_total"].GetMetric()[0]
+	if expected, got := "abc", m.GetCounter().GetExemplar().GetLabel()[0].GetValue(); expected != got {
+		t.Errorf("Wanted exemplar label value %q, got %q.", expected, got)
+	}
+	if expected, got := int64(1520872607), openmetrics.CreatedTimestamp(m).GetSeconds(); expected != got {
+		t.Errorf("Wanted created timestamp %d, got %d.", expected, got)
+	}
+}
+
+func TestPushCompressed(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, false, false, 1000, logger)
+	params := map[string]string{"job": "testjob"}
+	text := []byte("some_metric 3.14\nanother_metric 42\n")
+	// Decompresses to 1001 bytes.
+	tooLarge := []byte(fmt.Sprintf("some_metric 1 # %0984d\n", 0))
+
+	for _, encoding := range compression.Supported() {
+		for _, s := range []struct {
+			body []byte
+			code int
+		}{
+			{text, http.StatusAccepted},
+			{tooLarge, http.StatusRequestEntityTooLarge},
+		} {
+			mms.lastWriteRequest = storage.WriteRequest{}
+			body, err := compression.Compress(s.body, encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest("POST", "http://example.org/", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Encoding", encoding)
+			w := httptest.NewRecorder()
+			handler(w, req.WithContext(ctxWithParams(params, req)))
+			if expected, got := s.code, w.Code; expected != got {
+				t.Errorf("%s: Wanted status code %v, got %v.", encoding, expected, got)
+			}
+			if s.code != http.StatusAccepted {
+				if mms.lastWriteRequest.Labels != nil {
+					t.Errorf("%s: Wanted no write request, got %v.", encoding, mms.lastWriteRequest)
+				}
+				continue
+			}
+			if expected, got := 2, len(mms.lastWriteRequest.MetricFamilies); expected != got {
+				t.Errorf("%s: Wanted %d metric families, got %d.", encoding, expected, got)
+			}
+			if expected, got := int64(len(text)), mms.lastWriteRequest.BodySize; expected != got {
+				t.Errorf("%s: Wanted body size %d, got %d.", encoding, expected, got)
+			}
+		}
+	}
+
+	for encoding, code := range map[string]int{
+		"br":           http.StatusUnsupportedMediaType,
+		"gzip":         http.StatusBadRequest, // Not actually compressed.
+		"identity":     http.StatusAccepted,
+		"gzip, snappy": http.StatusUnsupportedMediaType,
+	} {
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Encoding", encoding)
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		if expected, got := code, w.Code; expected != got {
+			t.Errorf("%s: Wanted status code %v, got %v.", encoding, expected, got)
+		}
+	}
+}
+
+func TestPushBatch(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := PushBatch(&mms, 1<<20, logger)
+
+	post := func(body string, header http.Header) (int, BatchResponse) {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		req, err := http.NewRequest("POST", "http://example.org/metrics/batch", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var resp BatchResponse
+		if w.Code == http.StatusOK || w.Header().Get("Content-Type") == "application/json" {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Invalid response %q: %v", w.Body.String(), err)
+			}
+		}
+		return w.Code, resp
+	}
+
+	valid := `{"groups": [
+	{"labels": {"job": "job1", "instance": "a"}, "metrics": "some_metric 3.14\nanother_metric 42\n"},
+	{"labels": {"job": "job1", "instance": "b"}, "replace": true, "ttl": "5m", "aggregation": "sum",
+	 "format": "openmetrics", "metrics": "# TYPE some_metric gauge\nsome_metric 1\n# EOF\n"}
+]}`
+	code, resp := post(valid, nil)
+	if expected, got := http.StatusOK, code; expected != got {
+		t.Fatalf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !resp.Applied || len(resp.Groups) != 2 || resp.Groups[0].Error != "" || resp.Groups[1].Error != "" {
+		t.Errorf("Wanted applied batch without errors, got %+v.", resp)
+	}
+	batch := mms.lastWriteRequest.Batch
+	if expected, got := 2, len(batch); expected != got {
+		t.Fatalf("Wanted %d pushes in batch, got %d.", expected, got)
+	}
+	if expected, got := map[string]string{"job": "job1", "instance": "a"}, batch[0].Labels; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted labels %v, got %v.", expected, got)
+	}
+	if expected, got := 2, len(batch[0].MetricFamilies); expected != got {
+		t.Errorf("Wanted %d metric families, got %d.", expected, got)
+	}
+	if batch[0].Replace || !batch[1].Replace {
+		t.Error("Wanted only the second push to replace.")
+	}
+	if expected, got := 5*time.Minute, batch[1].TTL; expected != got {
+		t.Errorf("Wanted TTL %v, got %v.", expected, got)
+	}
+	if expected, got := storage.AggregationSum, batch[1].Aggregation; expected != got {
+		t.Errorf("Wanted aggregation %q, got %q.", expected, got)
+	}
+	if expected, got := dto.MetricType_GAUGE, batch[1].MetricFamilies["some_metric"].GetType(); expected != got {
+		t.Errorf("Wanted type %v, got %v.", expected, got)
+	}
+	if mms.lastWriteRequest.Done == nil || mms.lastWriteRequest.Sync {
+		t.Error("Wanted asynchronous batch with Done channel.")
+	}
+
+	code, _ = post(valid, http.Header{SyncHeader: {"true"}})
+	if expected, got := http.StatusOK, code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !mms.lastWriteRequest.Sync {
+		t.Error("Wanted synchronous batch.")
+	}
+
+	for _, body := range []string{"", "not JSON", `{"groups": []}`} {
+		if code, _ := post(body, nil); code != http.StatusBadRequest {
+			t.Errorf("Body %q: Wanted status code %v, got %v.", body, http.StatusBadRequest, code)
+		}
+	}
+
+	code, resp = post(`{"groups": [
+	{"labels": {"job": "job1"}, "metrics": "some_metric 1\n"},
+	{"labels": {"instance": "a"}, "metrics": "some_metric 1\n"},
+	{"labels": {"job": "job1", "__name__": "a"}, "metrics": "some_metric 1\n"},
+	{"labels": {"job": "job1"}, "ttl": "forever", "metrics": "some_metric 1\n"},
+	{"labels": {"job": "job1"}, "aggregation": "median", "metrics": "some_metric 1\n"},
+	{"labels": {"job": "job1"}, "format": "protobuf", "metrics": "some_metric 1\n"},
+	{"labels": {"job": "job1"}, "metrics": "some_metric one\n"}
+]}`, nil)
+	if expected, got := http.StatusBadRequest, code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if resp.Applied || len(resp.Groups) != 7 {
+		t.Fatalf("Wanted rejected batch with 7 results, got %+v.", resp)
+	}
+	for i, g := range resp.Groups {
+		if invalid := i > 0; invalid != (g.Error != "") {
+			t.Errorf("Group %d: Wanted invalid %t, got error %q.", i, invalid, g.Error)
+		}
+	}
+	if mms.lastWriteRequest.Batch != nil {
+		t.Error("Invalid batch has been submitted.")
+	}
+
+	mms.err = errors.New("1 of 2 pushes in the batch are invalid")
+	mms.batchErrors = []error{nil, errors.New("inconsistent")}
+	code, resp = post(valid, nil)
+	if expected, got := http.StatusBadRequest, code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if resp.Applied || resp.Error == "" || resp.Groups[0].Error != "" || resp.Groups[1].Error != "inconsistent" {
+		t.Errorf("Wanted rejected batch with error in second group, got %+v.", resp)
+	}
+
+	mms.err = storage.DurabilityError{Err: errors.New("disk full")}
+	mms.batchErrors = nil
+	code, resp = post(valid, http.Header{SyncHeader: {"true"}})
+	if expected, got := http.StatusInternalServerError, code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !resp.Applied || resp.Error == "" {
+		t.Errorf("Wanted applied batch with error, got %+v.", resp)
+	}
+	mms.err = nil
+
+	compressed, err := compression.Compress([]byte(valid), compression.Zstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ = post(string(compressed), http.Header{"Content-Encoding": {compression.Zstd}})
+	if expected, got := http.StatusOK, code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+}
+
+func TestMetricsOpenMetrics(t *testing.T) {
+	mf := &dto.MetricFamily{
+		Name: proto.String("transferred_bytes_total"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label:   []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String("testjob")}},
+				Counter: &dto.Counter{Value: proto.Float64(42)},
+			},
+		},
+	}
+	openmetrics.SetUnit(mf, "bytes")
+	openmetrics.SetCreatedTimestamp(mf.Metric[0], &timestamp.Timestamp{Seconds: 1520872607})
+	mms := MockMetricStore{
+		metricGroups: storage.GroupingKeyToMetricGroup{
+			"job\xfftestjob": storage.MetricGroup{
+				Labels: map[string]string{"job": "testjob"},
+				Metrics: storage.NameToTimestampedMetricFamilyMap{
+					"transferred_bytes_total": storage.TimestampedMetricFamily{
+						GobbableMetricFamily: (*storage.GobbableMetricFamily)(mf),
+					},
+				},
+			},
+		},
+	}
+	// Gatherers rebuild the metric families, dropping the unit.
+	g := prometheus.Gatherers{prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return mms.GetMetricFamilies(), nil
+	})}
+	handler := Metrics(g, &mms, promhttp.HandlerOpts{})
+
+	scenarios := []struct {
+		accept      string
+		contentType expfmt.Format
+		body        string
+	}{
+		{
+			"application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5",
+			expfmt.FmtOpenMetrics,
+			`# TYPE transferred_bytes counter
+# UNIT transferred_bytes bytes
+transferred_bytes_total{job="testjob"} 42.0
+transferred_bytes_created{job="testjob"} 1520872607
+# EOF
+`,
+		},
+		{
+			"text/plain",
+			expfmt.FmtText,
+			`# TYPE transferred_bytes_total counter
+transferred_bytes_total{job="testjob"} 42
+`,
+		},
+	}
+	for _, s := range scenarios {
+		req, err := http.NewRequest("GET", "http://example.org/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", s.accept)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if expected, got := http.StatusOK, w.Code; expected != got {
+			t.Errorf("Accept %q: Wanted status code %v, got %v.", s.accept, expected, got)
+		}
+		if expected, got := string(s.contentType), w.Header().Get("Content-Type"); expected != got {
+			t.Errorf("Accept %q: Wanted Content-Type %q, got %q.", s.accept, expected, got)
+		}
+		if expected, got := s.body, w.Body.String(); expected != got {
+			t.Errorf("Accept %q: Wanted body\n%s\ngot\n%s", s.accept, expected, got)
+		}
+	}
+}
+
+func TestPushSync(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, false, false, 1<<20, logger)
+	params := map[string]string{"job": "testjob"}
+
+	scenarios := []struct {
+		url    string
+		header string
+		err    error
+		hang   bool
+		code   int
+		sync   bool
+	}{
+		{"http://example.org/", "", nil, false, http.StatusAccepted, false},
+		{"http://example.org/?sync=true", "", nil, false, http.StatusOK, true},
+		{"http://example.org/?sync=false", "", nil, false, http.StatusAccepted, false},
+		{"http://example.org/", "5s", nil, false, http.StatusOK, true},
+		{"http://example.org/", "forever", nil, false, http.StatusBadRequest, false},
+		{"http://example.org/?sync=true", "", errors.New("inconsistent"), false, http.StatusBadRequest, true},
+		{"http://example.org/?sync=true", "", storage.DurabilityError{Err: errors.New("disk full")}, false, http.StatusInternalServerError, true},
+		{"http://example.org/", "10ms", nil, true, http.StatusServiceUnavailable, true},
+	}
+	for _, s := range scenarios {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		mms.err = s.err
+		mms.hang = s.hang
+		req, err := http.NewRequest("POST", s.url, bytes.NewBufferString("some_metric 3.14\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.header != "" {
+			req.Header.Set(SyncHeader, s.header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		if expected, got := s.code, w.Code; expected != got {
+			t.Errorf("URL %q, sync header %q: Wanted status code %v, got %v.", s.url, s.header, expected, got)
+		}
+		if expected, got := s.sync, mms.lastWriteRequest.Sync; expected != got {
+			t.Errorf("URL %q, sync header %q: Wanted sync %t, got %t.", s.url, s.header, expected, got)
+		}
+	}
+}
+
 func TestDelete(t *testing.T) {
 	mms := MockMetricStore{}
 	handler := Delete(&mms, false, logger)
@@ -500,7 +979,49 @@ func TestDelete(t *testing.T) {
 	if expected, got := "testinstance", mms.lastWriteRequest.Labels["instance"]; expected != got {
 		t.Errorf("Wanted instance %v, got %v.", expected, got)
 	}
+	if mms.lastWriteRequest.DeleteFamilies != nil {
+		t.Errorf("Write request unexpectedly has families to delete: %#v", mms.lastWriteRequest)
+	}
 
+	// With metric families to delete.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	w = httptest.NewRecorder()
+
+	params = map[string]string{
+		"job":    "testjob",
+		"labels": "/instance/testinstance",
+	}
+
+	familyReq, err := http.NewRequest("DELETE", "http://example.org/?family=foo_total&family=bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler(w, familyReq.WithContext(ctxWithParams(params, familyReq)))
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := []string{"foo_total", "bar"}, mms.lastWriteRequest.DeleteFamilies; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted families to delete %v, got %v.", expected, got)
+	}
+	if mms.lastWriteRequest.MetricFamilies != nil {
+		t.Errorf("Write request unexpectedly has metric families: %#v", mms.lastWriteRequest)
+	}
+
+	// With an invalid metric family name.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	w = httptest.NewRecorder()
+
+	familyReq, err = http.NewRequest("DELETE", "http://example.org/?family=foo-bar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler(w, familyReq.WithContext(ctxWithParams(params, familyReq)))
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp unexpectedly set: %#v", mms.lastWriteRequest)
+	}
 }
 
 func TestSplitLabels(t *testing.T) {
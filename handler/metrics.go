@@ -37,6 +37,14 @@ var (
 		},
 		[]string{"method"},
 	)
+	httpPushCompressionRatio = promauto.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "pushgateway_http_push_compression_ratio",
+			Help:       "Ratio of decompressed to compressed body size for compressed HTTP pushes to the Pushgateway.",
+			Objectives: map[float64]float64{0.1: 0.01, 0.5: 0.05, 0.9: 0.01},
+		},
+		[]string{"method", "encoding"},
+	)
 	httpPushDuration = promauto.NewSummaryVec(
 		prometheus.SummaryOpts{
 			Name:       "pushgateway_http_push_duration_seconds",
@@ -33,6 +33,8 @@ import (
 
 	dto "github.com/prometheus/client_model/go"
 
+	"github.com/prometheus/pushgateway/compression"
+	"github.com/prometheus/pushgateway/openmetrics"
 	"github.com/prometheus/pushgateway/storage"
 )
 
@@ -40,6 +42,22 @@ const (
 	// Base64Suffix is appended to a label name in the request URL path to
 	// mark the following label value as base64 encoded.
 	Base64Suffix = "@base64"
+	// TTLHeader is the HTTP header to set the TTL of the pushed group as a
+	// duration like "30m", overriding the default TTL.
+	TTLHeader = "Pushgateway-TTL"
+	// AggregationHeader is the HTTP header to aggregate the pushed metrics
+	// into the stored ones, with one of "last", "max", "min", or "sum" as
+	// the aggregation of gauges, or to disable aggregation with "none",
+	// overriding the configured aggregation of the job.
+	AggregationHeader = "Pushgateway-Aggregation"
+	// SyncHeader is the HTTP header to make a push wait until the pushed
+	// metrics are durable (see storage.WriteRequest). Its value is "true"
+	// to wait for up to DefaultSyncTimeout, or a duration like "5s" to wait
+	// for up to that long. The "sync" URL query parameter works the same.
+	SyncHeader = "Pushgateway-Sync"
+	// DefaultSyncTimeout is how long a synchronous push waits at most by
+	// default.
+	DefaultSyncTimeout = 10 * time.Second
 )
 
 // Push returns an http.Handler which accepts samples over HTTP and stores them
@@ -47,12 +65,18 @@ const (
 // given by the request are deleted before new ones are stored. If check is
 // true, the pushed metrics are immediately checked for consistency (with
 // existing metrics and themselves), and an inconsistent push is rejected with
-// http.StatusBadRequest.
+// http.StatusBadRequest. A synchronous push (see SyncHeader) is always checked
+// and answered with http.StatusOK only once the pushed metrics are durable.
+//
+// The body may be compressed with one of compression.Supported as announced by
+// the Content-Encoding header. A body decompressing to more than
+// maxDecompressedSize bytes is rejected with http.StatusRequestEntityTooLarge.
 //
 // The returned handler is already instrumented for Prometheus.
 func Push(
 	ms storage.MetricStore,
 	replace, check, jobBase64Encoded bool,
+	maxDecompressedSize int64,
 	logger log.Logger,
 ) func(http.ResponseWriter, *http.Request) {
 	var mtx sync.Mutex // Protects ps.
@@ -83,6 +107,47 @@ func Push(
 		}
 		labels["job"] = job
 
+		var ttl time.Duration
+		if h := r.Header.Get(TTLHeader); h != "" {
+			d, err := model.ParseDuration(h)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("invalid %s header %q", TTLHeader, h), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "invalid TTL header", "ttl", h)
+				return
+			}
+			ttl = time.Duration(d)
+		}
+
+		var aggregation storage.Aggregation
+		if h := r.Header.Get(AggregationHeader); h != "" {
+			if aggregation, err = storage.ParseAggregation(h); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s header: %v", AggregationHeader, err), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "invalid aggregation header", "aggregation", h)
+				return
+			}
+		}
+
+		var syncTimeout time.Duration
+		v := r.Header.Get(SyncHeader)
+		if v == "" && r.URL != nil {
+			v = r.URL.Query().Get("sync")
+		}
+		if v != "" {
+			if syncTimeout, err = parseSync(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "invalid sync parameter", "sync", v)
+				return
+			}
+		}
+
+		encoding := r.Header.Get("Content-Encoding")
+		body, wire, err := readBody(r, maxDecompressedSize)
+		if err != nil {
+			writeDecompressionError(w, err, encoding, logger)
+			return
+		}
+		defer body.Close()
+
 		var metricFamilies map[string]*dto.MetricFamily
 		ctMediatype, ctParams, ctErr := mime.ParseMediaType(r.Header.Get("Content-Type"))
 		if ctErr == nil && ctMediatype == "application/vnd.google.protobuf" &&
@@ -91,7 +156,7 @@ func Push(
 			metricFamilies = map[string]*dto.MetricFamily{}
 			for {
 				mf := &dto.MetricFamily{}
-				if _, err = pbutil.ReadDelimited(r.Body, mf); err != nil {
+				if _, err = pbutil.ReadDelimited(body, mf); err != nil {
 					if err == io.EOF {
 						err = nil
 					}
@@ -99,25 +164,35 @@ func Push(
 				}
 				metricFamilies[mf.GetName()] = mf
 			}
+		} else if ctErr == nil && ctMediatype == expfmt.OpenMetricsType {
+			metricFamilies, err = openmetrics.Parse(body)
 		} else {
 			// We could do further content-type checks here, but the
 			// fallback for now will anyway be the text format
 			// version 0.0.4, so just go for it and see if it works.
 			var parser expfmt.TextParser
-			metricFamilies, err = parser.TextToMetricFamilies(r.Body)
+			metricFamilies, err = parser.TextToMetricFamilies(body)
 		}
 		if err != nil {
+			if _, ok := body.err.(compression.TooLargeError); ok {
+				writeDecompressionError(w, body.err, encoding, logger)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			level.Debug(logger).Log("msg", "failed to parse text", "err", err.Error())
 			return
 		}
+		observeCompressionRatio(r, body, wire)
 		now := time.Now()
-		if !check {
+		if !check && syncTimeout == 0 {
 			ms.SubmitWriteRequest(storage.WriteRequest{
 				Labels:         labels,
 				Timestamp:      now,
 				MetricFamilies: metricFamilies,
 				Replace:        replace,
+				TTL:            ttl,
+				Aggregation:    aggregation,
+				BodySize:       body.n,
 			})
 			w.WriteHeader(http.StatusAccepted)
 			return
@@ -129,27 +204,56 @@ func Push(
 			Timestamp:      now,
 			MetricFamilies: metricFamilies,
 			Replace:        replace,
+			TTL:            ttl,
+			Aggregation:    aggregation,
+			BodySize:       body.n,
+			Sync:           syncTimeout > 0,
 			Done:           errCh,
 		})
-		for err := range errCh {
-			// Send only first error via HTTP, but log all of them.
-			// TODO(beorn): Consider sending all errors once we
-			// have a use case. (Currently, at most one error is
-			// produced.)
-			if !errReceived {
+		var timeout <-chan time.Time // Never fires for asynchronous pushes.
+		if syncTimeout > 0 {
+			timer := time.NewTimer(syncTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		for {
+			select {
+			case err, ok := <-errCh:
+				if !ok {
+					return
+				}
+				// Send only first error via HTTP, but log all of them.
+				// TODO(beorn): Consider sending all errors once we
+				// have a use case. (Currently, at most one error is
+				// produced.)
+				msg, code := "pushed metrics are invalid or inconsistent with existing metrics", http.StatusBadRequest
+				if _, ok := err.(storage.DurabilityError); ok {
+					msg, code = "pushed metrics could not be persisted", http.StatusInternalServerError
+				}
+				if !errReceived {
+					http.Error(w, fmt.Sprintf("%s: %v", msg, err), code)
+				}
+				level.Error(logger).Log(
+					"msg", msg,
+					"method", r.Method,
+					"source", r.RemoteAddr,
+					"err", err.Error(),
+				)
+				errReceived = true
+			case <-timeout:
 				http.Error(
 					w,
-					fmt.Sprintf("pushed metrics are invalid or inconsistent with existing metrics: %v", err),
-					http.StatusBadRequest,
+					fmt.Sprintf("push not acknowledged within %s, it might still be applied", syncTimeout),
+					http.StatusServiceUnavailable,
+				)
+				level.Warn(logger).Log(
+					"msg", "synchronous push timed out",
+					"method", r.Method,
+					"source", r.RemoteAddr,
+					"timeout", syncTimeout,
 				)
+				return
 			}
-			level.Error(logger).Log(
-				"msg", "pushed metrics are invalid or inconsistent with existing metrics",
-				"method", r.Method,
-				"source", r.RemoteAddr,
-				"err", err.Error(),
-			)
-			errReceived = true
 		}
 	})
 
@@ -164,6 +268,60 @@ func Push(
 	}
 }
 
+// readBody returns readers for the body of r, decompressed as announced by its
+// Content-Encoding header, and as read from the wire, respectively. The
+// decompressed body must be closed once read. An error is returned if the
+// Content-Encoding is not supported or the body cannot be decompressed.
+func readBody(r *http.Request, maxDecompressedSize int64) (body, wire *countingReader, err error) {
+	wire = &countingReader{r: r.Body}
+	body = &countingReader{r: wire}
+	encoding := r.Header.Get("Content-Encoding")
+	if encoding == "" || encoding == "identity" {
+		return body, wire, nil
+	}
+	if !compression.IsSupported(encoding) {
+		return nil, nil, unsupportedEncodingError(encoding)
+	}
+	rc, err := compression.NewReader(wire, encoding, maxDecompressedSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	body.r = rc
+	return body, wire, nil
+}
+
+// observeCompressionRatio observes the compression ratio of a fully read body
+// as returned by readBody, if it was compressed.
+func observeCompressionRatio(r *http.Request, body, wire *countingReader) {
+	if body.r != wire && wire.n > 0 {
+		httpPushCompressionRatio.WithLabelValues(
+			strings.ToLower(r.Method), r.Header.Get("Content-Encoding"),
+		).Observe(float64(body.n) / float64(wire.n))
+	}
+}
+
+type unsupportedEncodingError string
+
+func (e unsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported Content-Encoding %q", string(e))
+}
+
+// writeDecompressionError answers a push whose body could not be read with the
+// given encoding, see readBody.
+func writeDecompressionError(w http.ResponseWriter, err error, encoding string, logger log.Logger) {
+	if _, ok := err.(unsupportedEncodingError); ok {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		level.Debug(logger).Log("msg", "unsupported content encoding", "encoding", encoding)
+		return
+	}
+	code := http.StatusBadRequest
+	if _, ok := err.(compression.TooLargeError); ok {
+		code = http.StatusRequestEntityTooLarge
+	}
+	http.Error(w, fmt.Sprintf("failed to decompress %s body: %v", encoding, err), code)
+	level.Debug(logger).Log("msg", "failed to decompress body", "encoding", encoding, "err", err.Error())
+}
+
 // decodeBase64 decodes the provided string using the “Base 64 Encoding with URL
 // and Filename Safe Alphabet” (RFC 4648). Padding characters (i.e. trailing
 // '=') are ignored.
@@ -202,3 +360,44 @@ func splitLabels(labels string) (map[string]string, error) {
 	}
 	return result, nil
 }
+
+// parseSync parses the value of the SyncHeader and returns how long to wait
+// for the push to be durable, or 0 for an asynchronous push.
+func parseSync(s string) (time.Duration, error) {
+	switch s {
+	case "true":
+		return DefaultSyncTimeout, nil
+	case "false":
+		return 0, nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid sync value %q, must be true, false, or a positive duration", s)
+	}
+	return time.Duration(d), nil
+}
+
+// countingReader counts the bytes read from r. It also records the last error
+// other than io.EOF, as parsers do not necessarily pass it on unchanged.
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	if err != nil && err != io.EOF {
+		cr.err = err
+	}
+	return n, err
+}
+
+// Close closes r if it is an io.Closer.
+func (cr *countingReader) Close() error {
+	if c, ok := cr.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
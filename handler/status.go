@@ -27,6 +27,9 @@ import (
 	"github.com/go-kit/kit/log/level"
 
 	"github.com/prometheus/common/version"
+
+	dto "github.com/prometheus/client_model/go"
+
 	"github.com/prometheus/pushgateway/storage"
 )
 
@@ -73,6 +76,13 @@ func Status(
 				"base64": func(s string) string {
 					return base64.RawURLEncoding.EncodeToString([]byte(s))
 				},
+				"nativeHistogram": func(h *dto.Histogram) *storage.NativeHistogram {
+					nh, err := storage.GetNativeHistogram(h)
+					if err != nil {
+						return nil
+					}
+					return nh
+				},
 			})
 
 			f, err := root.Open("template.html")
@@ -21,6 +21,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+
 	"github.com/prometheus/pushgateway/asset"
 	"github.com/prometheus/pushgateway/storage"
 )
@@ -55,3 +59,54 @@ func TestPathPrefixPresenceInPage(t *testing.T) {
 		t.Log(body)
 	}
 }
+
+func TestNativeHistogramInPage(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", time.Minute, nil, logger)
+	status := Status(ms, asset.Assets, map[string]string{}, "", logger)
+	defer ms.Shutdown()
+
+	h := &dto.Histogram{
+		SampleCount: proto.Uint64(3),
+		SampleSum:   proto.Float64(2.5),
+	}
+	storage.SetNativeHistogram(h, &storage.NativeHistogram{
+		Schema:         0,
+		ZeroThreshold:  0.001,
+		ZeroCount:      1,
+		PositiveSpans:  []storage.BucketSpan{{Offset: 1, Length: 1}},
+		PositiveDeltas: []int64{2},
+	})
+	errCh := make(chan error, 1)
+	ms.SubmitWriteRequest(storage.WriteRequest{
+		Labels:    map[string]string{"job": "testjob"},
+		Timestamp: time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{
+			"native": {
+				Name:   proto.String("native"),
+				Type:   dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{{Histogram: h}},
+			},
+		},
+		Done: errCh,
+	})
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	w := httptest.NewRecorder()
+	status.ServeHTTP(w, &http.Request{})
+	if http.StatusOK != w.Code {
+		t.Fatalf("Wanted status %d, got %d", http.StatusOK, w.Code)
+	}
+	body := w.Body.String()
+	for _, s := range []string{
+		"Native histogram schema",
+		"Sample values in zero bucket [-0.001, 0.001]",
+		"Sample values in (1, 2]",
+		"offset 1, length 1",
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Body does not contain %q.", s)
+		}
+	}
+}
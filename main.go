@@ -15,6 +15,7 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"net/http/pprof"
@@ -41,8 +42,11 @@ import (
 
 	api_v1 "github.com/prometheus/pushgateway/api/v1"
 	"github.com/prometheus/pushgateway/asset"
+	"github.com/prometheus/pushgateway/cluster"
 	"github.com/prometheus/pushgateway/handler"
 	"github.com/prometheus/pushgateway/storage"
+	"github.com/prometheus/pushgateway/tcp_handler"
+	"github.com/prometheus/pushgateway/tcp_server"
 )
 
 func init() {
@@ -66,9 +70,29 @@ func main() {
 		routePrefix         = app.Flag("web.route-prefix", "Prefix for the internal routes of web endpoints. Defaults to the path of --web.external-url.").Default("").String()
 		enableLifeCycle     = app.Flag("web.enable-lifecycle", "Enable shutdown via HTTP request.").Default("false").Bool()
 		enableAdminAPI      = app.Flag("web.enable-admin-api", "Enable API endpoints for admin control actions.").Default("false").Bool()
-		persistenceFile     = app.Flag("persistence.file", "File to persist metrics. If empty, metrics are only kept in memory.").Default("").String()
+		storageBackend      = app.Flag("storage.backend", "Storage backend to use. \"file\" persists all metrics to a single file, \"bbolt\" persists each group as a record of an embedded key-value store.").Default(storage.FileBackend).Enum(storage.Backends()...)
+		persistenceFile     = app.Flag("persistence.file", "File to persist metrics. If empty, metrics are only kept in memory (not supported by the bbolt backend).").Default("").String()
 		persistenceInterval = app.Flag("persistence.interval", "The minimum interval at which to write out the persistence file.").Default("5m").Duration()
+		persistenceWAL      = app.Flag("persistence.wal", "Log every change to a write-ahead log next to the persistence file, which is replayed upon start-up. This greatly reduces data loss on crashes. The persistence file then only serves as a snapshot.").Default("false").Bool()
+		metricTTL           = app.Flag("metric.ttl", "Time after which a group of metrics is deleted if it has not been pushed to anymore. 0 disables expiry. Pushes can override it per group.").Default("0s").Duration()
+		clusterPeers        = app.Flag("cluster.peer", "Base URL (including the route prefix) of a peer Pushgateway to replicate metrics with, e.g. \"http://pushgateway2:9091\". Repeat for multiple peers. Each peer has to list this Pushgateway as a peer, too.").Strings()
+		pushAggregationFile = app.Flag("push.aggregation-config-file", "Path to a file with one job:aggregation per line. Pushes to groups of a listed job are aggregated into the stored metrics unless they select an aggregation themselves. Valid aggregations are none, last, max, min, and sum, which applies to gauges.").Default("").String()
+		pushQuotaFile       = app.Flag("push.quota-config-file", "Path to a file with one tenant:limit=value,... line per tenant, with the limits groups, series_per_group, series, and body_bytes. A tenant is the authenticated TCP user or else the job. The tenant \"*\" applies to all tenants not listed. If set, usage per tenant is exposed as metrics.").Default("").String()
+		pushTimestampPolicy = app.Flag("push.timestamp-policy", "What to do with pushed metrics that have timestamps: \"reject\" the push, \"strip\" the timestamps (counted by pushgateway_stripped_timestamps_total), or \"keep\" and expose them.").Default(string(storage.TimestampsReject)).Enum(string(storage.TimestampsReject), string(storage.TimestampsStrip), string(storage.TimestampsKeep))
+		pushTimestampMaxAge = app.Flag("push.timestamp-max-age", "With --push.timestamp-policy=keep, reject pushes with timestamps older than this. 0 disables the check.").Default("0s").Duration()
+		pushMaxDecompressed = app.Flag("push.max-decompressed-size", "Maximum size of the body of a compressed push after decompression. Larger HTTP pushes are rejected with status code 413. TCP frames are limited by --tcp.max-frame-size instead.").Default("64MB").Bytes()
 		pushUnchecked       = app.Flag("push.disable-consistency-check", "Do not check consistency of pushed metrics. DANGEROUS.").Default("false").Bool()
+		tcpListenAddress    = app.Flag("tcp.listen-address", "Address to listen on for the binary TCP protocol. If empty, the TCP service is disabled.").Default("").String()
+		tcpHBInterval       = app.Flag("tcp.heartbeat-interval", "Interval at which heartbeats are sent to TCP clients. 0 disables heartbeats.").Default("0s").Duration()
+		tcpHBTimeout        = app.Flag("tcp.heartbeat-timeout", "Time after which a TCP connection without any incoming traffic is closed. Only used if heartbeats are enabled.").Default("1m").Duration()
+		tcpConcurrency      = app.Flag("tcp.concurrency", "Maximum number of requests processed concurrently per TCP connection. If larger than 1, responses may be sent in a different order than the requests.").Default("4").Int()
+		tcpMaxInFlight      = app.Flag("tcp.max-in-flight", "Maximum number of requests per TCP connection that have been read but not answered yet. Reading from the connection pauses once reached.").Default("64").Int()
+		tcpMaxFrameSize     = app.Flag("tcp.max-frame-size", "Maximum size of a frame accepted on a TCP connection. Connections sending larger frames are closed.").Default("16MB").Bytes()
+		tcpTLSCertFile      = app.Flag("tcp.tls-cert-file", "Path to the certificate file for TLS on the TCP service. If empty, TLS is disabled. The certificate files are re-read upon SIGHUP.").Default("").String()
+		tcpTLSKeyFile       = app.Flag("tcp.tls-key-file", "Path to the key file for TLS on the TCP service.").Default("").String()
+		tcpTLSClientCAFile  = app.Flag("tcp.tls-client-ca-file", "Path to a file with CA certificates to verify TCP client certificates with. If set, clients have to present a valid certificate.").Default("").String()
+		tcpAuthSecretsFile  = app.Flag("tcp.auth-secrets-file", "Path to a file with one user:secret per line. If set, TCP connections have to authenticate before any other request.").Default("").String()
+		tcpAuthTimeout      = app.Flag("tcp.auth-timeout", "Time after which a TCP connection that has not authenticated yet is closed.").Default("10s").Duration()
 		promlogConfig       = promlog.Config{}
 	)
 	promlogflag.AddFlags(app, &promlogConfig)
@@ -96,7 +120,51 @@ func main() {
 		}
 	}
 
-	ms := storage.NewDiskMetricStore(*persistenceFile, *persistenceInterval, prometheus.DefaultGatherer, logger)
+	if *persistenceWAL && *persistenceFile == "" {
+		level.Error(logger).Log("msg", "--persistence.wal requires --persistence.file")
+		os.Exit(1)
+	}
+	opts := []storage.Option{
+		storage.WithTTL(*metricTTL),
+		storage.WithWAL(*persistenceWAL),
+		storage.WithTimestampPolicy(storage.TimestampPolicy(*pushTimestampPolicy), *pushTimestampMaxAge),
+	}
+	if *pushQuotaFile != "" {
+		cfg, err := storage.LoadQuotaConfig(*pushQuotaFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "error loading quota config", "file", *pushQuotaFile, "err", err)
+			os.Exit(1)
+		}
+		opts = append(opts, storage.WithQuotas(cfg))
+	}
+	ms, err := storage.NewMetricStore(*storageBackend, storage.BackendConfig{
+		PersistenceFile:          *persistenceFile,
+		PersistenceInterval:      *persistenceInterval,
+		GatherPredefinedHelpFrom: prometheus.DefaultGatherer,
+		Logger:                   logger,
+		Options:                  opts,
+	})
+	if err != nil {
+		level.Error(logger).Log("msg", "error creating metric store", "backend", *storageBackend, "err", err)
+		os.Exit(1)
+	}
+	if c, ok := ms.(prometheus.Collector); ok && *pushQuotaFile != "" {
+		prometheus.MustRegister(c)
+	}
+	var cs *cluster.Store
+	if len(*clusterPeers) > 0 {
+		cs = cluster.NewStore(ms, *clusterPeers, logger)
+		ms = cs
+		level.Info(logger).Log("msg", "replicating metrics", "node", cs.ID(), "peers", strings.Join(*clusterPeers, ","))
+	}
+	if *pushAggregationFile != "" {
+		cfg, err := storage.LoadAggregationConfig(*pushAggregationFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "error loading aggregation config", "file", *pushAggregationFile, "err", err)
+			os.Exit(1)
+		}
+		ms = storage.NewAggregatingMetricStore(ms, cfg)
+	}
 
 	// Create a Gatherer combining the DefaultGatherer and the metrics from the metric store.
 	g := prometheus.Gatherers{
@@ -109,7 +177,7 @@ func main() {
 	r.Get(*routePrefix+"/-/ready", handler.Ready(ms).ServeHTTP)
 	r.Get(
 		path.Join(*routePrefix, *metricsPath),
-		promhttp.HandlerFor(g, promhttp.HandlerOpts{
+		handler.Metrics(g, ms, promhttp.HandlerOpts{
 			ErrorLog: logFunc(level.Error(logger).Log),
 		}).ServeHTTP,
 	)
@@ -118,13 +186,17 @@ func main() {
 	pushAPIPath := *routePrefix + "/metrics"
 	for _, suffix := range []string{"", handler.Base64Suffix} {
 		jobBase64Encoded := suffix == handler.Base64Suffix
-		r.Put(pushAPIPath+"/job"+suffix+"/:job/*labels", handler.Push(ms, true, !*pushUnchecked, jobBase64Encoded, logger))
-		r.Post(pushAPIPath+"/job"+suffix+"/:job/*labels", handler.Push(ms, false, !*pushUnchecked, jobBase64Encoded, logger))
+		r.Put(pushAPIPath+"/job"+suffix+"/:job/*labels", handler.Push(ms, true, !*pushUnchecked, jobBase64Encoded, int64(*pushMaxDecompressed), logger))
+		r.Post(pushAPIPath+"/job"+suffix+"/:job/*labels", handler.Push(ms, false, !*pushUnchecked, jobBase64Encoded, int64(*pushMaxDecompressed), logger))
 		r.Del(pushAPIPath+"/job"+suffix+"/:job/*labels", handler.Delete(ms, jobBase64Encoded, logger))
-		r.Put(pushAPIPath+"/job"+suffix+"/:job", handler.Push(ms, true, !*pushUnchecked, jobBase64Encoded, logger))
-		r.Post(pushAPIPath+"/job"+suffix+"/:job", handler.Push(ms, false, !*pushUnchecked, jobBase64Encoded, logger))
+		r.Put(pushAPIPath+"/job"+suffix+"/:job", handler.Push(ms, true, !*pushUnchecked, jobBase64Encoded, int64(*pushMaxDecompressed), logger))
+		r.Post(pushAPIPath+"/job"+suffix+"/:job", handler.Push(ms, false, !*pushUnchecked, jobBase64Encoded, int64(*pushMaxDecompressed), logger))
 		r.Del(pushAPIPath+"/job"+suffix+"/:job", handler.Delete(ms, jobBase64Encoded, logger))
 	}
+	r.Post(pushAPIPath+"/batch", handler.PushBatch(ms, int64(*pushMaxDecompressed), logger).ServeHTTP)
+	if cs != nil {
+		r.Get(*routePrefix+cluster.StreamPath, cs.ServeHTTP)
+	}
 	r.Get(*routePrefix+"/static/*filepath", handler.Static(asset.Assets, *routePrefix).ServeHTTP)
 
 	statusHandler := handler.Status(ms, asset.Assets, flags, externalPathPrefix, logger)
@@ -192,9 +264,94 @@ func main() {
 
 	mux.Handle(apiPath+"/v1/", http.StripPrefix(apiPath+"/v1", av1))
 
-	go closeListenerOnQuit(l, quitCh, logger)
+	var (
+		ss     *tcp_server.SocketService
+		ssDone = make(chan struct{})
+	)
+	if *tcpListenAddress != "" {
+		level.Info(logger).Log("tcp_listen_address", *tcpListenAddress)
+		ss, err = tcp_server.NewSocketService(*tcpListenAddress, logger)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+		if err := ss.SetHeartBeat(*tcpHBInterval, *tcpHBTimeout); err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+		if err := ss.SetConcurrency(*tcpConcurrency, *tcpMaxInFlight); err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+		if *tcpMaxFrameSize > math.MaxUint32 {
+			level.Error(logger).Log("msg", "--tcp.max-frame-size must not exceed 4GB")
+			os.Exit(1)
+		}
+		if err := ss.SetMaxFrameSize(uint32(*tcpMaxFrameSize)); err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+		if *tcpAuthSecretsFile != "" {
+			auth, err := tcp_server.LoadAuthenticator(*tcpAuthSecretsFile)
+			if err != nil {
+				level.Error(logger).Log("msg", "failed to load TCP secrets", "err", err)
+				os.Exit(1)
+			}
+			if err := ss.SetAuthentication(auth, *tcpAuthTimeout); err != nil {
+				level.Error(logger).Log("err", err)
+				os.Exit(1)
+			}
+		}
+		if *tcpTLSCertFile != "" || *tcpTLSKeyFile != "" {
+			tlsReloader, err := tcp_server.NewTLSReloader(*tcpTLSCertFile, *tcpTLSKeyFile, *tcpTLSClientCAFile)
+			if err != nil {
+				level.Error(logger).Log("err", err)
+				os.Exit(1)
+			}
+			if err := ss.SetTLS(tlsReloader.GetConfig()); err != nil {
+				level.Error(logger).Log("err", err)
+				os.Exit(1)
+			}
+			go reloadTLSOnHangup(tlsReloader, logger)
+		} else if *tcpTLSClientCAFile != "" {
+			level.Error(logger).Log("msg", "--tcp.tls-client-ca-file requires --tcp.tls-cert-file and --tcp.tls-key-file")
+			os.Exit(1)
+		}
+		tcpRoutes := map[uint32]tcp_server.HandlerFunc{
+			tcp_server.KindPush:           tcp_handler.Push(ms, false, !*pushUnchecked, logger),
+			tcp_server.KindPushReplace:    tcp_handler.Push(ms, true, !*pushUnchecked, logger),
+			tcp_server.KindPushBatch:      tcp_handler.PushBatch(ms, logger),
+			tcp_server.KindDelete:         tcp_handler.Delete(ms, logger),
+			tcp_server.KindDeleteMatching: tcp_handler.DeleteMatching(ms, logger),
+			tcp_server.KindHealthy:        tcp_handler.Healthy(ms),
+			tcp_server.KindReady:          tcp_handler.Ready(ms),
+			tcp_server.KindStatus:         tcp_handler.Status(externalPathPrefix),
+			tcp_server.KindMetrics:        tcp_handler.Metrics(ms),
+		}
+		if *enableAdminAPI {
+			tcpRoutes[tcp_server.KindWipe] = tcp_handler.Wipe(ms, logger)
+		}
+		for kind, h := range tcpRoutes {
+			if err := ss.RegisterRoute(kind, h); err != nil {
+				level.Error(logger).Log("err", err)
+				os.Exit(1)
+			}
+		}
+		go func() {
+			err := ss.Serve()
+			level.Info(logger).Log("msg", "TCP service stopped", "reason", err)
+			close(ssDone)
+		}()
+	} else {
+		close(ssDone)
+	}
+
+	go closeListenerOnQuit(l, ss, quitCh, logger)
 	err = (&http.Server{Addr: *listenAddress, Handler: mux}).Serve(l)
 	level.Error(logger).Log("msg", "HTTP server stopped", "err", err)
+	// The TCP service closes its connections upon stopping and only returns
+	// once no handler can submit anything anymore.
+	<-ssDone
 	// To give running connections a chance to submit their payload, we wait
 	// for 1sec, but we don't want to wait long (e.g. until all connections
 	// are done) to not delay the shutdown.
@@ -238,9 +395,10 @@ func computeRoutePrefix(prefix string, externalURL *url.URL) string {
 	return prefix
 }
 
-// closeListenerOnQuite closes the provided listener upon closing the provided
-// quitCh or upon receiving a SIGINT or SIGTERM.
-func closeListenerOnQuit(l net.Listener, quitCh <-chan struct{}, logger log.Logger) {
+// closeListenerOnQuit closes the provided listener and stops the provided
+// SocketService (if not nil) upon closing the provided quitCh or upon receiving
+// a SIGINT or SIGTERM.
+func closeListenerOnQuit(l net.Listener, ss *tcp_server.SocketService, quitCh <-chan struct{}, logger log.Logger) {
 	notifier := make(chan os.Signal, 1)
 	signal.Notify(notifier, os.Interrupt, syscall.SIGTERM)
 
@@ -253,4 +411,22 @@ func closeListenerOnQuit(l net.Listener, quitCh <-chan struct{}, logger log.Logg
 		break
 	}
 	l.Close()
+	if ss != nil {
+		ss.Stop("pushgateway is shutting down")
+	}
+}
+
+// reloadTLSOnHangup re-reads the TLS certificate files of the TCP service upon
+// receiving a SIGHUP.
+func reloadTLSOnHangup(r *tcp_server.TLSReloader, logger log.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if err := r.Reload(); err != nil {
+			level.Error(logger).Log("msg", "failed to reload TLS certificates", "err", err)
+			continue
+		}
+		level.Info(logger).Log("msg", "reloaded TLS certificates")
+	}
 }
@@ -0,0 +1,227 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openmetrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricFamilyToOpenMetrics writes the provided MetricFamily in the OpenMetrics
+// text format to w. It works like expfmt.MetricFamilyToOpenMetrics, but
+// additionally writes the unit of the MetricFamily and the created timestamps
+// of its metrics. Like there, the caller has to write the final "# EOF" line
+// with FinalizeOpenMetrics after all metric families.
+func MetricFamilyToOpenMetrics(w io.Writer, mf *dto.MetricFamily) error {
+	name := mf.GetName()
+	if name == "" {
+		return fmt.Errorf("MetricFamily has no name: %s", mf)
+	}
+	var (
+		sb        strings.Builder
+		shortName = name
+		typ       string
+	)
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		if strings.HasSuffix(name, "_total") {
+			shortName, typ = strings.TrimSuffix(name, "_total"), "counter"
+		} else {
+			// Rendered as unknown to keep the output valid.
+			typ = "unknown"
+		}
+	case dto.MetricType_GAUGE:
+		typ = "gauge"
+	case dto.MetricType_SUMMARY:
+		typ = "summary"
+	case dto.MetricType_UNTYPED:
+		typ = "unknown"
+	case dto.MetricType_HISTOGRAM:
+		typ = "histogram"
+	default:
+		return fmt.Errorf("unknown metric type %s", mf.GetType())
+	}
+
+	if mf.Help != nil {
+		fmt.Fprintf(&sb, "# HELP %s %s\n", shortName, escape(mf.GetHelp()))
+	}
+	fmt.Fprintf(&sb, "# TYPE %s %s\n", shortName, typ)
+	if unit := Unit(mf); unit != "" && strings.HasSuffix(shortName, "_"+unit) {
+		fmt.Fprintf(&sb, "# UNIT %s %s\n", shortName, unit)
+	}
+
+	for _, m := range mf.GetMetric() {
+		switch typ {
+		case "counter":
+			if m.Counter == nil {
+				return fmt.Errorf("expected counter in metric %s %s", name, m)
+			}
+			writeSample(&sb, name, m, "", 0, formatFloat(m.Counter.GetValue()), m.Counter.Exemplar)
+		case "gauge":
+			if m.Gauge == nil {
+				return fmt.Errorf("expected gauge in metric %s %s", name, m)
+			}
+			writeSample(&sb, name, m, "", 0, formatFloat(m.Gauge.GetValue()), nil)
+		case "unknown":
+			var v float64
+			switch {
+			case m.Untyped != nil:
+				v = m.Untyped.GetValue()
+			case m.Counter != nil:
+				v = m.Counter.GetValue()
+			default:
+				return fmt.Errorf("expected untyped in metric %s %s", name, m)
+			}
+			writeSample(&sb, name, m, "", 0, formatFloat(v), nil)
+		case "summary":
+			if m.Summary == nil {
+				return fmt.Errorf("expected summary in metric %s %s", name, m)
+			}
+			for _, q := range m.Summary.GetQuantile() {
+				writeSample(&sb, name, m, model.QuantileLabel, q.GetQuantile(), formatFloat(q.GetValue()), nil)
+			}
+			writeSample(&sb, name+"_sum", m, "", 0, formatFloat(m.Summary.GetSampleSum()), nil)
+			writeSample(&sb, name+"_count", m, "", 0, strconv.FormatUint(m.Summary.GetSampleCount(), 10), nil)
+		case "histogram":
+			if m.Histogram == nil {
+				return fmt.Errorf("expected histogram in metric %s %s", name, m)
+			}
+			infSeen := false
+			for _, b := range m.Histogram.GetBucket() {
+				writeSample(&sb, name+"_bucket", m, model.BucketLabel, b.GetUpperBound(), strconv.FormatUint(b.GetCumulativeCount(), 10), b.Exemplar)
+				if math.IsInf(b.GetUpperBound(), +1) {
+					infSeen = true
+				}
+			}
+			if !infSeen {
+				writeSample(&sb, name+"_bucket", m, model.BucketLabel, math.Inf(+1), strconv.FormatUint(m.Histogram.GetSampleCount(), 10), nil)
+			}
+			writeSample(&sb, name+"_sum", m, "", 0, formatFloat(m.Histogram.GetSampleSum()), nil)
+			writeSample(&sb, name+"_count", m, "", 0, strconv.FormatUint(m.Histogram.GetSampleCount(), 10), nil)
+		}
+		if typ == "unknown" {
+			continue
+		}
+		if ts := CreatedTimestamp(m); ts != nil {
+			created := *m
+			created.TimestampMs = nil
+			writeSample(&sb, shortName+"_created", &created, "", 0, formatTimestamp(ts), nil)
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// FinalizeOpenMetrics writes the final "# EOF" line required by OpenMetrics.
+func FinalizeOpenMetrics(w io.Writer) error {
+	_, err := io.WriteString(w, "# EOF\n")
+	return err
+}
+
+// writeSample writes a single sample line. If extraLabel is not empty, it is
+// added to the labels of m with extraValue as its value.
+func writeSample(
+	sb *strings.Builder, name string, m *dto.Metric,
+	extraLabel string, extraValue float64,
+	value string, e *dto.Exemplar,
+) {
+	sb.WriteString(name)
+	labels := m.GetLabel()
+	if extraLabel != "" {
+		labels = append(append([]*dto.LabelPair{}, labels...), &dto.LabelPair{
+			Name:  proto.String(extraLabel),
+			Value: proto.String(formatFloat(extraValue)),
+		})
+	}
+	writeLabels(sb, labels)
+	sb.WriteByte(' ')
+	sb.WriteString(value)
+	if m.TimestampMs != nil {
+		sb.WriteByte(' ')
+		sb.WriteString(strconv.FormatFloat(float64(m.GetTimestampMs())/1000, 'f', -1, 64))
+	}
+	if e != nil {
+		sb.WriteString(" # ")
+		writeLabels(sb, e.GetLabel())
+		if len(e.GetLabel()) == 0 {
+			sb.WriteString("{}")
+		}
+		sb.WriteByte(' ')
+		sb.WriteString(formatFloat(e.GetValue()))
+		if e.Timestamp != nil {
+			sb.WriteByte(' ')
+			sb.WriteString(formatTimestamp(e.Timestamp))
+		}
+	}
+	sb.WriteByte('\n')
+}
+
+func writeLabels(sb *strings.Builder, labels []*dto.LabelPair) {
+	if len(labels) == 0 {
+		return
+	}
+	sb.WriteByte('{')
+	for i, lp := range labels {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(lp.GetName())
+		sb.WriteString(`="`)
+		sb.WriteString(escape(lp.GetValue()))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// formatFloat formats f as OpenMetrics requires, i.e. with the special values
+// "+Inf", "-Inf", and "NaN".
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+// formatTimestamp formats ts as seconds since the Unix epoch.
+func formatTimestamp(ts *timestamp.Timestamp) string {
+	s := strconv.FormatInt(ts.GetSeconds(), 10)
+	if nanos := ts.GetNanos(); nanos != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%09d", nanos), "0")
+	}
+	return s
+}
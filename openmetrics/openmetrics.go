@@ -0,0 +1,156 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package openmetrics reads and writes the OpenMetrics text format.
+//
+// The metric families are represented by the protobuf messages of the
+// Prometheus client data model, which know neither the unit of a metric family
+// nor the created timestamp of a metric. Both are kept as unknown fields of the
+// messages, using the field numbers later versions of the client data model
+// have assigned to them. Thus, they survive any marshaling and unmarshaling of
+// the messages, and the accessors of this package are forward compatible.
+package openmetrics
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Field numbers of the extras in the client data model.
+const (
+	metricFamilyUnitField protowire.Number = 5
+	counterCreatedField   protowire.Number = 3
+	summaryCreatedField   protowire.Number = 4
+	histogramCreatedField protowire.Number = 15
+)
+
+// Unit returns the unit of the provided MetricFamily or "" if it has none.
+func Unit(mf *dto.MetricFamily) string {
+	b, _ := unknownField(mf.XXX_unrecognized, metricFamilyUnitField)
+	return string(b)
+}
+
+// SetUnit sets the unit of the provided MetricFamily. An empty unit removes it.
+func SetUnit(mf *dto.MetricFamily, unit string) {
+	var v []byte
+	if unit != "" {
+		v = []byte(unit)
+	}
+	mf.XXX_unrecognized = setUnknownField(mf.XXX_unrecognized, metricFamilyUnitField, v)
+}
+
+// CreatedTimestamp returns the created timestamp of the provided Metric or nil
+// if it has none. Only counters, summaries, and histograms have one.
+func CreatedTimestamp(m *dto.Metric) *timestamp.Timestamp {
+	var (
+		b  []byte
+		ok bool
+	)
+	switch {
+	case m.Counter != nil:
+		b, ok = unknownField(m.Counter.XXX_unrecognized, counterCreatedField)
+	case m.Summary != nil:
+		b, ok = unknownField(m.Summary.XXX_unrecognized, summaryCreatedField)
+	case m.Histogram != nil:
+		b, ok = unknownField(m.Histogram.XXX_unrecognized, histogramCreatedField)
+	}
+	if !ok {
+		return nil
+	}
+	ts := &timestamp.Timestamp{}
+	if err := proto.Unmarshal(b, ts); err != nil {
+		return nil
+	}
+	return ts
+}
+
+// SetCreatedTimestamp sets the created timestamp of the provided Metric. A nil
+// timestamp removes it. Metrics other than counters, summaries, and histograms
+// are left alone.
+func SetCreatedTimestamp(m *dto.Metric, ts *timestamp.Timestamp) {
+	var v []byte
+	if ts != nil {
+		var err error
+		if v, err = proto.Marshal(ts); err != nil {
+			return
+		}
+		if v == nil {
+			v = []byte{} // The Unix epoch, which is still a timestamp.
+		}
+	}
+	switch {
+	case m.Counter != nil:
+		m.Counter.XXX_unrecognized = setUnknownField(m.Counter.XXX_unrecognized, counterCreatedField, v)
+	case m.Summary != nil:
+		m.Summary.XXX_unrecognized = setUnknownField(m.Summary.XXX_unrecognized, summaryCreatedField, v)
+	case m.Histogram != nil:
+		m.Histogram.XXX_unrecognized = setUnknownField(m.Histogram.XXX_unrecognized, histogramCreatedField, v)
+	}
+}
+
+// unknownField returns the value of the last length-delimited field with the
+// provided number in the provided unknown fields.
+func unknownField(b []byte, num protowire.Number) ([]byte, bool) {
+	var (
+		result []byte
+		found  bool
+	)
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			break
+		}
+		b = b[l:]
+		if n == num && typ == protowire.BytesType {
+			v, l := protowire.ConsumeBytes(b)
+			if l < 0 {
+				break
+			}
+			result, found = v, true
+			b = b[l:]
+			continue
+		}
+		if l = protowire.ConsumeFieldValue(n, typ, b); l < 0 {
+			break
+		}
+		b = b[l:]
+	}
+	return result, found
+}
+
+// setUnknownField returns a copy of the provided unknown fields with all
+// fields of the provided number replaced by a length-delimited one with the
+// provided value. A nil value removes the field.
+func setUnknownField(b []byte, num protowire.Number, v []byte) []byte {
+	var result []byte
+	for len(b) > 0 {
+		n, _, l := protowire.ConsumeField(b)
+		if l < 0 {
+			// Garbage. Keep it as it is.
+			result = append(result, b...)
+			break
+		}
+		if n != num {
+			result = append(result, b[:l]...)
+		}
+		b = b[l:]
+	}
+	if v != nil {
+		result = protowire.AppendTag(result, num, protowire.BytesType)
+		result = protowire.AppendBytes(result, v)
+	}
+	return result
+}
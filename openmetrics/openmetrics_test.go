@@ -0,0 +1,247 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openmetrics
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const exposition = `# HELP requests Total number of \"requests\".
+# TYPE requests counter
+requests_total{code="200"} 42.0 # {trace_id="abc"} 1.0 1520879607.789
+requests_created{code="200"} 1520872607.123
+requests_total{code="500"} 3.0
+# TYPE request_duration_seconds histogram
+# UNIT request_duration_seconds seconds
+request_duration_seconds_bucket{le="0.5"} 1 # {trace_id="def"} 0.3
+request_duration_seconds_bucket{le="+Inf"} 2
+request_duration_seconds_sum 1.5
+request_duration_seconds_count 2
+request_duration_seconds_created 1520872607.0
+# TYPE rpc summary
+rpc{quantile="0.9"} 0.25
+rpc_sum 17.0
+rpc_count 42
+# TYPE build info
+build_info{version="1.0"} 1.0
+# TYPE temperature_celsius gauge
+# UNIT temperature_celsius celsius
+temperature_celsius{room="a\\b\nc"} -2.5 1520879607.5
+other 1.0
+# EOF
+`
+
+func TestParse(t *testing.T) {
+	mfs, err := Parse(strings.NewReader(exposition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range mfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if expected, got := "build_info other request_duration_seconds requests_total rpc temperature_celsius", strings.Join(names, " "); expected != got {
+		t.Fatalf("Wanted metric families %q, got %q.", expected, got)
+	}
+
+	requests := mfs["requests_total"]
+	if expected, got := dto.MetricType_COUNTER, requests.GetType(); expected != got {
+		t.Errorf("Wanted type %s, got %s.", expected, got)
+	}
+	if expected, got := `Total number of "requests".`, requests.GetHelp(); expected != got {
+		t.Errorf("Wanted help %q, got %q.", expected, got)
+	}
+	if expected, got := 2, len(requests.GetMetric()); expected != got {
+		t.Fatalf("Wanted %d metrics, got %d.", expected, got)
+	}
+	m := requests.GetMetric()[0]
+	if expected, got := 42.0, m.GetCounter().GetValue(); expected != got {
+		t.Errorf("Wanted value %v, got %v.", expected, got)
+	}
+	if expected, got := "abc", m.GetCounter().GetExemplar().GetLabel()[0].GetValue(); expected != got {
+		t.Errorf("Wanted exemplar label %q, got %q.", expected, got)
+	}
+	if expected, got := (&timestamp.Timestamp{Seconds: 1520879607, Nanos: 789000000}), m.GetCounter().GetExemplar().GetTimestamp(); !proto.Equal(expected, got) {
+		t.Errorf("Wanted exemplar timestamp %v, got %v.", expected, got)
+	}
+	if expected, got := (&timestamp.Timestamp{Seconds: 1520872607, Nanos: 123000000}), CreatedTimestamp(m); !proto.Equal(expected, got) {
+		t.Errorf("Wanted created timestamp %v, got %v.", expected, got)
+	}
+	if got := CreatedTimestamp(requests.GetMetric()[1]); got != nil {
+		t.Errorf("Wanted no created timestamp, got %v.", got)
+	}
+
+	duration := mfs["request_duration_seconds"]
+	if expected, got := "seconds", Unit(duration); expected != got {
+		t.Errorf("Wanted unit %q, got %q.", expected, got)
+	}
+	h := duration.GetMetric()[0].GetHistogram()
+	if expected, got := 2, len(h.GetBucket()); expected != got {
+		t.Fatalf("Wanted %d buckets, got %d.", expected, got)
+	}
+	if expected, got := 0.3, h.GetBucket()[0].GetExemplar().GetValue(); expected != got {
+		t.Errorf("Wanted exemplar value %v, got %v.", expected, got)
+	}
+	if expected, got := uint64(2), h.GetSampleCount(); expected != got {
+		t.Errorf("Wanted sample count %d, got %d.", expected, got)
+	}
+
+	if expected, got := 1, len(mfs["rpc"].GetMetric()[0].GetSummary().GetQuantile()); expected != got {
+		t.Errorf("Wanted %d quantiles, got %d.", expected, got)
+	}
+	if expected, got := dto.MetricType_GAUGE, mfs["build_info"].GetType(); expected != got {
+		t.Errorf("Wanted type %s, got %s.", expected, got)
+	}
+	temperature := mfs["temperature_celsius"].GetMetric()[0]
+	if expected, got := "a\\b\nc", temperature.GetLabel()[0].GetValue(); expected != got {
+		t.Errorf("Wanted label value %q, got %q.", expected, got)
+	}
+	if expected, got := int64(1520879607500), temperature.GetTimestampMs(); expected != got {
+		t.Errorf("Wanted timestamp %d, got %d.", expected, got)
+	}
+	if expected, got := dto.MetricType_UNTYPED, mfs["other"].GetType(); expected != got {
+		t.Errorf("Wanted type %s, got %s.", expected, got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	scenarios := map[string]string{
+		"missing EOF":           "foo 1\n",
+		"content after EOF":     "foo 1\n# EOF\nbar 1\n",
+		"empty line":            "foo 1\n\n# EOF\n",
+		"plain comment":         "# foo\n# EOF\n",
+		"gauge histogram":       "# TYPE foo gaugehistogram\n# EOF\n",
+		"invalid type":          "# TYPE foo bar\n# EOF\n",
+		"metadata after sample": "# TYPE foo gauge\nfoo 1\n# HELP foo help\n# EOF\n",
+		"not contiguous":        "# TYPE foo gauge\nfoo 1\nbar 1\nfoo{a=\"b\"} 1\n# EOF\n",
+		"unit not in name":      "# TYPE foo gauge\n# UNIT foo seconds\n# EOF\n",
+		"negative counter":      "# TYPE foo counter\nfoo_total -1\n# EOF\n",
+		"exemplar on gauge":     "# TYPE foo gauge\nfoo 1 # {a=\"b\"} 1\n# EOF\n",
+		"missing le":            "# TYPE foo histogram\nfoo_bucket 1\n# EOF\n",
+		"fractional count":      "# TYPE foo summary\nfoo_count 1.5\n# EOF\n",
+		"trailing comma":        "foo{a=\"b\",} 1\n# EOF\n",
+		"duplicate label":       "foo{a=\"b\",a=\"c\"} 1\n# EOF\n",
+		"invalid value":         "foo inf\n# EOF\n",
+		"different timestamps":  "# TYPE foo summary\nfoo_sum 1 1\nfoo_count 1 2\n# EOF\n",
+		"long exemplar":         "# TYPE foo counter\nfoo_total 1 # {a=\"" + strings.Repeat("x", 128) + "\"} 1\n# EOF\n",
+		"counter collision":     "foo_total 1\n# TYPE foo counter\nfoo_total 1\n# EOF\n",
+	}
+	for name, input := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Parse(strings.NewReader(input)); err == nil {
+				t.Error("Expected error, got none.")
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	mfs, err := Parse(strings.NewReader(exposition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range mfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Units and created timestamps have to survive marshaling.
+	var buf bytes.Buffer
+	for _, name := range names {
+		b, err := proto.Marshal(mfs[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		mf := &dto.MetricFamily{}
+		if err := proto.Unmarshal(b, mf); err != nil {
+			t.Fatal(err)
+		}
+		if err := MetricFamilyToOpenMetrics(&buf, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := FinalizeOpenMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# TYPE build_info gauge
+build_info{version="1.0"} 1.0
+# TYPE other unknown
+other 1.0
+# TYPE request_duration_seconds histogram
+# UNIT request_duration_seconds seconds
+request_duration_seconds_bucket{le="0.5"} 1 # {trace_id="def"} 0.3
+request_duration_seconds_bucket{le="+Inf"} 2
+request_duration_seconds_sum 1.5
+request_duration_seconds_count 2
+request_duration_seconds_created 1520872607
+# HELP requests Total number of \"requests\".
+# TYPE requests counter
+requests_total{code="200"} 42.0 # {trace_id="abc"} 1.0 1520879607.789
+requests_created{code="200"} 1520872607.123
+requests_total{code="500"} 3.0
+# TYPE rpc summary
+rpc{quantile="0.9"} 0.25
+rpc_sum 17.0
+rpc_count 42
+# TYPE temperature_celsius gauge
+# UNIT temperature_celsius celsius
+temperature_celsius{room="a\\b\nc"} -2.5 1520879607.5
+# EOF
+`
+	if got := buf.String(); expected != got {
+		t.Errorf("Wanted exposition\n%s\ngot\n%s", expected, got)
+	}
+	if _, err := Parse(&buf); err != nil {
+		t.Errorf("Could not parse own exposition: %s", err)
+	}
+}
+
+func TestSetUnitAndCreatedTimestamp(t *testing.T) {
+	mf := &dto.MetricFamily{XXX_unrecognized: []byte{0x30, 0x01}} // Unrelated field 6.
+	SetUnit(mf, "bytes")
+	SetUnit(mf, "seconds")
+	if expected, got := "seconds", Unit(mf); expected != got {
+		t.Errorf("Wanted unit %q, got %q.", expected, got)
+	}
+	SetUnit(mf, "")
+	if expected, got := []byte{0x30, 0x01}, mf.XXX_unrecognized; !bytes.Equal(expected, got) {
+		t.Errorf("Wanted unknown fields %v, got %v.", expected, got)
+	}
+
+	m := &dto.Metric{Gauge: &dto.Gauge{}}
+	SetCreatedTimestamp(m, &timestamp.Timestamp{Seconds: 1})
+	if got := CreatedTimestamp(m); got != nil {
+		t.Errorf("Wanted no created timestamp of a gauge, got %v.", got)
+	}
+	m = &dto.Metric{Summary: &dto.Summary{}}
+	SetCreatedTimestamp(m, &timestamp.Timestamp{})
+	if expected, got := (&timestamp.Timestamp{}), CreatedTimestamp(m); !proto.Equal(expected, got) {
+		t.Errorf("Wanted created timestamp %v, got %v.", expected, got)
+	}
+	SetCreatedTimestamp(m, nil)
+	if got := CreatedTimestamp(m); got != nil {
+		t.Errorf("Wanted no created timestamp, got %v.", got)
+	}
+}
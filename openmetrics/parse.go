@@ -0,0 +1,600 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openmetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// maxLineLength is the maximum length of a line Parse accepts.
+	maxLineLength = 1 << 20
+	// exemplarMaxRunes is the maximum combined length of the label names
+	// and values of an exemplar as per the OpenMetrics specification.
+	exemplarMaxRunes = 128
+)
+
+// Parse reads metric families in the OpenMetrics text format from r, which has
+// to end with the "# EOF" line. The result is keyed by the names the metric
+// families have in the Prometheus data model, i.e. counters have the suffix
+// "_total" and info metrics the suffix "_info" (and are gauges), while
+// statesets are gauges and metrics of type unknown are untyped. Gauge
+// histograms are not supported. Exemplars, units, and created timestamps are
+// kept. Metric families without any metrics are left out, as with
+// expfmt.TextParser.
+func Parse(r io.Reader) (map[string]*dto.MetricFamily, error) {
+	p := parser{
+		result: map[string]*dto.MetricFamily{},
+		seen:   map[string]bool{},
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	for scanner.Scan() {
+		p.lineNum++
+		if p.eof {
+			return nil, p.errorf("unexpected content after # EOF")
+		}
+		if err := p.parseLine(scanner.Text()); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !p.eof {
+		return nil, p.errorf("missing # EOF")
+	}
+	for name, mf := range p.result {
+		if len(mf.GetMetric()) == 0 {
+			delete(p.result, name)
+		}
+	}
+	return p.result, nil
+}
+
+type parser struct {
+	result  map[string]*dto.MetricFamily
+	seen    map[string]bool // Names of all families so far.
+	current *family
+	lineNum int
+	eof     bool
+}
+
+// family is the metric family currently parsed.
+type family struct {
+	name    string // Name of the family in OpenMetrics.
+	typ     string // Type of the family in OpenMetrics.
+	sampled bool   // Whether any samples have been parsed yet.
+	mf      *dto.MetricFamily
+	metrics map[string]*dto.Metric // Keyed by label signature.
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("OpenMetrics parsing error in line %d: %s", p.lineNum, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) parseLine(line string) error {
+	if line == "" {
+		return p.errorf("empty line")
+	}
+	if line == "# EOF" {
+		p.eof = true
+		return nil
+	}
+	if strings.HasPrefix(line, "#") {
+		return p.parseMetadata(line)
+	}
+	return p.parseSample(line)
+}
+
+// parseMetadata parses a "# HELP", "# TYPE", or "# UNIT" line.
+func (p *parser) parseMetadata(line string) error {
+	parts := strings.SplitN(line, " ", 4)
+	if len(parts) < 3 || parts[0] != "#" {
+		return p.errorf("invalid comment %q", line)
+	}
+	keyword, name := parts[1], parts[2]
+	var value string
+	if len(parts) == 4 {
+		value = parts[3]
+	}
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return p.errorf("invalid metric name %q", name)
+	}
+	f, err := p.familyForMetadata(name)
+	if err != nil {
+		return err
+	}
+	switch keyword {
+	case "TYPE":
+		if f.typ != "" {
+			return p.errorf("second TYPE line for metric family %q", name)
+		}
+		if err := p.setType(f, value); err != nil {
+			return err
+		}
+	case "HELP":
+		if f.mf.Help != nil {
+			return p.errorf("second HELP line for metric family %q", name)
+		}
+		help, err := unescape(value)
+		if err != nil {
+			return p.errorf("invalid HELP for metric family %q: %v", name, err)
+		}
+		f.mf.Help = proto.String(help)
+	case "UNIT":
+		if Unit(f.mf) != "" {
+			return p.errorf("second UNIT line for metric family %q", name)
+		}
+		if value != "" && !strings.HasSuffix(name, "_"+value) {
+			return p.errorf("metric family %q does not have the suffix of its unit %q", name, value)
+		}
+		SetUnit(f.mf, value)
+	default:
+		return p.errorf("invalid comment %q", line)
+	}
+	return nil
+}
+
+// familyForMetadata returns the family the metadata of the provided name
+// belongs to, which is a new one if the name differs from the current one.
+func (p *parser) familyForMetadata(name string) (*family, error) {
+	if f := p.current; f != nil && f.name == name {
+		if f.sampled {
+			return nil, p.errorf("metadata for metric family %q after its samples", name)
+		}
+		return f, nil
+	}
+	return p.newFamily(name)
+}
+
+func (p *parser) newFamily(name string) (*family, error) {
+	if p.seen[name] {
+		return nil, p.errorf("metric family %q is not contiguous", name)
+	}
+	p.seen[name] = true
+	p.current = &family{
+		name:    name,
+		mf:      &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_UNTYPED.Enum()},
+		metrics: map[string]*dto.Metric{},
+	}
+	return p.current, nil
+}
+
+// setType sets the type of the provided family and with it the name in the
+// result.
+func (p *parser) setType(f *family, typ string) error {
+	var (
+		t    dto.MetricType
+		name = f.name
+	)
+	switch typ {
+	case "counter":
+		t, name = dto.MetricType_COUNTER, name+"_total"
+	case "gauge", "stateset":
+		t = dto.MetricType_GAUGE
+	case "info":
+		t, name = dto.MetricType_GAUGE, name+"_info"
+	case "summary":
+		t = dto.MetricType_SUMMARY
+	case "histogram":
+		t = dto.MetricType_HISTOGRAM
+	case "unknown":
+		t = dto.MetricType_UNTYPED
+	case "gaugehistogram":
+		return p.errorf("metric family %q has the unsupported type gaugehistogram", f.name)
+	default:
+		return p.errorf("invalid type %q for metric family %q", typ, f.name)
+	}
+	if _, ok := p.result[name]; ok || (name != f.name && p.seen[name]) {
+		return p.errorf("metric family %q collides with another one", f.name)
+	}
+	f.typ = typ
+	f.mf.Name = proto.String(name)
+	f.mf.Type = t.Enum()
+	return nil
+}
+
+// suffixes returns the sample name suffixes allowed for the provided type.
+func suffixes(typ string) []string {
+	switch typ {
+	case "counter":
+		return []string{"_total", "_created"}
+	case "summary":
+		return []string{"", "_sum", "_count", "_created"}
+	case "histogram":
+		return []string{"_bucket", "_sum", "_count", "_created"}
+	case "info":
+		return []string{"_info"}
+	}
+	return []string{""}
+}
+
+// familyForSample returns the family the sample of the provided name belongs
+// to and the suffix of the sample name.
+func (p *parser) familyForSample(name string) (*family, string, error) {
+	if f := p.current; f != nil {
+		for _, suffix := range suffixes(f.typ) {
+			if name == f.name+suffix {
+				return f, suffix, nil
+			}
+		}
+	}
+	f, err := p.newFamily(name)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, "", nil
+}
+
+func (p *parser) parseSample(line string) error {
+	i := strings.IndexAny(line, "{ ")
+	if i < 0 {
+		return p.errorf("expected a value after metric name in %q", line)
+	}
+	name := line[:i]
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return p.errorf("invalid metric name %q", name)
+	}
+	f, suffix, err := p.familyForSample(name)
+	if err != nil {
+		return err
+	}
+	if !f.sampled {
+		if _, ok := p.result[f.mf.GetName()]; ok {
+			return p.errorf("metric family %q collides with another one", f.name)
+		}
+		f.sampled = true
+		p.result[f.mf.GetName()] = f.mf
+	}
+	rest := line[i:]
+	var labels []*dto.LabelPair
+	if strings.HasPrefix(rest, "{") {
+		if labels, rest, err = parseLabels(rest); err != nil {
+			return p.errorf("invalid labels of metric %q: %v", name, err)
+		}
+	}
+	if !strings.HasPrefix(rest, " ") {
+		return p.errorf("expected a value after the labels of metric %q", name)
+	}
+	rest = rest[1:]
+	var exemplar *dto.Exemplar
+	if i := strings.Index(rest, " # "); i >= 0 {
+		if exemplar, err = parseExemplar(rest[i+3:]); err != nil {
+			return p.errorf("invalid exemplar of metric %q: %v", name, err)
+		}
+		rest = rest[:i]
+	}
+	fields := strings.Split(rest, " ")
+	if len(fields) > 2 {
+		return p.errorf("unexpected content after the value of metric %q", name)
+	}
+	value, err := parseFloat(fields[0])
+	if err != nil {
+		return p.errorf("invalid value of metric %q: %v", name, err)
+	}
+	var timestampMs *int64
+	if len(fields) == 2 {
+		ts, err := parseFloat(fields[1])
+		if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+			return p.errorf("invalid timestamp %q of metric %q", fields[1], name)
+		}
+		timestampMs = proto.Int64(int64(math.Round(ts * 1000)))
+	}
+
+	// Labels that distinguish the samples of a single metric.
+	var extraLabel string
+	switch {
+	case f.typ == "histogram" && suffix == "_bucket":
+		extraLabel = model.BucketLabel
+	case f.typ == "summary" && suffix == "":
+		extraLabel = model.QuantileLabel
+	}
+	var (
+		extraValue float64
+		hasExtra   bool
+	)
+	metricLabels := make([]*dto.LabelPair, 0, len(labels))
+	for _, lp := range labels {
+		if extraLabel != "" && lp.GetName() == extraLabel {
+			if extraValue, err = parseFloat(lp.GetValue()); err != nil {
+				return p.errorf("invalid %s label of metric %q: %v", extraLabel, name, err)
+			}
+			hasExtra = true
+			continue
+		}
+		metricLabels = append(metricLabels, lp)
+	}
+	if extraLabel != "" && !hasExtra {
+		return p.errorf("metric %q is missing the %s label", name, extraLabel)
+	}
+	m, err := p.metricFor(f, metricLabels)
+	if err != nil {
+		return err
+	}
+	if timestampMs != nil && suffix != "_created" {
+		if m.TimestampMs != nil && m.GetTimestampMs() != *timestampMs {
+			return p.errorf("samples of metric %q have different timestamps", name)
+		}
+		m.TimestampMs = timestampMs
+	}
+	if exemplar != nil && !(f.typ == "counter" && suffix == "_total") && !(f.typ == "histogram" && suffix == "_bucket") {
+		return p.errorf("unexpected exemplar for metric %q", name)
+	}
+
+	switch suffix {
+	case "_created":
+		ts, err := parseTimestamp(fields[0])
+		if err != nil {
+			return p.errorf("invalid created timestamp of metric %q: %v", name, err)
+		}
+		SetCreatedTimestamp(m, ts)
+		return nil
+	case "_sum":
+		if f.typ == "summary" {
+			m.Summary.SampleSum = proto.Float64(value)
+		} else {
+			m.Histogram.SampleSum = proto.Float64(value)
+		}
+		return nil
+	case "_count":
+		count, err := toCount(value)
+		if err != nil {
+			return p.errorf("invalid count of metric %q: %v", name, err)
+		}
+		if f.typ == "summary" {
+			m.Summary.SampleCount = proto.Uint64(count)
+		} else {
+			m.Histogram.SampleCount = proto.Uint64(count)
+		}
+		return nil
+	}
+	switch f.typ {
+	case "counter":
+		if math.IsNaN(value) || value < 0 {
+			return p.errorf("invalid counter value %v of metric %q", value, name)
+		}
+		m.Counter.Value = proto.Float64(value)
+		m.Counter.Exemplar = exemplar
+	case "summary":
+		m.Summary.Quantile = append(m.Summary.Quantile, &dto.Quantile{
+			Quantile: proto.Float64(extraValue),
+			Value:    proto.Float64(value),
+		})
+	case "histogram":
+		count, err := toCount(value)
+		if err != nil {
+			return p.errorf("invalid bucket count of metric %q: %v", name, err)
+		}
+		m.Histogram.Bucket = append(m.Histogram.Bucket, &dto.Bucket{
+			UpperBound:      proto.Float64(extraValue),
+			CumulativeCount: proto.Uint64(count),
+			Exemplar:        exemplar,
+		})
+	case "unknown", "":
+		m.Untyped.Value = proto.Float64(value)
+	default:
+		m.Gauge.Value = proto.Float64(value)
+	}
+	return nil
+}
+
+// metricFor returns the Metric of the provided family with the provided
+// labels, creating it if needed.
+func (p *parser) metricFor(f *family, labels []*dto.LabelPair) (*dto.Metric, error) {
+	sorted := append([]*dto.LabelPair{}, labels...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+	var sb strings.Builder
+	for i, lp := range sorted {
+		if i > 0 && lp.GetName() == sorted[i-1].GetName() {
+			return nil, p.errorf("duplicate label %q", lp.GetName())
+		}
+		sb.WriteString(lp.GetName())
+		sb.WriteByte(model.SeparatorByte)
+		sb.WriteString(lp.GetValue())
+		sb.WriteByte(model.SeparatorByte)
+	}
+	signature := sb.String()
+	if m, ok := f.metrics[signature]; ok {
+		return m, nil
+	}
+	m := &dto.Metric{Label: labels}
+	switch f.mf.GetType() {
+	case dto.MetricType_COUNTER:
+		m.Counter = &dto.Counter{}
+	case dto.MetricType_GAUGE:
+		m.Gauge = &dto.Gauge{}
+	case dto.MetricType_SUMMARY:
+		m.Summary = &dto.Summary{}
+	case dto.MetricType_HISTOGRAM:
+		m.Histogram = &dto.Histogram{}
+	default:
+		m.Untyped = &dto.Untyped{}
+	}
+	f.metrics[signature] = m
+	f.mf.Metric = append(f.mf.Metric, m)
+	return m, nil
+}
+
+// parseLabels parses the labels in braces at the start of s and returns them
+// together with the rest of s.
+func parseLabels(s string) ([]*dto.LabelPair, string, error) {
+	var labels []*dto.LabelPair
+	s = s[1:] // Skip "{".
+	for {
+		if len(labels) == 0 && strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+		i := strings.Index(s, `="`)
+		if i < 0 {
+			return nil, "", fmt.Errorf("expected label=\"value\"")
+		}
+		name := s[:i]
+		if !model.LabelName(name).IsValid() {
+			return nil, "", fmt.Errorf("invalid label name %q", name)
+		}
+		s = s[i+2:]
+		// Find the closing quote, skipping escaped characters.
+		j := 0
+		for ; j < len(s) && s[j] != '"'; j++ {
+			if s[j] == '\\' {
+				j++
+			}
+		}
+		if j >= len(s) {
+			return nil, "", fmt.Errorf("unterminated value of label %q", name)
+		}
+		value, err := unescape(s[:j])
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid value of label %q: %v", name, err)
+		}
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+		s = s[j+1:]
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = s[1:]
+			if strings.HasPrefix(s, "}") {
+				return nil, "", fmt.Errorf("trailing comma")
+			}
+		case strings.HasPrefix(s, "}"):
+			return labels, s[1:], nil
+		default:
+			return nil, "", fmt.Errorf("expected \",\" or \"}\" after value of label %q", name)
+		}
+	}
+}
+
+// parseExemplar parses an exemplar without the leading "# ".
+func parseExemplar(s string) (*dto.Exemplar, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, fmt.Errorf("expected labels")
+	}
+	labels, rest, err := parseLabels(s)
+	if err != nil {
+		return nil, err
+	}
+	var runes int
+	for _, lp := range labels {
+		runes += len([]rune(lp.GetName())) + len([]rune(lp.GetValue()))
+	}
+	if runes > exemplarMaxRunes {
+		return nil, fmt.Errorf("labels have %d characters, limit is %d", runes, exemplarMaxRunes)
+	}
+	if !strings.HasPrefix(rest, " ") {
+		return nil, fmt.Errorf("expected a value")
+	}
+	fields := strings.Split(rest[1:], " ")
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("unexpected content after the value")
+	}
+	value, err := parseFloat(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	e := &dto.Exemplar{Label: labels, Value: proto.Float64(value)}
+	if len(fields) == 2 {
+		if e.Timestamp, err = parseTimestamp(fields[1]); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func parseFloat(s string) (float64, error) {
+	// Only the OpenMetrics spellings of the special values are allowed.
+	switch s {
+	case "+Inf", "-Inf", "NaN":
+	default:
+		if strings.ContainsAny(s, "iInN_") {
+			return 0, fmt.Errorf("invalid number %q", s)
+		}
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// parseTimestamp parses a timestamp in seconds since the Unix epoch. Decimal
+// fractions are parsed exactly, down to nanoseconds.
+func parseTimestamp(s string) (*timestamp.Timestamp, error) {
+	var t time.Time
+	sec, frac := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		sec, frac = s[:i], s[i+1:]
+	}
+	secs, err := strconv.ParseInt(sec, 10, 64)
+	if err == nil && len(frac) <= 9 && strings.Trim(frac, "0123456789") == "" {
+		nanos, _ := strconv.ParseInt((frac + "000000000")[:9], 10, 64)
+		if strings.HasPrefix(sec, "-") {
+			nanos = -nanos
+		}
+		t = time.Unix(secs, nanos)
+	} else {
+		f, err := parseFloat(s)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("invalid timestamp %q", s)
+		}
+		secs, frac := math.Modf(f)
+		t = time.Unix(int64(secs), int64(math.Round(frac*1e9)))
+	}
+	return ptypes.TimestampProto(t)
+}
+
+func toCount(f float64) (uint64, error) {
+	if f < 0 || f != math.Trunc(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%v is not a non-negative integer", f)
+	}
+	return uint64(f), nil
+}
+
+// unescape resolves the escape sequences of a label value or a HELP text.
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("trailing backslash")
+		}
+		switch s[i] {
+		case '\\':
+			sb.WriteByte('\\')
+		case 'n':
+			sb.WriteByte('\n')
+		case '"':
+			sb.WriteByte('"')
+		default:
+			return "", fmt.Errorf("invalid escape sequence \\%c", s[i])
+		}
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,271 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Aggregation selects whether pushed metrics are aggregated with the stored
+// ones instead of replacing them, and if so, how gauges are aggregated. See
+// WriteRequest for details.
+type Aggregation string
+
+// The valid Aggregations. The empty Aggregation means no aggregation, but
+// unlike AggregationNone, it may be overridden by an AggregationConfig.
+const (
+	AggregationNone Aggregation = "none"
+	AggregationLast Aggregation = "last"
+	AggregationMax  Aggregation = "max"
+	AggregationMin  Aggregation = "min"
+	AggregationSum  Aggregation = "sum"
+)
+
+// ParseAggregation returns the Aggregation of the provided name.
+func ParseAggregation(s string) (Aggregation, error) {
+	switch a := Aggregation(s); a {
+	case AggregationNone, AggregationLast, AggregationMax, AggregationMin, AggregationSum:
+		return a, nil
+	}
+	return "", fmt.Errorf("invalid aggregation %q, must be one of none, last, max, min, or sum", s)
+}
+
+// Enabled returns whether pushed metrics are to be aggregated.
+func (a Aggregation) Enabled() bool {
+	return a != "" && a != AggregationNone
+}
+
+// AggregationConfig maps job names to the Aggregation of pushes to groups of
+// that job that do not set an Aggregation themselves.
+type AggregationConfig map[string]Aggregation
+
+// LoadAggregationConfig reads an AggregationConfig from file. Every line of the
+// file has the form "job:aggregation". Empty lines and lines starting with "#"
+// are ignored.
+func LoadAggregationConfig(file string) (AggregationConfig, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := AggregationConfig{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected job:aggregation", file, n)
+		}
+		job := strings.TrimSpace(line[:i])
+		if _, ok := cfg[job]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate job %q", file, n, job)
+		}
+		a, err := ParseAggregation(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		cfg[job] = a
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+type aggregatingMetricStore struct {
+	MetricStore
+	cfg AggregationConfig
+}
+
+// NewAggregatingMetricStore returns a MetricStore that sets the Aggregation of
+// pushes without one (including those in a batch) as configured for their job
+// in cfg and submits them to ms.
+func NewAggregatingMetricStore(ms MetricStore, cfg AggregationConfig) MetricStore {
+	return &aggregatingMetricStore{MetricStore: ms, cfg: cfg}
+}
+
+// SubmitWriteRequest implements the MetricStore interface.
+func (ams *aggregatingMetricStore) SubmitWriteRequest(wr WriteRequest) {
+	if wr.Batch != nil {
+		batch := make([]WriteRequest, len(wr.Batch))
+		for i, b := range wr.Batch {
+			batch[i] = ams.setAggregation(b)
+		}
+		wr.Batch = batch
+	}
+	ams.MetricStore.SubmitWriteRequest(ams.setAggregation(wr))
+}
+
+func (ams *aggregatingMetricStore) setAggregation(wr WriteRequest) WriteRequest {
+	if wr.MetricFamilies != nil && wr.Aggregation == "" {
+		wr.Aggregation = ams.cfg[wr.Labels[string(model.JobLabel)]]
+	}
+	return wr
+}
+
+// aggregate replaces the MetricFamilies of the provided WriteRequest by the
+// result of aggregating them into the metric families stored in the group with
+// the provided key. If any of them cannot be aggregated, an error is returned
+// and the MetricFamilies are left as they are. It must be called with the lock
+// held.
+func (dms *DiskMetricStore) aggregate(key string, wr WriteRequest) error {
+	group, ok := dms.metricGroups[key]
+	if !ok {
+		return nil
+	}
+	aggregated := map[string]*dto.MetricFamily{}
+	for name, mf := range wr.MetricFamilies {
+		if name == pushMetricName || name == pushFailedMetricName {
+			continue
+		}
+		tmf, ok := group.Metrics[name]
+		if !ok {
+			continue
+		}
+		amf, err := aggregateMetricFamily(tmf.GetMetricFamily(), mf, wr.Aggregation)
+		if err != nil {
+			return err
+		}
+		aggregated[name] = amf
+	}
+	for name, amf := range aggregated {
+		wr.MetricFamilies[name] = amf
+	}
+	return nil
+}
+
+// aggregateMetricFamily returns the MetricFamily resulting from aggregating
+// pushed into stored. Metrics are matched by their label sets. Stored metrics
+// without a pushed counterpart are kept as they are, and vice versa. Neither
+// stored nor pushed is modified.
+func aggregateMetricFamily(stored, pushed *dto.MetricFamily, a Aggregation) (*dto.MetricFamily, error) {
+	if stored.GetType() != pushed.GetType() {
+		return nil, fmt.Errorf(
+			"metric family %q of type %s cannot be aggregated with the stored one of type %s",
+			pushed.GetName(), pushed.GetType(), stored.GetType(),
+		)
+	}
+	pushedBySignature := make(map[string]*dto.Metric, len(pushed.GetMetric()))
+	for _, m := range pushed.GetMetric() {
+		pushedBySignature[labelsSignature(m)] = m
+	}
+
+	result := copyMetricFamily(pushed)
+	result.Metric = make([]*dto.Metric, 0, len(stored.GetMetric())+len(pushed.GetMetric()))
+	for _, s := range stored.GetMetric() {
+		signature := labelsSignature(s)
+		p, ok := pushedBySignature[signature]
+		if !ok {
+			result.Metric = append(result.Metric, s)
+			continue
+		}
+		delete(pushedBySignature, signature)
+		m, err := aggregateMetric(pushed.GetName(), pushed.GetType(), s, p, a)
+		if err != nil {
+			return nil, err
+		}
+		result.Metric = append(result.Metric, m)
+	}
+	// Keep the order of the pushed metrics.
+	for _, m := range pushed.GetMetric() {
+		if _, ok := pushedBySignature[labelsSignature(m)]; ok {
+			result.Metric = append(result.Metric, m)
+		}
+	}
+	return result, nil
+}
+
+// aggregateMetric aggregates the pushed Metric p into the stored Metric s of
+// the same label set. Counters and classic histograms are added up, gauges and
+// untyped metrics follow the Aggregation, and summaries are replaced, as
+// quantiles cannot be aggregated. Native histograms are not supported.
+func aggregateMetric(name string, t dto.MetricType, s, p *dto.Metric, a Aggregation) (*dto.Metric, error) {
+	m := proto.Clone(p).(*dto.Metric)
+	switch t {
+	case dto.MetricType_COUNTER:
+		if m.Counter == nil {
+			m.Counter = &dto.Counter{}
+		}
+		m.Counter.Value = proto.Float64(s.GetCounter().GetValue() + p.GetCounter().GetValue())
+	case dto.MetricType_GAUGE:
+		if m.Gauge == nil {
+			m.Gauge = &dto.Gauge{}
+		}
+		m.Gauge.Value = proto.Float64(aggregateValue(s.GetGauge().GetValue(), p.GetGauge().GetValue(), a))
+	case dto.MetricType_UNTYPED:
+		if m.Untyped == nil {
+			m.Untyped = &dto.Untyped{}
+		}
+		m.Untyped.Value = proto.Float64(aggregateValue(s.GetUntyped().GetValue(), p.GetUntyped().GetValue(), a))
+	case dto.MetricType_HISTOGRAM:
+		if m.Histogram == nil {
+			m.Histogram = &dto.Histogram{}
+		}
+		sh, ph := s.GetHistogram(), p.GetHistogram()
+		if isNativeHistogram(sh) || isNativeHistogram(ph) {
+			return nil, fmt.Errorf("native histogram %q cannot be aggregated", name)
+		}
+		if len(sh.GetBucket()) != len(ph.GetBucket()) {
+			return nil, fmt.Errorf("histogram %q cannot be aggregated as its buckets differ from the stored ones", name)
+		}
+		for i, b := range m.Histogram.GetBucket() {
+			sb := sh.GetBucket()[i]
+			if sb.GetUpperBound() != b.GetUpperBound() {
+				return nil, fmt.Errorf("histogram %q cannot be aggregated as its buckets differ from the stored ones", name)
+			}
+			b.CumulativeCount = proto.Uint64(sb.GetCumulativeCount() + b.GetCumulativeCount())
+		}
+		m.Histogram.SampleCount = proto.Uint64(sh.GetSampleCount() + ph.GetSampleCount())
+		m.Histogram.SampleSum = proto.Float64(sh.GetSampleSum() + ph.GetSampleSum())
+	}
+	return m, nil
+}
+
+func aggregateValue(stored, pushed float64, a Aggregation) float64 {
+	switch a {
+	case AggregationMax:
+		return math.Max(stored, pushed)
+	case AggregationMin:
+		return math.Min(stored, pushed)
+	case AggregationSum:
+		return stored + pushed
+	}
+	return pushed
+}
+
+// labelsSignature returns a string unique for the label set of m, which has to
+// be sorted by label name.
+func labelsSignature(m *dto.Metric) string {
+	var sb strings.Builder
+	for _, lp := range m.GetLabel() {
+		sb.WriteString(lp.GetName())
+		sb.WriteByte(model.SeparatorByte)
+		sb.WriteString(lp.GetValue())
+		sb.WriteByte(model.SeparatorByte)
+	}
+	return sb.String()
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Names of the backends registered by this package.
+const (
+	// FileBackend keeps all metrics in memory and persists them to a single
+	// file, see NewDiskMetricStore.
+	FileBackend = "file"
+	// BoltBackend keeps all metrics in memory and persists them to an
+	// embedded key-value store with one record per group, see
+	// NewKVMetricStore.
+	BoltBackend = "bbolt"
+)
+
+// BackendConfig is what a Backend gets to create a MetricStore from.
+type BackendConfig struct {
+	// PersistenceFile is where to persist metrics. How it is used depends on
+	// the backend. An empty string means no persistence, if the backend
+	// supports that.
+	PersistenceFile     string
+	PersistenceInterval time.Duration
+	// GatherPredefinedHelpFrom, if not nil, provides the help strings pushed
+	// metrics are adjusted to.
+	GatherPredefinedHelpFrom prometheus.Gatherer
+	Logger                   log.Logger
+	// Options are applied to DiskMetricStores. Other backends may ignore
+	// them.
+	Options []Option
+}
+
+// Backend creates a MetricStore from the provided BackendConfig.
+type Backend func(BackendConfig) (MetricStore, error)
+
+var (
+	backendsMtx sync.RWMutex
+	backends    = map[string]Backend{}
+)
+
+func init() {
+	RegisterBackend(FileBackend, func(cfg BackendConfig) (MetricStore, error) {
+		return NewDiskMetricStore(
+			cfg.PersistenceFile, cfg.PersistenceInterval, cfg.GatherPredefinedHelpFrom, cfg.Logger,
+			cfg.Options...,
+		), nil
+	})
+	RegisterBackend(BoltBackend, func(cfg BackendConfig) (MetricStore, error) {
+		return NewKVMetricStore(
+			cfg.PersistenceFile, cfg.PersistenceInterval, cfg.GatherPredefinedHelpFrom, cfg.Logger,
+			cfg.Options...,
+		)
+	})
+}
+
+// RegisterBackend makes a Backend available by name. It panics if a backend of
+// that name has already been registered.
+func RegisterBackend(name string, backend Backend) {
+	backendsMtx.Lock()
+	defer backendsMtx.Unlock()
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("storage backend %q registered twice", name))
+	}
+	backends[name] = backend
+}
+
+// Backends returns the names of all registered backends in sorted order.
+func Backends() []string {
+	backendsMtx.RLock()
+	defer backendsMtx.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewMetricStore creates a MetricStore with the backend of the provided name.
+func NewMetricStore(backend string, cfg BackendConfig) (MetricStore, error) {
+	backendsMtx.RLock()
+	b, ok := backends[backend]
+	backendsMtx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+	return b(cfg)
+}
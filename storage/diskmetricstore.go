@@ -14,7 +14,6 @@
 package storage
 
 import (
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -29,6 +28,7 @@ import (
 	"github.com/go-kit/kit/log/level"
 	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
 
 	dto "github.com/prometheus/client_model/go"
@@ -40,9 +40,27 @@ const (
 	pushFailedMetricName = "push_failure_time_seconds"
 	pushFailedMetricHelp = "Last Unix time when changing this group in the Pushgateway failed."
 	writeQueueCapacity   = 1000
+	// expiryCheckInterval is the interval at which expired groups are
+	// deleted.
+	expiryCheckInterval = 10 * time.Second
+	// tombstoneRetention is how long tombstones of conditional
+	// WriteRequests are kept.
+	tombstoneRetention = time.Hour
+	// maxAwaitingSync is the number of synchronous WriteRequests after
+	// which the WAL is synced even if the write queue is not empty yet.
+	maxAwaitingSync = 100
 )
 
-var errTimestamp = errors.New("pushed metrics must not have timestamps")
+var (
+	errTimestamp = errors.New("pushed metrics must not have timestamps")
+
+	expiredGroups = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pushgateway_expired_groups_total",
+			Help: "Total number of groups deleted because they have not been pushed to within their TTL.",
+		},
+	)
+)
 
 // DiskMetricStore is an implementation of MetricStore that persists metrics to
 // disk.
@@ -54,7 +72,50 @@ type DiskMetricStore struct {
 	metricGroups    GroupingKeyToMetricGroup
 	persistenceFile string
 	predefinedHelp  map[string]string
-	logger          log.Logger
+	ttl             time.Duration
+	expiryInterval  time.Duration
+	walEnabled      bool
+	restoreErr      error      // Set if restoring has failed in a way that must not be ignored.
+	wal             *wal       // Only set once restored. Only written to under lock.
+	walBatch        *walRecord // Collects the WAL records while applying a batch.
+	kv              *kvStore
+	dirty           map[string]struct{}  // Grouping keys changed since the last persisting to kv.
+	tombstones      map[string]time.Time // Metric families older than this are gone, by grouping key.
+	// Like tombstones, but for single metric families, by grouping key and
+	// metric name.
+	familyTombstones map[string]map[string]time.Time
+	timestampPolicy  TimestampPolicy
+	maxTimestampAge  time.Duration
+	quotas           QuotaConfig
+	groupTenants     map[string]string       // Tenant of the last push, by grouping key. Only tracked with quotas.
+	tenantUsage      map[string]*tenantUsage // Usage by tenant, kept up to date by account.
+	groupUsage       map[string]groupUsage   // What each group adds to tenantUsage, by grouping key.
+	logger           log.Logger
+}
+
+// Option configures a DiskMetricStore.
+type Option func(*DiskMetricStore)
+
+// WithTTL sets the default TTL of groups. Groups not pushed to for that long are
+// deleted. Pushes can override the default with the TTL field of the
+// WriteRequest. A TTL of 0 (the default) means groups never expire unless a
+// push sets a TTL.
+func WithTTL(ttl time.Duration) Option {
+	return func(dms *DiskMetricStore) {
+		dms.ttl = ttl
+	}
+}
+
+// WithWAL enables the write-ahead log. Every applied WriteRequest is then
+// appended to a log in the directory persistenceFile + ".wal", which is synced
+// to disk in batches whenever the write queue runs empty. Upon start-up, the
+// log is replayed on top of the persistence file. The persistence file then
+// merely serves as a snapshot, after which the log is truncated. The WAL
+// requires a persistence file to be configured.
+func WithWAL(enabled bool) Option {
+	return func(dms *DiskMetricStore) {
+		dms.walEnabled = enabled
+	}
 }
 
 type mfStat struct {
@@ -75,25 +136,80 @@ type mfStat struct {
 // If a non-nil Gatherer is provided, the help strings of metrics gathered by it
 // will be used as standard. Pushed metrics with deviating help strings will be
 // adjusted to avoid inconsistent expositions.
+//
+// Further behavior can be configured with Options.
 func NewDiskMetricStore(
 	persistenceFile string,
 	persistenceInterval time.Duration,
 	gatherPredefinedHelpFrom prometheus.Gatherer,
 	logger log.Logger,
+	opts ...Option,
+) *DiskMetricStore {
+	return newDiskMetricStore(persistenceFile, nil, persistenceInterval, gatherPredefinedHelpFrom, logger, opts...)
+}
+
+// NewKVMetricStore returns a DiskMetricStore that persists to an embedded
+// key-value store in the file dbFile instead of a single persistence file. Each
+// group is a record of its own, so that persisting only has to write the
+// groups changed since the previous persisting. Otherwise, it behaves like a
+// DiskMetricStore created with NewDiskMetricStore. In particular, all metrics
+// are still kept in memory and loaded from dbFile upon creation, so only the
+// cost of persisting is reduced, not the one of restoring. A WAL can be used on
+// top.
+func NewKVMetricStore(
+	dbFile string,
+	persistenceInterval time.Duration,
+	gatherPredefinedHelpFrom prometheus.Gatherer,
+	logger log.Logger,
+	opts ...Option,
+) (*DiskMetricStore, error) {
+	kv, err := openKVStore(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	return newDiskMetricStore(dbFile, kv, persistenceInterval, gatherPredefinedHelpFrom, logger, opts...), nil
+}
+
+func newDiskMetricStore(
+	persistenceFile string,
+	kv *kvStore,
+	persistenceInterval time.Duration,
+	gatherPredefinedHelpFrom prometheus.Gatherer,
+	logger log.Logger,
+	opts ...Option,
 ) *DiskMetricStore {
 	// TODO: Do that outside of the constructor to allow the HTTP server to
 	//  serve /-/healthy and /-/ready earlier.
 	dms := &DiskMetricStore{
-		writeQueue:      make(chan WriteRequest, writeQueueCapacity),
-		drain:           make(chan struct{}),
-		done:            make(chan error),
-		metricGroups:    GroupingKeyToMetricGroup{},
-		persistenceFile: persistenceFile,
-		logger:          logger,
+		writeQueue:       make(chan WriteRequest, writeQueueCapacity),
+		drain:            make(chan struct{}),
+		done:             make(chan error),
+		metricGroups:     GroupingKeyToMetricGroup{},
+		persistenceFile:  persistenceFile,
+		kv:               kv,
+		dirty:            map[string]struct{}{},
+		tombstones:       map[string]time.Time{},
+		familyTombstones: map[string]map[string]time.Time{},
+		groupTenants:     map[string]string{},
+		tenantUsage:      map[string]*tenantUsage{},
+		groupUsage:       map[string]groupUsage{},
+		expiryInterval:   expiryCheckInterval,
+		logger:           logger,
+	}
+	for _, opt := range opts {
+		opt(dms)
 	}
 	if err := dms.restore(); err != nil {
 		level.Error(logger).Log("msg", "could not load persisted metrics", "err", err)
 	}
+	if dms.walEnabled && persistenceFile != "" && dms.restoreErr == nil {
+		w, err := openWAL(dms.walDir())
+		if err != nil {
+			level.Error(logger).Log("msg", "could not open WAL, continuing without it", "dir", dms.walDir(), "err", err)
+		} else {
+			dms.wal = w
+		}
+	}
 	if helpStrings, err := extractPredefinedHelpStrings(gatherPredefinedHelpFrom); err == nil {
 		dms.predefinedHelp = helpStrings
 	} else {
@@ -130,8 +246,13 @@ func (dms *DiskMetricStore) Healthy() error {
 	return nil
 }
 
-// Ready implements the MetricStore interface.
+// Ready implements the MetricStore interface. The DiskMetricStore is not ready
+// if the persistence file could not be restored because it is corrupted or of
+// an unsupported format version.
 func (dms *DiskMetricStore) Ready() error {
+	if dms.restoreErr != nil {
+		return dms.restoreErr
+	}
 	return dms.Healthy()
 }
 
@@ -190,10 +311,17 @@ func (dms *DiskMetricStore) GetMetricFamilies() []*dto.MetricFamily {
 func (dms *DiskMetricStore) GetMetricFamiliesMap() GroupingKeyToMetricGroup {
 	dms.lock.RLock()
 	defer dms.lock.RUnlock()
-	groupsCopy := make(GroupingKeyToMetricGroup, len(dms.metricGroups))
-	for k, g := range dms.metricGroups {
+	return copyMetricGroups(dms.metricGroups)
+}
+
+// copyMetricGroups copies groups deep enough to be used while groups are
+// modified. The metric families themselves are never modified, only
+// replaced, so they are shared.
+func copyMetricGroups(groups GroupingKeyToMetricGroup) GroupingKeyToMetricGroup {
+	groupsCopy := make(GroupingKeyToMetricGroup, len(groups))
+	for k, g := range groups {
 		metricsCopy := make(NameToTimestampedMetricFamilyMap, len(g.Metrics))
-		groupsCopy[k] = MetricGroup{Labels: g.Labels, Metrics: metricsCopy}
+		groupsCopy[k] = MetricGroup{Labels: g.Labels, Metrics: metricsCopy, TTL: g.TTL}
 		for n, tmf := range g.Metrics {
 			metricsCopy[n] = tmf
 		}
@@ -205,42 +333,120 @@ func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
 	lastPersist := time.Now()
 	persistScheduled := false
 	lastWrite := time.Time{}
-	persistDone := make(chan time.Time)
+	persistDone := make(chan persistResult)
 	var persistTimer *time.Timer
+	expiryTicker := time.NewTicker(dms.expiryInterval)
+	defer expiryTicker.Stop()
+
+	// Done channels of processed synchronous WriteRequests, waiting for
+	// the WAL to be synced or, without WAL, for the next persist.
+	var (
+		awaitingSync    []chan error
+		awaitingPersist []persistWaiter
+	)
 
 	checkPersist := func() {
-		if dms.persistenceFile != "" && !persistScheduled && lastWrite.After(lastPersist) {
-			persistTimer = time.AfterFunc(
-				persistenceInterval-lastWrite.Sub(lastPersist),
-				func() {
-					persistStarted := time.Now()
-					if err := dms.persist(); err != nil {
-						level.Error(dms.logger).Log("msg", "error persisting metrics", "err", err)
-					} else {
-						level.Info(dms.logger).Log("msg", "metrics persisted", "file", dms.persistenceFile)
-					}
-					persistDone <- persistStarted
-				},
-			)
-			persistScheduled = true
+		if dms.persistenceFile == "" || !lastWrite.After(lastPersist) {
+			return
+		}
+		delay := persistenceInterval - lastWrite.Sub(lastPersist)
+		if len(awaitingPersist) > 0 {
+			// Do not let synchronous WriteRequests wait for the
+			// persistence interval.
+			if persistScheduled && persistTimer.Stop() {
+				persistScheduled = false
+			}
+			delay = 0
+		}
+		if persistScheduled {
+			return
 		}
+		persistTimer = time.AfterFunc(
+			delay,
+			func() {
+				persistStarted := time.Now()
+				err := dms.persist()
+				if err != nil {
+					level.Error(dms.logger).Log("msg", "error persisting metrics", "err", err)
+				} else {
+					level.Info(dms.logger).Log("msg", "metrics persisted", "file", dms.persistenceFile)
+				}
+				persistDone <- persistResult{started: persistStarted, err: err}
+			},
+		)
+		persistScheduled = true
+	}
+
+	// handle checks and processes the provided WriteRequest. Its Done
+	// channel is closed right away unless it has to wait for the WAL to be
+	// synced or for the next persist.
+	handle := func(wr WriteRequest) {
+		processed := dms.checkWriteRequest(wr)
+		if processed {
+			if err := dms.processWriteRequest(wr); err != nil {
+				// Rejected while being applied.
+				if wr.Done != nil {
+					wr.Done <- err
+				}
+				processed = false
+			}
+		} else if wr.Batch == nil {
+			// For a batch, checkBatch has taken care of that.
+			dms.setPushFailedTimestamp(wr)
+		}
+		if wr.Done == nil {
+			return
+		}
+		if processed && wr.Sync {
+			switch {
+			case dms.wal != nil:
+				awaitingSync = append(awaitingSync, wr.Done)
+				return
+			case dms.persistenceFile != "":
+				awaitingPersist = append(awaitingPersist, persistWaiter{done: wr.Done, processed: time.Now()})
+				return
+			}
+		}
+		close(wr.Done)
 	}
 
 	for {
 		select {
 		case wr := <-dms.writeQueue:
 			lastWrite = time.Now()
-			if dms.checkWriteRequest(wr) {
-				dms.processWriteRequest(wr)
-			} else {
-				dms.setPushFailedTimestamp(wr)
-			}
-			if wr.Done != nil {
-				close(wr.Done)
+			handle(wr)
+			if len(dms.writeQueue) == 0 || len(awaitingSync) >= maxAwaitingSync {
+				// Sync the WAL in batches, i.e. only once the
+				// queue is empty or enough synchronous
+				// WriteRequests are waiting.
+				err := dms.syncWAL()
+				for _, d := range awaitingSync {
+					releaseSync(d, err)
+				}
+				awaitingSync = nil
 			}
 			checkPersist()
-		case lastPersist = <-persistDone:
+		case now := <-expiryTicker.C:
+			dms.pruneTombstones(now)
+			if dms.expire(now) > 0 {
+				dms.syncWAL()
+				lastWrite = now
+				checkPersist()
+			}
+		case res := <-persistDone:
+			lastPersist = res.started
 			persistScheduled = false
+			// Everything processed before the persist started has
+			// been persisted.
+			var remaining []persistWaiter
+			for _, w := range awaitingPersist {
+				if w.processed.Before(res.started) {
+					releaseSync(w.done, res.err)
+				} else {
+					remaining = append(remaining, w)
+				}
+			}
+			awaitingPersist = remaining
 			checkPersist() // In case something has been written in the meantime.
 		case <-dms.drain:
 			// Prevent a scheduled persist from firing later.
@@ -251,9 +457,28 @@ func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
 			for {
 				select {
 				case wr := <-dms.writeQueue:
-					dms.processWriteRequest(wr)
+					// Synchronous ones are released below, once
+					// persisted.
+					handle(wr)
 				default:
-					dms.done <- dms.persist()
+					err := dms.persist()
+					if dms.wal != nil {
+						if walErr := dms.wal.close(); err == nil {
+							err = walErr
+						}
+					}
+					if dms.kv != nil {
+						if kvErr := dms.kv.close(); err == nil {
+							err = kvErr
+						}
+					}
+					for _, d := range awaitingSync {
+						releaseSync(d, err)
+					}
+					for _, w := range awaitingPersist {
+						releaseSync(w.done, err)
+					}
+					dms.done <- err
 					return
 				}
 			}
@@ -261,17 +486,210 @@ func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
 	}
 }
 
-func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) {
+// expire deletes all groups that have expired at the provided time and
+// returns how many. The deletion happens with a regular delete WriteRequest.
+func (dms *DiskMetricStore) expire(now time.Time) int {
+	var expired []map[string]string
+	dms.lock.RLock()
+	for _, group := range dms.metricGroups {
+		ttl := group.TTL
+		if ttl <= 0 {
+			ttl = dms.ttl
+		}
+		if ttl > 0 && now.Sub(group.LastUpdate()) > ttl {
+			expired = append(expired, group.Labels)
+		}
+	}
+	dms.lock.RUnlock()
+
+	for _, labels := range expired {
+		level.Debug(dms.logger).Log("msg", "deleting expired group", "labels", fmt.Sprint(labels))
+		dms.processWriteRequest(WriteRequest{Labels: labels, Timestamp: now})
+		expiredGroups.Inc()
+	}
+	return len(expired)
+}
+
+// syncWAL syncs the WAL to disk if there is any. Errors are logged and
+// returned.
+func (dms *DiskMetricStore) syncWAL() error {
+	if dms.wal == nil {
+		return nil
+	}
+	err := dms.wal.sync()
+	if err != nil {
+		level.Error(dms.logger).Log("msg", "error syncing WAL", "err", err)
+	}
+	return err
+}
+
+type persistResult struct {
+	started time.Time
+	err     error
+}
+
+// persistWaiter is the Done channel of a synchronous WriteRequest waiting for
+// the next persist, and when the WriteRequest has been processed.
+type persistWaiter struct {
+	done      chan error
+	processed time.Time
+}
+
+// releaseSync closes the Done channel of a synchronous WriteRequest. If the
+// WriteRequest could not be made durable, err is sent to the channel first as
+// a DurabilityError.
+func releaseSync(done chan error, err error) {
+	if err != nil {
+		done <- DurabilityError{Err: err}
+	}
+	close(done)
+}
+
+// logWAL appends the WriteRequest to the WAL if there is any. It must be called
+// with the lock held so that the WAL is cut consistently with snapshots. While a
+// batch is applied, the record is only added to walBatch.
+func (dms *DiskMetricStore) logWAL(wr WriteRequest, failed bool) {
+	if dms.wal == nil {
+		return
+	}
+	rec := newWALRecord(wr, failed)
+	if dms.walBatch != nil {
+		dms.walBatch.Batch = append(dms.walBatch.Batch, rec)
+		return
+	}
+	if err := dms.wal.log(rec); err != nil {
+		level.Error(dms.logger).Log("msg", "error writing to WAL", "err", err)
+	}
+}
+
+// markDirty records that the group with the provided key has changed, if
+// needed for persisting to kv. It must be called with the lock held.
+func (dms *DiskMetricStore) markDirty(key string) {
+	if dms.kv != nil {
+		dms.dirty[key] = struct{}{}
+	}
+}
+
+// processWriteRequest applies the provided WriteRequest. It returns an error if
+// the WriteRequest (or some of the WriteRequests in its Batch) had to be
+// rejected while being applied, in which case their push failure timestamps
+// have been set instead.
+func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) error {
 	dms.lock.Lock()
 	defer dms.lock.Unlock()
 
+	if wr.MatcherSets != nil {
+		dms.deleteMatching(wr)
+		return nil
+	}
+	if wr.Batch != nil {
+		return dms.applyBatch(wr)
+	}
+	return dms.applyWriteRequest(wr)
+}
+
+// applyBatch applies all WriteRequests in the Batch of the provided
+// WriteRequest, logging them to the WAL as a single record. The error of each
+// WriteRequest rejected while being applied is stored in the Result, and an
+// error summarizing them is returned. It must be called with the lock held.
+func (dms *DiskMetricStore) applyBatch(wr WriteRequest) error {
+	if dms.wal != nil && len(wr.Batch) > 0 {
+		dms.walBatch = &walRecord{}
+	}
+	rejected := 0
+	for i, b := range wr.Batch {
+		b.Conditional = wr.Conditional
+		if err := dms.applyWriteRequest(b); err != nil {
+			if wr.Result != nil {
+				if wr.Result.BatchErrors == nil {
+					wr.Result.BatchErrors = make([]error, len(wr.Batch))
+				}
+				wr.Result.BatchErrors[i] = err
+			}
+			rejected++
+		}
+	}
+	if dms.walBatch != nil {
+		rec := *dms.walBatch
+		dms.walBatch = nil
+		if err := dms.wal.log(rec); err != nil {
+			level.Error(dms.logger).Log("msg", "error writing to WAL", "err", err)
+		}
+	}
+	if rejected > 0 {
+		return fmt.Errorf("%d of %d pushes in the batch could not be applied", rejected, len(wr.Batch))
+	}
+	return nil
+}
+
+// deleteMatching deletes all groups matching the MatcherSets of the provided
+// WriteRequest, each with a regular delete WriteRequest, so that the WAL only
+// ever contains deletes of single groups. It must be called with the lock
+// held.
+func (dms *DiskMetricStore) deleteMatching(wr WriteRequest) {
+	var deleted int
+	for _, group := range dms.metricGroups {
+		for _, matchers := range wr.MatcherSets {
+			if matchesAll(matchers, group.Labels) {
+				dms.applyWriteRequest(WriteRequest{
+					Labels:      group.Labels,
+					Timestamp:   wr.Timestamp,
+					Conditional: wr.Conditional,
+				})
+				deleted++
+				break
+			}
+		}
+	}
+	if wr.Result != nil {
+		wr.Result.DeletedGroups = deleted
+	}
+}
+
+// applyWriteRequest applies a WriteRequest without MatcherSets. If its
+// MetricFamilies cannot be aggregated as requested, it is rejected like by
+// checkWriteRequest: the push failure timestamp is set instead, and the error is
+// returned. It must be called with the lock held.
+func (dms *DiskMetricStore) applyWriteRequest(wr WriteRequest) error {
 	key := groupingKeyFor(wr.Labels)
+	defer dms.account(key)
+	if wr.MetricFamilies != nil && wr.Aggregation.Enabled() {
+		// Usually already checked by checkWriteRequest, but the stored
+		// metric families might have changed in the meantime.
+		if err := dms.aggregate(key, wr); err != nil {
+			level.Warn(dms.logger).Log("msg", "pushed metrics rejected", "err", err)
+			dms.markPushFailed(wr)
+			return err
+		}
+		// The WAL gets the aggregated values only.
+		wr.Aggregation = ""
+	}
+	// Log before the MetricFamilies are changed below.
+	dms.logWAL(wr, false)
+	dms.markDirty(key)
+	if dms.quotas != nil && wr.MetricFamilies != nil {
+		dms.groupTenants[key] = tenantFor(wr)
+	}
 
+	if wr.Conditional {
+		dms.processConditionalWriteRequest(key, wr)
+		return nil
+	}
 	if wr.MetricFamilies == nil {
+		if wr.DeleteFamilies != nil {
+			if group, ok := dms.metricGroups[key]; ok {
+				for _, name := range wr.DeleteFamilies {
+					if name != pushMetricName && name != pushFailedMetricName {
+						delete(group.Metrics, name)
+					}
+				}
+			}
+			return nil
+		}
 		// No MetricFamilies means delete request. Delete the whole
 		// metric group, and we are done here.
 		delete(dms.metricGroups, key)
-		return
+		return nil
 	}
 	// Otherwise, it's an update.
 	group, ok := dms.metricGroups[key]
@@ -280,7 +698,6 @@ func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) {
 			Labels:  wr.Labels,
 			Metrics: NameToTimestampedMetricFamilyMap{},
 		}
-		dms.metricGroups[key] = group
 	} else if wr.Replace {
 		// For replace, we have to delete all metric families in the
 		// group except pre-existing push timestamps.
@@ -290,6 +707,8 @@ func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) {
 			}
 		}
 	}
+	group.TTL = wr.TTL
+	dms.metricGroups[key] = group
 	wr.MetricFamilies[pushMetricName] = newPushTimestampGauge(wr.Labels, wr.Timestamp)
 	// Only add a zero push-failed metric if none is there yet, so that a
 	// previously added fail timestamp is retained.
@@ -302,21 +721,149 @@ func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) {
 			GobbableMetricFamily: (*GobbableMetricFamily)(mf),
 		}
 	}
+	return nil
+}
+
+// processConditionalWriteRequest processes a WriteRequest with Conditional set
+// to true. It must be called with the lock held.
+func (dms *DiskMetricStore) processConditionalWriteRequest(key string, wr WriteRequest) {
+	tombstone := dms.tombstones[key]
+	if wr.Timestamp.Before(tombstone) {
+		return // Deleted or replaced later.
+	}
+	group, ok := dms.metricGroups[key]
+
+	if wr.MetricFamilies == nil && wr.DeleteFamilies != nil {
+		// Like a delete, but with a tombstone per metric family.
+		familyTombstones, exists := dms.familyTombstones[key]
+		if !exists {
+			familyTombstones = map[string]time.Time{}
+			dms.familyTombstones[key] = familyTombstones
+		}
+		newTombstone := wr.Timestamp.Add(time.Nanosecond)
+		for _, name := range wr.DeleteFamilies {
+			if name == pushMetricName || name == pushFailedMetricName {
+				continue
+			}
+			if newTombstone.After(familyTombstones[name]) {
+				familyTombstones[name] = newTombstone
+			}
+			// Reading from the nil map of a missing group is fine.
+			if tmf, ok := group.Metrics[name]; ok && tmf.Timestamp.Before(newTombstone) {
+				delete(group.Metrics, name)
+			}
+		}
+		return
+	}
+
+	// A delete removes everything up to and including its Timestamp, a
+	// replace everything before its Timestamp.
+	var newTombstone time.Time
+	switch {
+	case wr.MetricFamilies == nil:
+		newTombstone = wr.Timestamp.Add(time.Nanosecond)
+	case wr.Replace:
+		newTombstone = wr.Timestamp
+	}
+	if newTombstone.After(tombstone) {
+		dms.tombstones[key] = newTombstone
+		if ok {
+			for name, tmf := range group.Metrics {
+				if tmf.Timestamp.Before(newTombstone) &&
+					(wr.MetricFamilies == nil || name != pushFailedMetricName) {
+					delete(group.Metrics, name)
+				}
+			}
+			if wr.MetricFamilies == nil && len(group.Metrics) == 0 {
+				delete(dms.metricGroups, key)
+			}
+		}
+	}
+	if wr.MetricFamilies == nil {
+		return
+	}
+
+	if !ok {
+		group = MetricGroup{
+			Labels:  wr.Labels,
+			Metrics: NameToTimestampedMetricFamilyMap{},
+		}
+	}
+	if !wr.Timestamp.Before(group.LastUpdate()) {
+		group.TTL = wr.TTL
+	}
+	dms.metricGroups[key] = group
+	wr.MetricFamilies[pushMetricName] = newPushTimestampGauge(wr.Labels, wr.Timestamp)
+	if _, ok := group.Metrics[pushFailedMetricName]; !ok {
+		wr.MetricFamilies[pushFailedMetricName] = newPushFailedTimestampGauge(wr.Labels, time.Time{})
+	}
+	for name, mf := range wr.MetricFamilies {
+		if tmf, ok := group.Metrics[name]; ok && tmf.Timestamp.After(wr.Timestamp) {
+			continue
+		}
+		if wr.Timestamp.Before(dms.familyTombstones[key][name]) {
+			continue
+		}
+		group.Metrics[name] = TimestampedMetricFamily{
+			Timestamp:            wr.Timestamp,
+			GobbableMetricFamily: (*GobbableMetricFamily)(mf),
+		}
+	}
+}
+
+// pruneTombstones deletes tombstones older than tombstoneRetention.
+func (dms *DiskMetricStore) pruneTombstones(now time.Time) {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	for key, tombstone := range dms.tombstones {
+		if now.Sub(tombstone) > tombstoneRetention {
+			delete(dms.tombstones, key)
+		}
+	}
+	for key, familyTombstones := range dms.familyTombstones {
+		for name, tombstone := range familyTombstones {
+			if now.Sub(tombstone) > tombstoneRetention {
+				delete(familyTombstones, name)
+			}
+		}
+		if len(familyTombstones) == 0 {
+			delete(dms.familyTombstones, key)
+		}
+	}
+	// Not exactly tombstones, but in need of cleaning up, too.
+	for key := range dms.groupTenants {
+		if _, ok := dms.metricGroups[key]; !ok {
+			delete(dms.groupTenants, key)
+		}
+	}
 }
 
 func (dms *DiskMetricStore) setPushFailedTimestamp(wr WriteRequest) {
 	dms.lock.Lock()
 	defer dms.lock.Unlock()
 
-	key := groupingKeyFor(wr.Labels)
+	dms.markPushFailed(wr)
+}
 
+// markPushFailed is setPushFailedTimestamp for callers holding the lock.
+func (dms *DiskMetricStore) markPushFailed(wr WriteRequest) {
+	key := groupingKeyFor(wr.Labels)
 	group, ok := dms.metricGroups[key]
+	if !ok && dms.quotas != nil && dms.groupQuotaReached(wr) {
+		// Failed pushes must not circumvent the group quota.
+		return
+	}
+
+	dms.logWAL(wr, true)
+	dms.markDirty(key)
+
 	if !ok {
 		group = MetricGroup{
 			Labels:  wr.Labels,
 			Metrics: NameToTimestampedMetricFamilyMap{},
 		}
 		dms.metricGroups[key] = group
+		dms.account(key)
 	}
 
 	group.Metrics[pushFailedMetricName] = TimestampedMetricFamily{
@@ -340,55 +887,197 @@ func (dms *DiskMetricStore) setPushFailedTimestamp(wr WriteRequest) {
 // causing error is written to the Done channel of the WriteRequest.
 //
 // Special case: If the WriteRequest has no Done channel set, the (expensive)
-// consistency check is skipped. The WriteRequest is still sanitized, and the
-// presence of timestamps still results in returning false.
+// consistency check is skipped. The WriteRequest is still sanitized, native
+// histograms are still validated, and the TimestampPolicy and quotas are still
+// applied.
+//
+// A WriteRequest with a Batch is checked by checkBatch.
 func (dms *DiskMetricStore) checkWriteRequest(wr WriteRequest) bool {
+	if wr.Batch != nil {
+		return dms.checkBatch(wr)
+	}
 	if wr.MetricFamilies == nil {
 		// Delete request cannot create inconsistencies, and nothing has
 		// to be sanitized.
 		return true
 	}
-
-	var err error
-	defer func() {
-		if err != nil && wr.Done != nil {
+	// Without Done channel, don't do the expensive consistency check.
+	if err := dms.checkPush(wr, wr.Done != nil); err != nil {
+		if wr.Done != nil {
 			wr.Done <- err
 		}
-	}()
-
-	if timestampsPresent(wr.MetricFamilies) {
-		err = errTimestamp
 		return false
 	}
+	return true
+}
+
+// checkPush checks and sanitizes a WriteRequest with MetricFamilies as
+// described for checkWriteRequest and returns the causing error if the
+// WriteRequest is invalid. The consistency check is only performed if
+// consistency is true.
+func (dms *DiskMetricStore) checkPush(wr WriteRequest, consistency bool) error {
+	if err := dms.checkTimestamps(wr); err != nil {
+		return err
+	}
+	if err := checkNativeHistograms(wr.MetricFamilies); err != nil {
+		return err
+	}
 	for _, mf := range wr.MetricFamilies {
 		sanitizeLabels(mf, wr.Labels)
 	}
+	if dms.quotas != nil {
+		if err := dms.checkQuota(wr); err != nil {
+			return err
+		}
+	}
 
-	// Without Done channel, don't do the expensive consistency check.
-	if wr.Done == nil {
-		return true
+	if !consistency {
+		return nil
 	}
 
-	// Construct a test dms, acting on a copy of the metrics, to test the
-	// WriteRequest with.
-	tdms := &DiskMetricStore{
-		metricGroups:   dms.GetMetricFamiliesMap(),
-		predefinedHelp: dms.predefinedHelp,
-		logger:         log.NewNopLogger(),
+	if wr.Aggregation.Enabled() {
+		var err error
+		if wr, err = dms.aggregated(wr); err != nil {
+			return err
+		}
 	}
+
+	tdms := dms.scratch()
 	tdms.processWriteRequest(wr)
+	return tdms.checkConsistency()
+}
+
+// aggregated returns the provided WriteRequest with its MetricFamilies
+// aggregated into the stored ones as requested by its Aggregation, which is
+// cleared then. The aggregation happens on a copy of the MetricFamilies so that
+// only processing the WriteRequest for real changes them.
+func (dms *DiskMetricStore) aggregated(wr WriteRequest) (WriteRequest, error) {
+	wr.MetricFamilies = copyMetricFamilies(wr.MetricFamilies)
+	dms.lock.RLock()
+	err := dms.aggregate(groupingKeyFor(wr.Labels), wr)
+	dms.lock.RUnlock()
+	wr.Aggregation = ""
+	return wr, err
+}
 
+// checkConsistency returns an error if the metrics of dms cannot be gathered
+// consistently together with those of the DefaultGatherer.
+func (dms *DiskMetricStore) checkConsistency() error {
 	// Construct a test Gatherer to check if consistent gathering is possible.
 	tg := prometheus.Gatherers{
 		prometheus.DefaultGatherer,
 		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
-			return tdms.GetMetricFamilies(), nil
+			return dms.GetMetricFamilies(), nil
 		}),
 	}
-	if _, err = tg.Gather(); err != nil {
-		return false
+	_, err := tg.Gather()
+	return err
+}
+
+// checkBatch is checkWriteRequest for a WriteRequest with a Batch. The
+// WriteRequests in the Batch are checked one by one on a scratch copy of the
+// dms, to which the valid ones are applied, so that each is checked as if the
+// ones before it had been applied already. The consistency check is performed
+// once for all of them in the end and only repeated for each of them if it
+// fails, to find the culprits. If any of them is invalid, the push failure
+// timestamps of the invalid ones are set, and an error summarizing the outcome
+// is written to the Done channel. The error of each WriteRequest is stored in
+// the Result.
+func (dms *DiskMetricStore) checkBatch(wr WriteRequest) bool {
+	tdms, errs, invalid := dms.checkBatchItems(wr, false)
+	if tdms.checkConsistency() != nil {
+		_, errs, invalid = dms.checkBatchItems(wr, true)
+	}
+	if wr.Result != nil {
+		wr.Result.BatchErrors = errs
+	}
+	if invalid == 0 {
+		return true
+	}
+
+	for i, b := range wr.Batch {
+		if errs[i] != nil && isBatchPush(b) {
+			dms.setPushFailedTimestamp(b)
+		}
+	}
+	if wr.Done != nil {
+		wr.Done <- fmt.Errorf("%d of %d pushes in the batch are invalid", invalid, len(wr.Batch))
+	}
+	return false
+}
+
+// checkBatchItems checks the WriteRequests in the Batch of the provided
+// WriteRequest one by one with checkPush on a scratch copy of the dms, to which
+// the valid ones are applied. It returns the scratch copy, the error of each
+// WriteRequest, and the number of invalid ones.
+func (dms *DiskMetricStore) checkBatchItems(wr WriteRequest, consistency bool) (*DiskMetricStore, []error, int) {
+	tdms := dms.scratch()
+	errs := make([]error, len(wr.Batch))
+	invalid := 0
+	for i, b := range wr.Batch {
+		if !isBatchPush(b) {
+			errs[i] = errors.New("only pushes can be part of a batch")
+			invalid++
+			continue
+		}
+		b.Conditional = wr.Conditional
+		if errs[i] = tdms.checkPush(b, consistency); errs[i] != nil {
+			invalid++
+			continue
+		}
+		// Apply a copy so that only processing the batch for real
+		// changes the MetricFamilies. Without the consistency check,
+		// aggregation errors have not been found yet.
+		if b.Aggregation.Enabled() {
+			if b, errs[i] = tdms.aggregated(b); errs[i] != nil {
+				invalid++
+				continue
+			}
+		} else {
+			b.MetricFamilies = copyMetricFamilies(b.MetricFamilies)
+		}
+		tdms.processWriteRequest(b)
+	}
+	return tdms, errs, invalid
+}
+
+// isBatchPush returns whether the provided WriteRequest may be part of a batch.
+func isBatchPush(wr WriteRequest) bool {
+	return wr.MetricFamilies != nil && wr.MatcherSets == nil && wr.Batch == nil
+}
+
+// scratch returns a DiskMetricStore without persistence, acting on a copy of
+// the metrics of dms, to test WriteRequests with.
+func (dms *DiskMetricStore) scratch() *DiskMetricStore {
+	dms.lock.RLock()
+	groupTenants := make(map[string]string, len(dms.groupTenants))
+	for key, tenant := range dms.groupTenants {
+		groupTenants[key] = tenant
+	}
+	tenantUsage := make(map[string]*tenantUsage, len(dms.tenantUsage))
+	for tenant, u := range dms.tenantUsage {
+		copied := *u
+		tenantUsage[tenant] = &copied
+	}
+	groupUsage := make(map[string]groupUsage, len(dms.groupUsage))
+	for key, gu := range dms.groupUsage {
+		groupUsage[key] = gu
+	}
+	dms.lock.RUnlock()
+
+	return &DiskMetricStore{
+		metricGroups:     dms.GetMetricFamiliesMap(),
+		predefinedHelp:   dms.predefinedHelp,
+		tombstones:       map[string]time.Time{},
+		familyTombstones: map[string]map[string]time.Time{},
+		timestampPolicy:  dms.timestampPolicy,
+		maxTimestampAge:  dms.maxTimestampAge,
+		quotas:           dms.quotas,
+		groupTenants:     groupTenants,
+		tenantUsage:      tenantUsage,
+		groupUsage:       groupUsage,
+		logger:           log.NewNopLogger(),
 	}
-	return true
 }
 
 func (dms *DiskMetricStore) persist() error {
@@ -397,6 +1086,12 @@ func (dms *DiskMetricStore) persist() error {
 	if dms.persistenceFile == "" {
 		return nil
 	}
+	if dms.restoreErr != nil {
+		return dms.restoreErr
+	}
+	if dms.kv != nil {
+		return dms.persistKV()
+	}
 	f, err := ioutil.TempFile(
 		path.Dir(dms.persistenceFile),
 		path.Base(dms.persistenceFile)+".in_progress.",
@@ -405,11 +1100,27 @@ func (dms *DiskMetricStore) persist() error {
 		return err
 	}
 	inProgressFileName := f.Name()
-	e := gob.NewEncoder(f)
 
+	// Only the groups are copied while holding the lock, so that pushes
+	// are not blocked while encoding and writing them. With a WAL, a new
+	// segment is cut while still holding the lock, so that the snapshot
+	// contains exactly what has been logged to the older segments.
+	var segment int
 	dms.lock.RLock()
-	err = e.Encode(dms.metricGroups)
+	groups := copyMetricGroups(dms.metricGroups)
+	if dms.wal != nil {
+		segment, err = dms.wal.cut()
+	}
 	dms.lock.RUnlock()
+	if err == nil {
+		err = encodeSnapshot(f, groups)
+	}
+	if err == nil {
+		// The older segments of a WAL are deleted below, and
+		// synchronous WriteRequests are acknowledged after
+		// persisting, so the snapshot has to be on disk for sure.
+		err = f.Sync()
+	}
 	if err != nil {
 		f.Close()
 		os.Remove(inProgressFileName)
@@ -419,34 +1130,158 @@ func (dms *DiskMetricStore) persist() error {
 		os.Remove(inProgressFileName)
 		return err
 	}
-	return os.Rename(inProgressFileName, dms.persistenceFile)
+	if err := os.Rename(inProgressFileName, dms.persistenceFile); err != nil {
+		return err
+	}
+	if dms.wal == nil {
+		return nil
+	}
+	return dms.wal.truncate(segment)
+}
+
+// persistKV writes all groups changed since the previous call to kv.
+func (dms *DiskMetricStore) persistKV() error {
+	// As in persist, a new WAL segment is cut while still holding the
+	// lock. The lock has to be exclusive to reset the dirty groups.
+	var (
+		segment int
+		err     error
+	)
+	changes := make(map[string]*SnapshotGroup, len(dms.dirty))
+	dms.lock.Lock()
+	for key := range dms.dirty {
+		group, ok := dms.metricGroups[key]
+		if !ok {
+			changes[key] = nil
+			continue
+		}
+		if changes[key], err = newSnapshotGroup(group); err != nil {
+			dms.lock.Unlock()
+			return err
+		}
+	}
+	if dms.wal != nil {
+		if segment, err = dms.wal.cut(); err != nil {
+			dms.lock.Unlock()
+			return err
+		}
+	}
+	dms.dirty = map[string]struct{}{}
+	dms.lock.Unlock()
+
+	if err := dms.kv.write(changes); err != nil {
+		// Try again next time.
+		dms.lock.Lock()
+		for key := range changes {
+			dms.dirty[key] = struct{}{}
+		}
+		dms.lock.Unlock()
+		return err
+	}
+	if dms.wal == nil {
+		return nil
+	}
+	return dms.wal.truncate(segment)
+}
+
+func (dms *DiskMetricStore) walDir() string {
+	return dms.persistenceFile + ".wal"
 }
 
 func (dms *DiskMetricStore) restore() error {
 	if dms.persistenceFile == "" {
 		return nil
 	}
+	groups, err := dms.load()
+	if err != nil && dms.refuseRestore(err) {
+		return err
+	}
+	// Any other error is only reported, and the store starts empty like
+	// before the format was versioned, but with what has been logged since.
+	if groups != nil {
+		dms.metricGroups = groups
+		dms.accountAll()
+	}
+	dms.replayWAL()
+	return err
+}
+
+// load reads the groups from kv or from the persistence file. A missing
+// persistence file results in no groups.
+func (dms *DiskMetricStore) load() (GroupingKeyToMetricGroup, error) {
+	if dms.kv != nil {
+		return dms.kv.load()
+	}
 	f, err := os.Open(dms.persistenceFile)
 	if os.IsNotExist(err) {
-		return nil
+		return nil, nil
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
-	d := gob.NewDecoder(f)
-	if err := d.Decode(&dms.metricGroups); err != nil {
-		return err
+	groups, legacy, err := decodeSnapshot(f)
+	if err == nil && legacy {
+		level.Info(dms.logger).Log("msg", "migrating persistence file from the legacy format", "file", dms.persistenceFile)
 	}
-	return nil
+	return groups, err
+}
+
+// refuseRestore reports whether restoring has to be refused because of err,
+// which is the case for a newerFormatError or a corruptedFileError. If so, err
+// is stored as restoreErr, which disables persisting and the WAL, so that
+// neither a downgrade nor a corrupted file wipes the data.
+func (dms *DiskMetricStore) refuseRestore(err error) bool {
+	switch err.(type) {
+	case newerFormatError, corruptedFileError:
+		dms.restoreErr = err
+		return true
+	}
+	return false
+}
+
+// replayWAL applies the WAL (if enabled) on top of the restored snapshot.
+// Records already contained in the snapshot (possible after a crash between
+// writing the snapshot and truncating the WAL) are applied again, which is
+// harmless as replaying a WriteRequest is idempotent.
+func (dms *DiskMetricStore) replayWAL() {
+	if !dms.walEnabled {
+		return
+	}
+	replayed, err := replayWAL(dms.walDir(), func(wr WriteRequest, failed bool) {
+		if failed {
+			dms.setPushFailedTimestamp(wr)
+		} else {
+			dms.processWriteRequest(wr)
+		}
+	})
+	if replayed > 0 {
+		level.Info(dms.logger).Log("msg", "WAL replayed", "dir", dms.walDir(), "records", replayed)
+	}
+	if err != nil {
+		level.Warn(dms.logger).Log("msg", "WAL replay skipped corrupted records, probably caused by a crash while writing", "err", err)
+	}
+}
+
+// copyMetricFamilies returns a copy of the provided map, pointing to the same
+// MetricFamilies.
+func copyMetricFamilies(mfs map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
+	result := make(map[string]*dto.MetricFamily, len(mfs))
+	for name, mf := range mfs {
+		result[name] = mf
+	}
+	return result
 }
 
+// copyMetricFamily returns a shallow copy of mf. The unknown fields are copied,
+// too, as they hold the OpenMetrics unit (see package openmetrics).
 func copyMetricFamily(mf *dto.MetricFamily) *dto.MetricFamily {
 	return &dto.MetricFamily{
-		Name:   mf.Name,
-		Help:   mf.Help,
-		Type:   mf.Type,
-		Metric: append([]*dto.Metric{}, mf.Metric...),
+		Name:             mf.Name,
+		Help:             mf.Help,
+		Type:             mf.Type,
+		Metric:           append([]*dto.Metric{}, mf.Metric...),
+		XXX_unrecognized: mf.XXX_unrecognized,
 	}
 }
 
@@ -14,22 +14,31 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"path"
+	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/model"
 
 	dto "github.com/prometheus/client_model/go"
+	bolt "go.etcd.io/bbolt"
 
+	"github.com/prometheus/pushgateway/openmetrics"
 	"github.com/prometheus/pushgateway/testutil"
 )
 
@@ -908,6 +917,1320 @@ func TestAddDeletePersistRestore(t *testing.T) {
 	}
 }
 
+func TestOpenMetricsExtras(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestOpenMetricsExtras.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, 100*time.Millisecond, nil, logger)
+
+	const text = `# TYPE transferred_bytes counter
+# UNIT transferred_bytes bytes
+transferred_bytes_total 42 # {trace_id="abc"} 7
+transferred_bytes_created 1520872607
+# EOF
+`
+	ts := time.Now()
+	for _, instance := range []string{"instance1", "instance2"} {
+		mfs, err := openmetrics.Parse(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		errCh := make(chan error, 1)
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": instance},
+			Timestamp:      ts,
+			MetricFamilies: mfs,
+			Done:           errCh,
+		})
+		for err := range errCh {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The extras have to survive persisting and restoring as well as the
+	// merging of the metric families of both groups.
+	dms = NewDiskMetricStore(fileName, 100*time.Millisecond, nil, logger)
+	defer dms.Shutdown()
+	var mf *dto.MetricFamily
+	for _, f := range dms.GetMetricFamilies() {
+		if f.GetName() == "transferred_bytes_total" {
+			mf = f
+		}
+	}
+	if mf == nil {
+		t.Fatal("Metric family transferred_bytes_total not restored.")
+	}
+	if expected, got := "bytes", openmetrics.Unit(mf); expected != got {
+		t.Errorf("Wanted unit %q, got %q.", expected, got)
+	}
+	if expected, got := 2, len(mf.GetMetric()); expected != got {
+		t.Fatalf("Wanted %d metrics, got %d.", expected, got)
+	}
+	for _, m := range mf.GetMetric() {
+		if expected, got := int64(1520872607), openmetrics.CreatedTimestamp(m).GetSeconds(); expected != got {
+			t.Errorf("Wanted created timestamp %d, got %d.", expected, got)
+		}
+		if expected, got := 7.0, m.GetCounter().GetExemplar().GetValue(); expected != got {
+			t.Errorf("Wanted exemplar value %v, got %v.", expected, got)
+		}
+	}
+}
+
+func TestNativeHistograms(t *testing.T) {
+	newHistogram := func(count uint64, sum float64, nh *NativeHistogram) *dto.MetricFamily {
+		h := &dto.Histogram{
+			SampleCount: proto.Uint64(count),
+			SampleSum:   proto.Float64(sum),
+		}
+		SetNativeHistogram(h, nh)
+		return &dto.MetricFamily{
+			Name: proto.String("native"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("instance"), Value: proto.String("instance1")},
+						{Name: proto.String("job"), Value: proto.String("job1")},
+					},
+					Histogram: h,
+				},
+			},
+		}
+	}
+	integer := &NativeHistogram{
+		Schema:         1,
+		ZeroThreshold:  0.001,
+		ZeroCount:      2,
+		NegativeSpans:  []BucketSpan{{Offset: 0, Length: 1}},
+		NegativeDeltas: []int64{1},
+		PositiveSpans:  []BucketSpan{{Offset: -1, Length: 2}, {Offset: 1, Length: 1}},
+		PositiveDeltas: []int64{3, -1, 1},
+	}
+	float := &NativeHistogram{
+		SampleCountFloat: 4.5,
+		Schema:           0,
+		ZeroCountFloat:   0.5,
+		PositiveSpans:    []BucketSpan{{Offset: 1, Length: 1}},
+		PositiveCounts:   []float64{4},
+	}
+
+	scenarios := []struct {
+		name  string
+		mf    *dto.MetricFamily
+		valid bool
+	}{
+		{"integer", newHistogram(11, 42, integer), true},
+		{"float", newHistogram(0, 42, float), true},
+		{"no-op span", newHistogram(0, 0, &NativeHistogram{PositiveSpans: []BucketSpan{{}}}), true},
+		{"NaN observations", newHistogram(12, math.NaN(), integer), true},
+		{"sample count too low", newHistogram(10, 42, integer), false},
+		{"sample count too high", newHistogram(12, 42, integer), false},
+		{"schema out of range", newHistogram(0, 0, &NativeHistogram{Schema: 9}), false},
+		{"negative zero threshold", newHistogram(0, 0, &NativeHistogram{ZeroThreshold: -1}), false},
+		{"spans too short", newHistogram(1, 1, &NativeHistogram{PositiveDeltas: []int64{1}}), false},
+		{"negative span offset", newHistogram(2, 1, &NativeHistogram{
+			PositiveSpans:  []BucketSpan{{Offset: 0, Length: 1}, {Offset: -1, Length: 1}},
+			PositiveDeltas: []int64{1, 0},
+		}), false},
+		{"negative bucket count", newHistogram(0, 1, &NativeHistogram{
+			PositiveSpans:  []BucketSpan{{Offset: 0, Length: 2}},
+			PositiveDeltas: []int64{1, -2},
+		}), false},
+		{"mixed counts", newHistogram(0, 1, &NativeHistogram{
+			SampleCountFloat: 1,
+			PositiveSpans:    []BucketSpan{{Offset: 0, Length: 1}},
+			PositiveDeltas:   []int64{1},
+		}), false},
+	}
+	for _, s := range scenarios {
+		dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+		errCh := make(chan error, 1)
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+			Timestamp:      time.Now(),
+			MetricFamilies: testutil.MetricFamiliesMap(proto.Clone(s.mf).(*dto.MetricFamily)),
+			Done:           errCh,
+		})
+		var err error
+		for err = range errCh {
+		}
+		if s.valid && err != nil {
+			t.Errorf("%s: Unexpected error: %s", s.name, err)
+		}
+		if !s.valid && err == nil {
+			t.Errorf("%s: Expected error on pushing invalid native histogram.", s.name)
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Buckets.
+	nh, err := GetNativeHistogram(newHistogram(11, 42, integer).Metric[0].Histogram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(integer, nh) {
+		t.Errorf("Wanted native histogram %+v, got %+v.", integer, nh)
+	}
+	if expected, got := []NativeBucket{
+		{Lower: 0.5, Upper: math.Exp2(-0.5), Count: 3},
+		{Lower: math.Exp2(-0.5), Upper: 1, Count: 2},
+		{Lower: math.Exp2(0.5), Upper: 2, Count: 3},
+	}, nh.PositiveBuckets(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted positive buckets %v, got %v.", expected, got)
+	}
+	if expected, got := []NativeBucket{
+		{Lower: -1, Upper: -math.Exp2(-0.5), Count: 1},
+	}, nh.NegativeBuckets(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted negative buckets %v, got %v.", expected, got)
+	}
+	if nh, err := GetNativeHistogram(&dto.Histogram{}); nh != nil || err != nil {
+		t.Errorf("Wanted no native histogram, got %v, error %v.", nh, err)
+	}
+
+	// Native histograms must survive gob encoding as well as persisting and
+	// restoring.
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestNativeHistograms.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, 100*time.Millisecond, nil, logger)
+	mf := newHistogram(11, 42, integer)
+	errCh := make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: testutil.MetricFamiliesMap(proto.Clone(mf).(*dto.MetricFamily)),
+		Done:           errCh,
+	})
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+	// Native histograms cannot be aggregated.
+	errCh = make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: testutil.MetricFamiliesMap(proto.Clone(mf).(*dto.MetricFamily)),
+		Aggregation:    AggregationSum,
+		Done:           errCh,
+	})
+	var aggregationErr error
+	for aggregationErr = range errCh {
+	}
+	if aggregationErr == nil {
+		t.Error("Expected error on aggregating native histograms.")
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(dms.GetMetricFamiliesMap()); err != nil {
+		t.Fatal(err)
+	}
+	groups := GroupingKeyToMetricGroup{}
+	if err := gob.NewDecoder(&buf).Decode(&groups); err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range groups {
+		if got := group.Metrics["native"].GetMetricFamily(); !proto.Equal(mf, got) {
+			t.Errorf("Wanted metric family %v after gob round trip, got %v.", mf, got)
+		}
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	dms = NewDiskMetricStore(fileName, 100*time.Millisecond, nil, logger)
+	defer dms.Shutdown()
+	var restored *dto.MetricFamily
+	for _, got := range dms.GetMetricFamilies() {
+		if got.GetName() == "native" {
+			restored = got
+		}
+	}
+	if !proto.Equal(mf, restored) {
+		t.Errorf("Wanted restored metric family %v, got %v.", mf, restored)
+	}
+}
+
+func TestWAL(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestWAL.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	// The persistence interval is long enough to never persist during the
+	// test, so that everything has to be restored from the WAL.
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger, WithWAL(true))
+
+	ts1 := time.Now()
+	ts2 := ts1.Add(time.Second)
+	grouping1 := map[string]string{"job": "job1", "instance": "instance1"}
+	grouping2 := map[string]string{"job": "job1", "instance": "instance2"}
+	grouping3 := map[string]string{"job": "job2", "instance": "instance1"}
+	for _, wr := range []WriteRequest{
+		{Labels: grouping1, Timestamp: ts1, MetricFamilies: testutil.MetricFamiliesMap(mf3)},
+		{Labels: grouping2, Timestamp: ts1, MetricFamilies: testutil.MetricFamiliesMap(mf1b, mf2)},
+		{Labels: grouping3, Timestamp: ts1, MetricFamilies: testutil.MetricFamiliesMap(mf1b)},
+		// Replace with nothing must not turn into a delete.
+		{Labels: grouping2, Timestamp: ts2, MetricFamilies: map[string]*dto.MetricFamily{}, Replace: true},
+		{Labels: grouping3, Timestamp: ts2},
+		// Failed push.
+		{Labels: grouping1, Timestamp: ts2, MetricFamilies: testutil.MetricFamiliesMap(mf1ts)},
+	} {
+		errCh := make(chan error, 1)
+		wr.Done = errCh
+		dms.SubmitWriteRequest(wr)
+		for range errCh {
+		}
+	}
+	pushTimestamp := newPushTimestampGauge(grouping1, ts1)
+	pushTimestamp.Metric = append(
+		pushTimestamp.Metric, newPushTimestampGauge(grouping2, ts2).Metric[0],
+	)
+	pushFailedTimestamp := newPushFailedTimestampGauge(grouping1, ts2)
+	pushFailedTimestamp.Metric = append(
+		pushFailedTimestamp.Metric, newPushFailedTimestampGauge(grouping2, time.Time{}).Metric[0],
+	)
+	expected := []*dto.MetricFamily{mf3, pushTimestamp, pushFailedTimestamp}
+	if err := checkMetricFamilies(dms, expected...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Fatal("Persistence file exists, expected only a WAL.")
+	}
+
+	// Simulate a crash by restoring while the first dms is still running.
+	// Add a torn record, which must be ignored.
+	segments, err := walSegments(fileName + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(
+		path.Join(fileName+".wal", fmt.Sprintf("%08d", segments[len(segments)-1])),
+		os.O_WRONLY|os.O_APPEND, 0666,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{42, 0, 0, 0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	dms2 := NewDiskMetricStore(fileName, time.Hour, nil, logger, WithWAL(true))
+	if err := checkMetricFamilies(dms2, expected...); err != nil {
+		t.Fatal(err)
+	}
+	// Writes after the restore go to a new segment.
+	errCh := make(chan error, 1)
+	dms2.SubmitWriteRequest(WriteRequest{Labels: grouping1, Timestamp: ts2, Done: errCh})
+	for range errCh {
+	}
+	expected = []*dto.MetricFamily{
+		newPushTimestampGauge(grouping2, ts2),
+		newPushFailedTimestampGauge(grouping2, time.Time{}),
+	}
+	if err := checkMetricFamilies(dms2, expected...); err != nil {
+		t.Fatal(err)
+	}
+	dms3 := NewDiskMetricStore(fileName, time.Hour, nil, logger, WithWAL(true))
+	if err := checkMetricFamilies(dms3, expected...); err != nil {
+		t.Fatal(err)
+	}
+
+	// A shutdown writes a snapshot and truncates the WAL. (The "crashed"
+	// dms and dms2 are never shut down.)
+	if err := dms3.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if segments, err = walSegments(fileName + ".wal"); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 1, len(segments); expected != got {
+		t.Errorf("Wanted %d WAL segments, got %d.", expected, got)
+	}
+	dms4 := NewDiskMetricStore(fileName, time.Hour, nil, logger, WithWAL(true))
+	if err := checkMetricFamilies(dms4, expected...); err != nil {
+		t.Error(err)
+	}
+	if err := dms4.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadWALRecord(t *testing.T) {
+	scenarios := map[string][]byte{
+		"torn header": {42, 0, 0, 0, 1, 2},
+		"torn record": {42, 0, 0, 0, 1, 2, 3, 4, 5},
+		"too large":   {0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5},
+	}
+	for name, data := range scenarios {
+		if _, err := readWALRecord(bytes.NewReader(data)); err != errWALCorrupted {
+			t.Errorf("%s: Wanted %v, got %v.", name, errWALCorrupted, err)
+		}
+	}
+}
+
+func TestPersistenceFormat(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestPersistenceFormat.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+
+	ts := time.Now()
+	grouping := map[string]string{"job": "job1", "instance": "instance1"}
+	groups := GroupingKeyToMetricGroup{
+		groupingKeyFor(grouping): MetricGroup{
+			Labels: grouping,
+			Metrics: NameToTimestampedMetricFamilyMap{
+				"mf3": TimestampedMetricFamily{
+					Timestamp:            ts,
+					GobbableMetricFamily: (*GobbableMetricFamily)(mf3),
+				},
+			},
+			TTL: time.Hour,
+		},
+	}
+
+	// Legacy gob files are read and rewritten in the current format.
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(f).Encode(groups); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	if err := checkMetricFamilies(dms, mf3); err != nil {
+		t.Error(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(persistenceMagic)) {
+		t.Fatal("Persistence file has not been migrated.")
+	}
+	dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	got := dms.GetMetricFamiliesMap()[groupingKeyFor(grouping)]
+	if expected, got := time.Hour, got.TTL; expected != got {
+		t.Errorf("Wanted TTL %v, got %v.", expected, got)
+	}
+	if !ts.Equal(got.Metrics["mf3"].Timestamp) {
+		t.Errorf("Wanted timestamp %v, got %v.", ts, got.Metrics["mf3"].Timestamp)
+	}
+	if err := checkMetricFamilies(dms, mf3); err != nil {
+		t.Error(err)
+	}
+	if err := dms.Ready(); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A checksum mismatch or a truncated file must neither be loaded nor
+	// overwritten.
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-1]++
+	for name, content := range map[string][]byte{
+		"checksum mismatch": corrupted,
+		"truncated header":  data[:persistenceHeaderLength-1],
+		"truncated body":    data[:len(data)-1],
+	} {
+		if err := ioutil.WriteFile(fileName, content, 0666); err != nil {
+			t.Fatal(err)
+		}
+		dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+		if err := checkMetricFamilies(dms); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if err := dms.Ready(); err == nil {
+			t.Errorf("%s: Expected store not to be ready.", name)
+		}
+		if err := dms.Shutdown(); err == nil {
+			t.Errorf("%s: Expected error on shutdown.", name)
+		}
+		got, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, got) {
+			t.Errorf("%s: Corrupted persistence file has been overwritten.", name)
+		}
+	}
+
+	// An empty file holds no data, and a legacy file that cannot be
+	// decoded is ignored, so that the store starts empty in both cases.
+	for name, content := range map[string][]byte{
+		"empty":          {},
+		"invalid legacy": []byte("not a gob stream"),
+	} {
+		if err := ioutil.WriteFile(fileName, content, 0666); err != nil {
+			t.Fatal(err)
+		}
+		dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+		if err := checkMetricFamilies(dms); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if err := dms.Ready(); err != nil {
+			t.Errorf("%s: Unexpected error: %v", name, err)
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Errorf("%s: Unexpected error on shutdown: %v", name, err)
+		}
+	}
+
+	// A newer format version must neither be loaded nor overwritten.
+	newer := append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(newer[len(persistenceMagic):], persistenceFormatVersion+1)
+	if err := ioutil.WriteFile(fileName, newer, 0666); err != nil {
+		t.Fatal(err)
+	}
+	dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	if err := dms.Ready(); err == nil {
+		t.Error("Expected store not to be ready.")
+	}
+	if err := dms.Healthy(); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := dms.Shutdown(); err == nil {
+		t.Error("Expected error on shutdown.")
+	}
+	if data, err = ioutil.ReadFile(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newer, data) {
+		t.Error("Persistence file of newer format version has been overwritten.")
+	}
+}
+
+func TestKVMetricStore(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestKVMetricStore.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "metrics.db")
+
+	if _, err := NewKVMetricStore("", time.Hour, nil, logger); err == nil {
+		t.Error("Expected error without a database file.")
+	}
+
+	ms, err := NewMetricStore(BoltBackend, BackendConfig{
+		PersistenceFile:     fileName,
+		PersistenceInterval: time.Hour,
+		Logger:              logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts1 := time.Now()
+	ts2 := ts1.Add(time.Second)
+	grouping1 := map[string]string{"job": "job1", "instance": "instance1"}
+	grouping2 := map[string]string{"job": "job1", "instance": "instance2"}
+	grouping3 := map[string]string{"job": "job2", "instance": "instance1"}
+	for _, wr := range []WriteRequest{
+		{Labels: grouping1, Timestamp: ts1, MetricFamilies: testutil.MetricFamiliesMap(mf3), TTL: time.Hour},
+		{Labels: grouping2, Timestamp: ts1, MetricFamilies: testutil.MetricFamiliesMap(mf2)},
+		{Labels: grouping3, Timestamp: ts1, MetricFamilies: testutil.MetricFamiliesMap(mf1b)},
+		{Labels: grouping3, Timestamp: ts2},
+	} {
+		errCh := make(chan error, 1)
+		wr.Done = errCh
+		ms.SubmitWriteRequest(wr)
+		for err := range errCh {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+	if err := ms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	dms, err := NewKVMetricStore(fileName, time.Hour, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushTimestamp := newPushTimestampGauge(grouping1, ts1)
+	pushTimestamp.Metric = append(
+		pushTimestamp.Metric, newPushTimestampGauge(grouping2, ts1).Metric[0],
+	)
+	pushFailedTimestamp := newPushFailedTimestampGauge(grouping1, time.Time{})
+	pushFailedTimestamp.Metric = append(
+		pushFailedTimestamp.Metric, newPushFailedTimestampGauge(grouping2, time.Time{}).Metric[0],
+	)
+	if err := checkMetricFamilies(dms, mf2, mf3, pushTimestamp, pushFailedTimestamp); err != nil {
+		t.Error(err)
+	}
+	if expected, got := time.Hour, dms.GetMetricFamiliesMap()[groupingKeyFor(grouping1)].TTL; expected != got {
+		t.Errorf("Wanted TTL %v, got %v.", expected, got)
+	}
+
+	// Only changed groups are written.
+	errCh := make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{Labels: grouping1, Timestamp: ts2, Done: errCh})
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+	dms.lock.RLock()
+	if expected, got := 1, len(dms.dirty); expected != got {
+		t.Errorf("Wanted %d dirty groups, got %d.", expected, got)
+	}
+	dms.lock.RUnlock()
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every group is a record.
+	db, err := bolt.Open(fileName, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(kvGroupsBucket).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := []string{groupingKeyFor(grouping2)}, keys; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted keys %q, got %q.", expected, got)
+	}
+
+	// A newer format version must neither be loaded nor overwritten.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		version := make([]byte, 4)
+		binary.LittleEndian.PutUint32(version, persistenceFormatVersion+1)
+		return tx.Bucket(kvMetaBucket).Put(kvVersionKey, version)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	dms, err = NewKVMetricStore(fileName, time.Hour, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.Ready(); err == nil {
+		t.Error("Expected store not to be ready.")
+	}
+	if err := dms.Shutdown(); err == nil {
+		t.Error("Expected error on shutdown.")
+	}
+}
+
+func TestBackends(t *testing.T) {
+	if expected, got := []string{BoltBackend, FileBackend}, Backends(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted backends %q, got %q.", expected, got)
+	}
+	if _, err := NewMetricStore("unknown", BackendConfig{}); err == nil {
+		t.Error("Expected error for unknown backend.")
+	}
+}
+
+func TestConditionalWriteRequests(t *testing.T) {
+	ts := time.Now()
+	grouping1 := map[string]string{"job": "job1", "instance": "instance1"}
+	grouping2 := map[string]string{"job": "job1", "instance": "instance2"}
+	writeRequests := func() []WriteRequest {
+		return []WriteRequest{
+			{Labels: grouping1, Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(mf3)},
+			{Labels: grouping1, Timestamp: ts.Add(2 * time.Second), MetricFamilies: testutil.MetricFamiliesMap(mf2), Replace: true},
+			// Older than the replace.
+			{Labels: grouping1, Timestamp: ts.Add(time.Second), MetricFamilies: testutil.MetricFamiliesMap(mf1a)},
+			{Labels: grouping1, Timestamp: ts.Add(3 * time.Second), MetricFamilies: testutil.MetricFamiliesMap(mf1b)},
+			{Labels: grouping2, Timestamp: ts.Add(3 * time.Second), MetricFamilies: testutil.MetricFamiliesMap(mf3)},
+			{Labels: grouping2, Timestamp: ts.Add(4 * time.Second)},
+			// Deletes what the replace has pushed, but not the push
+			// timestamp.
+			{Labels: grouping1, Timestamp: ts.Add(2500 * time.Millisecond), DeleteFamilies: []string{"mf2", pushMetricName}},
+		}
+	}
+	pushTimestamp := newPushTimestampGauge(grouping1, ts.Add(3*time.Second))
+	pushFailedTimestamp := newPushFailedTimestampGauge(grouping1, time.Time{})
+
+	// Every order, applied twice, has to result in the same state.
+	var permute func(order []int, n int)
+	permute = func(order []int, n int) {
+		if n == 1 {
+			dms := &DiskMetricStore{
+				metricGroups:     GroupingKeyToMetricGroup{},
+				tombstones:       map[string]time.Time{},
+				familyTombstones: map[string]map[string]time.Time{},
+				tenantUsage:      map[string]*tenantUsage{},
+				groupUsage:       map[string]groupUsage{},
+				logger:           logger,
+			}
+			for i := 0; i < 2; i++ {
+				wrs := writeRequests()
+				for _, j := range order {
+					wrs[j].Conditional = true
+					dms.processWriteRequest(wrs[j])
+				}
+			}
+			if err := checkMetricFamilies(dms, mf1b, pushTimestamp, pushFailedTimestamp); err != nil {
+				t.Errorf("Order %v: %s", order, err)
+			}
+			return
+		}
+		// Heap's algorithm.
+		for i := 0; i < n-1; i++ {
+			permute(order, n-1)
+			if n%2 == 0 {
+				order[i], order[n-1] = order[n-1], order[i]
+			} else {
+				order[0], order[n-1] = order[n-1], order[0]
+			}
+		}
+		permute(order, n-1)
+	}
+	permute([]int{0, 1, 2, 3, 4, 5, 6}, 7)
+
+	// Tombstones are pruned eventually.
+	dms := &DiskMetricStore{
+		metricGroups:     GroupingKeyToMetricGroup{},
+		tombstones:       map[string]time.Time{},
+		familyTombstones: map[string]map[string]time.Time{},
+		tenantUsage:      map[string]*tenantUsage{},
+		groupUsage:       map[string]groupUsage{},
+		logger:           logger,
+	}
+	dms.processWriteRequest(WriteRequest{Labels: grouping2, Timestamp: ts, Conditional: true})
+	dms.processWriteRequest(WriteRequest{Labels: grouping1, Timestamp: ts, DeleteFamilies: []string{"mf2"}, Conditional: true})
+	dms.pruneTombstones(ts.Add(tombstoneRetention))
+	if expected, got := 1, len(dms.tombstones); expected != got {
+		t.Errorf("Wanted %d tombstones, got %d.", expected, got)
+	}
+	if expected, got := 1, len(dms.familyTombstones); expected != got {
+		t.Errorf("Wanted %d groups with family tombstones, got %d.", expected, got)
+	}
+	dms.pruneTombstones(ts.Add(2 * tombstoneRetention))
+	if expected, got := 0, len(dms.tombstones); expected != got {
+		t.Errorf("Wanted %d tombstones, got %d.", expected, got)
+	}
+	if expected, got := 0, len(dms.familyTombstones); expected != got {
+		t.Errorf("Wanted %d groups with family tombstones, got %d.", expected, got)
+	}
+}
+
+func TestDeleteFamilies(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestDeleteFamilies.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger, WithWAL(true))
+
+	ts1 := time.Now()
+	ts2 := ts1.Add(time.Second)
+	grouping1 := map[string]string{"job": "job1", "instance": "instance1"}
+	grouping2 := map[string]string{"job": "job1", "instance": "instance2"}
+	for _, wr := range []WriteRequest{
+		{Labels: grouping2, Timestamp: ts1, MetricFamilies: testutil.MetricFamiliesMap(proto.Clone(mf1a).(*dto.MetricFamily), mf2)},
+		{Labels: grouping2, Timestamp: ts2, DeleteFamilies: []string{"mf1", "nonexistent", pushMetricName, pushFailedMetricName}},
+		// Deleting families from a group that does not exist is a no-op.
+		{Labels: grouping1, Timestamp: ts2, DeleteFamilies: []string{"mf1"}},
+	} {
+		errCh := make(chan error, 1)
+		wr.Done = errCh
+		dms.SubmitWriteRequest(wr)
+		for err := range errCh {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+	expected := []*dto.MetricFamily{
+		mf2,
+		newPushTimestampGauge(grouping2, ts1),
+		newPushFailedTimestampGauge(grouping2, time.Time{}),
+	}
+	if err := checkMetricFamilies(dms, expected...); err != nil {
+		t.Error(err)
+	}
+	if expected, got := 1, len(dms.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Wanted %d groups, got %d.", expected, got)
+	}
+
+	// The delete is replayed from the WAL. (The first dms is never shut
+	// down.)
+	dms2 := NewDiskMetricStore(fileName, time.Hour, nil, logger, WithWAL(true))
+	if err := checkMetricFamilies(dms2, expected...); err != nil {
+		t.Error(err)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseMatchers(t *testing.T) {
+	scenarios := []struct {
+		in       string
+		expected []string // In Matcher.String form. Nil means error.
+	}{
+		{
+			in:       `{job="job1"}`,
+			expected: []string{`job="job1"`},
+		},
+		{
+			in:       ` { job = "job1" , instance!~"in.*",env=~` + "`pr\\.od`" + `, zone!="a\"b", } `,
+			expected: []string{`job="job1"`, `instance!~"in.*"`, `env=~"pr\\.od"`, `zone!="a\"b"`},
+		},
+		{in: `job="job1"`},              // No braces.
+		{in: `up{job="job1"}`},          // Metric name.
+		{in: `{}`},                      // Matches everything.
+		{in: `{job=~".*",instance=""}`}, // Matches everything, too.
+		{in: `{job="job1" instance="a"}`},
+		{in: `{job=="job1"}`},
+		{in: `{job="job1}`},
+		{in: `{1job="job1"}`},
+		{in: `{job=~"("}`},
+	}
+
+	for _, s := range scenarios {
+		matchers, err := ParseMatchers(s.in)
+		if s.expected == nil {
+			if err == nil {
+				t.Errorf("Expected error parsing %q, got %v.", s.in, matchers)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", s.in, err)
+			continue
+		}
+		var got []string
+		for _, m := range matchers {
+			got = append(got, m.String())
+		}
+		if !reflect.DeepEqual(s.expected, got) {
+			t.Errorf("Parsing %q: Wanted %q, got %q.", s.in, s.expected, got)
+		}
+	}
+}
+
+func TestDeleteMatching(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestDeleteMatching.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger, WithWAL(true))
+
+	ts := time.Now()
+	grouping1 := map[string]string{"job": "job1", "instance": "instance1"}
+	grouping2 := map[string]string{"job": "job1", "instance": "instance2"}
+	grouping3 := map[string]string{"job": "job2", "instance": "instance1"}
+	grouping4 := map[string]string{"job": "job2", "instance": "instance2", "env": "prod"}
+	for _, grouping := range []map[string]string{grouping1, grouping2, grouping3, grouping4} {
+		errCh := make(chan error, 1)
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         grouping,
+			Timestamp:      ts,
+			MetricFamilies: testutil.MetricFamiliesMap(proto.Clone(mf3).(*dto.MetricFamily)),
+			Done:           errCh,
+		})
+		for err := range errCh {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+
+	var matcherSets [][]*Matcher
+	for _, selector := range []string{`{job="job1",instance!="instance2"}`, `{env="prod"}`} {
+		matchers, err := ParseMatchers(selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	errCh := make(chan error, 1)
+	result := &WriteResult{}
+	dms.SubmitWriteRequest(WriteRequest{
+		Timestamp:   ts.Add(time.Second),
+		MatcherSets: matcherSets,
+		Done:        errCh,
+		Result:      result,
+	})
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+	if expected, got := 2, result.DeletedGroups; expected != got {
+		t.Errorf("Wanted %d deleted groups, got %d.", expected, got)
+	}
+
+	check := func(dms *DiskMetricStore) {
+		groups := dms.GetMetricFamiliesMap()
+		if expected, got := 2, len(groups); expected != got {
+			t.Errorf("Wanted %d groups, got %d.", expected, got)
+		}
+		for _, grouping := range []map[string]string{grouping2, grouping3} {
+			if _, ok := groups[groupingKeyFor(grouping)]; !ok {
+				t.Errorf("Group %v has been deleted.", grouping)
+			}
+		}
+	}
+	check(dms)
+	// The deletes are replayed from the WAL. (The first dms is never shut
+	// down.)
+	dms2 := NewDiskMetricStore(fileName, time.Hour, nil, logger, WithWAL(true))
+	check(dms2)
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestBatch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	cfg := QuotaConfig{DefaultTenant: {MaxGroups: 3}}
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger, WithWAL(true), WithQuotas(cfg))
+
+	ts := time.Now()
+	parse := func(text string) map[string]*dto.MetricFamily {
+		var parser expfmt.TextParser
+		mfs, err := parser.TextToMetricFamilies(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mfs
+	}
+	pushBatch := func(batch ...WriteRequest) (*WriteResult, error) {
+		ts = ts.Add(time.Second)
+		for i := range batch {
+			batch[i].Timestamp = ts
+		}
+		errCh := make(chan error, 1)
+		result := &WriteResult{}
+		dms.SubmitWriteRequest(WriteRequest{
+			Timestamp: ts,
+			Batch:     batch,
+			Done:      errCh,
+			Result:    result,
+		})
+		var err error
+		for err = range errCh {
+		}
+		return result, err
+	}
+	job1 := func(instance string) map[string]string {
+		return map[string]string{"job": "job1", "instance": instance}
+	}
+
+	result, err := pushBatch(
+		WriteRequest{Labels: job1("a"), MetricFamilies: parse("a 1\n")},
+		WriteRequest{Labels: job1("b"), MetricFamilies: parse("a 2\n")},
+	)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if expected, got := []error{nil, nil}, result.BatchErrors; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted batch errors %v, got %v.", expected, got)
+	}
+
+	result, err = pushBatch(
+		WriteRequest{Labels: job1("a"), MetricFamilies: parse("a 3\n"), Replace: true},
+		WriteRequest{Labels: job1("c"), MetricFamilies: parse("b 1\n")},
+		// Exceeds the group quota only because of the push before.
+		WriteRequest{Labels: job1("d"), MetricFamilies: parse("b 1\n")},
+		// Inconsistent with group a.
+		WriteRequest{Labels: job1("b"), MetricFamilies: parse("# TYPE a counter\na 1\n")},
+		// Not a push.
+		WriteRequest{Labels: job1("a")},
+	)
+	if err == nil {
+		t.Error("Expected error.")
+	}
+	for i, invalid := range []bool{false, false, true, true, true} {
+		if got := result.BatchErrors[i]; invalid != (got != nil) {
+			t.Errorf("Push %d: Wanted invalid %t, got error %v.", i, invalid, got)
+		}
+	}
+
+	check := func(dms *DiskMetricStore) {
+		groups := dms.GetMetricFamiliesMap()
+		if _, ok := groups[groupingKeyFor(job1("c"))]; ok {
+			t.Error("Group c of the rejected batch has been created.")
+		}
+		a := groups[groupingKeyFor(job1("a"))]
+		if expected, got := 1., a.Metrics["a"].GetMetricFamily().GetMetric()[0].GetUntyped().GetValue(); expected != got {
+			t.Errorf("Wanted value %f in group a, got %f.", expected, got)
+		}
+		if !a.LastPushSuccess() {
+			t.Error("Wanted last push to group a to be successful.")
+		}
+		// Invalid pushes have set the push failure timestamp, which
+		// creates group d as it is within the group quota on its own.
+		for _, instance := range []string{"b", "d"} {
+			if groups[groupingKeyFor(job1(instance))].LastPushSuccess() {
+				t.Errorf("Wanted last push to group %s to have failed.", instance)
+			}
+		}
+		if expected, got := 3, len(groups); expected != got {
+			t.Errorf("Wanted %d groups, got %d.", expected, got)
+		}
+	}
+	check(dms)
+	// The batches are replayed from the WAL. (The first dms is never shut
+	// down.)
+	dms2 := NewDiskMetricStore(fileName, time.Hour, nil, logger, WithWAL(true), WithQuotas(cfg))
+	check(dms2)
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestAggregation.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	configFile := path.Join(tempDir, "aggregation")
+	if err := ioutil.WriteFile(configFile, []byte("# Batch jobs.\njob1: sum\n\njob2:none\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadAggregationConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := (AggregationConfig{"job1": AggregationSum, "job2": AggregationNone}), cfg; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted aggregation config %v, got %v.", expected, got)
+	}
+	for _, content := range []string{"job1:sum\njob1:max\n", "job1:average\n", "job1\n"} {
+		if err := ioutil.WriteFile(configFile, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadAggregationConfig(configFile); err == nil {
+			t.Errorf("Expected error loading aggregation config %q.", content)
+		}
+	}
+
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger, WithWAL(true))
+	ams := NewAggregatingMetricStore(dms, cfg)
+
+	ts := time.Now()
+	grouping := map[string]string{"job": "job1", "instance": "instance1"}
+	push := func(text string, aggregation Aggregation) error {
+		var parser expfmt.TextParser
+		mfs, err := parser.TextToMetricFamilies(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts = ts.Add(time.Second)
+		errCh := make(chan error, 1)
+		ams.SubmitWriteRequest(WriteRequest{
+			Labels:         grouping,
+			Timestamp:      ts,
+			MetricFamilies: mfs,
+			Aggregation:    aggregation,
+			Done:           errCh,
+		})
+		for err = range errCh {
+		}
+		return err
+	}
+	// metric returns the metric of the provided family with the provided
+	// value of the label "code", or the first one if code is empty.
+	metric := func(ms MetricStore, name, code string) *dto.Metric {
+		t.Helper()
+		mf := ms.GetMetricFamiliesMap()[groupingKeyFor(grouping)].Metrics[name].GetMetricFamily()
+		for _, m := range mf.GetMetric() {
+			if code == "" {
+				return m
+			}
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "code" && lp.GetValue() == code {
+					return m
+				}
+			}
+		}
+		t.Fatalf("Metric %s{code=%q} not found.", name, code)
+		return nil
+	}
+
+	// The first push has nothing to aggregate with.
+	if err := push(`# TYPE c counter
+c{code="200"} 1
+# TYPE g gauge
+g 5
+# TYPE h histogram
+h_bucket{le="1"} 1
+h_bucket{le="+Inf"} 2
+h_sum 3
+h_count 2
+# TYPE s summary
+s{quantile="0.5"} 1
+s_sum 1
+s_count 1
+`, ""); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	// The second one is aggregated as configured for job1.
+	if err := push(`# TYPE c counter
+c{code="200"} 2
+c{code="500"} 1
+# TYPE g gauge
+g 3
+# TYPE h histogram
+h_bucket{le="1"} 1
+h_bucket{le="+Inf"} 1
+h_sum 0.5
+h_count 1
+# TYPE s summary
+s{quantile="0.5"} 2
+s_sum 2
+s_count 1
+`, ""); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	check := func(ms MetricStore) {
+		t.Helper()
+		if expected, got := 3.0, metric(ms, "c", "200").GetCounter().GetValue(); expected != got {
+			t.Errorf("Wanted c{code=\"200\"} %v, got %v.", expected, got)
+		}
+		if expected, got := 1.0, metric(ms, "c", "500").GetCounter().GetValue(); expected != got {
+			t.Errorf("Wanted c{code=\"500\"} %v, got %v.", expected, got)
+		}
+		if expected, got := 8.0, metric(ms, "g", "").GetGauge().GetValue(); expected != got {
+			t.Errorf("Wanted g %v, got %v.", expected, got)
+		}
+		h := metric(ms, "h", "").GetHistogram()
+		if expected, got := []uint64{2, 3}, []uint64{h.GetBucket()[0].GetCumulativeCount(), h.GetBucket()[1].GetCumulativeCount()}; !reflect.DeepEqual(expected, got) {
+			t.Errorf("Wanted h buckets %v, got %v.", expected, got)
+		}
+		if expected, got := uint64(3), h.GetSampleCount(); expected != got {
+			t.Errorf("Wanted h_count %v, got %v.", expected, got)
+		}
+		if expected, got := 3.5, h.GetSampleSum(); expected != got {
+			t.Errorf("Wanted h_sum %v, got %v.", expected, got)
+		}
+		if expected, got := 2.0, metric(ms, "s", "").GetSummary().GetQuantile()[0].GetValue(); expected != got {
+			t.Errorf("Wanted s{quantile=\"0.5\"} %v, got %v.", expected, got)
+		}
+	}
+	check(dms)
+
+	// Incompatible pushes are rejected and leave the group alone.
+	for _, text := range []string{
+		"# TYPE c gauge\nc{code=\"200\"} 1\n",
+		"# TYPE h histogram\nh_bucket{le=\"2\"} 1\nh_bucket{le=\"+Inf\"} 1\nh_sum 1\nh_count 1\n",
+	} {
+		if err := push(text, ""); err == nil {
+			t.Errorf("Expected error pushing %q.", text)
+		}
+	}
+	check(dms)
+
+	// Pushes that cannot be aggregated when applied (bypassing the check
+	// here) are rejected, too, and only set the push failure timestamp.
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(strings.NewReader("# TYPE g counter\ng 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts = ts.Add(time.Second)
+	if err := dms.processWriteRequest(WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: mfs,
+		Aggregation:    AggregationSum,
+	}); err == nil {
+		t.Error("Expected error applying a push that cannot be aggregated.")
+	}
+	check(dms)
+	if expected, got := float64(ts.UnixNano())/1e9, metric(dms, pushFailedMetricName, "").GetGauge().GetValue(); expected != got {
+		t.Errorf("Wanted push failure timestamp %v, got %v.", expected, got)
+	}
+
+	// The aggregated values are replayed from the WAL without being
+	// aggregated again. (The first dms is never shut down.)
+	dms2 := NewDiskMetricStore(fileName, time.Hour, nil, logger, WithWAL(true))
+	check(dms2)
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Gauges follow the aggregation of the push.
+	for _, tc := range []struct {
+		aggregation Aggregation
+		value       float64
+		expected    float64
+	}{
+		{AggregationMax, 3, 8},
+		{AggregationMin, 3, 3},
+		{AggregationSum, 2, 5},
+		{AggregationLast, 7, 7},
+		{AggregationNone, 4, 4},
+	} {
+		if err := push(fmt.Sprintf("# TYPE g gauge\ng %v\n", tc.value), tc.aggregation); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if got := metric(dms, "g", "").GetGauge().GetValue(); tc.expected != got {
+			t.Errorf("Aggregation %s: Wanted g %v, got %v.", tc.aggregation, tc.expected, got)
+		}
+	}
+	// Without aggregation, counters are replaced.
+	if err := push("# TYPE c counter\nc{code=\"200\"} 1\n", AggregationNone); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if expected, got := 1, len(dms.GetMetricFamiliesMap()[groupingKeyFor(grouping)].Metrics["c"].GetMetricFamily().GetMetric()); expected != got {
+		t.Errorf("Wanted %d metrics in c, got %d.", expected, got)
+	}
+	if expected, got := 1.0, metric(dms, "c", "200").GetCounter().GetValue(); expected != got {
+		t.Errorf("Wanted c{code=\"200\"} %v, got %v.", expected, got)
+	}
+}
+
+func TestSyncWriteRequests(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestSyncWriteRequests.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	grouping := map[string]string{"job": "job1", "instance": "instance1"}
+	for _, s := range []struct {
+		name string
+		file string
+		opts []Option
+	}{
+		{"no persistence", "", nil},
+		{"persistence file", path.Join(tempDir, "file"), nil},
+		{"WAL", path.Join(tempDir, "wal"), []Option{WithWAL(true)}},
+	} {
+		// The persistence interval is long enough to never persist
+		// unless forced to.
+		dms := NewDiskMetricStore(s.file, time.Hour, nil, logger, s.opts...)
+		errCh := make(chan error, 1)
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         grouping,
+			Timestamp:      time.Now(),
+			MetricFamilies: testutil.MetricFamiliesMap(proto.Clone(mf3).(*dto.MetricFamily)),
+			Sync:           true,
+			Done:           errCh,
+		})
+		done := time.After(10 * time.Second)
+	wait:
+		for {
+			select {
+			case err, ok := <-errCh:
+				if !ok {
+					break wait
+				}
+				t.Errorf("%s: Unexpected error: %s", s.name, err)
+			case <-done:
+				t.Fatalf("%s: Timed out waiting for the synchronous write request.", s.name)
+			}
+		}
+
+		// A new store finds the pushed metrics, even though the
+		// first one is not shut down.
+		if s.file != "" {
+			dms2 := NewDiskMetricStore(s.file, time.Hour, nil, logger, s.opts...)
+			if _, ok := dms2.GetMetricFamiliesMap()[groupingKeyFor(grouping)]; !ok {
+				t.Errorf("%s: Pushed group is not durable.", s.name)
+			}
+			if err := dms2.Shutdown(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestShutdownDrainsWriteQueue(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestShutdownDrainsWriteQueue.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	// Hold the lock so that the WriteRequests queue up and (most of them)
+	// are only processed while draining.
+	dms.lock.Lock()
+	ts := time.Now()
+	var errChs []chan error
+	submit := func(job string, mf *dto.MetricFamily, sync bool) {
+		errCh := make(chan error, 1)
+		errChs = append(errChs, errCh)
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": job},
+			Timestamp:      ts,
+			MetricFamilies: testutil.MetricFamiliesMap(proto.Clone(mf).(*dto.MetricFamily)),
+			Sync:           sync,
+			Done:           errCh,
+		})
+	}
+	submit("job1", mf3, false)
+	submit("job2", mf3, false)
+	submit("job3", mf3, true)
+	submit("job4", mfgc, false) // Inconsistent.
+	shutdownErr := make(chan error)
+	go func() { shutdownErr <- dms.Shutdown() }()
+	time.Sleep(10 * time.Millisecond) // Let the loop notice the shutdown.
+	dms.lock.Unlock()
+
+	timeout := time.After(10 * time.Second)
+	for i, errCh := range errChs {
+		var err error
+	wait:
+		for {
+			select {
+			case e, ok := <-errCh:
+				if !ok {
+					break wait
+				}
+				err = e
+			case <-timeout:
+				t.Fatalf("WriteRequest %d not done.", i)
+			}
+		}
+		if rejected := i == 3; rejected != (err != nil) {
+			t.Errorf("WriteRequest %d: Wanted rejected %t, got error %v.", i, rejected, err)
+		}
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatal(err)
+	}
+
+	dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	defer dms.Shutdown()
+	groups := dms.GetMetricFamiliesMap()
+	for _, job := range []string{"job1", "job2", "job3"} {
+		if _, ok := groups[groupingKeyFor(map[string]string{"job": job})].Metrics["mf3"]; !ok {
+			t.Errorf("Pushed metrics of %s not persisted.", job)
+		}
+	}
+	if _, ok := groups[groupingKeyFor(map[string]string{"job": "job4"})].Metrics["go_goroutines"]; ok {
+		t.Error("Inconsistent push applied.")
+	}
+}
+
 func TestNoPersistence(t *testing.T) {
 	dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
 
@@ -991,6 +2314,212 @@ func TestRejectTimestamps(t *testing.T) {
 	}
 }
 
+func TestTimestampPolicy(t *testing.T) {
+	ts := time.Now()
+	grouping := map[string]string{
+		"job":      "job1",
+		"instance": "instance2",
+	}
+	recent := proto.Clone(mf1ts).(*dto.MetricFamily)
+	recent.Metric[0].TimestampMs = proto.Int64(ts.Add(-time.Minute).UnixNano() / int64(time.Millisecond))
+	stripped := proto.Clone(mf1ts).(*dto.MetricFamily)
+	stripped.Metric[0].TimestampMs = nil
+
+	scenarios := []struct {
+		policy   TimestampPolicy
+		maxAge   time.Duration
+		pushed   *dto.MetricFamily
+		expected *dto.MetricFamily // nil if the push is rejected.
+	}{
+		{TimestampsReject, 0, mf1ts, nil},
+		{TimestampsStrip, 0, mf1ts, stripped},
+		{TimestampsKeep, 0, mf1ts, mf1ts},
+		{TimestampsKeep, time.Hour, mf1ts, nil},
+		{TimestampsKeep, time.Hour, recent, recent},
+	}
+	for _, s := range scenarios {
+		dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger, WithTimestampPolicy(s.policy, s.maxAge))
+		strippedBefore := promtestutil.ToFloat64(strippedTimestamps)
+		errCh := make(chan error, 1)
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         grouping,
+			Timestamp:      ts,
+			MetricFamilies: testutil.MetricFamiliesMap(proto.Clone(s.pushed).(*dto.MetricFamily)),
+			Done:           errCh,
+		})
+		var err error
+		for err = range errCh {
+		}
+		if s.expected == nil {
+			if err == nil {
+				t.Errorf("Policy %s, max age %s: Expected error on pushing metric with timestamp.", s.policy, s.maxAge)
+			}
+			if err := checkMetricFamilies(
+				dms,
+				newPushTimestampGauge(grouping, time.Time{}), newPushFailedTimestampGauge(grouping, ts),
+			); err != nil {
+				t.Errorf("Policy %s, max age %s: %s", s.policy, s.maxAge, err)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("Policy %s, max age %s: Unexpected error: %s", s.policy, s.maxAge, err)
+			}
+			if err := checkMetricFamilies(
+				dms, s.expected,
+				newPushTimestampGauge(grouping, ts), newPushFailedTimestampGauge(grouping, time.Time{}),
+			); err != nil {
+				t.Errorf("Policy %s, max age %s: %s", s.policy, s.maxAge, err)
+			}
+		}
+		expectedStripped := 0.0
+		if s.policy == TimestampsStrip {
+			expectedStripped = 1
+		}
+		if got := promtestutil.ToFloat64(strippedTimestamps) - strippedBefore; expectedStripped != got {
+			t.Errorf("Policy %s, max age %s: Wanted %v stripped timestamps, got %v.", s.policy, s.maxAge, expectedStripped, got)
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestQuotas.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	configFile := path.Join(tempDir, "quotas")
+	if err := ioutil.WriteFile(configFile, []byte(`# Small by default.
+*: groups=2, series_per_group=3, series=4, body_bytes=1KB
+alice:groups=1
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadQuotaConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedCfg := QuotaConfig{
+		DefaultTenant: {MaxGroups: 2, MaxSeriesPerGroup: 3, MaxSeries: 4, MaxBodyBytes: 1024},
+		"alice":       {MaxGroups: 1},
+	}
+	if !reflect.DeepEqual(expectedCfg, cfg) {
+		t.Errorf("Wanted quota config %v, got %v.", expectedCfg, cfg)
+	}
+	for _, content := range []string{"alice:groups=1\nalice:series=1\n", "alice:rows=1\n", "alice:groups=many\n", "alice\n"} {
+		if err := ioutil.WriteFile(configFile, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadQuotaConfig(configFile); err == nil {
+			t.Errorf("Expected error loading quota config %q.", content)
+		}
+	}
+
+	dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger, WithQuotas(cfg))
+	defer dms.Shutdown()
+	ts := time.Now()
+	push := func(wr WriteRequest, text string) error {
+		var parser expfmt.TextParser
+		mfs, err := parser.TextToMetricFamilies(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts = ts.Add(time.Second)
+		wr.Timestamp = ts
+		wr.MetricFamilies = mfs
+		errCh := make(chan error, 1)
+		wr.Done = errCh
+		dms.SubmitWriteRequest(wr)
+		for err = range errCh {
+		}
+		return err
+	}
+	job1 := func(instance string) map[string]string {
+		return map[string]string{"job": "job1", "instance": instance}
+	}
+
+	for _, s := range []struct {
+		name     string
+		wr       WriteRequest
+		text     string
+		rejected bool
+	}{
+		{"first group", WriteRequest{Labels: job1("a")}, "a 1\nb 1\n", false},
+		{"too many series in group", WriteRequest{Labels: job1("a")}, "c 1\nd 1\n", true},
+		{"replacing series", WriteRequest{Labels: job1("a"), Replace: true}, "c 1\nd 1\ne 1\n", false},
+		{"too many series in total", WriteRequest{Labels: job1("b")}, "a 1\nb 1\n", true},
+		{"second group", WriteRequest{Labels: job1("b")}, "a 1\n", false},
+		{"too many groups", WriteRequest{Labels: job1("c")}, "", true},
+		{"too large body", WriteRequest{Labels: job1("b"), BodySize: 1025}, "a 1\n", true},
+		{"histogram series", WriteRequest{Labels: job1("b")}, "# TYPE h histogram\nh_bucket{le=\"+Inf\"} 1\nh_sum 1\nh_count 1\n", true},
+		{"other job", WriteRequest{Labels: map[string]string{"job": "job2"}}, "a 1\n", false},
+		{"authenticated tenant", WriteRequest{Labels: map[string]string{"job": "job3"}, Tenant: "alice"}, "a 1\nb 1\nc 1\nd 1\ne 1\n", false},
+		{"too many groups for authenticated tenant", WriteRequest{Labels: map[string]string{"job": "job4"}, Tenant: "alice"}, "a 1\n", true},
+		{"taking over group of other tenant", WriteRequest{Labels: map[string]string{"job": "job2"}, Tenant: "alice"}, "a 1\n", true},
+		{"own group of authenticated tenant", WriteRequest{Labels: map[string]string{"job": "job3"}, Tenant: "alice"}, "a 2\n", false},
+	} {
+		err := push(s.wr, s.text)
+		if s.rejected && err == nil {
+			t.Errorf("%s: Expected error.", s.name)
+		}
+		if !s.rejected && err != nil {
+			t.Errorf("%s: Unexpected error: %s", s.name, err)
+		}
+	}
+	// Failed pushes have not created any groups.
+	if expected, got := 4, len(dms.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Wanted %d groups, got %d.", expected, got)
+	}
+
+	expected := `
+# HELP pushgateway_tenant_groups Number of groups currently stored for a tenant.
+# TYPE pushgateway_tenant_groups gauge
+pushgateway_tenant_groups{tenant="alice"} 1
+pushgateway_tenant_groups{tenant="job1"} 2
+pushgateway_tenant_groups{tenant="job2"} 1
+# HELP pushgateway_tenant_series Number of series currently stored for a tenant, excluding push timestamps.
+# TYPE pushgateway_tenant_series gauge
+pushgateway_tenant_series{tenant="alice"} 5
+pushgateway_tenant_series{tenant="job1"} 4
+pushgateway_tenant_series{tenant="job2"} 1
+`
+	if err := promtestutil.CollectAndCompare(dms, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	// Deletes free up the quota.
+	submit := func(wr WriteRequest) {
+		ts = ts.Add(time.Second)
+		wr.Timestamp = ts
+		errCh := make(chan error, 1)
+		wr.Done = errCh
+		dms.SubmitWriteRequest(wr)
+		for range errCh {
+		}
+	}
+	submit(WriteRequest{Labels: job1("a"), DeleteFamilies: []string{"c", "d"}})
+	submit(WriteRequest{Labels: job1("b")})
+	submit(WriteRequest{MatcherSets: [][]*Matcher{{{Name: "job", Value: "job2"}}}})
+	if err := push(WriteRequest{Labels: job1("c")}, "a 1\nb 1\nc 1\n"); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	expected = `
+# HELP pushgateway_tenant_groups Number of groups currently stored for a tenant.
+# TYPE pushgateway_tenant_groups gauge
+pushgateway_tenant_groups{tenant="alice"} 1
+pushgateway_tenant_groups{tenant="job1"} 2
+# HELP pushgateway_tenant_series Number of series currently stored for a tenant, excluding push timestamps.
+# TYPE pushgateway_tenant_series gauge
+pushgateway_tenant_series{tenant="alice"} 5
+pushgateway_tenant_series{tenant="job1"} 4
+`
+	if err := promtestutil.CollectAndCompare(dms, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestRejectInconsistentPush(t *testing.T) {
 	dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
 
@@ -1075,6 +2604,83 @@ func TestRejectInconsistentPush(t *testing.T) {
 	}
 }
 
+func TestExpiry(t *testing.T) {
+	dms := NewDiskMetricStore(
+		"", 100*time.Millisecond, nil, logger,
+		WithTTL(time.Hour),
+		func(dms *DiskMetricStore) { dms.expiryInterval = 10 * time.Millisecond },
+	)
+	defer dms.Shutdown()
+
+	before := &dto.Metric{}
+	if err := expiredGroups.Write(before); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	expired := map[string]string{"job": "job1", "instance": "expired"}
+	overridden := map[string]string{"job": "job1", "instance": "overridden"}
+	fresh := map[string]string{"job": "job1", "instance": "fresh"}
+	errCh := make(chan error, 1)
+	for _, wr := range []WriteRequest{
+		{Labels: expired, Timestamp: now.Add(-2 * time.Hour)},
+		{Labels: overridden, Timestamp: now.Add(-2 * time.Hour), TTL: 3 * time.Hour},
+		{Labels: fresh, Timestamp: now, Done: errCh},
+	} {
+		wr.MetricFamilies = testutil.MetricFamiliesMap(mf3)
+		dms.SubmitWriteRequest(wr)
+	}
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		groups := dms.GetMetricFamiliesMap()
+		if _, ok := groups[groupingKeyFor(expired)]; !ok {
+			if expected, got := 2, len(groups); expected != got {
+				t.Errorf("Wanted %d groups, got %d.", expected, got)
+			}
+			if _, ok := groups[groupingKeyFor(overridden)]; !ok {
+				t.Error("Group with TTL override has expired.")
+			}
+			if expected, got := 3*time.Hour, groups[groupingKeyFor(overridden)].TTL; expected != got {
+				t.Errorf("Wanted TTL %v, got %v.", expected, got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expired group has not been deleted.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	after := &dto.Metric{}
+	if err := expiredGroups.Write(after); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := before.GetCounter().GetValue()+1, after.GetCounter().GetValue(); expected != got {
+		t.Errorf("Wanted %v expired groups, got %v.", expected, got)
+	}
+
+	// Pushing without TTL resets the override to the default.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         overridden,
+		Timestamp:      now.Add(-2 * time.Hour),
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+	})
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := dms.GetMetricFamiliesMap()[groupingKeyFor(overridden)]; !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Group without TTL override has not been deleted.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestSanitizeLabels(t *testing.T) {
 	dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
 
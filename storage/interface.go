@@ -74,6 +74,11 @@ type MetricStore interface {
 // given Labels as a grouping key. Otherwise, this is a request to update the
 // MetricStore with the MetricFamilies.
 //
+// If MetricFamilies is nil but DeleteFamilies is not, only the metric families
+// with the names in DeleteFamilies are deleted from the group. The remaining
+// metric families and the push timestamps are kept, even if no other metric
+// families remain. The push timestamps themselves cannot be deleted that way.
+//
 // If Replace is true, the MetricFamilies will completely replace the metrics
 // with the same grouping key. Otherwise, only those MetricFamilies with the
 // same name as new MetricFamilies will be replaced.
@@ -88,18 +93,106 @@ type MetricStore interface {
 //
 // The Timestamp field marks the time the request was received from the
 // network. It is not related to the TimestampMs field in the Metric proto
-// message. In fact, WriteRequests containing any Metrics with a TimestampMs set
-// are invalid and will be rejected.
+// message. By default, WriteRequests containing any Metrics with a TimestampMs
+// set are invalid and will be rejected. (A DiskMetricStore may be configured to
+// strip or keep them instead, see WithTimestampPolicy.)
+//
+// If TTL is positive, the group expires and is deleted once it has not been
+// pushed to for that long. Otherwise, the default TTL of the MetricStore
+// applies (if any). Every push to a group sets its TTL anew. TTL is ignored for
+// delete requests.
+//
+// If Conditional is true, the WriteRequest is applied as if all conditional
+// WriteRequests had been applied in the order of their Timestamps, no matter in
+// which order they actually arrive: MetricFamilies stored with a newer
+// Timestamp are kept, and deletes and replaces leave a tombstone so that older
+// WriteRequests arriving later are ignored. Applying conditional WriteRequests
+// is thus idempotent and commutative, as needed to replicate them between
+// MetricStores. Tombstones are kept in memory only, and only for a limited
+// time.
+//
+// If MatcherSets is not nil, this is a request to delete all groups whose
+// grouping labels match all Matchers of at least one of the sets. Labels and
+// MetricFamilies are ignored then. All matching groups are deleted at once, i.e.
+// no other WriteRequest is processed in between. A conditional delete of that
+// kind only affects the groups present at the time it is applied.
+//
+// If Aggregation is enabled, the MetricFamilies are aggregated into the metric
+// families of the same name already stored in the group instead of replacing
+// them: Values of counters and histograms are added up, gauges and untyped
+// metrics are aggregated as selected by the Aggregation, and summaries are
+// replaced as usual. Metrics are matched by their label sets. A stored metric
+// family of a different type than the pushed one renders the WriteRequest
+// invalid. If Replace is true, metric families not in MetricFamilies are still
+// deleted. Aggregation happens in the MetricStore the WriteRequest is submitted
+// to. The aggregated values are what is logged to a WAL or replicated.
+//
+// If Batch is not nil, this is a request to apply all the WriteRequests in
+// Batch at once, i.e. no other WriteRequest is processed in between, and either
+// all of them are applied or, if any of them is invalid, none of them. Each
+// WriteRequest in Batch is checked as if the ones before it had been applied
+// already, and invalid ones update the push failure timestamp of their group as
+// usual. Only pushes, i.e. WriteRequests with MetricFamilies, can be part of a
+// Batch. Their Done, Result, Sync, and Conditional fields are ignored in favor
+// of those of the batch. All other fields of the batch are ignored. Unlike a
+// single push, a batch is checked for consistency with the existing metrics even
+// without a Done channel.
+//
+// Tenant is the authenticated client submitting the WriteRequest, if any. For
+// quotas, groups are accounted to the Tenant of the last push to them or, if
+// empty, to their job. BodySize is the size in bytes of the pushed body the
+// MetricFamilies were parsed from, if known. Both are only used to enforce
+// quotas, see WithQuotas.
 //
 // The Done channel may be nil. If it is not nil, it will be closed once the
 // write request is processed. Any errors occurring during processing are sent to
 // the channel before closing it.
+//
+// If Sync is true and the WriteRequest has been processed successfully, the
+// Done channel is only closed once the change is durable, i.e. once the WAL has
+// been synced or, without WAL, once the metrics have been persisted, which then
+// happens right away. Without any persistence, Sync has no effect. If the change
+// cannot be made durable, a DurabilityError is sent to the Done channel.
+//
+// Result may be nil. If it is not nil, the outcome of the processing is stored
+// in it before Done is closed.
 type WriteRequest struct {
 	Labels         map[string]string
 	Timestamp      time.Time
 	MetricFamilies map[string]*dto.MetricFamily
 	Replace        bool
+	TTL            time.Duration
+	Conditional    bool
+	DeleteFamilies []string
+	MatcherSets    [][]*Matcher
+	Aggregation    Aggregation
+	Batch          []WriteRequest
+	Tenant         string
+	BodySize       int64
+	Sync           bool
 	Done           chan error
+	Result         *WriteResult
+}
+
+// WriteResult is the outcome of a processed WriteRequest.
+type WriteResult struct {
+	// DeletedGroups is the number of groups deleted by a WriteRequest
+	// with MatcherSets.
+	DeletedGroups int
+	// BatchErrors holds the outcome of each WriteRequest in the Batch of
+	// a WriteRequest, in the same order: the error that makes it invalid,
+	// or nil. The batch has been applied if all of them are nil.
+	BatchErrors []error
+}
+
+// DurabilityError is sent to the Done channel of a processed WriteRequest with
+// Sync set if the change could not be made durable.
+type DurabilityError struct {
+	Err error
+}
+
+func (e DurabilityError) Error() string {
+	return "change processed but not persisted: " + e.Err.Error()
 }
 
 // GroupingKeyToMetricGroup is the first level of the metric store, keyed by
@@ -107,9 +200,24 @@ type WriteRequest struct {
 type GroupingKeyToMetricGroup map[string]MetricGroup
 
 // MetricGroup adds the grouping labels to a NameToTimestampedMetricFamilyMap.
+// TTL is the TTL set by the last push to the group (0 if none was set).
 type MetricGroup struct {
 	Labels  map[string]string
 	Metrics NameToTimestampedMetricFamilyMap
+	TTL     time.Duration
+}
+
+// LastUpdate returns the most recent push timestamp of all metric families in
+// the group, including the automatically added ones. Thus, failed pushes count
+// as updates, too.
+func (mg MetricGroup) LastUpdate() time.Time {
+	var last time.Time
+	for _, tmf := range mg.Metrics {
+		if tmf.Timestamp.After(last) {
+			last = tmf.Timestamp
+		}
+	}
+	return last
 }
 
 // SortedLabels returns the label names of the grouping labels sorted
@@ -0,0 +1,124 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	kvGroupsBucket = []byte("groups")
+	kvMetaBucket   = []byte("meta")
+	kvVersionKey   = []byte("version")
+)
+
+// kvStore persists every group as its own record in an embedded bbolt
+// database, keyed by grouping key. The records are protobuf encoded
+// SnapshotGroups, and the format version is stored in a separate bucket.
+type kvStore struct {
+	db *bolt.DB
+}
+
+func openKVStore(path string) (*kvStore, error) {
+	if path == "" {
+		return nil, errors.New("a persistence file is required for the embedded key-value store")
+	}
+	// The timeout prevents blocking forever if another process holds the
+	// database.
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &kvStore{db: db}, nil
+}
+
+// load reads all groups. A database of a newer format version results in a
+// newerFormatError, a record that cannot be decoded in a corruptedFileError.
+func (kv *kvStore) load() (GroupingKeyToMetricGroup, error) {
+	groups := GroupingKeyToMetricGroup{}
+	err := kv.db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(kvMetaBucket); meta != nil {
+			if v := meta.Get(kvVersionKey); len(v) == 4 {
+				if version := binary.LittleEndian.Uint32(v); version > persistenceFormatVersion {
+					return newerFormatError{version: version}
+				}
+			}
+		}
+		b := tx.Bucket(kvGroupsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			sg := &SnapshotGroup{}
+			if err := proto.Unmarshal(v, sg); err != nil {
+				return corruptedFileError{err: err}
+			}
+			group, err := sg.metricGroup()
+			if err != nil {
+				return corruptedFileError{err: err}
+			}
+			groups[string(k)] = group
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// write stores the provided groups by grouping key in a single transaction. A
+// nil group deletes the record.
+func (kv *kvStore) write(groups map[string]*SnapshotGroup) error {
+	return kv.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(kvMetaBucket)
+		if err != nil {
+			return err
+		}
+		version := make([]byte, 4)
+		binary.LittleEndian.PutUint32(version, persistenceFormatVersion)
+		if err := meta.Put(kvVersionKey, version); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists(kvGroupsBucket)
+		if err != nil {
+			return err
+		}
+		for key, sg := range groups {
+			if sg == nil {
+				if err := b.Delete([]byte(key)); err != nil {
+					return err
+				}
+				continue
+			}
+			v, err := proto.Marshal(sg)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (kv *kvStore) close() error {
+	return kv.db.Close()
+}
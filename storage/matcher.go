@@ -0,0 +1,202 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// MatchType is the type of a Matcher.
+type MatchType int
+
+// The match types, as known from Prometheus.
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+var matchTypeStrings = map[MatchType]string{
+	MatchEqual:     "=",
+	MatchNotEqual:  "!=",
+	MatchRegexp:    "=~",
+	MatchNotRegexp: "!~",
+}
+
+func (t MatchType) String() string {
+	if s, ok := matchTypeStrings[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("MatchType(%d)", int(t))
+}
+
+// Matcher matches the value of a grouping label. As in Prometheus, a missing
+// label is treated like a label with an empty value, and regular expressions
+// are fully anchored.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewMatcher returns a Matcher, or an error if the label name or the regular
+// expression is invalid.
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	if !model.LabelName(name).IsValid() {
+		return nil, fmt.Errorf("invalid label name %q", name)
+	}
+	m := &Matcher{Type: t, Name: name, Value: value}
+	switch t {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	default:
+		return nil, fmt.Errorf("invalid match type %d", int(t))
+	}
+	return m, nil
+}
+
+// Matches returns whether the Matcher matches the provided label value.
+func (m *Matcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+func (m *Matcher) String() string {
+	return m.Name + m.Type.String() + strconv.Quote(m.Value)
+}
+
+// matchesAll returns whether all the matchers match the provided labels.
+func matchesAll(matchers []*Matcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		if !m.Matches(labels[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseMatchers parses a selector of the form {name="value", ...} with the
+// match types =, !=, =~, and !~, as used in the match[] parameter of the
+// Prometheus API. Values are quoted with double quotes or backticks. Metric
+// names are not supported, as grouping keys have none. To prevent deleting
+// everything by accident, at least one of the matchers must not match the empty
+// string.
+func ParseMatchers(s string) ([]*Matcher, error) {
+	in := strings.TrimSpace(s)
+	if !strings.HasPrefix(in, "{") || !strings.HasSuffix(in, "}") {
+		return nil, fmt.Errorf("selector %q must be enclosed in braces", s)
+	}
+	in = in[1 : len(in)-1]
+
+	var matchers []*Matcher
+	for {
+		in = strings.TrimLeft(in, " \t\n")
+		if in == "" {
+			break
+		}
+		i := 0
+		for i < len(in) && isLabelNameChar(in[i], i == 0) {
+			i++
+		}
+		name := in[:i]
+		in = strings.TrimLeft(in[i:], " \t\n")
+
+		var t MatchType
+		switch {
+		case strings.HasPrefix(in, "=~"):
+			t = MatchRegexp
+		case strings.HasPrefix(in, "!="):
+			t = MatchNotEqual
+		case strings.HasPrefix(in, "!~"):
+			t = MatchNotRegexp
+		case strings.HasPrefix(in, "="):
+			t = MatchEqual
+		default:
+			return nil, fmt.Errorf("selector %q: expected match type after label name %q", s, name)
+		}
+		in = strings.TrimLeft(in[len(t.String()):], " \t\n")
+
+		value, rest, err := unquotePrefix(in)
+		if err != nil {
+			return nil, fmt.Errorf("selector %q: invalid value for label name %q: %v", s, name, err)
+		}
+		m, err := NewMatcher(t, name, value)
+		if err != nil {
+			return nil, fmt.Errorf("selector %q: %v", s, err)
+		}
+		matchers = append(matchers, m)
+
+		in = strings.TrimLeft(rest, " \t\n")
+		if in == "" {
+			break
+		}
+		if in[0] != ',' {
+			return nil, fmt.Errorf("selector %q: expected comma after matcher %s", s, m)
+		}
+		in = in[1:]
+	}
+
+	for _, m := range matchers {
+		if !m.Matches("") {
+			return matchers, nil
+		}
+	}
+	return nil, fmt.Errorf("selector %q: at least one matcher must not match the empty string", s)
+}
+
+func isLabelNameChar(b byte, first bool) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (!first && b >= '0' && b <= '9')
+}
+
+// unquotePrefix unquotes the quoted string at the start of s and returns it
+// together with the remainder of s.
+func unquotePrefix(s string) (value, rest string, err error) {
+	if s == "" || (s[0] != '"' && s[0] != '`') {
+		return "", "", errors.New("expected quoted string")
+	}
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quote == '"':
+			i++ // Skip the escaped character.
+		case s[i] == quote:
+			value, err := strconv.Unquote(s[:i+1])
+			return value, s[i+1:], err
+		}
+	}
+	return "", "", errors.New("unterminated quoted string")
+}
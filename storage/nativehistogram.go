@@ -0,0 +1,487 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Field numbers of the native histogram fields of dto.Histogram in later
+// versions of the client data model.
+const (
+	sampleCountFloatField protowire.Number = 4
+	schemaField           protowire.Number = 5
+	zeroThresholdField    protowire.Number = 6
+	zeroCountField        protowire.Number = 7
+	zeroCountFloatField   protowire.Number = 8
+	negativeSpanField     protowire.Number = 9
+	negativeDeltaField    protowire.Number = 10
+	negativeCountField    protowire.Number = 11
+	positiveSpanField     protowire.Number = 12
+	positiveDeltaField    protowire.Number = 13
+	positiveCountField    protowire.Number = 14
+	exemplarsField        protowire.Number = 16
+
+	bucketSpanOffsetField protowire.Number = 1
+	bucketSpanLengthField protowire.Number = 2
+)
+
+// The valid range of native histogram schemas.
+const (
+	MinNativeHistogramSchema = -4
+	MaxNativeHistogramSchema = 8
+)
+
+// BucketSpan is a range of consecutive buckets of a NativeHistogram. Offset is
+// the gap to the end of the previous span (or, for the first span, the index
+// of its first bucket).
+type BucketSpan struct {
+	Offset int32
+	Length uint32
+}
+
+// NativeHistogram holds the fields of a native (also called sparse) histogram.
+// The client data model used by the Pushgateway does not know them yet, so
+// they are kept as unknown fields of dto.Histogram, which survive persistence
+// and are exposed unchanged in the protobuf format. Use GetNativeHistogram and
+// SetNativeHistogram to access them.
+//
+// Buckets of integer histograms are delta encoded in NegativeDeltas and
+// PositiveDeltas (each delta relative to the previous bucket), while float
+// histograms have absolute counts in NegativeCounts and PositiveCounts and
+// use the float versions of the sample and zero count.
+type NativeHistogram struct {
+	SampleCountFloat float64
+	Schema           int32
+	ZeroThreshold    float64
+	ZeroCount        uint64
+	ZeroCountFloat   float64
+	NegativeSpans    []BucketSpan
+	NegativeDeltas   []int64
+	NegativeCounts   []float64
+	PositiveSpans    []BucketSpan
+	PositiveDeltas   []int64
+	PositiveCounts   []float64
+	Exemplars        []*dto.Exemplar
+}
+
+// IsFloat returns whether nh is a float histogram.
+func (nh *NativeHistogram) IsFloat() bool {
+	return nh.SampleCountFloat != 0 || nh.ZeroCountFloat != 0 ||
+		len(nh.NegativeCounts) > 0 || len(nh.PositiveCounts) > 0
+}
+
+// NativeBucket is a bucket of a NativeHistogram with its absolute count.
+type NativeBucket struct {
+	Lower, Upper float64
+	Count        float64
+}
+
+// NegativeBuckets returns the negative buckets of nh with their boundaries
+// and absolute counts, starting with the one closest to zero.
+func (nh *NativeHistogram) NegativeBuckets() []NativeBucket {
+	buckets := nativeBuckets(nh.Schema, nh.NegativeSpans, nh.NegativeDeltas, nh.NegativeCounts)
+	for i, b := range buckets {
+		buckets[i].Lower, buckets[i].Upper = -b.Upper, -b.Lower
+	}
+	return buckets
+}
+
+// PositiveBuckets returns the positive buckets of nh with their boundaries
+// and absolute counts, starting with the one closest to zero.
+func (nh *NativeHistogram) PositiveBuckets() []NativeBucket {
+	return nativeBuckets(nh.Schema, nh.PositiveSpans, nh.PositiveDeltas, nh.PositiveCounts)
+}
+
+func nativeBuckets(schema int32, spans []BucketSpan, deltas []int64, counts []float64) []NativeBucket {
+	var (
+		result []NativeBucket
+		index  int32
+		count  int64
+		i      int
+	)
+	for n, span := range spans {
+		if n == 0 {
+			index = span.Offset
+		} else {
+			index += span.Offset
+		}
+		for j := uint32(0); j < span.Length; j, index, i = j+1, index+1, i+1 {
+			b := NativeBucket{
+				Lower: nativeBucketBound(schema, index-1),
+				Upper: nativeBucketBound(schema, index),
+			}
+			switch {
+			case i < len(counts):
+				b.Count = counts[i]
+			case i < len(deltas):
+				count += deltas[i]
+				b.Count = float64(count)
+			}
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+// nativeBucketBound returns the upper bound of the positive bucket with the
+// provided index, which is 2^(index * 2^-schema).
+func nativeBucketBound(schema, index int32) float64 {
+	return math.Exp2(float64(index) * math.Exp2(-float64(schema)))
+}
+
+// GetNativeHistogram returns the native histogram fields of h or nil if h is
+// a classic histogram only.
+func GetNativeHistogram(h *dto.Histogram) (*NativeHistogram, error) {
+	var (
+		nh     NativeHistogram
+		native bool
+		b      = h.XXX_unrecognized
+	)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		var err error
+		switch num {
+		case sampleCountFloatField:
+			nh.SampleCountFloat, n = consumeDouble(typ, b)
+		case schemaField:
+			var v uint64
+			v, n = consumeVarint(typ, b)
+			nh.Schema = int32(protowire.DecodeZigZag(v & math.MaxUint32))
+		case zeroThresholdField:
+			nh.ZeroThreshold, n = consumeDouble(typ, b)
+		case zeroCountField:
+			nh.ZeroCount, n = consumeVarint(typ, b)
+		case zeroCountFloatField:
+			nh.ZeroCountFloat, n = consumeDouble(typ, b)
+		case negativeSpanField, positiveSpanField:
+			var span BucketSpan
+			span, n = consumeBucketSpan(typ, b)
+			if num == negativeSpanField {
+				nh.NegativeSpans = append(nh.NegativeSpans, span)
+			} else {
+				nh.PositiveSpans = append(nh.PositiveSpans, span)
+			}
+		case negativeDeltaField:
+			nh.NegativeDeltas, n = consumeSint64s(nh.NegativeDeltas, typ, b)
+		case positiveDeltaField:
+			nh.PositiveDeltas, n = consumeSint64s(nh.PositiveDeltas, typ, b)
+		case negativeCountField:
+			nh.NegativeCounts, n = consumeDoubles(nh.NegativeCounts, typ, b)
+		case positiveCountField:
+			nh.PositiveCounts, n = consumeDoubles(nh.PositiveCounts, typ, b)
+		case exemplarsField:
+			var v []byte
+			if v, n = consumeBytes(typ, b); n >= 0 {
+				e := &dto.Exemplar{}
+				if err = proto.Unmarshal(v, e); err == nil {
+					nh.Exemplars = append(nh.Exemplars, e)
+				}
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("invalid native histogram field %d: %v", num, protowire.ParseError(n))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid native histogram field %d: %v", num, err)
+		}
+		if num >= schemaField && num <= positiveCountField {
+			native = true
+		}
+		b = b[n:]
+	}
+	if !native {
+		return nil, nil
+	}
+	return &nh, nil
+}
+
+// isNativeHistogram returns whether h has valid native histogram fields.
+func isNativeHistogram(h *dto.Histogram) bool {
+	nh, err := GetNativeHistogram(h)
+	return err == nil && nh != nil
+}
+
+// SetNativeHistogram sets the native histogram fields of h to the ones of nh,
+// replacing any existing ones. Other unknown fields of h are kept. A nil nh
+// turns h into a classic histogram only.
+func SetNativeHistogram(h *dto.Histogram, nh *NativeHistogram) {
+	var b []byte
+	for rest := h.XXX_unrecognized; len(rest) > 0; {
+		num, _, n := protowire.ConsumeField(rest)
+		if n < 0 {
+			b = append(b, rest...)
+			break
+		}
+		if num < sampleCountFloatField || (num > positiveCountField && num != exemplarsField) {
+			b = append(b, rest[:n]...)
+		}
+		rest = rest[n:]
+	}
+	if nh != nil {
+		if nh.SampleCountFloat != 0 {
+			b = protowire.AppendTag(b, sampleCountFloatField, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(nh.SampleCountFloat))
+		}
+		// The schema is always written to mark the histogram as native.
+		b = protowire.AppendTag(b, schemaField, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(int64(nh.Schema)))
+		b = protowire.AppendTag(b, zeroThresholdField, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(nh.ZeroThreshold))
+		if nh.ZeroCount != 0 {
+			b = protowire.AppendTag(b, zeroCountField, protowire.VarintType)
+			b = protowire.AppendVarint(b, nh.ZeroCount)
+		}
+		if nh.ZeroCountFloat != 0 {
+			b = protowire.AppendTag(b, zeroCountFloatField, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(nh.ZeroCountFloat))
+		}
+		b = appendBucketSpans(b, negativeSpanField, nh.NegativeSpans)
+		b = appendSint64s(b, negativeDeltaField, nh.NegativeDeltas)
+		b = appendDoubles(b, negativeCountField, nh.NegativeCounts)
+		b = appendBucketSpans(b, positiveSpanField, nh.PositiveSpans)
+		b = appendSint64s(b, positiveDeltaField, nh.PositiveDeltas)
+		b = appendDoubles(b, positiveCountField, nh.PositiveCounts)
+		for _, e := range nh.Exemplars {
+			v, err := proto.Marshal(e)
+			if err != nil {
+				continue
+			}
+			b = protowire.AppendTag(b, exemplarsField, protowire.BytesType)
+			b = protowire.AppendBytes(b, v)
+		}
+	}
+	h.XXX_unrecognized = b
+}
+
+// validateNativeHistogram returns an error if the provided native histogram
+// fields are invalid for the provided histogram.
+func validateNativeHistogram(h *dto.Histogram, nh *NativeHistogram) error {
+	if nh.Schema < MinNativeHistogramSchema || nh.Schema > MaxNativeHistogramSchema {
+		return fmt.Errorf("schema %d out of range [%d, %d]", nh.Schema, MinNativeHistogramSchema, MaxNativeHistogramSchema)
+	}
+	if math.IsNaN(nh.ZeroThreshold) || nh.ZeroThreshold < 0 {
+		return fmt.Errorf("invalid zero threshold %v", nh.ZeroThreshold)
+	}
+	for _, side := range []struct {
+		name   string
+		spans  []BucketSpan
+		deltas []int64
+		counts []float64
+	}{
+		{"negative", nh.NegativeSpans, nh.NegativeDeltas, nh.NegativeCounts},
+		{"positive", nh.PositiveSpans, nh.PositiveDeltas, nh.PositiveCounts},
+	} {
+		if len(side.deltas) > 0 && len(side.counts) > 0 {
+			return fmt.Errorf("both integer and float %s buckets", side.name)
+		}
+		var length int
+		for i, span := range side.spans {
+			if i > 0 && span.Offset < 0 {
+				return fmt.Errorf("%s span %d has negative offset %d", side.name, i, span.Offset)
+			}
+			length += int(span.Length)
+		}
+		if n := len(side.deltas) + len(side.counts); n != length {
+			return fmt.Errorf("%s spans need %d buckets, have %d", side.name, length, n)
+		}
+	}
+
+	var sum float64 // Of all bucket counts, including the zero bucket.
+	for _, b := range append(nh.NegativeBuckets(), nh.PositiveBuckets()...) {
+		if b.Count < 0 || math.IsNaN(b.Count) {
+			return fmt.Errorf("bucket (%v, %v] has invalid count %v", b.Lower, b.Upper, b.Count)
+		}
+		sum += b.Count
+	}
+	count := float64(h.GetSampleCount())
+	if nh.IsFloat() {
+		if len(nh.NegativeDeltas) > 0 || len(nh.PositiveDeltas) > 0 || nh.ZeroCount != 0 {
+			return fmt.Errorf("mix of integer and float counts")
+		}
+		if nh.ZeroCountFloat < 0 || math.IsNaN(nh.ZeroCountFloat) {
+			return fmt.Errorf("invalid zero count %v", nh.ZeroCountFloat)
+		}
+		sum += nh.ZeroCountFloat
+		count = nh.SampleCountFloat
+	} else {
+		sum += float64(nh.ZeroCount)
+	}
+	// Observations of NaN are counted, but not in any bucket.
+	if sum > count || !math.IsNaN(h.GetSampleSum()) && sum != count {
+		return fmt.Errorf("sample count %v does not match the %v observations in buckets", count, sum)
+	}
+	return nil
+}
+
+// checkNativeHistograms validates the native histograms in the provided metric
+// families.
+func checkNativeHistograms(metricFamilies map[string]*dto.MetricFamily) error {
+	for name, mf := range metricFamilies {
+		if mf.GetType() != dto.MetricType_HISTOGRAM {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.Histogram == nil {
+				continue
+			}
+			nh, err := GetNativeHistogram(m.Histogram)
+			if err == nil && nh != nil {
+				err = validateNativeHistogram(m.Histogram, nh)
+			}
+			if err != nil {
+				return fmt.Errorf("pushed metric family %q has an invalid native histogram: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func consumeVarint(typ protowire.Type, b []byte) (uint64, int) {
+	if typ != protowire.VarintType {
+		return 0, -1
+	}
+	return protowire.ConsumeVarint(b)
+}
+
+func consumeDouble(typ protowire.Type, b []byte) (float64, int) {
+	if typ != protowire.Fixed64Type {
+		return 0, -1
+	}
+	v, n := protowire.ConsumeFixed64(b)
+	return math.Float64frombits(v), n
+}
+
+func consumeBytes(typ protowire.Type, b []byte) ([]byte, int) {
+	if typ != protowire.BytesType {
+		return nil, -1
+	}
+	return protowire.ConsumeBytes(b)
+}
+
+func consumeBucketSpan(typ protowire.Type, b []byte) (BucketSpan, int) {
+	var span BucketSpan
+	v, n := consumeBytes(typ, b)
+	if n < 0 {
+		return span, n
+	}
+	for len(v) > 0 {
+		num, typ, l := protowire.ConsumeTag(v)
+		if l < 0 {
+			return span, l
+		}
+		v = v[l:]
+		var x uint64
+		switch num {
+		case bucketSpanOffsetField:
+			x, l = consumeVarint(typ, v)
+			span.Offset = int32(protowire.DecodeZigZag(x & math.MaxUint32))
+		case bucketSpanLengthField:
+			x, l = consumeVarint(typ, v)
+			span.Length = uint32(x)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, v)
+		}
+		if l < 0 {
+			return span, l
+		}
+		v = v[l:]
+	}
+	return span, n
+}
+
+// consumeSint64s consumes a packed or unpacked repeated sint64 field.
+func consumeSint64s(result []int64, typ protowire.Type, b []byte) ([]int64, int) {
+	if typ == protowire.VarintType {
+		v, n := protowire.ConsumeVarint(b)
+		return append(result, protowire.DecodeZigZag(v)), n
+	}
+	packed, n := consumeBytes(typ, b)
+	for len(packed) > 0 && n >= 0 {
+		v, l := protowire.ConsumeVarint(packed)
+		if l < 0 {
+			return result, l
+		}
+		result = append(result, protowire.DecodeZigZag(v))
+		packed = packed[l:]
+	}
+	return result, n
+}
+
+// consumeDoubles consumes a packed or unpacked repeated double field.
+func consumeDoubles(result []float64, typ protowire.Type, b []byte) ([]float64, int) {
+	if typ == protowire.Fixed64Type {
+		v, n := consumeDouble(typ, b)
+		return append(result, v), n
+	}
+	packed, n := consumeBytes(typ, b)
+	for len(packed) > 0 && n >= 0 {
+		v, l := protowire.ConsumeFixed64(packed)
+		if l < 0 {
+			return result, l
+		}
+		result = append(result, math.Float64frombits(v))
+		packed = packed[l:]
+	}
+	return result, n
+}
+
+func appendBucketSpans(b []byte, num protowire.Number, spans []BucketSpan) []byte {
+	for _, span := range spans {
+		var v []byte
+		v = protowire.AppendTag(v, bucketSpanOffsetField, protowire.VarintType)
+		v = protowire.AppendVarint(v, protowire.EncodeZigZag(int64(span.Offset)))
+		v = protowire.AppendTag(v, bucketSpanLengthField, protowire.VarintType)
+		v = protowire.AppendVarint(v, uint64(span.Length))
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, v)
+	}
+	return b
+}
+
+func appendSint64s(b []byte, num protowire.Number, values []int64) []byte {
+	if len(values) == 0 {
+		return b
+	}
+	var v []byte
+	for _, x := range values {
+		v = protowire.AppendVarint(v, protowire.EncodeZigZag(x))
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendDoubles(b []byte, num protowire.Number, values []float64) []byte {
+	if len(values) == 0 {
+		return b
+	}
+	var v []byte
+	for _, x := range values {
+		v = protowire.AppendFixed64(v, math.Float64bits(x))
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The persistence file starts with a header of persistenceHeaderLength bytes:
+// persistenceMagic, the format version (uint32), and the CRC32C checksum of
+// the body (uint32), both little endian. The body is a protobuf encoded
+// Snapshot.
+//
+// Files without the magic bytes are legacy files, i.e. a bare gob stream of a
+// GroupingKeyToMetricGroup. They are still read, and they are replaced by a
+// file in the current format upon the next persisting.
+const (
+	persistenceMagic         = "PGWSNAP\n"
+	persistenceHeaderLength  = len(persistenceMagic) + 8
+	persistenceFormatVersion = 1
+)
+
+// newerFormatError is returned when reading a persistence file written in a
+// newer format than this version of the Pushgateway understands.
+type newerFormatError struct {
+	version uint32
+}
+
+func (e newerFormatError) Error() string {
+	return fmt.Sprintf(
+		"persistence file has format version %d, but only versions up to %d are supported, refusing to overwrite it",
+		e.version, persistenceFormatVersion,
+	)
+}
+
+// corruptedFileError is returned when reading a persistence file in the
+// current format that cannot be decoded, e.g. because of a checksum mismatch
+// or truncation.
+type corruptedFileError struct {
+	err error
+}
+
+func (e corruptedFileError) Error() string {
+	return fmt.Sprintf(
+		"persistence file cannot be read (%v), refusing to overwrite it, move it aside to start with an empty store",
+		e.err,
+	)
+}
+
+// encodeSnapshot writes the provided groups in the current format.
+func encodeSnapshot(w io.Writer, groups GroupingKeyToMetricGroup) error {
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	// Sort to make the file reproducible.
+	sort.Strings(keys)
+
+	snapshot := &Snapshot{Groups: make([]*SnapshotGroup, 0, len(groups))}
+	for _, key := range keys {
+		sg, err := newSnapshotGroup(groups[key])
+		if err != nil {
+			return err
+		}
+		snapshot.Groups = append(snapshot.Groups, sg)
+	}
+	body, err := proto.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, persistenceHeaderLength)
+	copy(header, persistenceMagic)
+	binary.LittleEndian.PutUint32(header[len(persistenceMagic):], persistenceFormatVersion)
+	binary.LittleEndian.PutUint32(header[len(persistenceMagic)+4:], crc32.Checksum(body, crc32c))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// decodeSnapshot reads groups written by encodeSnapshot or by the legacy gob
+// encoding. It also reports whether the legacy encoding was found. Empty data
+// results in no groups. A file of a newer format version results in a
+// newerFormatError, a file in the current format that cannot be decoded in a
+// corruptedFileError.
+func decodeSnapshot(r io.Reader) (groups GroupingKeyToMetricGroup, legacy bool, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) == 0 {
+		return GroupingKeyToMetricGroup{}, false, nil
+	}
+	if !bytes.HasPrefix(data, []byte(persistenceMagic)) {
+		groups = GroupingKeyToMetricGroup{}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&groups); err != nil {
+			return nil, true, err
+		}
+		return groups, true, nil
+	}
+	if len(data) < persistenceHeaderLength {
+		return nil, false, corruptedFileError{err: errors.New("persistence file header is truncated")}
+	}
+	version := binary.LittleEndian.Uint32(data[len(persistenceMagic):])
+	if version > persistenceFormatVersion {
+		return nil, false, newerFormatError{version: version}
+	}
+	if version == 0 {
+		return nil, false, corruptedFileError{err: errors.New("persistence file has invalid format version 0")}
+	}
+	body := data[persistenceHeaderLength:]
+	if crc32.Checksum(body, crc32c) != binary.LittleEndian.Uint32(data[len(persistenceMagic)+4:]) {
+		return nil, false, corruptedFileError{err: errors.New("persistence file checksum mismatch")}
+	}
+
+	snapshot := &Snapshot{}
+	if err := proto.Unmarshal(body, snapshot); err != nil {
+		return nil, false, corruptedFileError{err: err}
+	}
+	groups = make(GroupingKeyToMetricGroup, len(snapshot.GetGroups()))
+	for _, sg := range snapshot.GetGroups() {
+		group, err := sg.metricGroup()
+		if err != nil {
+			return nil, false, corruptedFileError{err: err}
+		}
+		groups[groupingKeyFor(group.Labels)] = group
+	}
+	return groups, false, nil
+}
+
+// newSnapshotGroup converts a MetricGroup into its persisted form.
+func newSnapshotGroup(group MetricGroup) (*SnapshotGroup, error) {
+	sg := &SnapshotGroup{
+		Labels:   group.Labels,
+		Families: make([]*SnapshotFamily, 0, len(group.Metrics)),
+	}
+	if group.TTL != 0 {
+		sg.TtlNs = proto.Int64(int64(group.TTL))
+	}
+	names := make([]string, 0, len(group.Metrics))
+	for name := range group.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tmf := group.Metrics[name]
+		mf, err := proto.Marshal(tmf.GetMetricFamily())
+		if err != nil {
+			return nil, err
+		}
+		sf := &SnapshotFamily{MetricFamily: mf}
+		if !tmf.Timestamp.IsZero() {
+			sf.TimestampNs = proto.Int64(tmf.Timestamp.UnixNano())
+		}
+		sg.Families = append(sg.Families, sf)
+	}
+	return sg, nil
+}
+
+// metricGroup converts the persisted form back into a MetricGroup.
+func (sg *SnapshotGroup) metricGroup() (MetricGroup, error) {
+	labels := sg.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	group := MetricGroup{
+		Labels:  labels,
+		Metrics: make(NameToTimestampedMetricFamilyMap, len(sg.GetFamilies())),
+		TTL:     time.Duration(sg.GetTtlNs()),
+	}
+	for _, sf := range sg.GetFamilies() {
+		mf := &dto.MetricFamily{}
+		if err := proto.Unmarshal(sf.GetMetricFamily(), mf); err != nil {
+			return MetricGroup{}, err
+		}
+		tmf := TimestampedMetricFamily{GobbableMetricFamily: (*GobbableMetricFamily)(mf)}
+		if sf.TimestampNs != nil {
+			tmf.Timestamp = time.Unix(0, sf.GetTimestampNs())
+		}
+		group.Metrics[mf.GetName()] = tmf
+	}
+	return group, nil
+}
@@ -0,0 +1,365 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/units"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DefaultTenant is the name under which a QuotaConfig lists the Quota of all
+// tenants not listed explicitly.
+const DefaultTenant = "*"
+
+// Quota limits what a tenant may store. A limit of 0 means no limit.
+type Quota struct {
+	// MaxGroups is the maximum number of groups.
+	MaxGroups int
+	// MaxSeriesPerGroup is the maximum number of series in a single group.
+	MaxSeriesPerGroup int
+	// MaxSeries is the maximum number of series in all groups.
+	MaxSeries int
+	// MaxBodyBytes is the maximum size of a single push.
+	MaxBodyBytes int64
+}
+
+// QuotaConfig maps tenants to their Quota. A tenant is either the
+// authenticated client that pushed a group or, if there is none, the job of the
+// group (see WriteRequest).
+type QuotaConfig map[string]Quota
+
+// quotaFor returns the Quota of the provided tenant and whether there is any.
+func (cfg QuotaConfig) quotaFor(tenant string) (Quota, bool) {
+	if q, ok := cfg[tenant]; ok {
+		return q, true
+	}
+	q, ok := cfg[DefaultTenant]
+	return q, ok
+}
+
+// LoadQuotaConfig reads a QuotaConfig from file. Every line of the file has the
+// form "tenant:limit=value,...", with the limits groups, series_per_group,
+// series, and body_bytes (the latter with an optional unit like "1MB"). Empty
+// lines and lines starting with "#" are ignored.
+func LoadQuotaConfig(file string) (QuotaConfig, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := QuotaConfig{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected tenant:limit=value,...", file, n)
+		}
+		tenant := strings.TrimSpace(line[:i])
+		if _, ok := cfg[tenant]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate tenant %q", file, n, tenant)
+		}
+		q, err := parseQuota(line[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		cfg[tenant] = q
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func parseQuota(s string) (Quota, error) {
+	var q Quota
+	for _, limit := range strings.Split(s, ",") {
+		i := strings.Index(limit, "=")
+		if i < 0 {
+			return Quota{}, fmt.Errorf("expected limit=value, got %q", strings.TrimSpace(limit))
+		}
+		name, value := strings.TrimSpace(limit[:i]), strings.TrimSpace(limit[i+1:])
+		var err error
+		switch name {
+		case "groups":
+			q.MaxGroups, err = strconv.Atoi(value)
+		case "series_per_group":
+			q.MaxSeriesPerGroup, err = strconv.Atoi(value)
+		case "series":
+			q.MaxSeries, err = strconv.Atoi(value)
+		case "body_bytes":
+			var b units.Base2Bytes
+			b, err = units.ParseBase2Bytes(value)
+			q.MaxBodyBytes = int64(b)
+		default:
+			return Quota{}, fmt.Errorf("unknown limit %q", name)
+		}
+		if err != nil {
+			return Quota{}, fmt.Errorf("invalid value for limit %q: %v", name, err)
+		}
+	}
+	return q, nil
+}
+
+// WithQuotas enforces the provided QuotaConfig. Pushes that would make a tenant
+// exceed its Quota are rejected by the consistency check, even if the
+// WriteRequest has no Done channel. Deletes are never rejected.
+func WithQuotas(cfg QuotaConfig) Option {
+	return func(dms *DiskMetricStore) {
+		dms.quotas = cfg
+	}
+}
+
+var (
+	quotaRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushgateway_quota_rejections_total",
+			Help: "Total number of pushes rejected because the tenant would have exceeded a limit of its quota.",
+		},
+		[]string{"tenant", "limit"},
+	)
+
+	tenantGroupsDesc = prometheus.NewDesc(
+		"pushgateway_tenant_groups",
+		"Number of groups currently stored for a tenant.",
+		[]string{"tenant"}, nil,
+	)
+	tenantSeriesDesc = prometheus.NewDesc(
+		"pushgateway_tenant_series",
+		"Number of series currently stored for a tenant, excluding push timestamps.",
+		[]string{"tenant"}, nil,
+	)
+)
+
+// Describe implements prometheus.Collector. The DiskMetricStore exposes the
+// current usage of all tenants as metrics. This is meant to be used with
+// quotas, but works without them, too.
+func (dms *DiskMetricStore) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tenantGroupsDesc
+	ch <- tenantSeriesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (dms *DiskMetricStore) Collect(ch chan<- prometheus.Metric) {
+	dms.lock.RLock()
+	defer dms.lock.RUnlock()
+	for tenant, u := range dms.tenantUsage {
+		ch <- prometheus.MustNewConstMetric(tenantGroupsDesc, prometheus.GaugeValue, float64(u.groups), tenant)
+		ch <- prometheus.MustNewConstMetric(tenantSeriesDesc, prometheus.GaugeValue, float64(u.series), tenant)
+	}
+}
+
+type tenantUsage struct {
+	groups, series int
+}
+
+// groupUsage is what a single group adds to the usage of its tenant.
+type groupUsage struct {
+	tenant string
+	series int
+}
+
+// tenantFor returns the tenant the provided WriteRequest is accounted to.
+func tenantFor(wr WriteRequest) string {
+	if wr.Tenant != "" {
+		return wr.Tenant
+	}
+	return wr.Labels[string(model.JobLabel)]
+}
+
+// groupTenant returns the tenant the group with the provided key is accounted
+// to, i.e. the tenant of the last push to it. Groups not pushed to since the
+// start-up are accounted to their job. It must be called with the lock held.
+func (dms *DiskMetricStore) groupTenant(key string, group MetricGroup) string {
+	if tenant, ok := dms.groupTenants[key]; ok {
+		return tenant
+	}
+	return group.Labels[string(model.JobLabel)]
+}
+
+// account updates tenantUsage after the group with the provided key has been
+// changed, created, or deleted. It only looks at that group. It must be called
+// with the lock held.
+func (dms *DiskMetricStore) account(key string) {
+	if gu, ok := dms.groupUsage[key]; ok {
+		u := dms.tenantUsage[gu.tenant]
+		u.groups--
+		u.series -= gu.series
+		if u.groups == 0 {
+			delete(dms.tenantUsage, gu.tenant)
+		}
+		delete(dms.groupUsage, key)
+	}
+	group, ok := dms.metricGroups[key]
+	if !ok {
+		return
+	}
+	gu := groupUsage{tenant: dms.groupTenant(key, group)}
+	for name, tmf := range group.Metrics {
+		if name != pushMetricName && name != pushFailedMetricName {
+			gu.series += seriesCount(tmf.GetMetricFamily())
+		}
+	}
+	dms.groupUsage[key] = gu
+	u, ok := dms.tenantUsage[gu.tenant]
+	if !ok {
+		u = &tenantUsage{}
+		dms.tenantUsage[gu.tenant] = u
+	}
+	u.groups++
+	u.series += gu.series
+}
+
+// accountAll rebuilds tenantUsage from scratch, which is only needed after
+// restoring. It must be called with the lock held.
+func (dms *DiskMetricStore) accountAll() {
+	dms.tenantUsage = map[string]*tenantUsage{}
+	dms.groupUsage = map[string]groupUsage{}
+	for key := range dms.metricGroups {
+		dms.account(key)
+	}
+}
+
+// usage returns the usage of the provided tenant, leaving out the group with
+// the provided key. It must be called with the lock held.
+func (dms *DiskMetricStore) usage(tenant, skipKey string) tenantUsage {
+	var u tenantUsage
+	if tu, ok := dms.tenantUsage[tenant]; ok {
+		u = *tu
+	}
+	if gu, ok := dms.groupUsage[skipKey]; ok && gu.tenant == tenant {
+		u.groups--
+		u.series -= gu.series
+	}
+	return u
+}
+
+// checkQuota returns an error if applying the provided WriteRequest would make
+// its tenant exceed its Quota. The MetricFamilies have to be sanitized already.
+func (dms *DiskMetricStore) checkQuota(wr WriteRequest) error {
+	tenant := tenantFor(wr)
+	q, ok := dms.quotas.quotaFor(tenant)
+	if !ok {
+		return nil
+	}
+	exceeded := func(limit string, format string, args ...interface{}) error {
+		quotaRejections.WithLabelValues(tenant, limit).Inc()
+		return fmt.Errorf("quota of tenant %q exceeded: "+format, append([]interface{}{tenant}, args...)...)
+	}
+	if q.MaxBodyBytes > 0 && wr.BodySize > q.MaxBodyBytes {
+		return exceeded("body_bytes", "push of %d bytes, limit is %d bytes", wr.BodySize, q.MaxBodyBytes)
+	}
+
+	dms.lock.RLock()
+	defer dms.lock.RUnlock()
+
+	key := groupingKeyFor(wr.Labels)
+	group := dms.metricGroups[key]
+	var groupSeries int
+	for name, mf := range wr.MetricFamilies {
+		if name == pushMetricName || name == pushFailedMetricName {
+			continue
+		}
+		if tmf, ok := group.Metrics[name]; ok && wr.Aggregation.Enabled() {
+			groupSeries += aggregatedSeriesCount(tmf.GetMetricFamily(), mf)
+			continue
+		}
+		groupSeries += seriesCount(mf)
+	}
+	if !wr.Replace {
+		for name, tmf := range group.Metrics {
+			if _, ok := wr.MetricFamilies[name]; !ok && name != pushMetricName && name != pushFailedMetricName {
+				groupSeries += seriesCount(tmf.GetMetricFamily())
+			}
+		}
+	}
+	if q.MaxSeriesPerGroup > 0 && groupSeries > q.MaxSeriesPerGroup {
+		return exceeded("series_per_group", "%d series in group %v, limit is %d", groupSeries, wr.Labels, q.MaxSeriesPerGroup)
+	}
+	if q.MaxGroups <= 0 && q.MaxSeries <= 0 {
+		return nil
+	}
+	// The usage leaves out the group only if the tenant owns it already,
+	// so that taking over a group of another tenant counts as a new one.
+	u := dms.usage(tenant, key)
+	if q.MaxGroups > 0 && u.groups >= q.MaxGroups {
+		return exceeded("groups", "%d groups, limit is %d", u.groups+1, q.MaxGroups)
+	}
+	if q.MaxSeries > 0 && u.series+groupSeries > q.MaxSeries {
+		return exceeded("series", "%d series, limit is %d", u.series+groupSeries, q.MaxSeries)
+	}
+	return nil
+}
+
+// groupQuotaReached returns whether the tenant of the provided WriteRequest may
+// not have any more groups. It must be called with the lock held.
+func (dms *DiskMetricStore) groupQuotaReached(wr WriteRequest) bool {
+	tenant := tenantFor(wr)
+	q, ok := dms.quotas.quotaFor(tenant)
+	if !ok || q.MaxGroups <= 0 {
+		return false
+	}
+	u, ok := dms.tenantUsage[tenant]
+	return ok && u.groups >= q.MaxGroups
+}
+
+// seriesCount returns the number of series the provided MetricFamily is exposed
+// as.
+func seriesCount(mf *dto.MetricFamily) int {
+	var n int
+	for _, m := range mf.GetMetric() {
+		n += metricSeriesCount(m)
+	}
+	return n
+}
+
+// aggregatedSeriesCount returns the number of series resulting from
+// aggregating pushed into stored.
+func aggregatedSeriesCount(stored, pushed *dto.MetricFamily) int {
+	n := seriesCount(stored)
+	signatures := make(map[string]struct{}, len(stored.GetMetric()))
+	for _, m := range stored.GetMetric() {
+		signatures[labelsSignature(m)] = struct{}{}
+	}
+	for _, m := range pushed.GetMetric() {
+		if _, ok := signatures[labelsSignature(m)]; !ok {
+			n += metricSeriesCount(m)
+		}
+	}
+	return n
+}
+
+func metricSeriesCount(m *dto.Metric) int {
+	switch {
+	case m.Summary != nil:
+		return len(m.Summary.GetQuantile()) + 2 // Plus _sum and _count.
+	case m.Histogram != nil:
+		return len(m.Histogram.GetBucket()) + 2 // Plus _sum and _count.
+	}
+	return 1
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TimestampPolicy determines how a DiskMetricStore treats pushed metrics with
+// timestamps.
+type TimestampPolicy string
+
+// The valid TimestampPolicies.
+const (
+	// TimestampsReject rejects pushes containing any metrics with
+	// timestamps. This is the default.
+	TimestampsReject TimestampPolicy = "reject"
+	// TimestampsStrip removes the timestamps from pushed metrics, which are
+	// then stored as if they had been pushed without timestamps.
+	TimestampsStrip TimestampPolicy = "strip"
+	// TimestampsKeep stores pushed metrics with their timestamps, which are
+	// thus exposed, too.
+	TimestampsKeep TimestampPolicy = "keep"
+)
+
+var strippedTimestamps = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pushgateway_stripped_timestamps_total",
+		Help: "Total number of timestamps removed from pushed metrics.",
+	},
+)
+
+// WithTimestampPolicy sets how pushed metrics with timestamps are treated. With
+// TimestampsKeep, pushes containing timestamps older than maxAge (relative to
+// the Timestamp of the WriteRequest) are rejected, as Prometheus would regard
+// the samples as stale anyway. A maxAge of 0 disables that check. maxAge is
+// ignored by the other policies.
+func WithTimestampPolicy(policy TimestampPolicy, maxAge time.Duration) Option {
+	return func(dms *DiskMetricStore) {
+		dms.timestampPolicy = policy
+		dms.maxTimestampAge = maxAge
+	}
+}
+
+// checkTimestamps applies the TimestampPolicy of the dms to the MetricFamilies
+// of the provided WriteRequest, which are modified in place if timestamps are
+// stripped. An error is returned if the WriteRequest has to be rejected.
+func (dms *DiskMetricStore) checkTimestamps(wr WriteRequest) error {
+	switch dms.timestampPolicy {
+	case TimestampsStrip:
+		if n := stripTimestamps(wr.MetricFamilies); n > 0 {
+			strippedTimestamps.Add(float64(n))
+			level.Debug(dms.logger).Log(
+				"msg", "stripped timestamps from pushed metrics",
+				"labels", fmt.Sprint(wr.Labels), "count", n,
+			)
+		}
+		return nil
+	case TimestampsKeep:
+		if dms.maxTimestampAge <= 0 {
+			return nil
+		}
+		oldest := wr.Timestamp.Add(-dms.maxTimestampAge)
+		for name, mf := range wr.MetricFamilies {
+			for _, m := range mf.GetMetric() {
+				if m.TimestampMs == nil {
+					continue
+				}
+				if ts := time.Unix(0, m.GetTimestampMs()*int64(time.Millisecond)); ts.Before(oldest) {
+					return fmt.Errorf(
+						"pushed metric family %q has a timestamp %s older than the maximum age of %s",
+						name, ts.UTC().Format(time.RFC3339), dms.maxTimestampAge,
+					)
+				}
+			}
+		}
+		return nil
+	}
+	if timestampsPresent(wr.MetricFamilies) {
+		return errTimestamp
+	}
+	return nil
+}
+
+// stripTimestamps removes all timestamps from the provided metric families and
+// returns how many it has removed.
+func stripTimestamps(metricFamilies map[string]*dto.MetricFamily) int {
+	var n int
+	for _, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			if m.TimestampMs != nil {
+				m.TimestampMs = nil
+				n++
+			}
+		}
+	}
+	return n
+}
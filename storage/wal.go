@@ -0,0 +1,346 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxWALRecordSize is the size of the largest WAL record. Larger records are
+// not logged, and a larger length read from the WAL can only be the garbage of
+// a torn write, which must not be trusted with allocating memory.
+const maxWALRecordSize = 1 << 30
+
+var (
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+	errWALCorrupted = errors.New("corrupted WAL record")
+)
+
+// walRecord is what is logged for each applied WriteRequest.
+type walRecord struct {
+	Labels         map[string]string
+	Timestamp      time.Time
+	MetricFamilies map[string]*GobbableMetricFamily
+	Replace        bool
+	TTL            time.Duration
+	Conditional    bool
+	// Delete is needed as gob does not distinguish between a nil and an
+	// empty map.
+	Delete         bool
+	DeleteFamilies []string
+	// Failed marks a WriteRequest that failed the checks, which only
+	// updates the push failure timestamp.
+	Failed bool
+	// Batch holds the records of the WriteRequests applied as a batch, so
+	// that a crash while writing cannot leave only a part of the batch to
+	// be replayed. All other fields are unset then.
+	Batch []walRecord
+}
+
+// wal is a write-ahead log of WriteRequests. It consists of numbered segment
+// files in a directory. Records are appended to the newest segment. Upon a
+// snapshot of the DiskMetricStore, a new segment is cut, and once the snapshot
+// is safely on disk, all older segments are removed.
+//
+// Each record consists of its length (uint32), its CRC32C checksum (uint32),
+// and a gob-encoded walRecord.
+type wal struct {
+	dir string
+
+	mtx     sync.Mutex // Protects all of the following.
+	segment int
+	f       *os.File
+	w       *bufio.Writer
+	dirty   bool // Whether anything has been written since the last sync.
+}
+
+// openWAL opens the WAL in dir for appending, creating dir if needed.
+// Appending always starts with a new segment, so that a torn write at the end
+// of the previous segment does not affect new records.
+func openWAL(dir string) (*wal, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	segments, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{dir: dir}
+	next := 1
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+	if err := w.openSegment(next); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// walSegments returns the numbers of all segments in dir in ascending order.
+func walSegments(dir string) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var segments []int
+	for _, fi := range files {
+		n, err := strconv.Atoi(fi.Name())
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (w *wal) segmentPath(n int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d", n))
+}
+
+// openSegment must be called with mtx locked (or before w is shared).
+func (w *wal) openSegment(n int) error {
+	f, err := os.OpenFile(w.segmentPath(n), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	w.segment = n
+	w.f = f
+	w.w = bufio.NewWriter(f)
+	return nil
+}
+
+// newWALRecord returns the record to log for wr.
+func newWALRecord(wr WriteRequest, failed bool) walRecord {
+	rec := walRecord{
+		Labels:      wr.Labels,
+		Timestamp:   wr.Timestamp,
+		Replace:     wr.Replace,
+		TTL:         wr.TTL,
+		Conditional: wr.Conditional,
+		Delete:      wr.MetricFamilies == nil,
+		Failed:      failed,
+	}
+	if rec.Delete {
+		rec.DeleteFamilies = wr.DeleteFamilies
+	}
+	if !rec.Delete && !failed {
+		rec.MetricFamilies = make(map[string]*GobbableMetricFamily, len(wr.MetricFamilies))
+		for name, mf := range wr.MetricFamilies {
+			rec.MetricFamilies[name] = (*GobbableMetricFamily)(mf)
+		}
+	}
+	return rec
+}
+
+// log appends rec. It does not wait for the record to be synced to disk.
+func (w *wal) log(rec walRecord) error {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(&rec); err != nil {
+		return err
+	}
+	if buf.Len() > maxWALRecordSize {
+		return fmt.Errorf("WAL record of %d bytes exceeds the maximum of %d bytes", buf.Len(), maxWALRecordSize)
+	}
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header, uint32(buf.Len()))
+	binary.LittleEndian.PutUint32(header[4:], crc32.Checksum(buf.Bytes(), crc32c))
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if _, err := w.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	w.dirty = true
+	return nil
+}
+
+// sync flushes all logged records and syncs them to disk.
+func (w *wal) sync() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.syncLocked()
+}
+
+func (w *wal) syncLocked() error {
+	if !w.dirty {
+		return nil
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// cut syncs and closes the current segment and starts a new one. It returns
+// the number of the new segment.
+func (w *wal) cut() (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if err := w.syncLocked(); err != nil {
+		return 0, err
+	}
+	if err := w.f.Close(); err != nil {
+		return 0, err
+	}
+	if err := w.openSegment(w.segment + 1); err != nil {
+		return 0, err
+	}
+	return w.segment, nil
+}
+
+// truncate removes all segments before the given one.
+func (w *wal) truncate(before int) error {
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, n := range segments {
+		if n >= before {
+			break
+		}
+		if err := os.Remove(w.segmentPath(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close syncs and closes the WAL.
+func (w *wal) close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if err := w.syncLocked(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// replayWAL calls apply for every record in the WAL in dir, in order. A
+// corrupted or incomplete record ends the replay of its segment, as it can
+// only be caused by a crash while writing. Replay continues with the next
+// segment, and the first such error is returned in the end.
+func replayWAL(dir string, apply func(wr WriteRequest, failed bool)) (int, error) {
+	segments, err := walSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		replayed int
+		firstErr error
+	)
+	for _, n := range segments {
+		f, err := os.Open(filepath.Join(dir, fmt.Sprintf("%08d", n)))
+		if err != nil {
+			return replayed, err
+		}
+		r := bufio.NewReader(f)
+		for {
+			rec, err := readWALRecord(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("segment %d: %s", n, err)
+				}
+				break
+			}
+			if rec.Batch != nil {
+				for _, r := range rec.Batch {
+					apply(r.writeRequest(), r.Failed)
+				}
+			} else {
+				apply(rec.writeRequest(), rec.Failed)
+			}
+			replayed++
+		}
+		f.Close()
+	}
+	return replayed, firstErr
+}
+
+// writeRequest converts the record back into the logged WriteRequest.
+func (rec *walRecord) writeRequest() WriteRequest {
+	wr := WriteRequest{
+		Labels:      rec.Labels,
+		Timestamp:   rec.Timestamp,
+		Replace:     rec.Replace,
+		TTL:         rec.TTL,
+		Conditional: rec.Conditional,
+	}
+	if rec.Delete {
+		wr.DeleteFamilies = rec.DeleteFamilies
+	} else {
+		wr.MetricFamilies = make(map[string]*dto.MetricFamily, len(rec.MetricFamilies))
+		for name, mf := range rec.MetricFamilies {
+			wr.MetricFamilies[name] = (*dto.MetricFamily)(mf)
+		}
+	}
+	return wr
+}
+
+func readWALRecord(r io.Reader) (*walRecord, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errWALCorrupted
+		}
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header)
+	if size > maxWALRecordSize {
+		return nil, errWALCorrupted
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errWALCorrupted
+	}
+	if crc32.Checksum(data, crc32c) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, errWALCorrupted
+	}
+	rec := &walRecord{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(rec); err != nil {
+		return nil, errWALCorrupted
+	}
+	return rec, nil
+}
@@ -0,0 +1,758 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tcp_client provides a client for the binary TCP protocol of the
+// Pushgateway as served by the tcp_server package.
+package tcp_client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/compression"
+	"github.com/prometheus/pushgateway/tcp_handler"
+	"github.com/prometheus/pushgateway/tcp_server"
+)
+
+// handshakeTimeout is the time to wait for the TLS handshake and the
+// authentication to complete.
+const handshakeTimeout = 10 * time.Second
+
+// ErrClosed is returned by requests on a closed Client.
+var ErrClosed = errors.New("client closed")
+
+// Options configure a Client. The zero value is usable.
+type Options struct {
+	// HeartbeatInterval is the interval at which heartbeats are sent to
+	// the server. 0 disables sending heartbeats on our own. Heartbeats
+	// sent by the server are always answered.
+	HeartbeatInterval time.Duration
+	// MinBackoff is the time to wait before the first attempt to
+	// reconnect. It defaults to 100ms.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum time to wait between attempts to
+	// reconnect. The wait time doubles with each failed attempt up to
+	// MaxBackoff. It defaults to 30s.
+	MaxBackoff time.Duration
+	// User and Secret authenticate every connection if User is not
+	// empty. The server must have authentication enabled then.
+	User   string
+	Secret string
+	// UseHMAC authenticates by answering a challenge instead of sending
+	// the secret to the server.
+	UseHMAC bool
+	// MaxFrameSize is the size of the largest frame accepted from the
+	// server. It defaults to tcp_server.DefaultMaxFrameSize. Frames
+	// larger than the maximum negotiated with the server are refused
+	// without being sent.
+	MaxFrameSize uint32
+	// Compression is the compression of push bodies, one of
+	// compression.Supported. It is only used if the server supports it.
+	// If empty, nothing is compressed.
+	Compression string
+	// TLSConfig enables TLS if not nil. To authenticate with a client
+	// certificate, set its Certificates.
+	TLSConfig *tls.Config
+	// Logger is used to log connection problems. If nil, nothing is
+	// logged.
+	Logger log.Logger
+}
+
+// Client is a client for the binary TCP protocol of the Pushgateway. It keeps
+// one connection to the server, which it re-establishes with exponential
+// backoff whenever it is lost. Requests are sent over that connection and
+// matched with their responses by package id, so a Client is safe to be used
+// concurrently. Requests are not retried.
+type Client struct {
+	address string
+	opts    Options
+	logger  log.Logger
+
+	mtx       sync.Mutex // Protects conn and connected.
+	conn      *conn
+	connected chan struct{} // Closed once conn is set.
+
+	closed chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns a Client for the server listening on address. It starts
+// connecting in the background right away. To free its resources, Close has
+// to be called.
+func New(address string, opts Options) *Client {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 30 * time.Second
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+	if opts.MaxFrameSize == 0 {
+		opts.MaxFrameSize = tcp_server.DefaultMaxFrameSize
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{
+		address:   address,
+		opts:      opts,
+		logger:    logger,
+		connected: make(chan struct{}),
+		closed:    make(chan struct{}),
+		cancel:    cancel,
+	}
+	c.wg.Add(1)
+	go c.run(ctx)
+	return c
+}
+
+// Close closes the connection to the server and stops reconnecting. Pending
+// requests fail.
+func (c *Client) Close() error {
+	select {
+	case <-c.closed:
+		return ErrClosed
+	default:
+	}
+	close(c.closed)
+	c.cancel()
+	c.mtx.Lock()
+	if c.conn != nil {
+		c.conn.close(ErrClosed)
+	}
+	c.mtx.Unlock()
+	c.wg.Wait()
+	return nil
+}
+
+// Push pushes the metric families to the group identified by job and grouping,
+// replacing all metrics in that group (like PUT over HTTP).
+func (c *Client) Push(ctx context.Context, job string, grouping map[string]string, mfs []*dto.MetricFamily) error {
+	return c.push(ctx, tcp_server.KindPushReplace, job, grouping, mfs)
+}
+
+// PushAdd pushes the metric families to the group identified by job and
+// grouping, replacing only metrics with the same name (like POST over HTTP).
+func (c *Client) PushAdd(ctx context.Context, job string, grouping map[string]string, mfs []*dto.MetricFamily) error {
+	return c.push(ctx, tcp_server.KindPush, job, grouping, mfs)
+}
+
+// push sends a PushAction.
+func (c *Client) push(ctx context.Context, kind uint32, job string, grouping map[string]string, mfs []*dto.MetricFamily) error {
+	action, err := pushAction(job, grouping, mfs)
+	if err != nil {
+		return err
+	}
+	_, err = c.requestCompressed(ctx, kind, action)
+	return err
+}
+
+// BatchPush is a push to a single group as part of a batch, see PushBatch. If
+// Replace is true, all metrics in the group are replaced (like with Push),
+// otherwise only those with the same name (like with PushAdd).
+type BatchPush struct {
+	Job            string
+	Grouping       map[string]string
+	Replace        bool
+	MetricFamilies []*dto.MetricFamily
+}
+
+// BatchError is returned by PushBatch if the batch has not been applied because
+// some of its pushes are invalid. Errors holds the error of each push, in the
+// order of the batch, empty for valid ones.
+type BatchError struct {
+	Errors []string
+}
+
+func (e *BatchError) Error() string {
+	var invalid []string
+	for i, err := range e.Errors {
+		if err != "" {
+			invalid = append(invalid, fmt.Sprintf("push %d: %s", i, err))
+		}
+	}
+	return fmt.Sprintf("batch not applied, %d of %d pushes are invalid: %s", len(invalid), len(e.Errors), strings.Join(invalid, "; "))
+}
+
+// PushBatch pushes to many groups at once. Either all pushes are applied or, if
+// any of them is invalid, none of them, and a *BatchError is returned.
+func (c *Client) PushBatch(ctx context.Context, pushes []BatchPush) error {
+	batch := &tcp_handler.PushBatchAction{}
+	for _, p := range pushes {
+		action, err := pushAction(p.Job, p.Grouping, p.MetricFamilies)
+		if err != nil {
+			return err
+		}
+		if p.Replace {
+			action.Replace = proto.Bool(true)
+		}
+		batch.Pushes = append(batch.Pushes, action)
+	}
+	body, err := c.requestCompressed(ctx, tcp_server.KindPushBatch, batch)
+	if err != nil {
+		return err
+	}
+	resp := &tcp_handler.PushBatchResponse{}
+	if err := proto.Unmarshal(body, resp); err != nil {
+		return err
+	}
+	if !resp.GetApplied() {
+		return &BatchError{Errors: resp.GetErrors()}
+	}
+	return nil
+}
+
+func pushAction(job string, grouping map[string]string, mfs []*dto.MetricFamily) (*tcp_handler.PushAction, error) {
+	body := &bytes.Buffer{}
+	for _, mf := range mfs {
+		if _, err := pbutil.WriteDelimited(body, mf); err != nil {
+			return nil, err
+		}
+	}
+	return &tcp_handler.PushAction{
+		Job:    proto.String(job),
+		Labels: grouping,
+		Format: tcp_handler.PushAction_PROTO_DELIMITED.Enum(),
+		Body:   body.Bytes(),
+	}, nil
+}
+
+// requestCompressed sends the delimited msg, compressed with the compression
+// negotiated for the connection, if any.
+func (c *Client) requestCompressed(ctx context.Context, kind uint32, msg proto.Message) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if _, err := pbutil.WriteDelimited(buf, msg); err != nil {
+		return nil, err
+	}
+	cn, err := c.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := buf.Bytes()
+	if cn.compression != tcp_server.CompressionNone {
+		if req, err = compression.Compress(req, cn.compression); err != nil {
+			return nil, err
+		}
+		kind |= tcp_server.FlagCompressed
+	}
+	return cn.request(ctx, kind, req)
+}
+
+// Delete deletes the group identified by job and grouping.
+func (c *Client) Delete(ctx context.Context, job string, grouping map[string]string) error {
+	action := &tcp_handler.DeleteAction{
+		Job:    proto.String(job),
+		Labels: grouping,
+	}
+	_, err := c.requestMessage(ctx, tcp_server.KindDelete, action)
+	return err
+}
+
+// DeleteFamilies deletes the metric families of the provided names from the
+// group identified by job and grouping, keeping the rest of the group.
+func (c *Client) DeleteFamilies(ctx context.Context, job string, grouping map[string]string, families ...string) error {
+	if len(families) == 0 {
+		return errors.New("no metric families to delete")
+	}
+	action := &tcp_handler.DeleteAction{
+		Job:      proto.String(job),
+		Labels:   grouping,
+		Families: families,
+	}
+	_, err := c.requestMessage(ctx, tcp_server.KindDelete, action)
+	return err
+}
+
+// DeleteMatching deletes all groups matching any of the provided selectors,
+// e.g. {job="job1",instance=~"a.*"}, and returns how many groups it has deleted.
+func (c *Client) DeleteMatching(ctx context.Context, selectors ...string) (int, error) {
+	body, err := c.requestMessage(ctx, tcp_server.KindDeleteMatching, &tcp_handler.DeleteMatchingAction{
+		Match: selectors,
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp := &tcp_handler.DeleteMatchingResponse{}
+	if err := proto.Unmarshal(body, resp); err != nil {
+		return 0, err
+	}
+	return int(resp.GetDeletedGroups()), nil
+}
+
+// Healthy returns nil if the Pushgateway reports to be healthy.
+func (c *Client) Healthy(ctx context.Context) error {
+	_, err := c.Request(ctx, tcp_server.KindHealthy, nil)
+	return err
+}
+
+// Ready returns nil if the Pushgateway reports to be ready.
+func (c *Client) Ready(ctx context.Context) error {
+	_, err := c.Request(ctx, tcp_server.KindReady, nil)
+	return err
+}
+
+// Status returns build and runtime information of the Pushgateway.
+func (c *Client) Status(ctx context.Context) (map[string]string, error) {
+	body, err := c.Request(ctx, tcp_server.KindStatus, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := &tcp_handler.MapResponse{}
+	if err := proto.Unmarshal(body, resp); err != nil {
+		return nil, err
+	}
+	return resp.GetMap(), nil
+}
+
+func (c *Client) requestMessage(ctx context.Context, kind uint32, msg proto.Message) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if _, err := pbutil.WriteDelimited(buf, msg); err != nil {
+		return nil, err
+	}
+	return c.Request(ctx, kind, buf.Bytes())
+}
+
+// Request sends a request of the given kind and waits for its response. If
+// the server answers with an error, a *tcp_server.RequestError is
+// returned. If no connection is available, Request waits for one until ctx is
+// done.
+func (c *Client) Request(ctx context.Context, kind uint32, body []byte) ([]byte, error) {
+	cn, err := c.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cn.request(ctx, kind, body)
+}
+
+// ProtocolVersion returns the protocol version negotiated for the current
+// connection, or 0 if there is no connection.
+func (c *Client) ProtocolVersion() uint32 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.conn == nil {
+		return 0
+	}
+	return c.conn.version
+}
+
+// Compression returns the compression of pushes negotiated for the current
+// connection, or an empty string if there is no connection.
+func (c *Client) Compression() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.conn == nil {
+		return ""
+	}
+	return c.conn.compression
+}
+
+// getConn returns the current connection, waiting for one if needed.
+func (c *Client) getConn(ctx context.Context) (*conn, error) {
+	for {
+		c.mtx.Lock()
+		cn, connected := c.conn, c.connected
+		c.mtx.Unlock()
+		if cn != nil {
+			return cn, nil
+		}
+		select {
+		case <-connected:
+		case <-c.closed:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dial connects to the server, performing the TLS handshake if configured.
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	raw, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil || c.opts.TLSConfig == nil {
+		return raw, err
+	}
+
+	config := c.opts.TLSConfig.Clone()
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(c.address); err == nil {
+			config.ServerName = host
+		}
+	}
+	tc := tls.Client(raw, config)
+	if deadline, ok := ctx.Deadline(); ok {
+		tc.SetDeadline(deadline)
+	} else {
+		tc.SetDeadline(time.Now().Add(handshakeTimeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// connect dials the server and authenticates. The returned channel is closed
+// once the connection is broken.
+func (c *Client) connect(ctx context.Context) (*conn, <-chan struct{}, error) {
+	raw, err := c.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cn := newConn(raw, c.opts.MaxFrameSize)
+	readDone := make(chan struct{})
+	go func() {
+		cn.read()
+		close(readDone)
+	}()
+	if err := c.hello(ctx, cn); err != nil {
+		cn.close(err)
+		<-readDone
+		return nil, nil, err
+	}
+	if err := c.authenticate(ctx, cn); err != nil {
+		cn.close(err)
+		<-readDone
+		return nil, nil, err
+	}
+	return cn, readDone, nil
+}
+
+// hello negotiates the protocol version and capabilities of cn. Servers that
+// predate negotiation are assumed to speak the first protocol version.
+func (c *Client) hello(ctx context.Context, cn *conn) error {
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	compressions := []string{tcp_server.CompressionNone}
+	if c.opts.Compression != "" {
+		compressions = []string{c.opts.Compression, tcp_server.CompressionNone}
+	}
+	body, err := proto.Marshal(&tcp_server.Hello{
+		MinVersion:   proto.Uint32(tcp_server.MinProtocolVersion),
+		MaxVersion:   proto.Uint32(tcp_server.MaxProtocolVersion),
+		Encodings:    []string{tcp_server.EncodingProtoDelimited},
+		Compressions: compressions,
+		MaxFrameSize: proto.Uint32(c.opts.MaxFrameSize),
+	})
+	if err != nil {
+		return err
+	}
+	cn.compression = tcp_server.CompressionNone
+	body, err = cn.request(ctx, tcp_server.KindHello, body)
+	if rerr, ok := err.(*tcp_server.RequestError); ok && rerr.Type == tcp_server.ErrorResponse_NOT_FOUND {
+		cn.version = tcp_server.MinProtocolVersion
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hello := &tcp_server.Hello{}
+	if err := proto.Unmarshal(body, hello); err != nil {
+		return err
+	}
+	cn.version = hello.GetMaxVersion()
+	if len(hello.GetCompressions()) > 0 {
+		cn.compression = hello.GetCompressions()[0]
+	}
+	if m := hello.GetMaxFrameSize(); m > 0 && m < c.opts.MaxFrameSize {
+		atomic.StoreUint32(&cn.maxFrameSize, m)
+	}
+	return nil
+}
+
+// authenticate authenticates cn if a user is configured.
+func (c *Client) authenticate(ctx context.Context, cn *conn) error {
+	if c.opts.User == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	req := &tcp_server.AuthRequest{User: proto.String(c.opts.User)}
+	if c.opts.UseHMAC {
+		req.Method = tcp_server.AuthRequest_HMAC.Enum()
+		resp, err := cn.auth(ctx, req)
+		if err != nil {
+			return err
+		}
+		req.Proof = tcp_server.ComputeProof([]byte(c.opts.Secret), resp.GetChallenge())
+	} else {
+		req.Token = []byte(c.opts.Secret)
+	}
+	_, err := cn.auth(ctx, req)
+	return err
+}
+
+// run maintains the connection to the server until the Client is closed.
+func (c *Client) run(ctx context.Context) {
+	defer c.wg.Done()
+
+	backoff := c.opts.MinBackoff
+	for {
+		cn, readDone, err := c.connect(ctx)
+		if err != nil {
+			level.Debug(c.logger).Log("msg", "failed to connect", "address", c.address, "backoff", backoff, "err", err)
+			select {
+			case <-time.After(backoff):
+			case <-c.closed:
+				return
+			}
+			backoff *= 2
+			if backoff > c.opts.MaxBackoff {
+				backoff = c.opts.MaxBackoff
+			}
+			continue
+		}
+		backoff = c.opts.MinBackoff
+
+		c.mtx.Lock()
+		c.conn = cn
+		close(c.connected)
+		c.mtx.Unlock()
+
+		// The Client might have been closed before the connection
+		// became visible to Close.
+		select {
+		case <-c.closed:
+			cn.close(ErrClosed)
+		default:
+		}
+
+		go cn.heartbeat(c.opts.HeartbeatInterval)
+		<-readDone
+		level.Debug(c.logger).Log("msg", "connection lost", "address", c.address, "err", cn.err)
+
+		c.mtx.Lock()
+		c.conn = nil
+		c.connected = make(chan struct{})
+		c.mtx.Unlock()
+
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+	}
+}
+
+// conn is one connection to the server.
+type conn struct {
+	raw          net.Conn
+	maxFrameSize uint32 // Accessed atomically, lowered by the hello.
+	version      uint32 // Negotiated protocol version.
+	compression  string // Negotiated compression of pushes.
+
+	writeMtx sync.Mutex // Serializes writes to raw.
+
+	mtx     sync.Mutex // Protects pending.
+	pending map[string]chan *tcp_server.Package
+
+	heartbeats chan struct{} // Heartbeats of the server to be answered.
+
+	once sync.Once
+	done chan struct{} // Closed once the connection is broken.
+	err  error         // Why the connection is broken.
+}
+
+func newConn(raw net.Conn, maxFrameSize uint32) *conn {
+	return &conn{
+		raw:          raw,
+		maxFrameSize: maxFrameSize,
+		pending:      map[string]chan *tcp_server.Package{},
+		heartbeats:   make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+}
+
+func (cn *conn) close(err error) {
+	cn.once.Do(func() {
+		cn.err = err
+		close(cn.done)
+		cn.raw.Close()
+	})
+}
+
+func (cn *conn) register(id []byte) <-chan *tcp_server.Package {
+	ch := make(chan *tcp_server.Package, 1)
+	cn.mtx.Lock()
+	cn.pending[string(id)] = ch
+	cn.mtx.Unlock()
+	return ch
+}
+
+func (cn *conn) unregister(id []byte) {
+	cn.mtx.Lock()
+	delete(cn.pending, string(id))
+	cn.mtx.Unlock()
+}
+
+// write writes pkg to the connection. Packages larger than the max frame size
+// are refused with a BAD_DATA *tcp_server.RequestError, as the server would
+// close the connection upon them.
+func (cn *conn) write(ctx context.Context, pkg *tcp_server.Package) error {
+	data, err := tcp_server.Encode(pkg)
+	if err != nil {
+		return err
+	}
+	if size, max := uint32(len(data)-4), atomic.LoadUint32(&cn.maxFrameSize); size > max {
+		return tcp_server.NewRequestError(tcp_server.ErrorResponse_BAD_DATA, fmt.Errorf(
+			"frame size %d exceeds the maximum of %d bytes", size, max,
+		))
+	}
+
+	cn.writeMtx.Lock()
+	defer cn.writeMtx.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	if err := cn.raw.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	if _, err := cn.raw.Write(data); err != nil {
+		// A partial write leaves the stream in an undefined state.
+		cn.close(err)
+		return err
+	}
+	return nil
+}
+
+// request sends a request of the given kind and waits for its response.
+func (cn *conn) request(ctx context.Context, kind uint32, body []byte) ([]byte, error) {
+	req := tcp_server.NewPackage(kind, body)
+	respCh := cn.register(req.GetId())
+	defer cn.unregister(req.GetId())
+
+	if err := cn.write(ctx, req); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-respCh:
+		if resp.GetKind() == tcp_server.KindError {
+			return nil, decodeError(resp)
+		}
+		return resp.GetBody(), nil
+	case <-cn.done:
+		return nil, cn.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (cn *conn) auth(ctx context.Context, req *tcp_server.AuthRequest) (*tcp_server.AuthResponse, error) {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err = cn.request(ctx, tcp_server.KindAuth, body)
+	if err != nil {
+		return nil, err
+	}
+	resp := &tcp_server.AuthResponse{}
+	if err := proto.Unmarshal(body, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// read reads packages until the connection breaks.
+func (cn *conn) read() {
+	for {
+		pkg, err := readPackage(cn.raw, atomic.LoadUint32(&cn.maxFrameSize))
+		if err != nil {
+			cn.close(err)
+			return
+		}
+
+		switch pkg.GetKind() {
+		case tcp_server.KindHeartbeat:
+			select {
+			case cn.heartbeats <- struct{}{}:
+			default: // An answer is pending already.
+			}
+		case tcp_server.KindResponse, tcp_server.KindError:
+			cn.mtx.Lock()
+			ch, ok := cn.pending[string(pkg.GetId())]
+			cn.mtx.Unlock()
+			if ok {
+				select {
+				case ch <- pkg:
+				default: // Duplicate response.
+				}
+			}
+		}
+	}
+}
+
+// heartbeat answers the heartbeats of the server and, if interval is positive,
+// sends heartbeats on its own at that interval until the connection is broken.
+func (cn *conn) heartbeat(interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-cn.heartbeats:
+		case <-cn.done:
+			return
+		}
+		cn.write(context.Background(), tcp_server.NewPackage(tcp_server.KindHeartbeat, []byte{}))
+	}
+}
+
+// readPackage reads one framed package as written by tcp_server.Encode.
+func readPackage(r io.Reader, maxFrameSize uint32) (*tcp_server.Package, error) {
+	data, err := tcp_server.ReadFrame(r, maxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	return tcp_server.Decode(data)
+}
+
+// decodeError converts a package of kind KindError into a
+// *tcp_server.RequestError.
+func decodeError(pkg *tcp_server.Package) error {
+	resp := &tcp_server.ErrorResponse{}
+	if err := proto.Unmarshal(pkg.GetBody(), resp); err != nil {
+		return err
+	}
+	return tcp_server.NewRequestError(resp.GetType(), errors.New(resp.GetMessage()))
+}
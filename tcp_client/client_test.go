@@ -0,0 +1,537 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+	"github.com/prometheus/pushgateway/tcp_handler"
+	"github.com/prometheus/pushgateway/tcp_server"
+	"github.com/prometheus/pushgateway/testutil"
+)
+
+var (
+	logger = log.NewNopLogger()
+
+	mf1 = &dto.MetricFamily{
+		Name: proto.String("mf1"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Counter: &dto.Counter{
+					Value: proto.Float64(42),
+				},
+			},
+		},
+	}
+	mf2 = &dto.MetricFamily{
+		Name: proto.String("mf2"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Gauge: &dto.Gauge{
+					Value: proto.Float64(3.14),
+				},
+			},
+		},
+	}
+)
+
+// startServer starts a SocketService with all handlers for push, delete,
+// health, and status registered. The returned channel is closed once the
+// service has stopped.
+func startServer(t *testing.T, address string, ms storage.MetricStore) (*tcp_server.SocketService, <-chan struct{}) {
+	s, err := tcp_server.NewSocketService(address, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := map[uint32]tcp_server.HandlerFunc{
+		tcp_server.KindPush:           tcp_handler.Push(ms, false, true, logger),
+		tcp_server.KindPushReplace:    tcp_handler.Push(ms, true, true, logger),
+		tcp_server.KindDelete:         tcp_handler.Delete(ms, logger),
+		tcp_server.KindDeleteMatching: tcp_handler.DeleteMatching(ms, logger),
+		tcp_server.KindPushBatch:      tcp_handler.PushBatch(ms, logger),
+		tcp_server.KindHealthy:        tcp_handler.Healthy(ms),
+		tcp_server.KindReady:          tcp_handler.Ready(ms),
+		tcp_server.KindStatus:         tcp_handler.Status(""),
+	}
+	for kind, h := range routes {
+		if err := s.RegisterRoute(kind, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.Serve()
+		close(stopped)
+	}()
+	return s, stopped
+}
+
+func testContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 5*time.Second)
+}
+
+func TestClient(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	defer ms.Shutdown()
+	s, _ := startServer(t, "127.0.0.1:0", ms)
+	defer s.Stop("test done")
+
+	c := New(s.GetAddr().String(), Options{})
+	defer c.Close()
+	ctx, cancel := testContext()
+	defer cancel()
+
+	if err := c.Healthy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint32(tcp_server.MaxProtocolVersion), c.ProtocolVersion(); expected != got {
+		t.Errorf("Wanted protocol version %d, got %d.", expected, got)
+	}
+	if err := c.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	status, err := c.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := status["birth"]; !ok {
+		t.Errorf("Status %v lacks birth.", status)
+	}
+
+	grouping := map[string]string{"instance": "inst1"}
+	if err := c.Push(ctx, "job1", grouping, []*dto.MetricFamily{mf1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PushAdd(ctx, "job1", grouping, []*dto.MetricFamily{mf2}); err != nil {
+		t.Fatal(err)
+	}
+	groups := ms.GetMetricFamiliesMap()
+	if expected, got := 1, len(groups); expected != got {
+		t.Fatalf("Wanted %d groups, got %d.", expected, got)
+	}
+	for _, g := range groups {
+		if expected, got := "job1", g.Labels["job"]; expected != got {
+			t.Errorf("Wanted job %q, got %q.", expected, got)
+		}
+		for _, name := range []string{"mf1", "mf2"} {
+			if _, ok := g.Metrics[name]; !ok {
+				t.Errorf("Metric family %s missing.", name)
+			}
+		}
+	}
+
+	// Push replaces everything.
+	if err := c.Push(ctx, "job1", grouping, []*dto.MetricFamily{mf2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range ms.GetMetricFamiliesMap() {
+		if _, ok := g.Metrics["mf1"]; ok {
+			t.Error("Metric family mf1 unexpectedly still present.")
+		}
+	}
+
+	// Delete single metric families.
+	if err := c.PushAdd(ctx, "job1", grouping, []*dto.MetricFamily{mf1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteFamilies(ctx, "job1", grouping, "mf1"); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the delete to be processed.
+	if err := c.PushAdd(ctx, "job1", grouping, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range ms.GetMetricFamiliesMap() {
+		if _, ok := g.Metrics["mf1"]; ok {
+			t.Error("Metric family mf1 unexpectedly still present.")
+		}
+		if _, ok := g.Metrics["mf2"]; !ok {
+			t.Error("Metric family mf2 missing.")
+		}
+	}
+
+	// Inconsistent push results in a typed error.
+	inconsistent := &dto.MetricFamily{
+		Name: proto.String("mf2"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{{Name: proto.String("x"), Value: proto.String("y")}},
+				Counter: &dto.Counter{
+					Value: proto.Float64(1),
+				},
+			},
+		},
+	}
+	err = c.PushAdd(ctx, "job2", nil, []*dto.MetricFamily{inconsistent})
+	reqErr, ok := err.(*tcp_server.RequestError)
+	if !ok {
+		t.Fatalf("Wanted *tcp_server.RequestError, got %v.", err)
+	}
+	if expected, got := tcp_server.ErrorResponse_BAD_DATA, reqErr.Type; expected != got {
+		t.Errorf("Wanted error type %v, got %v.", expected, got)
+	}
+
+	if err := c.Delete(ctx, "job1", grouping); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the delete to be processed.
+	if err := c.Push(ctx, "job3", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range ms.GetMetricFamiliesMap() {
+		if g.Labels["job"] == "job1" {
+			t.Error("Group of job1 unexpectedly still present.")
+		}
+	}
+
+	// The failed push has created a group for job2, too.
+	deleted, err := c.DeleteMatching(ctx, `{job=~"job[23]"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, deleted; expected != got {
+		t.Errorf("Wanted %d deleted groups, got %d.", expected, got)
+	}
+	if expected, got := 0, len(ms.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Wanted %d groups, got %d.", expected, got)
+	}
+}
+
+func TestClientPushBatch(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	defer ms.Shutdown()
+	s, _ := startServer(t, "127.0.0.1:0", ms)
+	defer s.Stop("test done")
+
+	c := New(s.GetAddr().String(), Options{})
+	defer c.Close()
+	ctx, cancel := testContext()
+	defer cancel()
+
+	if err := c.PushBatch(ctx, []BatchPush{
+		{Job: "job1", Grouping: map[string]string{"instance": "a"}, MetricFamilies: []*dto.MetricFamily{mf1}},
+		{Job: "job1", Grouping: map[string]string{"instance": "b"}, Replace: true, MetricFamilies: []*dto.MetricFamily{mf1, mf2}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, len(ms.GetMetricFamiliesMap()); expected != got {
+		t.Fatalf("Wanted %d groups, got %d.", expected, got)
+	}
+
+	// The second push is inconsistent with the first one, so none is applied.
+	inconsistent := &dto.MetricFamily{
+		Name: proto.String("mf2"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{{Name: proto.String("x"), Value: proto.String("y")}},
+				Counter: &dto.Counter{
+					Value: proto.Float64(1),
+				},
+			},
+		},
+	}
+	err := c.PushBatch(ctx, []BatchPush{
+		{Job: "job2", MetricFamilies: []*dto.MetricFamily{mf2}},
+		{Job: "job3", MetricFamilies: []*dto.MetricFamily{inconsistent}},
+	})
+	batchErr, ok := err.(*BatchError)
+	if !ok {
+		t.Fatalf("Wanted *BatchError, got %v.", err)
+	}
+	if expected, got := 2, len(batchErr.Errors); expected != got {
+		t.Fatalf("Wanted %d errors, got %d.", expected, got)
+	}
+	if batchErr.Errors[0] != "" || batchErr.Errors[1] == "" {
+		t.Errorf("Wanted an error for the second push only, got %q.", batchErr.Errors)
+	}
+	// The invalid push has created a group for job3 with its failure
+	// timestamp, but without metrics.
+	for _, g := range ms.GetMetricFamiliesMap() {
+		if job := g.Labels["job"]; job != "job1" {
+			if _, ok := g.Metrics["mf2"]; ok {
+				t.Errorf("Metric family mf2 unexpectedly present for %s.", job)
+			}
+		}
+	}
+}
+
+func TestClientCompression(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	defer ms.Shutdown()
+	s, _ := startServer(t, "127.0.0.1:0", ms)
+	defer s.Stop("test done")
+	ctx, cancel := testContext()
+	defer cancel()
+
+	for compression, negotiated := range map[string]string{
+		"":                           tcp_server.CompressionNone,
+		"br":                         tcp_server.CompressionNone,
+		tcp_server.CompressionGzip:   tcp_server.CompressionGzip,
+		tcp_server.CompressionZstd:   tcp_server.CompressionZstd,
+		tcp_server.CompressionSnappy: tcp_server.CompressionSnappy,
+	} {
+		c := New(s.GetAddr().String(), Options{Compression: compression})
+		if err := c.Push(ctx, "job_"+negotiated, nil, []*dto.MetricFamily{mf1, mf2}); err != nil {
+			t.Fatalf("%q: %v", compression, err)
+		}
+		if expected, got := negotiated, c.Compression(); expected != got {
+			t.Errorf("%q: Wanted compression %q, got %q.", compression, expected, got)
+		}
+		c.Close()
+	}
+	groups := ms.GetMetricFamiliesMap()
+	if expected, got := 4, len(groups); expected != got {
+		t.Fatalf("Wanted %d groups, got %d.", expected, got)
+	}
+	for _, g := range groups {
+		for _, name := range []string{"mf1", "mf2"} {
+			if _, ok := g.Metrics[name]; !ok {
+				t.Errorf("Metric family %s missing in group %v.", name, g.Labels)
+			}
+		}
+	}
+}
+
+func TestClientMaxFrameSize(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	defer ms.Shutdown()
+	s, _ := startServer(t, "127.0.0.1:0", ms)
+	defer s.Stop("test done")
+
+	c := New(s.GetAddr().String(), Options{MaxFrameSize: 256})
+	defer c.Close()
+	ctx, cancel := testContext()
+	defer cancel()
+
+	large := &dto.MetricFamily{
+		Name: proto.String("large"),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for i := 0; i < 20; i++ {
+		large.Metric = append(large.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: proto.String("i"), Value: proto.String(fmt.Sprint(i))}},
+			Gauge: &dto.Gauge{Value: proto.Float64(float64(i))},
+		})
+	}
+	err := c.Push(ctx, "job1", nil, []*dto.MetricFamily{large})
+	rerr, ok := err.(*tcp_server.RequestError)
+	if !ok {
+		t.Fatalf("Wanted *tcp_server.RequestError, got %v.", err)
+	}
+	if expected, got := tcp_server.ErrorResponse_BAD_DATA, rerr.Type; expected != got {
+		t.Errorf("Wanted error type %s, got %s.", expected, got)
+	}
+	if len(ms.GetMetricFamiliesMap()) != 0 {
+		t.Errorf("Unexpected groups: %v", ms.GetMetricFamiliesMap())
+	}
+
+	// The connection is still usable.
+	if err := c.Push(ctx, "job1", nil, []*dto.MetricFamily{mf1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	defer ms.Shutdown()
+
+	// Reserve an address without a server listening.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	c := New(address, Options{MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond})
+	defer c.Close()
+
+	// No server, so the request runs into the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.Healthy(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wanted %v, got %v.", context.DeadlineExceeded, err)
+	}
+
+	s, stopped := startServer(t, address, ms)
+	ctx, cancel = testContext()
+	defer cancel()
+	if err := c.Healthy(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart the server. The client has to reconnect.
+	s.Stop("restart")
+	<-stopped
+	s, _ = startServer(t, address, ms)
+	defer s.Stop("test done")
+	for {
+		err := c.Healthy(ctx)
+		if err == nil {
+			break
+		}
+		if err == context.DeadlineExceeded {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClientHeartbeat(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	defer ms.Shutdown()
+	s, err := tcp_server.NewSocketService("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetHeartBeat(20*time.Millisecond, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterRoute(tcp_server.KindHealthy, tcp_handler.Healthy(ms)); err != nil {
+		t.Fatal(err)
+	}
+	disconnected := make(chan struct{}, 1)
+	s.RegisterDisconnectHandler(func(*tcp_server.Session, error) { disconnected <- struct{}{} })
+	go s.Serve()
+	defer s.Stop("test done")
+
+	c := New(s.GetAddr().String(), Options{})
+	defer c.Close()
+	ctx, cancel := testContext()
+	defer cancel()
+	if err := c.Healthy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// The client is idle for longer than the heartbeat timeout but answers
+	// the heartbeats of the server, so the connection has to survive.
+	select {
+	case <-disconnected:
+		t.Fatal("Connection unexpectedly closed.")
+	case <-time.After(300 * time.Millisecond):
+	}
+	if err := c.Healthy(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	ca := testutil.NewCertificateAuthority("test-ca")
+	keyPair := func(commonName string) tls.Certificate {
+		certPEM, keyPEM := ca.Issue(commonName)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.CertPEM)
+
+	ms := storage.NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	defer ms.Shutdown()
+	s, err := tcp_server.NewSocketService("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTLS(&tls.Config{
+		Certificates: []tls.Certificate{keyPair("server")},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterRoute(tcp_server.KindHealthy, tcp_handler.Healthy(ms)); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Stop("test done")
+
+	c := New(s.GetAddr().String(), Options{
+		TLSConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{keyPair("client")},
+		},
+	})
+	defer c.Close()
+	ctx, cancel := testContext()
+	defer cancel()
+
+	if err := c.Healthy(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	// Pushes are accounted to the authenticated user, not to the job.
+	ms := storage.NewDiskMetricStore(
+		"", 100*time.Millisecond, nil, logger,
+		storage.WithQuotas(storage.QuotaConfig{"job1": {MaxGroups: 1}}),
+	)
+	defer ms.Shutdown()
+	s, err := tcp_server.NewSocketService("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := tcp_server.NewAuthenticator(map[string]string{"job1": "secret"})
+	if err := s.SetAuthentication(auth, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterRoute(tcp_server.KindHealthy, tcp_handler.Healthy(ms)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterRoute(tcp_server.KindPushReplace, tcp_handler.Push(ms, true, true, logger)); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Stop("test done")
+
+	for _, useHMAC := range []bool{false, true} {
+		c := New(s.GetAddr().String(), Options{User: "job1", Secret: "secret", UseHMAC: useHMAC})
+		ctx, cancel := testContext()
+		if err := c.Healthy(ctx); err != nil {
+			t.Errorf("HMAC %t: %s", useHMAC, err)
+		}
+		if err := c.Push(ctx, "job2", nil, []*dto.MetricFamily{proto.Clone(mf1).(*dto.MetricFamily)}); err != nil {
+			t.Errorf("HMAC %t: %s", useHMAC, err)
+		}
+		if err := c.Push(ctx, "job3", nil, []*dto.MetricFamily{proto.Clone(mf1).(*dto.MetricFamily)}); err == nil {
+			t.Errorf("HMAC %t: Expected error pushing beyond the group quota of the user.", useHMAC)
+		}
+		cancel()
+		c.Close()
+	}
+
+	c := New(s.GetAddr().String(), Options{User: "job1", Secret: "wrong"})
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := c.Healthy(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wanted %v with wrong secret, got %v.", context.DeadlineExceeded, err)
+	}
+}
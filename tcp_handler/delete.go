@@ -15,78 +15,114 @@ package tcp_handler
 
 import (
 	"bytes"
-	"encoding/base64"
-	"github.com/matttproud/golang_protobuf_extensions/pbutil"
-	"github.com/prometheus/pushgateway/storage"
-	"io"
-	"strings"
-	"sync"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	"github.com/prometheus/common/model"
 
+	"github.com/prometheus/pushgateway/storage"
 	. "github.com/prometheus/pushgateway/tcp_server"
 )
 
-
-// Delete returns a handler that accepts delete requests.
+// Delete returns a handler that accepts a delimited DeleteAction and deletes
+// the group with the grouping key given by it, or only the metric families of
+// that group named by it.
 //
 // The returned handler is already instrumented for Prometheus.
-func Delete(ms storage.MetricStore, jobBase64Encoded bool, logger log.Logger) func(*Session, *Package) {
-	var mtx sync.Mutex // Protects ps.
-
+func Delete(ms storage.MetricStore, logger log.Logger) HandlerFunc {
 	return InstrumentWithCounter(
-		"delete", func(session *Session, pkg *Package) {
-		mtx.Lock()
-		action := &DeleteAction{}
-		reader := bytes.NewReader(pkg.GetBody())
-
-		_, err := pbutil.ReadDelimited(reader, action)
-		if err != nil {
-			if err == io.EOF {
-				err = nil
+		"delete",
+		func(session *Session, pkg *Package) ([]byte, error) {
+			action := &DeleteAction{}
+			if _, err := pbutil.ReadDelimited(bytes.NewReader(pkg.GetBody()), action); err != nil {
+				level.Debug(logger).Log("msg", "failed to parse delete action", "err", err.Error())
+				return nil, NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf("invalid delete action: %v", err))
 			}
-		}
 
-		job := *action.Job
-		if jobBase64Encoded {
-			var err error
-			if job, err = _decodeBase64(job); err != nil {
-				level.Debug(logger).Log("msg", "invalid base64 encoding in job name", "job", job, "err", err.Error())
-				return
+			labels, err := groupingLabels(action.GetJob(), action.GetLabels())
+			if err != nil {
+				level.Debug(logger).Log("msg", "invalid grouping key", "err", err.Error())
+				return nil, NewRequestError(ErrorResponse_BAD_DATA, err)
 			}
-		}
-		labels := action.Labels
-
-		mtx.Unlock()
+			var families []string
+			for _, name := range action.GetFamilies() {
+				if !model.IsValidMetricName(model.LabelValue(name)) {
+					level.Debug(logger).Log("msg", "invalid metric family name", "family", name)
+					return nil, NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf("invalid metric family name %q", name))
+				}
+				families = append(families, name)
+			}
+			ms.SubmitWriteRequest(storage.WriteRequest{
+				Labels:         labels,
+				Timestamp:      time.Now(),
+				DeleteFamilies: families,
+			})
+			return nil, nil
+		},
+	)
+}
 
-		if err != nil {
-			level.Debug(logger).Log("msg", "failed to parse URL", "url", labels, "err", err.Error())
-			return
-		}
-		if job == "" {
-			level.Debug(logger).Log("msg", "job name is required")
-			return
-		}
-		labels["job"] = job
-		ms.SubmitWriteRequest(storage.WriteRequest{
-			Labels:    labels,
-			Timestamp: time.Now(),
-		})
+// DeleteMatching returns a handler that accepts a delimited
+// DeleteMatchingAction and deletes all groups matching any of its selectors. It
+// answers with a DeleteMatchingResponse.
+//
+// The returned handler is already instrumented for Prometheus.
+func DeleteMatching(ms storage.MetricStore, logger log.Logger) HandlerFunc {
+	return InstrumentWithCounter(
+		"delete_matching",
+		func(session *Session, pkg *Package) ([]byte, error) {
+			action := &DeleteMatchingAction{}
+			if _, err := pbutil.ReadDelimited(bytes.NewReader(pkg.GetBody()), action); err != nil {
+				level.Debug(logger).Log("msg", "failed to parse delete matching action", "err", err.Error())
+				return nil, NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf("invalid delete matching action: %v", err))
+			}
+			if len(action.GetMatch()) == 0 {
+				return nil, NewRequestError(ErrorResponse_BAD_DATA, errors.New("no selector provided"))
+			}
+			matcherSets := make([][]*storage.Matcher, 0, len(action.GetMatch()))
+			for _, s := range action.GetMatch() {
+				matchers, err := storage.ParseMatchers(s)
+				if err != nil {
+					level.Debug(logger).Log("msg", "invalid selector", "err", err.Error())
+					return nil, NewRequestError(ErrorResponse_BAD_DATA, err)
+				}
+				matcherSets = append(matcherSets, matchers)
+			}
 
-		pkg, err = NewSuccessResponse(pkg.GetId())
-		if err != nil {
-			level.Error(logger).Log(err.Error())
-		}
-		session.GetConn().SendPackage(pkg)
-	})
+			errCh := make(chan error, 1)
+			result := &storage.WriteResult{}
+			ms.SubmitWriteRequest(storage.WriteRequest{
+				Timestamp:   time.Now(),
+				MatcherSets: matcherSets,
+				Done:        errCh,
+				Result:      result,
+			})
+			var firstErr error
+			for err := range errCh {
+				// Send only first error, but log all of them.
+				if firstErr == nil {
+					firstErr = NewRequestError(
+						ErrorResponse_BAD_DATA,
+						fmt.Errorf("matching groups could not be deleted: %v", err),
+					)
+				}
+				level.Error(logger).Log(
+					"msg", "matching groups could not be deleted",
+					"source", session.GetConn().GetName(),
+					"err", err.Error(),
+				)
+			}
+			if firstErr != nil {
+				return nil, firstErr
+			}
+			return proto.Marshal(&DeleteMatchingResponse{
+				DeletedGroups: proto.Uint32(uint32(result.DeletedGroups)),
+			})
+		},
+	)
 }
-
-// decodeBase64 decodes the provided string using the “Base 64 Encoding with URL
-// and Filename Safe Alphabet” (RFC 4648). Padding characters (i.e. trailing
-// '=') are ignored.
-func _decodeBase64(s string) (string, error) {
-	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
-	return string(b), err
-}
\ No newline at end of file
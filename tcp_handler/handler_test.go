@@ -0,0 +1,643 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/protobuf/proto"
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+	. "github.com/prometheus/pushgateway/tcp_server"
+)
+
+var logger = log.NewNopLogger()
+
+// MockMetricStore isn't doing any of the validation and sanitation a real
+// metric store implementation has to do. Those are tested in the storage
+// package. Here we only ensure that the right method calls are performed
+// by the code in the handlers.
+type MockMetricStore struct {
+	mtx              sync.Mutex
+	lastWriteRequest storage.WriteRequest
+	metricGroups     storage.GroupingKeyToMetricGroup
+	writeRequests    []storage.WriteRequest
+	err              error   // If non-nil, will be sent to Done channel in request.
+	deletedGroups    int     // Stored in the Result of a request with MatcherSets.
+	batchErrors      []error // Stored in the Result of a request with a Batch.
+}
+
+func (m *MockMetricStore) SubmitWriteRequest(req storage.WriteRequest) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.writeRequests = append(m.writeRequests, req)
+	m.lastWriteRequest = req
+	if req.MatcherSets != nil && req.Result != nil {
+		req.Result.DeletedGroups = m.deletedGroups
+	}
+	if req.Batch != nil && req.Result != nil {
+		req.Result.BatchErrors = m.batchErrors
+	}
+	if req.Done != nil {
+		if m.err != nil {
+			req.Done <- m.err
+		}
+		close(req.Done)
+	}
+}
+
+func (m *MockMetricStore) GetMetricFamilies() []*dto.MetricFamily {
+	panic("not implemented")
+}
+
+func (m *MockMetricStore) GetMetricFamiliesMap() storage.GroupingKeyToMetricGroup {
+	return m.metricGroups
+}
+
+func (m *MockMetricStore) Shutdown() error {
+	return nil
+}
+
+func (m *MockMetricStore) Healthy() error {
+	return nil
+}
+
+func (m *MockMetricStore) Ready() error {
+	return nil
+}
+
+// roundTrip starts a SocketService with the given handler registered for kind,
+// sends one request with the given body, and returns the response.
+func roundTrip(t *testing.T, kind uint32, handler HandlerFunc, body []byte) *Package {
+	s, err := NewSocketService("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop("test done")
+	if err := s.RegisterRoute(kind, handler); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	c, err := net.Dial("tcp", s.GetAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := NewPackage(kind, body)
+	data, err := Encode(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	var size uint32
+	if err := binary.Read(c, binary.LittleEndian, &size); err != nil {
+		t.Fatal(err)
+	}
+	data = make([]byte, size)
+	if _, err := io.ReadFull(c, data); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(req.GetId(), resp.GetId()) {
+		t.Errorf("Response id %x does not match request id %x.", resp.GetId(), req.GetId())
+	}
+	return resp
+}
+
+func delimited(t *testing.T, msgs ...proto.Message) []byte {
+	buf := &bytes.Buffer{}
+	for _, msg := range msgs {
+		if _, err := pbutil.WriteDelimited(buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestPush(t *testing.T) {
+	mms := &MockMetricStore{}
+	handler := Push(mms, false, true, logger)
+	handlerReplace := Push(mms, true, true, logger)
+
+	// No job name.
+	resp := roundTrip(t, KindPush, handler, delimited(t, &PushAction{}))
+	if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if len(mms.writeRequests) != 0 {
+		t.Errorf("Unexpected write request: %#v", mms.writeRequests)
+	}
+
+	// Invalid grouping label.
+	resp = roundTrip(t, KindPush, handler, delimited(t, &PushAction{
+		Job:    proto.String("testjob"),
+		Labels: map[string]string{"__name__": "foo"},
+	}))
+	if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if len(mms.writeRequests) != 0 {
+		t.Errorf("Unexpected write request: %#v", mms.writeRequests)
+	}
+
+	// With job name and instance name and text content.
+	resp = roundTrip(t, KindPush, handler, delimited(t, &PushAction{
+		Job:    proto.String("testjob"),
+		Labels: map[string]string{"instance": "testinstance"},
+		Format: PushAction_TEXT.Enum(),
+		Body:   []byte("some_metric 3.14\nanother_metric 42\n"),
+	}))
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp not set: %#v", mms.lastWriteRequest)
+	}
+	if expected, got := "testjob", mms.lastWriteRequest.Labels["job"]; expected != got {
+		t.Errorf("Wanted job %v, got %v.", expected, got)
+	}
+	if expected, got := "testinstance", mms.lastWriteRequest.Labels["instance"]; expected != got {
+		t.Errorf("Wanted instance %v, got %v.", expected, got)
+	}
+	if mms.lastWriteRequest.Replace {
+		t.Error("Write request unexpectedly has replace set.")
+	}
+	if expected, got := 3.14, mms.lastWriteRequest.MetricFamilies["some_metric"].GetMetric()[0].GetUntyped().GetValue(); expected != got {
+		t.Errorf("Wanted value %v, got %v.", expected, got)
+	}
+
+	// With job name, replace flag, and protobuf content.
+	mf := &dto.MetricFamily{
+		Name: proto.String("some_metric"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Untyped: &dto.Untyped{
+					Value: proto.Float64(1.234),
+				},
+			},
+		},
+	}
+	resp = roundTrip(t, KindPush, handler, delimited(t, &PushAction{
+		Job:     proto.String("testjob"),
+		Replace: proto.Bool(true),
+		Body:    delimited(t, mf),
+		TtlMs:   proto.Int64(90000),
+	}))
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if !mms.lastWriteRequest.Replace {
+		t.Error("Write request does not have replace set.")
+	}
+	if expected, got := 90*time.Second, mms.lastWriteRequest.TTL; expected != got {
+		t.Errorf("Wanted TTL %v, got %v.", expected, got)
+	}
+
+	if !proto.Equal(mf, mms.lastWriteRequest.MetricFamilies["some_metric"]) {
+		t.Errorf("Wanted metric family %v, got %v.", mf, mms.lastWriteRequest.MetricFamilies["some_metric"])
+	}
+
+	// Negative TTL.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	resp = roundTrip(t, KindPush, handler, delimited(t, &PushAction{
+		Job:   proto.String("testjob"),
+		Body:  delimited(t, mf),
+		TtlMs: proto.Int64(-1),
+	}))
+	if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if !mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp unexpectedly set: %#v", mms.lastWriteRequest)
+	}
+
+	// Aggregation.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	resp = roundTrip(t, KindPush, handler, delimited(t, &PushAction{
+		Job:         proto.String("testjob"),
+		Body:        delimited(t, mf),
+		Aggregation: proto.String("max"),
+	}))
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if expected, got := storage.AggregationMax, mms.lastWriteRequest.Aggregation; expected != got {
+		t.Errorf("Wanted aggregation %q, got %q.", expected, got)
+	}
+
+	// Invalid aggregation.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	resp = roundTrip(t, KindPush, handler, delimited(t, &PushAction{
+		Job:         proto.String("testjob"),
+		Body:        delimited(t, mf),
+		Aggregation: proto.String("average"),
+	}))
+	if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if !mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp unexpectedly set: %#v", mms.lastWriteRequest)
+	}
+
+	// OpenMetrics content.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	resp = roundTrip(t, KindPush, handler, delimited(t, &PushAction{
+		Job:    proto.String("testjob"),
+		Format: PushAction_OPENMETRICS.Enum(),
+		Body:   []byte("# TYPE some_counter counter\nsome_counter_total 42 # {trace_id=\"abc\"} 1\n# EOF\n"),
+	}))
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if expected, got := "abc", mms.lastWriteRequest.MetricFamilies["some_counter_total"].GetMetric()[0].GetCounter().GetExemplar().GetLabel()[0].GetValue(); expected != got {
+		t.Errorf("Wanted exemplar label value %q, got %q.", expected, got)
+	}
+
+	// OpenMetrics content without # EOF.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	resp = roundTrip(t, KindPush, handler, delimited(t, &PushAction{
+		Job:    proto.String("testjob"),
+		Format: PushAction_OPENMETRICS.Enum(),
+		Body:   []byte("some_metric 3.14\n"),
+	}))
+	if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if !mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp unexpectedly set: %#v", mms.lastWriteRequest)
+	}
+
+	// Replace via handler, inconsistent with existing metrics.
+	mms.err = errors.New("testerror")
+	resp = roundTrip(t, KindPushReplace, handlerReplace, delimited(t, &PushAction{
+		Job:  proto.String("testjob"),
+		Body: delimited(t, mf),
+	}))
+	if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	errResp := &ErrorResponse{}
+	if err := proto.Unmarshal(resp.GetBody(), errResp); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := ErrorResponse_BAD_DATA, errResp.GetType(); expected != got {
+		t.Errorf("Wanted error type %v, got %v.", expected, got)
+	}
+	if expected, got := "pushed metrics are invalid or inconsistent with existing metrics: testerror", errResp.GetMessage(); expected != got {
+		t.Errorf("Wanted error %q, got %q.", expected, got)
+	}
+	if !mms.lastWriteRequest.Replace {
+		t.Error("Write request does not have replace set.")
+	}
+}
+
+func TestPushBatch(t *testing.T) {
+	mms := &MockMetricStore{}
+	handler := PushBatch(mms, logger)
+
+	// No pushes.
+	resp := roundTrip(t, KindPushBatch, handler, delimited(t, &PushBatchAction{}))
+	if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+
+	// One invalid push.
+	resp = roundTrip(t, KindPushBatch, handler, delimited(t, &PushBatchAction{
+		Pushes: []*PushAction{
+			{Job: proto.String("testjob"), Body: []byte("some_metric 1\n"), Format: PushAction_TEXT.Enum()},
+			{Job: proto.String("testjob"), TtlMs: proto.Int64(-1)},
+		},
+	}))
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Fatalf("Wanted kind %d, got %d.", expected, got)
+	}
+	result := &PushBatchResponse{}
+	if err := proto.Unmarshal(resp.GetBody(), result); err != nil {
+		t.Fatal(err)
+	}
+	if result.GetApplied() {
+		t.Error("Batch with invalid push reported as applied.")
+	}
+	if expected, got := 2, len(result.GetErrors()); expected != got {
+		t.Fatalf("Wanted %d errors, got %d.", expected, got)
+	}
+	if result.GetErrors()[0] != "" || result.GetErrors()[1] == "" {
+		t.Errorf("Wanted an error for the second push only, got %q.", result.GetErrors())
+	}
+	if len(mms.writeRequests) != 0 {
+		t.Errorf("Unexpected write request: %#v", mms.writeRequests)
+	}
+
+	// Valid pushes.
+	action := &PushBatchAction{
+		Pushes: []*PushAction{
+			{
+				Job:    proto.String("testjob"),
+				Labels: map[string]string{"instance": "a"},
+				Format: PushAction_TEXT.Enum(),
+				Body:   []byte("some_metric 3.14\n"),
+			},
+			{
+				Job:     proto.String("testjob"),
+				Labels:  map[string]string{"instance": "b"},
+				Replace: proto.Bool(true),
+				Format:  PushAction_TEXT.Enum(),
+				Body:    []byte("some_metric 42\n"),
+				TtlMs:   proto.Int64(90000),
+			},
+		},
+	}
+	resp = roundTrip(t, KindPushBatch, handler, delimited(t, action))
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Fatalf("Wanted kind %d, got %d.", expected, got)
+	}
+	result = &PushBatchResponse{}
+	if err := proto.Unmarshal(resp.GetBody(), result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.GetApplied() {
+		t.Errorf("Batch not applied: %v", result)
+	}
+	batch := mms.lastWriteRequest.Batch
+	if expected, got := 2, len(batch); expected != got {
+		t.Fatalf("Wanted %d pushes in batch, got %d.", expected, got)
+	}
+	if expected, got := "a", batch[0].Labels["instance"]; expected != got {
+		t.Errorf("Wanted instance %v, got %v.", expected, got)
+	}
+	if batch[0].Replace || !batch[1].Replace {
+		t.Error("Wanted only the second push to replace.")
+	}
+	if expected, got := 90*time.Second, batch[1].TTL; expected != got {
+		t.Errorf("Wanted TTL %v, got %v.", expected, got)
+	}
+	if expected, got := 42., batch[1].MetricFamilies["some_metric"].GetMetric()[0].GetUntyped().GetValue(); expected != got {
+		t.Errorf("Wanted value %v, got %v.", expected, got)
+	}
+
+	// Rejected by the metric store.
+	mms.err = errors.New("1 of 2 pushes in the batch are invalid")
+	mms.batchErrors = []error{errors.New("inconsistent"), nil}
+	resp = roundTrip(t, KindPushBatch, handler, delimited(t, action))
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Fatalf("Wanted kind %d, got %d.", expected, got)
+	}
+	result = &PushBatchResponse{}
+	if err := proto.Unmarshal(resp.GetBody(), result); err != nil {
+		t.Fatal(err)
+	}
+	if result.GetApplied() {
+		t.Error("Rejected batch reported as applied.")
+	}
+	if expected, got := []string{"inconsistent", ""}, result.GetErrors(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted errors %q, got %q.", expected, got)
+	}
+
+	// Rejected without per-push errors.
+	mms.batchErrors = nil
+	resp = roundTrip(t, KindPushBatch, handler, delimited(t, action))
+	if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	mms := &MockMetricStore{}
+	handler := Delete(mms, logger)
+
+	// No job name.
+	resp := roundTrip(t, KindDelete, handler, delimited(t, &DeleteAction{}))
+	if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if len(mms.writeRequests) != 0 {
+		t.Errorf("Unexpected write request: %#v", mms.writeRequests)
+	}
+
+	// With job name and instance name.
+	resp = roundTrip(t, KindDelete, handler, delimited(t, &DeleteAction{
+		Job:    proto.String("testjob"),
+		Labels: map[string]string{"instance": "testinstance"},
+	}))
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if expected, got := "testjob", mms.lastWriteRequest.Labels["job"]; expected != got {
+		t.Errorf("Wanted job %v, got %v.", expected, got)
+	}
+	if expected, got := "testinstance", mms.lastWriteRequest.Labels["instance"]; expected != got {
+		t.Errorf("Wanted instance %v, got %v.", expected, got)
+	}
+	if mms.lastWriteRequest.MetricFamilies != nil {
+		t.Errorf("Write request unexpectedly has metric families: %#v", mms.lastWriteRequest)
+	}
+	if mms.lastWriteRequest.DeleteFamilies != nil {
+		t.Errorf("Write request unexpectedly has families to delete: %#v", mms.lastWriteRequest)
+	}
+
+	// With metric families to delete.
+	resp = roundTrip(t, KindDelete, handler, delimited(t, &DeleteAction{
+		Job:      proto.String("testjob"),
+		Families: []string{"foo_total", "bar"},
+	}))
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if expected, got := []string{"foo_total", "bar"}, mms.lastWriteRequest.DeleteFamilies; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted families to delete %v, got %v.", expected, got)
+	}
+
+	// With an invalid metric family name.
+	mms.writeRequests = nil
+	resp = roundTrip(t, KindDelete, handler, delimited(t, &DeleteAction{
+		Job:      proto.String("testjob"),
+		Families: []string{"foo-bar"},
+	}))
+	if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if len(mms.writeRequests) != 0 {
+		t.Errorf("Unexpected write request: %#v", mms.writeRequests)
+	}
+}
+
+func TestDeleteMatching(t *testing.T) {
+	mms := &MockMetricStore{deletedGroups: 3}
+	handler := DeleteMatching(mms, logger)
+
+	// No selector.
+	resp := roundTrip(t, KindDeleteMatching, handler, delimited(t, &DeleteMatchingAction{}))
+	if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	// Invalid selector.
+	resp = roundTrip(t, KindDeleteMatching, handler, delimited(t, &DeleteMatchingAction{
+		Match: []string{`{job="testjob"}`, `{job=~".*"}`},
+	}))
+	if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if len(mms.writeRequests) != 0 {
+		t.Errorf("Unexpected write request: %#v", mms.writeRequests)
+	}
+
+	resp = roundTrip(t, KindDeleteMatching, handler, delimited(t, &DeleteMatchingAction{
+		Match: []string{`{job="testjob"}`, `{instance=~"a.*",env!="prod"}`},
+	}))
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Fatalf("Wanted kind %d, got %d.", expected, got)
+	}
+	result := &DeleteMatchingResponse{}
+	if err := proto.Unmarshal(resp.GetBody(), result); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint32(3), result.GetDeletedGroups(); expected != got {
+		t.Errorf("Wanted %d deleted groups, got %d.", expected, got)
+	}
+	if expected, got := 2, len(mms.lastWriteRequest.MatcherSets); expected != got {
+		t.Fatalf("Wanted %d matcher sets, got %d.", expected, got)
+	}
+	if expected, got := 2, len(mms.lastWriteRequest.MatcherSets[1]); expected != got {
+		t.Errorf("Wanted %d matchers, got %d.", expected, got)
+	}
+	if mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp not set: %#v", mms.lastWriteRequest)
+	}
+
+	// Error from the store.
+	mms.err = errors.New("cannot delete")
+	resp = roundTrip(t, KindDeleteMatching, handler, delimited(t, &DeleteMatchingAction{
+		Match: []string{`{job="testjob"}`},
+	}))
+	if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+		t.Fatalf("Wanted kind %d, got %d.", expected, got)
+	}
+	errResp := &ErrorResponse{}
+	if err := proto.Unmarshal(resp.GetBody(), errResp); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := ErrorResponse_BAD_DATA, errResp.GetType(); expected != got {
+		t.Errorf("Wanted error type %s, got %s.", expected, got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	mf := &dto.MetricFamily{
+		Name: proto.String("some_metric"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label:   []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String("testjob")}},
+				Untyped: &dto.Untyped{Value: proto.Float64(42)},
+			},
+		},
+	}
+	mms := &MockMetricStore{
+		metricGroups: storage.GroupingKeyToMetricGroup{
+			"job\xfftestjob": storage.MetricGroup{
+				Labels: map[string]string{"job": "testjob"},
+				Metrics: storage.NameToTimestampedMetricFamilyMap{
+					"some_metric": storage.TimestampedMetricFamily{
+						GobbableMetricFamily: (*storage.GobbableMetricFamily)(mf),
+					},
+				},
+			},
+			"job\xffemptyjob": storage.MetricGroup{
+				Labels:  map[string]string{"job": "emptyjob"},
+				Metrics: storage.NameToTimestampedMetricFamilyMap{},
+			},
+		},
+	}
+
+	resp := roundTrip(t, KindMetrics, Metrics(mms), nil)
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Fatalf("Wanted kind %d, got %d.", expected, got)
+	}
+	result := &MetricsResponse{}
+	if err := proto.Unmarshal(resp.GetBody(), result); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, len(result.GetGroups()); expected != got {
+		t.Fatalf("Wanted %d groups, got %d.", expected, got)
+	}
+	empty, group := result.GetGroups()[0], result.GetGroups()[1]
+	if expected, got := "emptyjob", empty.GetLabels()["job"]; expected != got {
+		t.Errorf("Wanted job %q, got %q.", expected, got)
+	}
+	if len(empty.GetMetrics()) != 0 {
+		t.Errorf("Wanted no metrics, got %x.", empty.GetMetrics())
+	}
+	if expected, got := "testjob", group.GetLabels()["job"]; expected != got {
+		t.Errorf("Wanted job %q, got %q.", expected, got)
+	}
+	if !group.GetLastPushSuccessful() {
+		t.Error("Wanted last push to be successful.")
+	}
+	got := &dto.MetricFamily{}
+	r := bytes.NewReader(group.GetMetrics())
+	if _, err := pbutil.ReadDelimited(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(mf, got) {
+		t.Errorf("Wanted metric family %v, got %v.", mf, got)
+	}
+	if r.Len() != 0 {
+		t.Errorf("Wanted one metric family, got %d trailing bytes.", r.Len())
+	}
+}
+
+func TestWipe(t *testing.T) {
+	metricCount := 5
+	mgs := storage.GroupingKeyToMetricGroup{}
+	for i := 0; i < metricCount; i++ {
+		mgs[string(rune('a'+i))] = storage.MetricGroup{}
+	}
+	mms := &MockMetricStore{metricGroups: mgs}
+
+	resp := roundTrip(t, KindWipe, Wipe(mms, logger), nil)
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Fatalf("Wanted kind %d, got %d.", expected, got)
+	}
+	if expected, got := metricCount, len(mms.writeRequests); expected != got {
+		t.Fatalf("Wanted %d write requests, got %d.", expected, got)
+	}
+	for i, wr := range mms.writeRequests {
+		if wr.MetricFamilies != nil {
+			t.Errorf("Write request %d is not a delete request: %#v", i, wr)
+		}
+	}
+}
@@ -14,6 +14,9 @@
 package tcp_handler
 
 import (
+	"strings"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
@@ -36,6 +39,14 @@ var (
 		},
 		[]string{"method"},
 	)
+	tcpPushCompressionRatio = promauto.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "pushgateway_tcp_push_compression_ratio",
+			Help:       "Ratio of decompressed to compressed body size for compressed TCP pushes to the Pushgateway.",
+			Objectives: map[float64]float64{0.1: 0.01, 0.5: 0.05, 0.9: 0.01},
+		},
+		[]string{"method", "compression"},
+	)
 	tcpPushDuration = promauto.NewSummaryVec(
 		prometheus.SummaryOpts{
 			Name:       "pushgateway_tcp_push_duration_seconds",
@@ -46,9 +57,44 @@ var (
 	)
 )
 
-func InstrumentWithCounter(handlerName string, handler func(*Session, *Package)) func(*Session, *Package) {
-	return func(session *Session, pkg *Package) {
-		tcpCnt.MustCurryWith(prometheus.Labels{"handler": handlerName})
-		handler(session, pkg)
+// InstrumentWithCounter counts the requests handled by handler, labeled with
+// the handler name, the package kind as method, and the outcome as code.
+func InstrumentWithCounter(handlerName string, handler HandlerFunc) HandlerFunc {
+	cnt := tcpCnt.MustCurryWith(prometheus.Labels{"handler": handlerName})
+	return func(session *Session, pkg *Package) ([]byte, error) {
+		body, err := handler(session, pkg)
+		cnt.WithLabelValues(code(err), KindName(pkg.GetKind())).Inc()
+		return body, err
+	}
+}
+
+// InstrumentPush observes the body size as sent, the compression ratio of
+// compressed bodies, and the handling duration of push requests, labeled with
+// the provided method.
+func InstrumentPush(method string, handler HandlerFunc) HandlerFunc {
+	size := tcpPushSize.WithLabelValues(method)
+	ratio := tcpPushCompressionRatio.MustCurryWith(prometheus.Labels{"method": method})
+	duration := tcpPushDuration.WithLabelValues(method)
+	return func(session *Session, pkg *Package) ([]byte, error) {
+		start := time.Now()
+		body, err := handler(session, pkg)
+		duration.Observe(time.Since(start).Seconds())
+		size.Observe(float64(pkg.GetWireSize()))
+		if c := pkg.GetCompression(); c != CompressionNone && pkg.GetWireSize() > 0 {
+			ratio.WithLabelValues(c).Observe(float64(len(pkg.GetBody())) / float64(pkg.GetWireSize()))
+		}
+		return body, err
+	}
+}
+
+// code returns the value of the code label for the outcome of a request.
+func code(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	typ := ErrorResponse_INTERNAL
+	if reqErr, ok := err.(*RequestError); ok {
+		typ = reqErr.Type
 	}
+	return strings.ToLower(typ.String())
 }
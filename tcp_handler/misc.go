@@ -14,10 +14,6 @@
 package tcp_handler
 
 import (
-
-	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/log/level"
-
 	"github.com/prometheus/pushgateway/storage"
 	. "github.com/prometheus/pushgateway/tcp_server"
 )
@@ -26,23 +22,14 @@ import (
 // uses the Healthy method of the MetricScore to detect healthy state.
 //
 // The returned handler is already instrumented for Prometheus.
-func Healthy(ms storage.MetricStore, logger log.Logger) func(*Session, *Package) {
+func Healthy(ms storage.MetricStore) HandlerFunc {
 	return InstrumentWithCounter(
 		"healthy",
-		func(session *Session, pkg *Package) {
-			err := ms.Healthy()
-
-			var response *Package
-			if err == nil{
-				response, _ = NewStateResponse(pkg.GetId(), CodeSuccess)
-			} else {
-				response, _ = NewStateResponse(pkg.GetId(), CodeFailed)
-			}
-			if err != nil {
-				level.Error(logger).Log(err.Error())
+		func(*Session, *Package) ([]byte, error) {
+			if err := ms.Healthy(); err != nil {
+				return nil, NewRequestError(ErrorResponse_UNAVAILABLE, err)
 			}
-			session.GetConn().SendPackage(response)
-
+			return nil, nil
 		},
 	)
 }
@@ -52,22 +39,14 @@ func Healthy(ms storage.MetricStore, logger log.Logger) func(*Session, *Package)
 // state.
 //
 // The returned handler is already instrumented for Prometheus.
-func Ready(ms storage.MetricStore, logger log.Logger) func(*Session, *Package) {
+func Ready(ms storage.MetricStore) HandlerFunc {
 	return InstrumentWithCounter(
 		"ready",
-		func(session *Session, pkg *Package) {
-			err := ms.Ready()
-
-			var response *Package
-			if err == nil{
-				response, _ = NewStateResponse(pkg.GetId(), CodeSuccess)
-			} else {
-				response, _ = NewStateResponse(pkg.GetId(), CodeFailed)
-			}
-			if err != nil {
-				level.Error(logger).Log(err.Error())
+		func(*Session, *Package) ([]byte, error) {
+			if err := ms.Ready(); err != nil {
+				return nil, NewRequestError(ErrorResponse_UNAVAILABLE, err)
 			}
-			session.GetConn().SendPackage(response)
+			return nil, nil
 		},
 	)
 }
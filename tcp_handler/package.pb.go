@@ -25,6 +25,68 @@ const (
 // of the legacy proto package is being used.
 const _ = proto.ProtoPackageIsVersion4
 
+type PushAction_Format int32
+
+const (
+	// Varint length-delimited io.prometheus.client.MetricFamily messages.
+	PushAction_PROTO_DELIMITED PushAction_Format = 0
+	// Text exposition format 0.0.4.
+	PushAction_TEXT PushAction_Format = 1
+	// OpenMetrics text format, including the final "# EOF" line.
+	PushAction_OPENMETRICS PushAction_Format = 2
+)
+
+// Enum value maps for PushAction_Format.
+var (
+	PushAction_Format_name = map[int32]string{
+		0: "PROTO_DELIMITED",
+		1: "TEXT",
+		2: "OPENMETRICS",
+	}
+	PushAction_Format_value = map[string]int32{
+		"PROTO_DELIMITED": 0,
+		"TEXT":            1,
+		"OPENMETRICS":     2,
+	}
+)
+
+func (x PushAction_Format) Enum() *PushAction_Format {
+	p := new(PushAction_Format)
+	*p = x
+	return p
+}
+
+func (x PushAction_Format) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (PushAction_Format) Descriptor() protoreflect.EnumDescriptor {
+	return file_package_proto_enumTypes[0].Descriptor()
+}
+
+func (PushAction_Format) Type() protoreflect.EnumType {
+	return &file_package_proto_enumTypes[0]
+}
+
+func (x PushAction_Format) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Do not use.
+func (x *PushAction_Format) UnmarshalJSON(b []byte) error {
+	num, err := protoimpl.X.UnmarshalJSONEnum(x.Descriptor(), b)
+	if err != nil {
+		return err
+	}
+	*x = PushAction_Format(num)
+	return nil
+}
+
+// Deprecated: Use PushAction_Format.Descriptor instead.
+func (PushAction_Format) EnumDescriptor() ([]byte, []int) {
+	return file_package_proto_rawDescGZIP(), []int{3, 0}
+}
+
 type DeleteAction struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -32,6 +94,9 @@ type DeleteAction struct {
 
 	Job    *string           `protobuf:"bytes,1,opt,name=job" json:"job,omitempty"`
 	Labels map[string]string `protobuf:"bytes,2,rep,name=labels" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// If not empty, only the metric families of these names are deleted from
+	// the group, like with the family parameters of DELETE over HTTP.
+	Families []string `protobuf:"bytes,3,rep,name=families" json:"families,omitempty"`
 }
 
 func (x *DeleteAction) Reset() {
@@ -80,6 +145,370 @@ func (x *DeleteAction) GetLabels() map[string]string {
 	return nil
 }
 
+func (x *DeleteAction) GetFamilies() []string {
+	if x != nil {
+		return x.Families
+	}
+	return nil
+}
+
+// DeleteMatchingAction deletes all groups matching any of the selectors, like
+// the match[] parameters of DELETE /api/v1/metrics over HTTP.
+type DeleteMatchingAction struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Match []string `protobuf:"bytes,1,rep,name=match" json:"match,omitempty"`
+}
+
+func (x *DeleteMatchingAction) Reset() {
+	*x = DeleteMatchingAction{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_package_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DeleteMatchingAction) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteMatchingAction) ProtoMessage() {}
+
+func (x *DeleteMatchingAction) ProtoReflect() protoreflect.Message {
+	mi := &file_package_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteMatchingAction.ProtoReflect.Descriptor instead.
+func (*DeleteMatchingAction) Descriptor() ([]byte, []int) {
+	return file_package_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *DeleteMatchingAction) GetMatch() []string {
+	if x != nil {
+		return x.Match
+	}
+	return nil
+}
+
+type DeleteMatchingResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	DeletedGroups *uint32 `protobuf:"varint,1,opt,name=deleted_groups,json=deletedGroups" json:"deleted_groups,omitempty"`
+}
+
+func (x *DeleteMatchingResponse) Reset() {
+	*x = DeleteMatchingResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_package_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DeleteMatchingResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteMatchingResponse) ProtoMessage() {}
+
+func (x *DeleteMatchingResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_package_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteMatchingResponse.ProtoReflect.Descriptor instead.
+func (*DeleteMatchingResponse) Descriptor() ([]byte, []int) {
+	return file_package_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *DeleteMatchingResponse) GetDeletedGroups() uint32 {
+	if x != nil && x.DeletedGroups != nil {
+		return *x.DeletedGroups
+	}
+	return 0
+}
+
+type PushAction struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Job    *string           `protobuf:"bytes,1,opt,name=job" json:"job,omitempty"`
+	Labels map[string]string `protobuf:"bytes,2,rep,name=labels" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// If true, all metrics in the group are replaced, as with KindPushReplace.
+	Replace *bool              `protobuf:"varint,3,opt,name=replace" json:"replace,omitempty"`
+	Format  *PushAction_Format `protobuf:"varint,4,opt,name=format,enum=tcp_handler.PushAction_Format,def=0" json:"format,omitempty"`
+	Body    []byte             `protobuf:"bytes,5,opt,name=body" json:"body,omitempty"`
+	// If positive, the group expires after not being pushed to for that many
+	// milliseconds, overriding the default TTL.
+	TtlMs *int64 `protobuf:"varint,6,opt,name=ttl_ms,json=ttlMs" json:"ttl_ms,omitempty"`
+	// If set, the pushed metrics are aggregated into the stored ones, see the
+	// Pushgateway-Aggregation HTTP header for the possible values.
+	Aggregation *string `protobuf:"bytes,7,opt,name=aggregation" json:"aggregation,omitempty"`
+}
+
+// Default values for PushAction fields.
+const (
+	Default_PushAction_Format = PushAction_PROTO_DELIMITED
+)
+
+func (x *PushAction) Reset() {
+	*x = PushAction{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_package_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PushAction) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushAction) ProtoMessage() {}
+
+func (x *PushAction) ProtoReflect() protoreflect.Message {
+	mi := &file_package_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushAction.ProtoReflect.Descriptor instead.
+func (*PushAction) Descriptor() ([]byte, []int) {
+	return file_package_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *PushAction) GetJob() string {
+	if x != nil && x.Job != nil {
+		return *x.Job
+	}
+	return ""
+}
+
+func (x *PushAction) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+func (x *PushAction) GetReplace() bool {
+	if x != nil && x.Replace != nil {
+		return *x.Replace
+	}
+	return false
+}
+
+func (x *PushAction) GetFormat() PushAction_Format {
+	if x != nil && x.Format != nil {
+		return *x.Format
+	}
+	return Default_PushAction_Format
+}
+
+func (x *PushAction) GetBody() []byte {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+func (x *PushAction) GetTtlMs() int64 {
+	if x != nil && x.TtlMs != nil {
+		return *x.TtlMs
+	}
+	return 0
+}
+
+func (x *PushAction) GetAggregation() string {
+	if x != nil && x.Aggregation != nil {
+		return *x.Aggregation
+	}
+	return ""
+}
+
+// PushBatchAction pushes to many groups at once, like POST /metrics/batch over
+// HTTP. Either all pushes are applied or, if any of them is invalid, none of
+// them.
+type PushBatchAction struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Pushes []*PushAction `protobuf:"bytes,1,rep,name=pushes" json:"pushes,omitempty"`
+}
+
+func (x *PushBatchAction) Reset() {
+	*x = PushBatchAction{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_package_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PushBatchAction) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushBatchAction) ProtoMessage() {}
+
+func (x *PushBatchAction) ProtoReflect() protoreflect.Message {
+	mi := &file_package_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushBatchAction.ProtoReflect.Descriptor instead.
+func (*PushBatchAction) Descriptor() ([]byte, []int) {
+	return file_package_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *PushBatchAction) GetPushes() []*PushAction {
+	if x != nil {
+		return x.Pushes
+	}
+	return nil
+}
+
+type PushBatchResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Applied *bool `protobuf:"varint,1,opt,name=applied" json:"applied,omitempty"`
+	// The error of each push of the PushBatchAction, in the same order, empty
+	// for valid ones.
+	Errors []string `protobuf:"bytes,2,rep,name=errors" json:"errors,omitempty"`
+}
+
+func (x *PushBatchResponse) Reset() {
+	*x = PushBatchResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_package_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PushBatchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushBatchResponse) ProtoMessage() {}
+
+func (x *PushBatchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_package_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushBatchResponse.ProtoReflect.Descriptor instead.
+func (*PushBatchResponse) Descriptor() ([]byte, []int) {
+	return file_package_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *PushBatchResponse) GetApplied() bool {
+	if x != nil && x.Applied != nil {
+		return *x.Applied
+	}
+	return false
+}
+
+func (x *PushBatchResponse) GetErrors() []string {
+	if x != nil {
+		return x.Errors
+	}
+	return nil
+}
+
+// MetricsResponse answers KindMetrics with all groups, like GET
+// /api/v1/metrics over HTTP.
+type MetricsResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Groups []*MetricsResponse_Group `protobuf:"bytes,1,rep,name=groups" json:"groups,omitempty"`
+}
+
+func (x *MetricsResponse) Reset() {
+	*x = MetricsResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_package_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MetricsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MetricsResponse) ProtoMessage() {}
+
+func (x *MetricsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_package_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MetricsResponse.ProtoReflect.Descriptor instead.
+func (*MetricsResponse) Descriptor() ([]byte, []int) {
+	return file_package_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *MetricsResponse) GetGroups() []*MetricsResponse_Group {
+	if x != nil {
+		return x.Groups
+	}
+	return nil
+}
+
 type MapResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -91,7 +520,7 @@ type MapResponse struct {
 func (x *MapResponse) Reset() {
 	*x = MapResponse{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_package_proto_msgTypes[1]
+		mi := &file_package_proto_msgTypes[7]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -104,7 +533,7 @@ func (x *MapResponse) String() string {
 func (*MapResponse) ProtoMessage() {}
 
 func (x *MapResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_package_proto_msgTypes[1]
+	mi := &file_package_proto_msgTypes[7]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -117,7 +546,7 @@ func (x *MapResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use MapResponse.ProtoReflect.Descriptor instead.
 func (*MapResponse) Descriptor() ([]byte, []int) {
-	return file_package_proto_rawDescGZIP(), []int{1}
+	return file_package_proto_rawDescGZIP(), []int{7}
 }
 
 func (x *MapResponse) GetMap() map[string]string {
@@ -127,30 +556,155 @@ func (x *MapResponse) GetMap() map[string]string {
 	return nil
 }
 
+type MetricsResponse_Group struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Labels             map[string]string `protobuf:"bytes,1,rep,name=labels" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	LastPushSuccessful *bool             `protobuf:"varint,2,opt,name=last_push_successful,json=lastPushSuccessful" json:"last_push_successful,omitempty"`
+	// Varint length-delimited io.prometheus.client.MetricFamily messages,
+	// including push_time_seconds and push_failure_time_seconds.
+	Metrics []byte `protobuf:"bytes,3,opt,name=metrics" json:"metrics,omitempty"`
+}
+
+func (x *MetricsResponse_Group) Reset() {
+	*x = MetricsResponse_Group{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_package_proto_msgTypes[10]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MetricsResponse_Group) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MetricsResponse_Group) ProtoMessage() {}
+
+func (x *MetricsResponse_Group) ProtoReflect() protoreflect.Message {
+	mi := &file_package_proto_msgTypes[10]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MetricsResponse_Group.ProtoReflect.Descriptor instead.
+func (*MetricsResponse_Group) Descriptor() ([]byte, []int) {
+	return file_package_proto_rawDescGZIP(), []int{6, 0}
+}
+
+func (x *MetricsResponse_Group) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+func (x *MetricsResponse_Group) GetLastPushSuccessful() bool {
+	if x != nil && x.LastPushSuccessful != nil {
+		return *x.LastPushSuccessful
+	}
+	return false
+}
+
+func (x *MetricsResponse_Group) GetMetrics() []byte {
+	if x != nil {
+		return x.Metrics
+	}
+	return nil
+}
+
 var File_package_proto protoreflect.FileDescriptor
 
 var file_package_proto_rawDesc = []byte{
 	0x0a, 0x0d, 0x70, 0x61, 0x63, 0x6b, 0x61, 0x67, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
-	0x0b, 0x74, 0x63, 0x70, 0x5f, 0x68, 0x61, 0x6e, 0x64, 0x6c, 0x65, 0x72, 0x22, 0x9a, 0x01, 0x0a,
+	0x0b, 0x74, 0x63, 0x70, 0x5f, 0x68, 0x61, 0x6e, 0x64, 0x6c, 0x65, 0x72, 0x22, 0xb6, 0x01, 0x0a,
 	0x0c, 0x44, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x10, 0x0a,
 	0x03, 0x6a, 0x6f, 0x62, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6a, 0x6f, 0x62, 0x12,
 	0x3d, 0x0a, 0x06, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32,
 	0x25, 0x2e, 0x74, 0x63, 0x70, 0x5f, 0x68, 0x61, 0x6e, 0x64, 0x6c, 0x65, 0x72, 0x2e, 0x44, 0x65,
 	0x6c, 0x65, 0x74, 0x65, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x4c, 0x61, 0x62, 0x65, 0x6c,
-	0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x06, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x1a, 0x39,
-	0x0a, 0x0b, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a,
-	0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12,
-	0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05,
-	0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x7a, 0x0a, 0x0b, 0x4d, 0x61, 0x70,
-	0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x33, 0x0a, 0x03, 0x6d, 0x61, 0x70, 0x18,
-	0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x21, 0x2e, 0x74, 0x63, 0x70, 0x5f, 0x68, 0x61, 0x6e, 0x64,
-	0x6c, 0x65, 0x72, 0x2e, 0x4d, 0x61, 0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e,
-	0x4d, 0x61, 0x70, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x03, 0x6d, 0x61, 0x70, 0x1a, 0x36, 0x0a,
-	0x08, 0x4d, 0x61, 0x70, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79,
+	0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x06, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x12, 0x1a,
+	0x0a, 0x08, 0x66, 0x61, 0x6d, 0x69, 0x6c, 0x69, 0x65, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09,
+	0x52, 0x08, 0x66, 0x61, 0x6d, 0x69, 0x6c, 0x69, 0x65, 0x73, 0x1a, 0x39, 0x0a, 0x0b, 0x4c, 0x61,
+	0x62, 0x65, 0x6c, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79,
 	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76,
 	0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75,
-	0x65, 0x3a, 0x02, 0x38, 0x01, 0x42, 0x0f, 0x5a, 0x0d, 0x2e, 0x3b, 0x74, 0x63, 0x70, 0x5f, 0x68,
-	0x61, 0x6e, 0x64, 0x6c, 0x65, 0x72,
+	0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x2c, 0x0a, 0x14, 0x44, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x4d,
+	0x61, 0x74, 0x63, 0x68, 0x69, 0x6e, 0x67, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x14, 0x0a,
+	0x05, 0x6d, 0x61, 0x74, 0x63, 0x68, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x05, 0x6d, 0x61,
+	0x74, 0x63, 0x68, 0x22, 0x3f, 0x0a, 0x16, 0x44, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x4d, 0x61, 0x74,
+	0x63, 0x68, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x25, 0x0a,
+	0x0e, 0x64, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x64, 0x5f, 0x67, 0x72, 0x6f, 0x75, 0x70, 0x73, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0d, 0x64, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x64, 0x47, 0x72,
+	0x6f, 0x75, 0x70, 0x73, 0x22, 0x80, 0x03, 0x0a, 0x0a, 0x50, 0x75, 0x73, 0x68, 0x41, 0x63, 0x74,
+	0x69, 0x6f, 0x6e, 0x12, 0x10, 0x0a, 0x03, 0x6a, 0x6f, 0x62, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x03, 0x6a, 0x6f, 0x62, 0x12, 0x3b, 0x0a, 0x06, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x18,
+	0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x23, 0x2e, 0x74, 0x63, 0x70, 0x5f, 0x68, 0x61, 0x6e, 0x64,
+	0x6c, 0x65, 0x72, 0x2e, 0x50, 0x75, 0x73, 0x68, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x4c,
+	0x61, 0x62, 0x65, 0x6c, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x06, 0x6c, 0x61, 0x62, 0x65,
+	0x6c, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x63, 0x65, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x08, 0x52, 0x07, 0x72, 0x65, 0x70, 0x6c, 0x61, 0x63, 0x65, 0x12, 0x47, 0x0a, 0x06,
+	0x66, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1e, 0x2e, 0x74,
+	0x63, 0x70, 0x5f, 0x68, 0x61, 0x6e, 0x64, 0x6c, 0x65, 0x72, 0x2e, 0x50, 0x75, 0x73, 0x68, 0x41,
+	0x63, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x46, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x3a, 0x0f, 0x50, 0x52,
+	0x4f, 0x54, 0x4f, 0x5f, 0x44, 0x45, 0x4c, 0x49, 0x4d, 0x49, 0x54, 0x45, 0x44, 0x52, 0x06, 0x66,
+	0x6f, 0x72, 0x6d, 0x61, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x05, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x12, 0x15, 0x0a, 0x06, 0x74, 0x74, 0x6c,
+	0x5f, 0x6d, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x74, 0x74, 0x6c, 0x4d, 0x73,
+	0x12, 0x20, 0x0a, 0x0b, 0x61, 0x67, 0x67, 0x72, 0x65, 0x67, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18,
+	0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x61, 0x67, 0x67, 0x72, 0x65, 0x67, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x1a, 0x39, 0x0a, 0x0b, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x45, 0x6e, 0x74, 0x72,
+	0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03,
+	0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x38, 0x0a,
+	0x06, 0x46, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x12, 0x13, 0x0a, 0x0f, 0x50, 0x52, 0x4f, 0x54, 0x4f,
+	0x5f, 0x44, 0x45, 0x4c, 0x49, 0x4d, 0x49, 0x54, 0x45, 0x44, 0x10, 0x00, 0x12, 0x08, 0x0a, 0x04,
+	0x54, 0x45, 0x58, 0x54, 0x10, 0x01, 0x12, 0x0f, 0x0a, 0x0b, 0x4f, 0x50, 0x45, 0x4e, 0x4d, 0x45,
+	0x54, 0x52, 0x49, 0x43, 0x53, 0x10, 0x02, 0x22, 0x42, 0x0a, 0x0f, 0x50, 0x75, 0x73, 0x68, 0x42,
+	0x61, 0x74, 0x63, 0x68, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x2f, 0x0a, 0x06, 0x70, 0x75,
+	0x73, 0x68, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x74, 0x63, 0x70,
+	0x5f, 0x68, 0x61, 0x6e, 0x64, 0x6c, 0x65, 0x72, 0x2e, 0x50, 0x75, 0x73, 0x68, 0x41, 0x63, 0x74,
+	0x69, 0x6f, 0x6e, 0x52, 0x06, 0x70, 0x75, 0x73, 0x68, 0x65, 0x73, 0x22, 0x45, 0x0a, 0x11, 0x50,
+	0x75, 0x73, 0x68, 0x42, 0x61, 0x74, 0x63, 0x68, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x12, 0x18, 0x0a, 0x07, 0x61, 0x70, 0x70, 0x6c, 0x69, 0x65, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x08, 0x52, 0x07, 0x61, 0x70, 0x70, 0x6c, 0x69, 0x65, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x65, 0x72,
+	0x72, 0x6f, 0x72, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x06, 0x65, 0x72, 0x72, 0x6f,
+	0x72, 0x73, 0x22, 0xa6, 0x02, 0x0a, 0x0f, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x52, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x3a, 0x0a, 0x06, 0x67, 0x72, 0x6f, 0x75, 0x70, 0x73,
+	0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x22, 0x2e, 0x74, 0x63, 0x70, 0x5f, 0x68, 0x61, 0x6e,
+	0x64, 0x6c, 0x65, 0x72, 0x2e, 0x4d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x2e, 0x47, 0x72, 0x6f, 0x75, 0x70, 0x52, 0x06, 0x67, 0x72, 0x6f, 0x75,
+	0x70, 0x73, 0x1a, 0xd6, 0x01, 0x0a, 0x05, 0x47, 0x72, 0x6f, 0x75, 0x70, 0x12, 0x46, 0x0a, 0x06,
+	0x6c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x2e, 0x2e, 0x74,
+	0x63, 0x70, 0x5f, 0x68, 0x61, 0x6e, 0x64, 0x6c, 0x65, 0x72, 0x2e, 0x4d, 0x65, 0x74, 0x72, 0x69,
+	0x63, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e, 0x47, 0x72, 0x6f, 0x75, 0x70,
+	0x2e, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x06, 0x6c, 0x61,
+	0x62, 0x65, 0x6c, 0x73, 0x12, 0x30, 0x0a, 0x14, 0x6c, 0x61, 0x73, 0x74, 0x5f, 0x70, 0x75, 0x73,
+	0x68, 0x5f, 0x73, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x66, 0x75, 0x6c, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x12, 0x6c, 0x61, 0x73, 0x74, 0x50, 0x75, 0x73, 0x68, 0x53, 0x75, 0x63, 0x63,
+	0x65, 0x73, 0x73, 0x66, 0x75, 0x6c, 0x12, 0x18, 0x0a, 0x07, 0x6d, 0x65, 0x74, 0x72, 0x69, 0x63,
+	0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x6d, 0x65, 0x74, 0x72, 0x69, 0x63, 0x73,
+	0x1a, 0x39, 0x0a, 0x0b, 0x4c, 0x61, 0x62, 0x65, 0x6c, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12,
+	0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65,
+	0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x7a, 0x0a, 0x0b, 0x4d,
+	0x61, 0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x33, 0x0a, 0x03, 0x6d, 0x61,
+	0x70, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x21, 0x2e, 0x74, 0x63, 0x70, 0x5f, 0x68, 0x61,
+	0x6e, 0x64, 0x6c, 0x65, 0x72, 0x2e, 0x4d, 0x61, 0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x2e, 0x4d, 0x61, 0x70, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x03, 0x6d, 0x61, 0x70, 0x1a,
+	0x36, 0x0a, 0x08, 0x4d, 0x61, 0x70, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b,
+	0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a,
+	0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61,
+	0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x42, 0x0f, 0x5a, 0x0d, 0x2e, 0x3b, 0x74, 0x63, 0x70,
+	0x5f, 0x68, 0x61, 0x6e, 0x64, 0x6c, 0x65, 0x72,
 }
 
 var (
@@ -165,21 +719,37 @@ func file_package_proto_rawDescGZIP() []byte {
 	return file_package_proto_rawDescData
 }
 
-var file_package_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_package_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_package_proto_msgTypes = make([]protoimpl.MessageInfo, 13)
 var file_package_proto_goTypes = []interface{}{
-	(*DeleteAction)(nil), // 0: tcp_handler.DeleteAction
-	(*MapResponse)(nil),  // 1: tcp_handler.MapResponse
-	nil,                  // 2: tcp_handler.DeleteAction.LabelsEntry
-	nil,                  // 3: tcp_handler.MapResponse.MapEntry
+	(PushAction_Format)(0),         // 0: tcp_handler.PushAction.Format
+	(*DeleteAction)(nil),           // 1: tcp_handler.DeleteAction
+	(*DeleteMatchingAction)(nil),   // 2: tcp_handler.DeleteMatchingAction
+	(*DeleteMatchingResponse)(nil), // 3: tcp_handler.DeleteMatchingResponse
+	(*PushAction)(nil),             // 4: tcp_handler.PushAction
+	(*PushBatchAction)(nil),        // 5: tcp_handler.PushBatchAction
+	(*PushBatchResponse)(nil),      // 6: tcp_handler.PushBatchResponse
+	(*MetricsResponse)(nil),        // 7: tcp_handler.MetricsResponse
+	(*MapResponse)(nil),            // 8: tcp_handler.MapResponse
+	nil,                            // 9: tcp_handler.DeleteAction.LabelsEntry
+	nil,                            // 10: tcp_handler.PushAction.LabelsEntry
+	(*MetricsResponse_Group)(nil),  // 11: tcp_handler.MetricsResponse.Group
+	nil,                            // 12: tcp_handler.MetricsResponse.Group.LabelsEntry
+	nil,                            // 13: tcp_handler.MapResponse.MapEntry
 }
 var file_package_proto_depIdxs = []int32{
-	2, // 0: tcp_handler.DeleteAction.labels:type_name -> tcp_handler.DeleteAction.LabelsEntry
-	3, // 1: tcp_handler.MapResponse.map:type_name -> tcp_handler.MapResponse.MapEntry
-	2, // [2:2] is the sub-list for method output_type
-	2, // [2:2] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	9,  // 0: tcp_handler.DeleteAction.labels:type_name -> tcp_handler.DeleteAction.LabelsEntry
+	10, // 1: tcp_handler.PushAction.labels:type_name -> tcp_handler.PushAction.LabelsEntry
+	0,  // 2: tcp_handler.PushAction.format:type_name -> tcp_handler.PushAction.Format
+	4,  // 3: tcp_handler.PushBatchAction.pushes:type_name -> tcp_handler.PushAction
+	11, // 4: tcp_handler.MetricsResponse.groups:type_name -> tcp_handler.MetricsResponse.Group
+	13, // 5: tcp_handler.MapResponse.map:type_name -> tcp_handler.MapResponse.MapEntry
+	12, // 6: tcp_handler.MetricsResponse.Group.labels:type_name -> tcp_handler.MetricsResponse.Group.LabelsEntry
+	7,  // [7:7] is the sub-list for method output_type
+	7,  // [7:7] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
 }
 
 func init() { file_package_proto_init() }
@@ -201,6 +771,78 @@ func file_package_proto_init() {
 			}
 		}
 		file_package_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DeleteMatchingAction); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_package_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DeleteMatchingResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_package_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PushAction); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_package_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PushBatchAction); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_package_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PushBatchResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_package_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MetricsResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_package_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*MapResponse); i {
 			case 0:
 				return &v.state
@@ -212,19 +854,32 @@ func file_package_proto_init() {
 				return nil
 			}
 		}
+		file_package_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MetricsResponse_Group); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_package_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   4,
+			NumEnums:      1,
+			NumMessages:   13,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
 		GoTypes:           file_package_proto_goTypes,
 		DependencyIndexes: file_package_proto_depIdxs,
+		EnumInfos:         file_package_proto_enumTypes,
 		MessageInfos:      file_package_proto_msgTypes,
 	}.Build()
 	File_package_proto = out.File
@@ -14,188 +14,238 @@
 package tcp_handler
 
 import (
-	"encoding/base64"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"mime"
-	"net/http"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
 	"github.com/matttproud/golang_protobuf_extensions/pbutil"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/model"
-	"github.com/prometheus/common/route"
 
 	dto "github.com/prometheus/client_model/go"
 
+	"github.com/prometheus/pushgateway/openmetrics"
 	"github.com/prometheus/pushgateway/storage"
 
 	. "github.com/prometheus/pushgateway/tcp_server"
 )
 
-const (
-	// Base64Suffix is appended to a label name in the request URL path to
-	// mark the following label value as base64 encoded.
-	Base64Suffix = "@base64"
-)
-
-// Push returns an http.Handler which accepts samples over HTTP and stores them
-// in the MetricStore. If replace is true, all metrics for the job and instance
-// given by the request are deleted before new ones are stored. If check is
-// true, the pushed metrics are immediately checked for consistency (with
-// existing metrics and themselves), and an inconsistent push is rejected with
-// http.StatusBadRequest.
+// Push returns a handler which accepts a delimited PushAction and stores the
+// contained metrics in the MetricStore. If replace or the replace field of the
+// PushAction is true, all metrics for the grouping key given by the PushAction
+// are deleted before new ones are stored. If check is true, the pushed metrics
+// are immediately checked for consistency (with existing metrics and
+// themselves), and an inconsistent push is answered with an error of type
+// ErrorResponse_BAD_DATA carrying the reason. Otherwise, the push is answered
+// as soon as it has been submitted.
 //
 // The returned handler is already instrumented for Prometheus.
 func Push(
 	ms storage.MetricStore,
-	replace, check, jobBase64Encoded bool,
+	replace, check bool,
 	logger log.Logger,
-) func(*Session, *Package) {
-	var mtx sync.Mutex // Protects ps.
-
-	instrumentedHandler :=  InstrumentWithCounter("push", func(session *Session, pkg *Package) {
-		job := route.Param(r.Context(), "job")
-		if jobBase64Encoded {
-			var err error
-			if job, err = decodeBase64(job); err != nil {
-				http.Error(w, fmt.Sprintf("invalid base64 encoding in job name %q: %v", job, err), http.StatusBadRequest)
-				level.Debug(logger).Log("msg", "invalid base64 encoding in job name", "job", job, "err", err.Error())
-				return
-			}
+) HandlerFunc {
+	method := "push"
+	if replace {
+		method = "push_replace"
+	}
+
+	return InstrumentPush(method, InstrumentWithCounter("push", func(session *Session, pkg *Package) ([]byte, error) {
+		action := &PushAction{}
+		if _, err := pbutil.ReadDelimited(bytes.NewReader(pkg.GetBody()), action); err != nil {
+			level.Debug(logger).Log("msg", "failed to parse push action", "err", err.Error())
+			return nil, NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf("invalid push action: %v", err))
 		}
-		labelsString := route.Param(r.Context(), "labels")
-		mtx.Unlock()
 
-		labels, err := splitLabels(labelsString)
+		wr, err := pushWriteRequest(action, replace)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			level.Debug(logger).Log("msg", "failed to parse URL", "url", labelsString, "err", err.Error())
-			return
+			level.Debug(logger).Log("msg", "invalid push action", "err", err.Error())
+			return nil, NewRequestError(ErrorResponse_BAD_DATA, err)
 		}
-		if job == "" {
-			http.Error(w, "job name is required", http.StatusBadRequest)
-			level.Debug(logger).Log("msg", "job name is required")
-			return
+		if session.IsAuthenticated() {
+			wr.Tenant = session.GetUserID()
 		}
-		labels["job"] = job
-
-		var metricFamilies map[string]*dto.MetricFamily
-		ctMediatype, ctParams, ctErr := mime.ParseMediaType(r.Header.Get("Content-Type"))
-		if ctErr == nil && ctMediatype == "application/vnd.google.protobuf" &&
-			ctParams["encoding"] == "delimited" &&
-			ctParams["proto"] == "io.prometheus.client.MetricFamily" {
-			metricFamilies = map[string]*dto.MetricFamily{}
-			for {
-				mf := &dto.MetricFamily{}
-				if _, err = pbutil.ReadDelimited(r.Body, mf); err != nil {
-					if err == io.EOF {
-						err = nil
-					}
-					break
-				}
-				metricFamilies[mf.GetName()] = mf
+		if !check {
+			ms.SubmitWriteRequest(wr)
+			return nil, nil
+		}
+		errCh := make(chan error, 1)
+		wr.Done = errCh
+		ms.SubmitWriteRequest(wr)
+		var firstErr error
+		for err := range errCh {
+			// Send only first error, but log all of them.
+			if firstErr == nil {
+				firstErr = NewRequestError(
+					ErrorResponse_BAD_DATA,
+					fmt.Errorf("pushed metrics are invalid or inconsistent with existing metrics: %v", err),
+				)
 			}
-		} else {
-			// We could do further content-type checks here, but the
-			// fallback for now will anyway be the text format
-			// version 0.0.4, so just go for it and see if it works.
-			var parser expfmt.TextParser
-			metricFamilies, err = parser.TextToMetricFamilies(r.Body)
+			level.Error(logger).Log(
+				"msg", "pushed metrics are invalid or inconsistent with existing metrics",
+				"method", method,
+				"source", session.GetConn().GetName(),
+				"err", err.Error(),
+			)
 		}
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			level.Debug(logger).Log("msg", "failed to parse text", "err", err.Error())
-			return
+		return nil, firstErr
+	}))
+}
+
+// PushBatch returns a handler which accepts a delimited PushBatchAction and
+// applies all contained pushes at once: Either all of them are applied, or, if
+// any of them is invalid, none of them. A batch is always checked for
+// consistency. Invalid pushes do not make the request fail but are reported in
+// the PushBatchResponse the request is answered with once the batch has been
+// processed.
+//
+// The returned handler is already instrumented for Prometheus.
+func PushBatch(ms storage.MetricStore, logger log.Logger) HandlerFunc {
+	return InstrumentPush("push_batch", InstrumentWithCounter("push_batch", func(session *Session, pkg *Package) ([]byte, error) {
+		action := &PushBatchAction{}
+		if _, err := pbutil.ReadDelimited(bytes.NewReader(pkg.GetBody()), action); err != nil {
+			level.Debug(logger).Log("msg", "failed to parse push batch action", "err", err.Error())
+			return nil, NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf("invalid push batch action: %v", err))
+		}
+		if len(action.GetPushes()) == 0 {
+			return nil, NewRequestError(ErrorResponse_BAD_DATA, errors.New("no pushes in batch"))
 		}
+
 		now := time.Now()
-		if !check {
-			ms.SubmitWriteRequest(storage.WriteRequest{
-				Labels:         labels,
-				Timestamp:      now,
-				MetricFamilies: metricFamilies,
-				Replace:        replace,
-			})
-			w.WriteHeader(http.StatusAccepted)
-			return
+		resp := &PushBatchResponse{Errors: make([]string, len(action.GetPushes()))}
+		batch := make([]storage.WriteRequest, len(action.GetPushes()))
+		invalid := false
+		for i, push := range action.GetPushes() {
+			wr, err := pushWriteRequest(push, false)
+			if err != nil {
+				resp.Errors[i] = err.Error()
+				invalid = true
+				continue
+			}
+			wr.Timestamp = now
+			if session.IsAuthenticated() {
+				wr.Tenant = session.GetUserID()
+			}
+			batch[i] = wr
+		}
+		if invalid {
+			level.Debug(logger).Log("msg", "invalid pushes in batch")
+			resp.Applied = proto.Bool(false)
+			return proto.Marshal(resp)
 		}
+
 		errCh := make(chan error, 1)
-		errReceived := false
+		result := &storage.WriteResult{}
 		ms.SubmitWriteRequest(storage.WriteRequest{
-			Labels:         labels,
-			Timestamp:      now,
-			MetricFamilies: metricFamilies,
-			Replace:        replace,
-			Done:           errCh,
+			Timestamp: now,
+			Batch:     batch,
+			Done:      errCh,
+			Result:    result,
 		})
+		applied := true
 		for err := range errCh {
-			// Send only first error via HTTP, but log all of them.
-			// TODO(beorn): Consider sending all errors once we
-			// have a use case. (Currently, at most one error is
-			// produced.)
-			if !errReceived {
-				http.Error(
-					w,
-					fmt.Sprintf("pushed metrics are invalid or inconsistent with existing metrics: %v", err),
-					http.StatusBadRequest,
-				)
-			}
+			applied = false
 			level.Error(logger).Log(
-				"msg", "pushed metrics are invalid or inconsistent with existing metrics",
-				"method", r.Method,
-				"source", r.RemoteAddr,
+				"msg", "batch push failed",
+				"source", session.GetConn().GetName(),
 				"err", err.Error(),
 			)
-			errReceived = true
 		}
+		if !applied && result.BatchErrors == nil {
+			// Rejected before the pushes could be checked.
+			return nil, NewRequestError(ErrorResponse_INTERNAL, errors.New("batch push failed"))
+		}
+		for i, err := range result.BatchErrors {
+			if err != nil {
+				resp.Errors[i] = err.Error()
+			}
+		}
+		resp.Applied = proto.Bool(applied)
+		return proto.Marshal(resp)
+	}))
+}
+
+// pushWriteRequest converts a PushAction into a WriteRequest with the current
+// time as Timestamp. If replace is true, the WriteRequest replaces all metrics
+// in the group, no matter the replace field of the PushAction.
+func pushWriteRequest(action *PushAction, replace bool) (storage.WriteRequest, error) {
+	labels, err := groupingLabels(action.GetJob(), action.GetLabels())
+	if err != nil {
+		return storage.WriteRequest{}, err
 	}
 
-	return func(session *Session, pkg *Package) {
-		mtx.Lock()
-		instrumentedHandler(session, pkg)
+	if action.GetTtlMs() < 0 {
+		return storage.WriteRequest{}, fmt.Errorf("negative TTL %dms", action.GetTtlMs())
 	}
-}
 
-// decodeBase64 decodes the provided string using the “Base 64 Encoding with URL
-// and Filename Safe Alphabet” (RFC 4648). Padding characters (i.e. trailing
-// '=') are ignored.
-func decodeBase64(s string) (string, error) {
-	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
-	return string(b), err
-}
+	var aggregation storage.Aggregation
+	if action.Aggregation != nil {
+		if aggregation, err = storage.ParseAggregation(action.GetAggregation()); err != nil {
+			return storage.WriteRequest{}, err
+		}
+	}
 
-// splitLabels splits a labels string into a label map mapping names to values.
-func splitLabels(labels string) (map[string]string, error) {
-	result := map[string]string{}
-	if len(labels) <= 1 {
-		return result, nil
+	var metricFamilies map[string]*dto.MetricFamily
+	body := bytes.NewReader(action.GetBody())
+	switch action.GetFormat() {
+	case PushAction_PROTO_DELIMITED:
+		metricFamilies = map[string]*dto.MetricFamily{}
+		for {
+			mf := &dto.MetricFamily{}
+			if _, err = pbutil.ReadDelimited(body, mf); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				break
+			}
+			metricFamilies[mf.GetName()] = mf
+		}
+	case PushAction_TEXT:
+		var parser expfmt.TextParser
+		metricFamilies, err = parser.TextToMetricFamilies(body)
+	case PushAction_OPENMETRICS:
+		metricFamilies, err = openmetrics.Parse(body)
+	default:
+		err = fmt.Errorf("unknown format %d", action.GetFormat())
 	}
-	components := strings.Split(labels[1:], "/")
-	if len(components)%2 != 0 {
-		return nil, fmt.Errorf("odd number of components in label string %q", labels)
+	if err != nil {
+		return storage.WriteRequest{}, err
 	}
 
-	for i := 0; i < len(components)-1; i += 2 {
-		name, value := components[i], components[i+1]
-		trimmedName := strings.TrimSuffix(name, Base64Suffix)
-		if !model.LabelNameRE.MatchString(trimmedName) ||
-			strings.HasPrefix(trimmedName, model.ReservedLabelPrefix) {
-			return nil, fmt.Errorf("improper label name %q", trimmedName)
-		}
-		if name == trimmedName {
-			result[name] = value
-			continue
-		}
-		decodedValue, err := decodeBase64(value)
-		if err != nil {
-			return nil, fmt.Errorf("invalid base64 encoding for label %s=%q: %v", trimmedName, value, err)
+	return storage.WriteRequest{
+		Labels:         labels,
+		Timestamp:      time.Now(),
+		MetricFamilies: metricFamilies,
+		Replace:        replace || action.GetReplace(),
+		TTL:            time.Duration(action.GetTtlMs()) * time.Millisecond,
+		Aggregation:    aggregation,
+		BodySize:       int64(len(action.GetBody())),
+	}, nil
+}
+
+// groupingLabels checks the provided job name and grouping labels and combines
+// them into a new label map. A "job" label is not allowed in labels as the job
+// is passed separately. As the job is a protobuf string, it never needs to be
+// base64 encoded like in the URL path of HTTP pushes.
+func groupingLabels(job string, labels map[string]string) (map[string]string, error) {
+	if job == "" {
+		return nil, errors.New("job name is required")
+	}
+	result := make(map[string]string, len(labels)+1)
+	for name, value := range labels {
+		if !model.LabelNameRE.MatchString(name) ||
+			strings.HasPrefix(name, model.ReservedLabelPrefix) ||
+			name == string(model.JobLabel) {
+			return nil, fmt.Errorf("improper label name %q", name)
 		}
-		result[trimmedName] = decodedValue
+		result[name] = value
 	}
+	result["job"] = job
 	return result, nil
 }
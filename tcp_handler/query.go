@@ -0,0 +1,91 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp_handler
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+
+	"github.com/prometheus/pushgateway/storage"
+	. "github.com/prometheus/pushgateway/tcp_server"
+)
+
+// Metrics answers with a MetricsResponse containing all groups in the
+// MetricStore, sorted by grouping key, with their metric families sorted by
+// name.
+//
+// The returned handler is already instrumented for Prometheus.
+func Metrics(ms storage.MetricStore) HandlerFunc {
+	return InstrumentWithCounter(
+		"metrics",
+		func(*Session, *Package) ([]byte, error) {
+			groups := ms.GetMetricFamiliesMap()
+			keys := make([]string, 0, len(groups))
+			for key := range groups {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			resp := &MetricsResponse{Groups: make([]*MetricsResponse_Group, 0, len(keys))}
+			for _, key := range keys {
+				group := groups[key]
+				names := make([]string, 0, len(group.Metrics))
+				for name := range group.Metrics {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+
+				buf := &bytes.Buffer{}
+				for _, name := range names {
+					if _, err := pbutil.WriteDelimited(buf, group.Metrics[name].GetMetricFamily()); err != nil {
+						return nil, err
+					}
+				}
+				resp.Groups = append(resp.Groups, &MetricsResponse_Group{
+					Labels:             group.Labels,
+					LastPushSuccessful: proto.Bool(group.LastPushSuccess()),
+					Metrics:            buf.Bytes(),
+				})
+			}
+			return proto.Marshal(resp)
+		},
+	)
+}
+
+// Wipe deletes all the metrics in the MetricStore. Like its HTTP counterpart,
+// it only submits the deletions and answers without waiting for them.
+//
+// The returned handler is already instrumented for Prometheus.
+func Wipe(ms storage.MetricStore, logger log.Logger) HandlerFunc {
+	return InstrumentWithCounter(
+		"wipe",
+		func(*Session, *Package) ([]byte, error) {
+			level.Debug(logger).Log("msg", "start wiping metric store")
+			// Delete all metric groups by sending write requests with MetricFamilies equal to nil.
+			for _, group := range ms.GetMetricFamiliesMap() {
+				ms.SubmitWriteRequest(storage.WriteRequest{
+					Labels:    group.Labels,
+					Timestamp: time.Now(),
+				})
+			}
+			return nil, nil
+		},
+	)
+}
@@ -0,0 +1,132 @@
+package tcp_server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// challengeLength is the number of random bytes of an HMAC challenge.
+const challengeLength = 32
+
+var errAuthFailed = NewRequestError(ErrorResponse_UNAUTHENTICATED, errors.New("authentication failed"))
+
+// Authenticator checks AuthRequests against the secrets of known users.
+type Authenticator struct {
+	_secrets map[string][]byte
+}
+
+// NewAuthenticator create a new Authenticator for the given secrets by user
+func NewAuthenticator(secrets map[string]string) *Authenticator {
+	a := &Authenticator{_secrets: make(map[string][]byte, len(secrets))}
+	for user, secret := range secrets {
+		a._secrets[user] = []byte(secret)
+	}
+	return a
+}
+
+// LoadAuthenticator create a new Authenticator with the secrets from file.
+// Every line of the file has the form "user:secret". Empty lines and lines
+// starting with "#" are ignored.
+func LoadAuthenticator(file string) (*Authenticator, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	secrets := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 || i == len(line)-1 {
+			return nil, fmt.Errorf("%s:%d: expected user:secret", file, n)
+		}
+		user := line[:i]
+		if _, ok := secrets[user]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate user %q", file, n, user)
+		}
+		secrets[user] = line[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("no secrets found in %s", file)
+	}
+	return NewAuthenticator(secrets), nil
+}
+
+// authenticate processes req for session. It either authenticates the
+// session, issues a new challenge, or fails. All failures look the same to
+// the client, whether the user is unknown or the secret is wrong.
+func (a *Authenticator) authenticate(session *Session, req *AuthRequest) (*AuthResponse, error) {
+	secret, known := a._secrets[req.GetUser()]
+
+	switch req.GetMethod() {
+	case AuthRequest_TOKEN:
+		session.swapChallenge(nil)
+		if !known || subtle.ConstantTimeCompare(secret, req.GetToken()) != 1 {
+			return nil, errAuthFailed
+		}
+
+	case AuthRequest_HMAC:
+		if req.Proof == nil {
+			challenge := make([]byte, challengeLength)
+			if _, err := rand.Read(challenge); err != nil {
+				return nil, err
+			}
+			session.swapChallenge(challenge)
+			return &AuthResponse{Challenge: challenge}, nil
+		}
+		// A challenge can only be answered once.
+		challenge := session.swapChallenge(nil)
+		if !known || challenge == nil || !hmac.Equal(ComputeProof(secret, challenge), req.GetProof()) {
+			return nil, errAuthFailed
+		}
+
+	default:
+		return nil, NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf("unknown authentication method %d", req.GetMethod()))
+	}
+
+	session.authenticate(req.GetUser())
+	return &AuthResponse{}, nil
+}
+
+// ComputeProof computes the proof for an HMAC challenge.
+func ComputeProof(secret, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// onAuth handles a package of kind KindAuth.
+func (s *SocketService) onAuth(session *Session, pkg *Package) ([]byte, error) {
+	if s._auth == nil {
+		return nil, NewRequestError(ErrorResponse_NOT_FOUND, errors.New("authentication is not enabled"))
+	}
+	if session.IsAuthenticated() {
+		return nil, NewRequestError(ErrorResponse_BAD_DATA, errors.New("connection is already authenticated"))
+	}
+	req := &AuthRequest{}
+	if err := proto.Unmarshal(pkg._body, req); err != nil {
+		return nil, NewRequestError(ErrorResponse_BAD_DATA, err)
+	}
+	resp, err := s._auth.authenticate(session, req)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(resp)
+}
@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 )
 
-//1. size  	uint32
-//2. kind  	uint32
-//3. signature uint32
-//4. body  	[]byte
+//1. size  	uint32 (length of all following fields)
+//2. id  	[16]byte
+//3. kind  	uint32
+//4. signature uint32
+//5. body  	[]byte
 
 // Encode from Package to []byte
 func Encode(pkg *Package) ([]byte, error) {
@@ -42,51 +45,68 @@ func Encode(pkg *Package) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
-//1. kind  	uint32
-//2. signature uint32
-//3. body  	[]byte
-func Decode(data []byte) (*Package, error) {
-	reader := bytes.NewReader(data)
-
-	inherentLength := uint32(32 + 4 + 4)
-	size := uint32(len(data))
-	if size < inherentLength {
-		return nil, errors.New("package is invalid")
+// ReadFrame reads one encoded Package from r and returns it without the size
+// field, ready to be passed to Decode. Frames shorter than the header or
+// longer than maxFrameSize are rejected with a BAD_DATA *RequestError before
+// anything is allocated for them. A maxFrameSize of 0 means
+// DefaultMaxFrameSize.
+func ReadFrame(r io.Reader, maxFrameSize uint32) ([]byte, error) {
+	if maxFrameSize == 0 {
+		maxFrameSize = DefaultMaxFrameSize
 	}
 
-	id := make([]byte, 32)
-	err := binary.Read(reader, binary.LittleEndian, &id)
-	if err != nil {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
 		return nil, err
 	}
-
-	var kind uint32
-	err = binary.Read(reader, binary.LittleEndian, &kind)
-	if err != nil {
+	size := binary.LittleEndian.Uint32(header)
+	if size < headerLength {
+		return nil, NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf(
+			"frame size %d is smaller than the header of %d bytes", size, headerLength,
+		))
+	}
+	if err := checkFrameSize(size, maxFrameSize); err != nil {
 		return nil, err
 	}
 
-	var signature uint32
-	err = binary.Read(reader, binary.LittleEndian, &signature)
-	if err != nil {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
 		return nil, err
 	}
+	return data, nil
+}
 
-	body := make([]byte, size)
-	err = binary.Read(reader, binary.LittleEndian, &body)
-	if err != nil {
-		return nil, err
+// checkFrameSize returns a BAD_DATA *RequestError if a frame of the given
+// size, without the size field, is larger than maxFrameSize.
+func checkFrameSize(size, maxFrameSize uint32) error {
+	if size > maxFrameSize {
+		return NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf(
+			"frame size %d exceeds the maximum of %d bytes", size, maxFrameSize,
+		))
+	}
+	return nil
+}
+
+// Decode from []byte to Package. The size field must already be stripped.
+// The body of the returned Package refers to data instead of a copy.
+// 1. id  	[16]byte
+// 2. kind  	uint32
+// 3. signature uint32
+// 4. body  	[]byte
+func Decode(data []byte) (*Package, error) {
+	if len(data) < headerLength {
+		return nil, NewRequestError(ErrorResponse_BAD_DATA, errors.New("package is invalid"))
 	}
 
 	pkg := &Package{}
-	pkg._id = id
-	pkg._size = size
-	pkg._kind = kind
-	pkg._checksum = signature
-	pkg._body = body
+	pkg._size = uint32(len(data))
+	pkg._id = data[:idLength]
+	pkg._kind = binary.LittleEndian.Uint32(data[idLength:])
+	pkg._checksum = binary.LittleEndian.Uint32(data[idLength+4:])
+	pkg._body = data[headerLength:]
 
 	if !pkg.Verify() {
-		return nil, errors.New("package is changed")
+		return nil, NewRequestError(ErrorResponse_BAD_DATA, errors.New("package is changed"))
 	}
 	return pkg, nil
 }
@@ -0,0 +1,100 @@
+package tcp_server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestReadFrame(t *testing.T) {
+	frame := func(size uint32, data []byte) []byte {
+		buf := make([]byte, 4, 4+len(data))
+		binary.LittleEndian.PutUint32(buf, size)
+		return append(buf, data...)
+	}
+	valid, err := Encode(NewPackage(KindPush, []byte("body")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		name  string
+		input []byte
+		max   uint32
+		err   string
+	}{
+		{
+			name:  "valid",
+			input: valid,
+		},
+		{
+			name:  "too short",
+			input: frame(headerLength-1, make([]byte, headerLength-1)),
+			err:   "BAD_DATA: frame size 23 is smaller than the header of 24 bytes",
+		},
+		{
+			name:  "too large",
+			input: frame(headerLength+5, make([]byte, headerLength+5)),
+			max:   headerLength + 4,
+			err:   "BAD_DATA: frame size 29 exceeds the maximum of 28 bytes",
+		},
+		{
+			name:  "negative as int32",
+			input: frame(0xffffffff, nil),
+			err:   "BAD_DATA: frame size 4294967295 exceeds the maximum of 16777216 bytes",
+		},
+		{
+			name:  "truncated",
+			input: frame(headerLength+10, make([]byte, headerLength)),
+			err:   "unexpected EOF",
+		},
+	}
+	for _, s := range scenarios {
+		data, err := ReadFrame(bytes.NewReader(s.input), s.max)
+		if s.err != "" {
+			if err == nil || err.Error() != s.err {
+				t.Errorf("%s: Wanted error %q, got %v.", s.name, s.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", s.name, err)
+			continue
+		}
+		if !bytes.Equal(s.input[4:], data) {
+			t.Errorf("%s: Wanted frame %x, got %x.", s.name, s.input[4:], data)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, pkg := range []*Package{
+		NewPackage(KindHeartbeat, []byte{}),
+		NewPackage(KindPush, []byte("body")),
+		NewErrorResponse(make([]byte, idLength), NewRequestError(ErrorResponse_BAD_DATA, errors.New("bad"))),
+	} {
+		data, err := Encode(pkg)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data[4:])
+	}
+	f.Add([]byte{})
+	f.Add(make([]byte, headerLength))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pkg, err := Decode(data)
+		if err != nil {
+			return
+		}
+		// Whatever decodes has to encode to the same bytes.
+		encoded, err := Encode(pkg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, encoded[4:]) {
+			t.Errorf("Wanted %x after round trip, got %x.", data, encoded[4:])
+		}
+	})
+}
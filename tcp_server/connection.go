@@ -1,28 +1,35 @@
 package tcp_server
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
 	"errors"
-	"fmt"
-	levels "github.com/go-kit/kit/log/deprecated_levels"
-	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 )
 
+var errConnectionClosed = errors.New("connection closed")
+
 // Connection wrap net.Connection
 type Connection struct {
-	_sid      string
-	_raw      net.Conn
-	_data     chan []byte
-	_done     chan error
-	_timer    *time.Timer
-	_name     string
-	_pkg      chan *Package
-	_interval time.Duration
-	_timeout  time.Duration
+	_sid       string
+	_raw       net.Conn
+	_data      chan []byte
+	_done      chan error
+	_closed    chan struct{}
+	_closeOnce sync.Once
+	_timer     *time.Timer
+	_name      string
+	_pkg       chan *Package
+	_slots     chan struct{}
+	_maxFrame  uint32
+	_interval  time.Duration
+	_timeout   time.Duration
+	_logger    log.Logger
 }
 
 // GetName Get conn name
@@ -30,15 +37,21 @@ func (c *Connection) GetName() string {
 	return c._name
 }
 
-// NewConn create new conn
-func NewConn(c net.Conn, interval time.Duration, timeout time.Duration) *Connection {
+// NewConn create new conn. At most maxInFlight packages are read from the
+// connection without having been released. Frames larger than maxFrameSize
+// are a protocol error when read and are refused when sent.
+func NewConn(c net.Conn, interval time.Duration, timeout time.Duration, maxInFlight int, maxFrameSize uint32, logger log.Logger) *Connection {
 	conn := &Connection{
 		_raw:      c,
-		_data:     make(chan []byte, 1000),
+		_data:     make(chan []byte, maxInFlight+1),
 		_done:     make(chan error),
-		_pkg:      make(chan *Package, 1000),
+		_closed:   make(chan struct{}),
+		_pkg:      make(chan *Package, maxInFlight),
+		_slots:    make(chan struct{}, maxInFlight),
+		_maxFrame: maxFrameSize,
 		_interval: interval,
 		_timeout:  timeout,
+		_logger:   logger,
 	}
 
 	conn._name = c.RemoteAddr().String()
@@ -51,26 +64,29 @@ func NewConn(c net.Conn, interval time.Duration, timeout time.Duration) *Connect
 	return conn
 }
 
-// Close close connection
+// Close close connection. It is safe to call Close more than once.
 func (c *Connection) Close() error {
-	if !c._timer.Stop() {
-		return errors.New(fmt.Sprintf("failed to stop timer of connection: %s", c._raw.RemoteAddr().String()))
-	}
-	return c._raw.Close()
+	err := errConnectionClosed
+	c._closeOnce.Do(func() {
+		c._timer.Stop()
+		close(c._closed)
+		err = c._raw.Close()
+	})
+	return err
 }
 
-// SendPackage send Package
+// SendPackage send Package. Packages larger than the max frame size are
+// refused with a BAD_DATA *RequestError.
 func (c *Connection) SendPackage(pkg *Package) error {
 	data, err := Encode(pkg)
 	if err != nil {
 		return err
 	}
 
-	c._data <- data
-	return nil
+	return c.send(data)
 }
 
-// SendPackage send Package
+// SendResponse send a response to the request with the given id
 func (c *Connection) SendResponse(id []byte, body []byte) error {
 	pkg := NewResponse(id, KindResponse, body)
 	data, err := Encode(pkg)
@@ -78,8 +94,84 @@ func (c *Connection) SendResponse(id []byte, body []byte) error {
 		return err
 	}
 
-	c._data <- data
-	return nil
+	return c.send(data)
+}
+
+// GetMaxFrameSize get the size of the largest frame, without the size field,
+// that is read from or sent to the connection
+func (c *Connection) GetMaxFrameSize() uint32 {
+	return atomic.LoadUint32(&c._maxFrame)
+}
+
+// limitMaxFrameSize lowers the max frame size to size, as negotiated with
+// the client. It never raises it.
+func (c *Connection) limitMaxFrameSize(size uint32) {
+	for {
+		current := atomic.LoadUint32(&c._maxFrame)
+		if size == 0 || size >= current || atomic.CompareAndSwapUint32(&c._maxFrame, current, size) {
+			return
+		}
+	}
+}
+
+// send queues data for the write coroutine unless the connection is closed
+// or data, which includes the size field, exceeds the max frame size.
+func (c *Connection) send(data []byte) error {
+	if err := checkFrameSize(uint32(len(data)-4), c.GetMaxFrameSize()); err != nil {
+		return err
+	}
+	select {
+	case c._data <- data:
+		return nil
+	case <-c._closed:
+		return errConnectionClosed
+	}
+}
+
+// release frees the in-flight slot taken by a package read from the
+// connection. It has to be called once the package has been handled.
+func (c *Connection) release() {
+	<-c._slots
+}
+
+// fail reports err to the service, which will then close the connection.
+func (c *Connection) fail(ctx context.Context, err error) {
+	select {
+	case c._done <- err:
+	case <-ctx.Done():
+	}
+}
+
+// abort reports err to the service like fail. If err is a protocol error of
+// the client, it is sent to the client first, as the connection cannot be
+// used anymore. As the id of the offending request is unknown, the error
+// carries an id of zeros.
+func (c *Connection) abort(ctx context.Context, err error) {
+	if _, ok := err.(*RequestError); ok {
+		level.Debug(c._logger).Log("msg", "protocol error", "connection", c._name, "err", err)
+		c.writeError(make([]byte, idLength), err)
+	}
+	c.fail(ctx, err)
+}
+
+// reject answers the request with the given id with err and closes the
+// connection.
+func (c *Connection) reject(id []byte, err error) {
+	c.writeError(id, err)
+	_ = c.Close()
+}
+
+// writeError writes the error response for the request with the given id
+// right away, so that it is written before the connection is closed.
+func (c *Connection) writeError(id []byte, err error) {
+	data, encErr := Encode(NewErrorResponse(id, err))
+	if encErr != nil {
+		return
+	}
+	// Bypassing the write coroutine is safe as the write of a whole frame
+	// is atomic.
+	_ = c._raw.SetWriteDeadline(time.Now().Add(abortWriteTimeout))
+	_, _ = c._raw.Write(data)
 }
 
 // writeCoroutine write coroutine
@@ -95,7 +187,8 @@ func (c *Connection) writeCoroutine(ctx context.Context) {
 			}
 
 			if _, err := c._raw.Write(data); err != nil {
-				c._done <- err
+				c.fail(ctx, err)
+				return
 			}
 
 		case <-c._timer.C:
@@ -104,7 +197,7 @@ func (c *Connection) writeCoroutine(ctx context.Context) {
 			pkg := NewPackage(KindHeartbeat, data)
 			err := c.SendPackage(pkg)
 			if err != nil {
-				levels.WarnValue("failed to send heartbeat for connection: " + c._raw.RemoteAddr().String())
+				level.Warn(c._logger).Log("msg", "failed to send heartbeat", "connection", c._name, "err", err)
 			}
 
 			// 设置心跳timer
@@ -122,51 +215,42 @@ func (c *Connection) readCoroutine(ctx context.Context) {
 		case <-ctx.Done():
 			return
 
-		default:
+		// 占用一个请求槽位。All slots taken means reading pauses.
+		case c._slots <- struct{}{}:
 			// 设置超时
-			if c._interval > 0 {
+			if c._interval > 0 && c._timeout > 0 {
 				err := c._raw.SetReadDeadline(time.Now().Add(c._timeout))
 				if err != nil {
-					c._done <- err
-					continue
+					c.fail(ctx, err)
+					return
 				}
 			}
-			// 读取长度
-			header := make([]byte, 4)
-			_, err := io.ReadFull(c._raw, header)
-			if err != nil {
-				c._done <- err
-				continue
-			}
-
-			reader := bytes.NewReader(header)
-
-			var size int32
-			err = binary.Read(reader, binary.LittleEndian, &size)
-			if err != nil {
-				c._done <- err
-				continue
-			}
-
 			// 读取数据
-			data := make([]byte, size)
-			_, err = io.ReadFull(c._raw, data)
+			data, err := ReadFrame(c._raw, c.GetMaxFrameSize())
 			if err != nil {
-				c._done <- err
-				continue
+				c.abort(ctx, err)
+				return
+			}
+			// The max frame size may have been lowered by a hello
+			// handled while this frame was being read.
+			if err := checkFrameSize(uint32(len(data)), c.GetMaxFrameSize()); err != nil {
+				c.abort(ctx, err)
+				return
 			}
 
 			// 解码
 			pkg, err := Decode(data)
 			if err != nil {
-				c._done <- err
-				continue
+				c.abort(ctx, err)
+				return
 			}
 
 			if pkg._kind == KindHeartbeat {
+				c.release()
 				continue
 			}
 
+			// Cannot block as a slot has been taken.
 			c._pkg <- pkg
 		}
 	}
@@ -1,5 +1,47 @@
 package tcp_server
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/pushgateway/compression"
+)
+
+// Protocol versions spoken by the SocketService. Connections that do not send
+// a Hello speak MinProtocolVersion.
+const (
+	MinProtocolVersion = 1
+	MaxProtocolVersion = 1
+)
+
+// Body encodings and frame compressions announced in a Hello.
+const (
+	EncodingProtoDelimited = "proto-delimited"
+	EncodingText           = "text"
+	CompressionNone        = "none"
+	CompressionGzip        = compression.Gzip
+	CompressionZstd        = compression.Zstd
+	CompressionSnappy      = compression.Snappy
+)
+
+// FlagCompressed is set in the kind of a frame whose body is compressed with
+// the compression negotiated for the connection (see Hello). Only requests of
+// clients may be compressed. The checksum covers the compressed body and the
+// kind including the flag.
+const FlagCompressed = 1 << 31
+
+// DefaultMaxFrameSize is the largest frame accepted unless configured
+// otherwise.
+const DefaultMaxFrameSize = 16 << 20
+
+// abortWriteTimeout is the time to wait for a protocol error to be sent before
+// closing the connection.
+const abortWriteTimeout = time.Second
+
+// tlsHandshakeTimeout is the time a client has for the TLS handshake after
+// connecting.
+const tlsHandshakeTimeout = 10 * time.Second
+
 const (
 	STUnknown = iota
 	StateInitialized
@@ -7,13 +49,74 @@ const (
 	StateStop
 )
 
+// Package kinds. Clients and the tcp_handler package rely on these numbers,
+// so existing values must never change. New kinds have to be appended.
 const (
+	// KindHeartbeat is sent by both sides to keep a connection alive.
+	// Clients answer heartbeats of the SocketService with a heartbeat.
+	// The SocketService never answers heartbeats.
 	KindHeartbeat = iota
+	// KindResponse answers a request successfully. It carries the id of
+	// the request.
 	KindResponse
+	// KindError answers a request that could not be processed. It carries
+	// the id of the request.
+	KindError
+	// KindPush pushes metrics, replacing metrics of the same name in the
+	// group (like POST over HTTP).
+	KindPush
+	// KindPushReplace pushes metrics, replacing all metrics in the group
+	// (like PUT over HTTP).
+	KindPushReplace
+	// KindDelete deletes a group (like DELETE over HTTP).
+	KindDelete
+	// KindHealthy queries the health of the Pushgateway.
+	KindHealthy
+	// KindReady queries if the Pushgateway is ready.
+	KindReady
+	// KindStatus queries runtime and build information.
+	KindStatus
+	// KindMetrics queries the pushed metrics.
+	KindMetrics
+	// KindWipe deletes all groups.
+	KindWipe
+	// KindAuth authenticates the connection with an AuthRequest. If the
+	// SocketService requires authentication, it rejects all other
+	// requests until authentication has succeeded.
+	KindAuth
+	// KindHello negotiates the protocol version and capabilities of the
+	// connection with a Hello. It is allowed before authentication.
+	KindHello
+	// KindDeleteMatching deletes all groups matching label matchers (like
+	// DELETE /api/v1/metrics over HTTP).
+	KindDeleteMatching
+	// KindPushBatch pushes metrics to many groups at once (like POST
+	// /metrics/batch over HTTP).
+	KindPushBatch
 )
 
+var kindNames = map[uint32]string{
+	KindHeartbeat:      "heartbeat",
+	KindResponse:       "response",
+	KindError:          "error",
+	KindPush:           "push",
+	KindPushReplace:    "push_replace",
+	KindDelete:         "delete",
+	KindHealthy:        "healthy",
+	KindReady:          "ready",
+	KindStatus:         "status",
+	KindMetrics:        "metrics",
+	KindWipe:           "wipe",
+	KindAuth:           "auth",
+	KindHello:          "hello",
+	KindDeleteMatching: "delete_matching",
+	KindPushBatch:      "push_batch",
+}
 
-const (
-	CodeSuccess = iota
-	CodeFailed
-)
+// KindName returns a human-readable name of the given package kind.
+func KindName(kind uint32) string {
+	if name, ok := kindNames[kind]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown_%d", kind)
+}
@@ -0,0 +1,19 @@
+package tcp_server
+
+import "fmt"
+
+// RequestError is an error of a specific type returned by a HandlerFunc. The
+// type is passed on to the client in the ErrorResponse.
+type RequestError struct {
+	Type ErrorResponse_Type
+	Err  error
+}
+
+// NewRequestError creates a new RequestError.
+func NewRequestError(typ ErrorResponse_Type, err error) *RequestError {
+	return &RequestError{Type: typ, Err: err}
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Err)
+}
@@ -0,0 +1,104 @@
+package tcp_server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/prometheus/pushgateway/compression"
+)
+
+// newServerHello create the Hello announcing what the SocketService supports
+func newServerHello() *Hello {
+	return &Hello{
+		MinVersion:   proto.Uint32(MinProtocolVersion),
+		MaxVersion:   proto.Uint32(MaxProtocolVersion),
+		Encodings:    []string{EncodingProtoDelimited, EncodingText},
+		Compressions: append([]string{CompressionNone}, compression.Supported()...),
+		MaxFrameSize: proto.Uint32(DefaultMaxFrameSize),
+	}
+}
+
+// negotiate returns what server and client have in common, or a BAD_DATA
+// RequestError if they are incompatible.
+func negotiate(server, client *Hello) (*Hello, error) {
+	if client.GetMinVersion() > client.GetMaxVersion() {
+		return nil, NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf(
+			"invalid protocol version range %d to %d", client.GetMinVersion(), client.GetMaxVersion(),
+		))
+	}
+	version := server.GetMaxVersion()
+	if client.GetMaxVersion() < version {
+		version = client.GetMaxVersion()
+	}
+	if version < server.GetMinVersion() || version < client.GetMinVersion() {
+		return nil, NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf(
+			"unsupported protocol version: client speaks %d to %d, server speaks %d to %d",
+			client.GetMinVersion(), client.GetMaxVersion(), server.GetMinVersion(), server.GetMaxVersion(),
+		))
+	}
+
+	encodings := intersect(client.GetEncodings(), server.GetEncodings())
+	if len(encodings) == 0 {
+		return nil, NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf(
+			"no common body encoding: client supports %q, server supports %q",
+			strings.Join(client.GetEncodings(), ","), strings.Join(server.GetEncodings(), ","),
+		))
+	}
+	compressions := intersect(client.GetCompressions(), server.GetCompressions())
+	if len(intersect(compressions, []string{CompressionNone})) == 0 {
+		compressions = append(compressions, CompressionNone)
+	}
+
+	if c := client.GetMaxFrameSize(); c > 0 && c < headerLength {
+		return nil, NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf(
+			"max frame size must be at least %d bytes, got %d", headerLength, c,
+		))
+	}
+	maxFrameSize := server.GetMaxFrameSize()
+	if c := client.GetMaxFrameSize(); c > 0 && (maxFrameSize == 0 || c < maxFrameSize) {
+		maxFrameSize = c
+	}
+
+	return &Hello{
+		MinVersion:   proto.Uint32(version),
+		MaxVersion:   proto.Uint32(version),
+		Encodings:    encodings,
+		Compressions: compressions,
+		MaxFrameSize: proto.Uint32(maxFrameSize),
+	}, nil
+}
+
+// intersect returns the elements of a that are also in b, in the order of a.
+func intersect(a, b []string) []string {
+	var result []string
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				result = append(result, x)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// onHello handles a package of kind KindHello. A failed negotiation can be
+// retried, but once negotiated, the result cannot be changed anymore.
+func (s *SocketService) onHello(session *Session, pkg *Package) ([]byte, error) {
+	client := &Hello{}
+	if err := proto.Unmarshal(pkg._body, client); err != nil {
+		return nil, NewRequestError(ErrorResponse_BAD_DATA, err)
+	}
+	negotiated, err := negotiate(s._hello, client)
+	if err != nil {
+		return nil, err
+	}
+	if !session.setHello(negotiated) {
+		return nil, NewRequestError(ErrorResponse_BAD_DATA, errors.New("protocol has already been negotiated"))
+	}
+	session.GetConn().limitMaxFrameSize(negotiated.GetMaxFrameSize())
+	return proto.Marshal(negotiated)
+}
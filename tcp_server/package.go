@@ -7,26 +7,41 @@ import (
 	"hash/adler32"
 	"net"
 
+	"github.com/golang/protobuf/proto"
 	. "github.com/satori/go.uuid"
 )
 
+const (
+	// idLength is the length of the id of a Package (a binary UUID).
+	idLength = Size
+	// headerLength is the length of everything following the size field
+	// of an encoded Package except the body: id, kind, and checksum.
+	headerLength = idLength + 4 + 4
+)
+
 type Package struct {
-	_size  		uint32
+	// _size is the length of the encoded Package without the size field.
+	_size uint32
 
-	/// 36 bytes
-	_id       []byte
+	/// 16 bytes
+	_id []byte
 
 	_kind     uint32
 	_checksum uint32
 
-	_body  		[]byte
-	_error 		net.Error
+	_body  []byte
+	_error net.Error
+
+	// _compression is the compression the body has been decompressed
+	// from, and _wireSize the size of the body before decompression.
+	_compression string
+	_wireSize    int
 }
 
 // NewMessage create a new message
 func NewResponse(id []byte, kind uint32, body []byte) *Package {
 	pkg := &Package{
-		_size:     uint32(len(body)) + 4 + 4,
+		_size:     uint32(len(body)) + headerLength,
 		_id:       id,
 		_kind:     kind,
 		_checksum: checksum(id, kind, body),
@@ -36,29 +51,36 @@ func NewResponse(id []byte, kind uint32, body []byte) *Package {
 	return pkg
 }
 
-func NewStateResponse(id []byte, code int) (*Package, error) {
-	body := new(bytes.Buffer)
-	err := binary.Write(body, binary.LittleEndian, code)
-
-	if err != nil {
-		return nil, err
-	}
-	return NewResponse(id, KindResponse, body.Bytes()), nil
+// NewSuccessResponse creates a response of kind KindResponse to the request
+// with the given id.
+func NewSuccessResponse(id []byte, body []byte) *Package {
+	return NewResponse(id, KindResponse, body)
 }
 
-func NewSuccessResponse(id []byte) (*Package, error) {
-	return NewStateResponse(id, CodeSuccess)
-}
-
-func NewFailureResponse(id []byte) (*Package, error) {
-	return NewStateResponse(id, CodeFailed)
+// NewErrorResponse creates a response of kind KindError to the request with
+// the given id. Its body is an ErrorResponse. The type of the ErrorResponse is
+// taken from err if it is a *RequestError. Otherwise, it is
+// ErrorResponse_INTERNAL.
+func NewErrorResponse(id []byte, err error) *Package {
+	resp := &ErrorResponse{
+		Type:      ErrorResponse_INTERNAL.Enum(),
+		Message:   proto.String(err.Error()),
+		RequestId: id,
+	}
+	if reqErr, ok := err.(*RequestError); ok {
+		resp.Type = reqErr.Type.Enum()
+		resp.Message = proto.String(reqErr.Err.Error())
+	}
+	// Marshaling cannot fail as ErrorResponse has no required fields.
+	body, _ := proto.Marshal(resp)
+	return NewResponse(id, KindError, body)
 }
 
 // NewMessage create a new message
 func NewPackage(kind uint32, body []byte) *Package {
 	id := NewV4().Bytes()
 	pkg := &Package{
-		_size:     uint32(len(body)) + 4 + 4,
+		_size:     uint32(len(body)) + headerLength,
 		_id:       id,
 		_kind:     kind,
 		_checksum: checksum(id, kind, body),
@@ -68,16 +90,39 @@ func NewPackage(kind uint32, body []byte) *Package {
 	return pkg
 }
 
-// GetData get message data
+// GetId get the id of the package. Responses carry the id of the request.
 func (pkg *Package) GetId() []byte {
 	return pkg._id
 }
 
+// GetKind get the kind of the package
+func (pkg *Package) GetKind() uint32 {
+	return pkg._kind
+}
+
 // GetData get message data
 func (pkg *Package) GetBody() []byte {
 	return pkg._body
 }
 
+// GetCompression get the compression the body has been decompressed from, or
+// CompressionNone
+func (pkg *Package) GetCompression() string {
+	if pkg._compression == "" {
+		return CompressionNone
+	}
+	return pkg._compression
+}
+
+// GetWireSize get the size of the body as it has been sent, which differs from
+// the size of GetBody for a compressed body
+func (pkg *Package) GetWireSize() int {
+	if pkg._compression == "" {
+		return len(pkg._body)
+	}
+	return pkg._wireSize
+}
+
 // Verify verify checksum
 func (pkg *Package) Verify() bool {
 	return pkg._checksum == pkg.Checksum()
@@ -88,10 +133,6 @@ func (pkg *Package) Checksum() uint32 {
 }
 
 func checksum(id []byte, kind uint32, body []byte) uint32 {
-	if body == nil  {
-		return 0
-	}
-
 	data := new(bytes.Buffer)
 
 	err := binary.Write(data, binary.LittleEndian, id)
@@ -0,0 +1,252 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.21.0
+// 	protoc        v3.3.0
+// source: response.proto
+
+package tcp_server
+
+import (
+	proto "github.com/golang/protobuf/proto"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// This is a compile-time assertion that a sufficiently up-to-date version
+// of the legacy proto package is being used.
+const _ = proto.ProtoPackageIsVersion4
+
+// Type mirrors the error types of the HTTP API.
+type ErrorResponse_Type int32
+
+const (
+	ErrorResponse_INTERNAL        ErrorResponse_Type = 0
+	ErrorResponse_BAD_DATA        ErrorResponse_Type = 1
+	ErrorResponse_UNAVAILABLE     ErrorResponse_Type = 2
+	ErrorResponse_NOT_FOUND       ErrorResponse_Type = 3
+	ErrorResponse_UNAUTHENTICATED ErrorResponse_Type = 4
+)
+
+// Enum value maps for ErrorResponse_Type.
+var (
+	ErrorResponse_Type_name = map[int32]string{
+		0: "INTERNAL",
+		1: "BAD_DATA",
+		2: "UNAVAILABLE",
+		3: "NOT_FOUND",
+		4: "UNAUTHENTICATED",
+	}
+	ErrorResponse_Type_value = map[string]int32{
+		"INTERNAL":        0,
+		"BAD_DATA":        1,
+		"UNAVAILABLE":     2,
+		"NOT_FOUND":       3,
+		"UNAUTHENTICATED": 4,
+	}
+)
+
+func (x ErrorResponse_Type) Enum() *ErrorResponse_Type {
+	p := new(ErrorResponse_Type)
+	*p = x
+	return p
+}
+
+func (x ErrorResponse_Type) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ErrorResponse_Type) Descriptor() protoreflect.EnumDescriptor {
+	return file_response_proto_enumTypes[0].Descriptor()
+}
+
+func (ErrorResponse_Type) Type() protoreflect.EnumType {
+	return &file_response_proto_enumTypes[0]
+}
+
+func (x ErrorResponse_Type) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Do not use.
+func (x *ErrorResponse_Type) UnmarshalJSON(b []byte) error {
+	num, err := protoimpl.X.UnmarshalJSONEnum(x.Descriptor(), b)
+	if err != nil {
+		return err
+	}
+	*x = ErrorResponse_Type(num)
+	return nil
+}
+
+// Deprecated: Use ErrorResponse_Type.Descriptor instead.
+func (ErrorResponse_Type) EnumDescriptor() ([]byte, []int) {
+	return file_response_proto_rawDescGZIP(), []int{0, 0}
+}
+
+// ErrorResponse is the body of a package of kind KindError.
+type ErrorResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Type *ErrorResponse_Type `protobuf:"varint,1,opt,name=type,enum=tcp_server.ErrorResponse_Type,def=0" json:"type,omitempty"`
+	// message is a human-readable description of the error.
+	Message *string `protobuf:"bytes,2,opt,name=message" json:"message,omitempty"`
+	// request_id is the id of the request that failed.
+	RequestId []byte `protobuf:"bytes,3,opt,name=request_id,json=requestId" json:"request_id,omitempty"`
+}
+
+// Default values for ErrorResponse fields.
+const (
+	Default_ErrorResponse_Type = ErrorResponse_INTERNAL
+)
+
+func (x *ErrorResponse) Reset() {
+	*x = ErrorResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_response_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ErrorResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ErrorResponse) ProtoMessage() {}
+
+func (x *ErrorResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_response_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ErrorResponse.ProtoReflect.Descriptor instead.
+func (*ErrorResponse) Descriptor() ([]byte, []int) {
+	return file_response_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ErrorResponse) GetType() ErrorResponse_Type {
+	if x != nil && x.Type != nil {
+		return *x.Type
+	}
+	return Default_ErrorResponse_Type
+}
+
+func (x *ErrorResponse) GetMessage() string {
+	if x != nil && x.Message != nil {
+		return *x.Message
+	}
+	return ""
+}
+
+func (x *ErrorResponse) GetRequestId() []byte {
+	if x != nil {
+		return x.RequestId
+	}
+	return nil
+}
+
+var File_response_proto protoreflect.FileDescriptor
+
+var file_response_proto_rawDesc = []byte{
+	0x0a, 0x0e, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x12, 0x0a, 0x74, 0x63, 0x70, 0x5f, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x22, 0xdf, 0x01, 0x0a,
+	0x0d, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x3c,
+	0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1e, 0x2e, 0x74,
+	0x63, 0x70, 0x5f, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x2e, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x2e, 0x54, 0x79, 0x70, 0x65, 0x3a, 0x08, 0x49, 0x4e,
+	0x54, 0x45, 0x52, 0x4e, 0x41, 0x4c, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x18, 0x0a, 0x07,
+	0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x6d,
+	0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x1d, 0x0a, 0x0a, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x5f, 0x69, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x72, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x49, 0x64, 0x22, 0x57, 0x0a, 0x04, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0c, 0x0a,
+	0x08, 0x49, 0x4e, 0x54, 0x45, 0x52, 0x4e, 0x41, 0x4c, 0x10, 0x00, 0x12, 0x0c, 0x0a, 0x08, 0x42,
+	0x41, 0x44, 0x5f, 0x44, 0x41, 0x54, 0x41, 0x10, 0x01, 0x12, 0x0f, 0x0a, 0x0b, 0x55, 0x4e, 0x41,
+	0x56, 0x41, 0x49, 0x4c, 0x41, 0x42, 0x4c, 0x45, 0x10, 0x02, 0x12, 0x0d, 0x0a, 0x09, 0x4e, 0x4f,
+	0x54, 0x5f, 0x46, 0x4f, 0x55, 0x4e, 0x44, 0x10, 0x03, 0x12, 0x13, 0x0a, 0x0f, 0x55, 0x4e, 0x41,
+	0x55, 0x54, 0x48, 0x45, 0x4e, 0x54, 0x49, 0x43, 0x41, 0x54, 0x45, 0x44, 0x10, 0x04, 0x42, 0x0e,
+	0x5a, 0x0c, 0x2e, 0x3b, 0x74, 0x63, 0x70, 0x5f, 0x73, 0x65, 0x72, 0x76, 0x65, 0x72,
+}
+
+var (
+	file_response_proto_rawDescOnce sync.Once
+	file_response_proto_rawDescData = file_response_proto_rawDesc
+)
+
+func file_response_proto_rawDescGZIP() []byte {
+	file_response_proto_rawDescOnce.Do(func() {
+		file_response_proto_rawDescData = protoimpl.X.CompressGZIP(file_response_proto_rawDescData)
+	})
+	return file_response_proto_rawDescData
+}
+
+var file_response_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_response_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_response_proto_goTypes = []interface{}{
+	(ErrorResponse_Type)(0), // 0: tcp_server.ErrorResponse.Type
+	(*ErrorResponse)(nil),   // 1: tcp_server.ErrorResponse
+}
+var file_response_proto_depIdxs = []int32{
+	0, // 0: tcp_server.ErrorResponse.type:type_name -> tcp_server.ErrorResponse.Type
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_response_proto_init() }
+func file_response_proto_init() {
+	if File_response_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_response_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ErrorResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_response_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_response_proto_goTypes,
+		DependencyIndexes: file_response_proto_depIdxs,
+		EnumInfos:         file_response_proto_enumTypes,
+		MessageInfos:      file_response_proto_msgTypes,
+	}.Build()
+	File_response_proto = out.File
+	file_response_proto_rawDesc = nil
+	file_response_proto_goTypes = nil
+	file_response_proto_depIdxs = nil
+}
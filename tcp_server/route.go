@@ -1,14 +1,27 @@
 package tcp_server
 
+// HandlerFunc handles a request Package received within a Session. The
+// SocketService answers every request exactly once: with the returned body as
+// a KindResponse or, if an error is returned, with an ErrorResponse as a
+// KindError. Use NewRequestError to return errors of a specific type.
+type HandlerFunc func(*Session, *Package) ([]byte, error)
+
 type Route struct {
-	_kind uint32
-	_handler func(*Session, *Package)
+	_kind    uint32
+	_handler HandlerFunc
 }
 
-func NewRoute(kind uint32, handler func(*Session, *Package)) *Route {
+func NewRoute(kind uint32, handler HandlerFunc) *Route {
 	route := &Route{
-		_kind: kind,
+		_kind:    kind,
 		_handler: handler,
 	}
 	return route
-}
\ No newline at end of file
+}
+
+// isReservedKind returns true for kinds handled by the SocketService itself,
+// which cannot be routed.
+func isReservedKind(kind uint32) bool {
+	return kind == KindHeartbeat || kind == KindResponse || kind == KindError ||
+		kind == KindAuth || kind == KindHello
+}
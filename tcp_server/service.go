@@ -1,33 +1,48 @@
 package tcp_server
 
 import (
-	"container/list"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
-)
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+
+	"github.com/prometheus/pushgateway/compression"
+)
 
 // SocketService struct
 type SocketService struct {
-	_onReceivePackage 	func(*Session, *Package)
-	_onReceiveResponse 	func(*Session, *Package)
-	_onConnect    		func(*Session)
-	_onDisconnect 		func(*Session, error)
-	_routes				*sync.Map
-	_sessions     		*sync.Map
-	_interval      time.Duration
-	_timeout       time.Duration
-	_listenAddress string
-	_status        int
-	_listener      net.Listener
-	_stop          chan error
-}
-
-// NewSocketService create a new socket service
-func NewSocketService(listenAddress string) (*SocketService, error) {
+	_onReceivePackage  func(*Session, *Package)
+	_onReceiveResponse func(*Session, *Package)
+	_onConnect         func(*Session)
+	_onDisconnect      func(*Session, error)
+	_routes            *sync.Map
+	_sessions          *sync.Map
+	_interval          time.Duration
+	_timeout           time.Duration
+	_concurrency       int
+	_maxInFlight       int
+	_maxFrameSize      uint32
+	_auth              *Authenticator
+	_hello             *Hello
+	_authTimeout       time.Duration
+	_listenAddress     string
+	_status            int
+	_listener          net.Listener
+	_stop              chan error
+	_connections       sync.WaitGroup
+	_logger            log.Logger
+}
+
+// NewSocketService create a new socket service listening on listenAddress. The
+// service does not accept connections before Serve is called.
+func NewSocketService(listenAddress string, logger log.Logger) (*SocketService, error) {
 	l, err := net.Listen("tcp", listenAddress)
 
 	if err != nil {
@@ -35,49 +50,111 @@ func NewSocketService(listenAddress string) (*SocketService, error) {
 	}
 
 	s := &SocketService{
-		_sessions:     &sync.Map{},
-		_stop:          make(chan error),
+		_routes:        &sync.Map{},
+		_sessions:      &sync.Map{},
+		_stop:          make(chan error, 1),
 		_interval:      0 * time.Second,
 		_timeout:       0 * time.Second,
+		_concurrency:   1,
+		_maxInFlight:   1,
+		_maxFrameSize:  DefaultMaxFrameSize,
+		_hello:         newServerHello(),
 		_listenAddress: listenAddress,
 		_status:        StateInitialized,
 		_listener:      l,
+		_logger:        logger,
 	}
 
 	return s, nil
 }
-// RegMessageHandler register message handler
+
+// onReceivePackage dispatches pkg to the handler registered for its kind and
+// sends the response. Packages of unknown kind are answered with an error.
 func (s *SocketService) onReceivePackage(session *Session, pkg *Package) {
-	v, _ := s._routes.Load(pkg._kind)
-	if v == nil {
-		return
+	var resp *Package
+	if body, err := s.dispatch(session, pkg); err != nil {
+		level.Debug(s._logger).Log("msg", "request failed", "kind", KindName(pkg._kind), "connection", session.GetConn().GetName(), "err", err)
+		if err == errAuthFailed {
+			// Guessing secrets must cost a new connection per guess.
+			session.GetConn().reject(pkg._id, err)
+			return
+		}
+		resp = NewErrorResponse(pkg._id, err)
+	} else {
+		resp = NewSuccessResponse(pkg._id, body)
 	}
 
-	routes := v.(*list.List)
-	if routes.Len() == 0 {
-		return
+	err := session.GetConn().SendPackage(resp)
+	if reqErr, ok := err.(*RequestError); ok && resp._kind == KindResponse {
+		// The response exceeds the max frame size, so at least tell
+		// the client why it doesn't get it.
+		err = session.GetConn().SendPackage(NewErrorResponse(pkg._id, NewRequestError(
+			ErrorResponse_BAD_DATA, fmt.Errorf("response cannot be sent: %v", reqErr.Err),
+		)))
 	}
-
-	for e := routes.Front(); e != nil; e = e.Next() {
-		e.Value.(*Route)._handler(session, pkg)
+	if err != nil {
+		level.Debug(s._logger).Log("msg", "failed to send response", "connection", session.GetConn().GetName(), "err", err)
 	}
 }
 
-// RegMessageHandler register message handler
-func (s *SocketService) addRoute(kind uint32, handler func(*Session, *Package)) {
-	route := NewRoute(kind, handler)
-
-	v, _ := s._routes.Load(kind)
-	if v == nil {
-		routes := list.New()
-		routes.PushBack(route)
+// decompress replaces the body of pkg by its decompressed version if
+// FlagCompressed is set in its kind, which is cleared then. The decompressed
+// body must not be larger than the max frame size of the connection.
+func (s *SocketService) decompress(session *Session, pkg *Package) error {
+	if pkg._kind&FlagCompressed == 0 {
+		return nil
+	}
+	pkg._kind &^= FlagCompressed
+	c := session.GetCompression()
+	if c == CompressionNone {
+		return NewRequestError(ErrorResponse_BAD_DATA, errors.New("compressed frame, but no compression has been negotiated"))
+	}
+	body, err := compression.Decompress(pkg._body, c, int64(session.GetConn().GetMaxFrameSize()))
+	if err != nil {
+		return NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf("failed to decompress %s body: %v", c, err))
+	}
+	pkg._compression = c
+	pkg._wireSize = len(pkg._body)
+	pkg._body = body
+	return nil
+}
 
-		s._routes.Store(kind, routes)
-		return
+// dispatch handles pkg and returns the body of the response. Only packages
+// of authenticated sessions are decompressed, and hellos and authentication
+// requests must never be compressed.
+func (s *SocketService) dispatch(session *Session, pkg *Package) ([]byte, error) {
+	switch kind := pkg._kind &^ FlagCompressed; {
+	case kind == KindHello || kind == KindAuth:
+		if pkg._kind != kind {
+			return nil, NewRequestError(ErrorResponse_BAD_DATA, fmt.Errorf("%s frames must not be compressed", KindName(kind)))
+		}
+		if kind == KindHello {
+			return s.onHello(session, pkg)
+		}
+		return s.onAuth(session, pkg)
+	case s._auth != nil && !session.IsAuthenticated():
+		return nil, NewRequestError(ErrorResponse_UNAUTHENTICATED, errors.New("connection is not authenticated"))
+	}
+	if err := s.decompress(session, pkg); err != nil {
+		return nil, err
 	}
+	if v, ok := s._routes.Load(pkg._kind); ok {
+		return v.(*Route)._handler(session, pkg)
+	}
+	return nil, NewRequestError(ErrorResponse_NOT_FOUND, fmt.Errorf("unknown package kind %d", pkg._kind))
+}
 
-	routes := v.(*list.List)
-	routes.PushBack(route)
+// RegisterRoute registers the handler for packages of the given kind. Only one
+// handler can be registered per kind. Heartbeats and responses are handled by
+// the SocketService itself and cannot be routed.
+func (s *SocketService) RegisterRoute(kind uint32, handler HandlerFunc) error {
+	if isReservedKind(kind) {
+		return fmt.Errorf("package kind %d is reserved", kind)
+	}
+	if _, loaded := s._routes.LoadOrStore(kind, NewRoute(kind, handler)); loaded {
+		return fmt.Errorf("route for package kind %d already registered", kind)
+	}
+	return nil
 }
 
 // RegConnectHandler register connect handler
@@ -90,7 +167,7 @@ func (s *SocketService) RegisterReceivePackageHnadler(handler func(*Session, *Pa
 }
 
 // RegConnectHandler register connect handler
-func (s *SocketService) RegisterConnectHandler(handler func(*Session,)) {
+func (s *SocketService) RegisterConnectHandler(handler func(*Session)) {
 	s._onConnect = handler
 }
 
@@ -99,52 +176,82 @@ func (s *SocketService) RegisterDisconnectHandler(handler func(*Session, error))
 	s._onDisconnect = handler
 }
 
-// Run socket service
-func (s *SocketService) run() {
+// Serve accepts connections and handles them until Stop is called or the
+// listener fails. Once stopping, all open connections are closed, and Serve
+// only returns after their handlers have returned, so that no handler submits
+// anything after Serve has returned. The returned error is the reason for
+// stopping.
+func (s *SocketService) Serve() error {
 	s._status = StateRunning
 	ctx, cancel := context.WithCancel(context.Background())
 
-	defer func() {
-		s._status = StateStop
-		cancel()
-		_ = s._listener.Close()
-	}()
-
 	go s.acceptHandler(ctx)
 
-	for {
-		select {
-		case <-s._stop:
-			return
-		}
-	}
+	err := <-s._stop
+
+	s._status = StateStop
+	cancel()
+	_ = s._listener.Close()
+	s._connections.Wait()
+	return err
 }
 
 func (s *SocketService) acceptHandler(ctx context.Context) {
 	for {
 		c, err := s._listener.Accept()
 		if err != nil {
-			s._stop <- err
+			s.stop(err)
 			return
 		}
 
+		s._connections.Add(1)
 		go s.connectHandler(ctx, c)
 	}
 }
 
 func (s *SocketService) connectHandler(ctx context.Context, c net.Conn) {
-	conn := NewConn(c, s._interval, s._timeout)
+	var state *tls.ConnectionState
+	if tc, ok := c.(*tls.Conn); ok {
+		cs, err := handshake(tc)
+		if err != nil {
+			level.Debug(s._logger).Log("msg", "TLS handshake failed", "connection", c.RemoteAddr(), "err", err)
+			_ = c.Close()
+			s._connections.Done()
+			return
+		}
+		state = cs
+	}
+
+	conn := NewConn(c, s._interval, s._timeout, s._maxInFlight, s._maxFrameSize, s._logger)
 	session := NewSession(conn)
+	if state != nil && len(state.VerifiedChains) > 0 {
+		session.setClientCertificate(state.VerifiedChains[0][0])
+	}
 	s._sessions.Store(session.GetSessionID(), session)
 
 	connctx, cancel := context.WithCancel(ctx)
+	var workers sync.WaitGroup
 
 	defer func() {
 		cancel()
 		_ = conn.Close()
+		// Handlers still running can't answer anymore, but whatever
+		// they submit has to be submitted before we report being done.
+		workers.Wait()
 		s._sessions.Delete(session.GetSessionID())
+		s._connections.Done()
 	}()
 
+	if s._auth != nil {
+		t := time.AfterFunc(s._authTimeout, func() {
+			if !session.IsAuthenticated() {
+				level.Debug(s._logger).Log("msg", "closing unauthenticated connection", "connection", conn.GetName())
+				_ = conn.Close()
+			}
+		})
+		defer t.Stop()
+	}
+
 	go conn.readCoroutine(connctx)
 	go conn.writeCoroutine(connctx)
 
@@ -152,21 +259,63 @@ func (s *SocketService) connectHandler(ctx context.Context, c net.Conn) {
 		s._onConnect(session)
 	}
 
-	for {
-		select {
-		case err := <-conn._done:
-			if s._onDisconnect != nil {
-				s._onDisconnect(session, err)
-			}
-			return
-		case pkg := <-conn._pkg:
-			if pkg._kind == KindResponse {
-				s._onReceiveResponse(session, pkg)
-			} else {
-				s.onReceivePackage(session, pkg)
+	for i := 0; i < s._concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				select {
+				case <-connctx.Done():
+					return
+				case pkg := <-conn._pkg:
+					s.handlePackage(session, pkg)
+					conn.release()
+				}
 			}
+		}()
+	}
+
+	var err error
+	select {
+	case <-connctx.Done():
+		err = connctx.Err()
+	case err = <-conn._done:
+	}
+	if s._onDisconnect != nil {
+		s._onDisconnect(session, err)
+	}
+}
+
+func (s *SocketService) handlePackage(session *Session, pkg *Package) {
+	if pkg._kind == KindResponse || pkg._kind == KindError {
+		if s._onReceiveResponse != nil {
+			s._onReceiveResponse(session, pkg)
 		}
+		return
 	}
+	s.onReceivePackage(session, pkg)
+}
+
+// handshake performs the TLS handshake on c, which would otherwise only
+// happen with the first read, so that the client certificate is known before
+// any package is handled.
+func handshake(c *tls.Conn) (*tls.ConnectionState, error) {
+	if err := c.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return nil, err
+	}
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	if err := c.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	state := c.ConnectionState()
+	return &state, nil
+}
+
+// GetAddr get the address the socket service is listening on
+func (s *SocketService) GetAddr() net.Addr {
+	return s._listener.Addr()
 }
 
 // GetStatus get socket service status
@@ -174,9 +323,17 @@ func (s *SocketService) GetStatus() int {
 	return s._status
 }
 
-// Stop stop socket service with reason
+// Stop stop socket service with reason. It does not wait for Serve to return.
 func (s *SocketService) Stop(reason string) {
-	s._stop <- errors.New(reason)
+	s.stop(errors.New(reason))
+}
+
+// stop records the first reason for stopping. Later reasons are dropped.
+func (s *SocketService) stop(err error) {
+	select {
+	case s._stop <- err:
+	default:
+	}
 }
 
 // SetHeartBeat set heart beat
@@ -191,6 +348,83 @@ func (s *SocketService) SetHeartBeat(hbInterval time.Duration, hbTimeout time.Du
 	return nil
 }
 
+// SetTLS makes the service only accept TLS connections using config. To verify
+// client certificates, config has to set ClientAuth accordingly. The subject
+// of a verified client certificate is available via Session.GetClientSubject.
+func (s *SocketService) SetTLS(config *tls.Config) error {
+	if s._status == StateRunning {
+		return errors.New("Can't set TLS on service running")
+	}
+	if config == nil {
+		return errors.New("TLS config must not be nil")
+	}
+
+	s._listener = tls.NewListener(s._listener, config)
+
+	return nil
+}
+
+// SetAuthentication requires every connection to authenticate with a request
+// of kind KindAuth before any other request is handled. Connections that are
+// not authenticated within timeout are closed.
+func (s *SocketService) SetAuthentication(auth *Authenticator, timeout time.Duration) error {
+	if s._status == StateRunning {
+		return errors.New("Can't set authentication on service running")
+	}
+	if auth == nil {
+		return errors.New("authenticator must not be nil")
+	}
+	if timeout <= 0 {
+		return errors.New("authentication timeout must be positive")
+	}
+
+	s._auth = auth
+	s._authTimeout = timeout
+
+	return nil
+}
+
+// SetMaxFrameSize sets the size of the largest frame accepted from clients,
+// without the size field. Larger frames are answered with an error and the
+// connection is closed. The default is DefaultMaxFrameSize.
+func (s *SocketService) SetMaxFrameSize(size uint32) error {
+	if s._status == StateRunning {
+		return errors.New("Can't set max frame size on service running")
+	}
+	if size < headerLength {
+		return fmt.Errorf("max frame size must be at least %d bytes, got %d", headerLength, size)
+	}
+
+	s._maxFrameSize = size
+	s._hello.MaxFrameSize = proto.Uint32(size)
+
+	return nil
+}
+
+// SetConcurrency sets how many requests are processed concurrently per
+// connection and how many requests per connection may be in flight, i.e. read
+// but not yet answered. Once maxInFlight is reached, reading from the
+// connection pauses until a request has been answered. With a concurrency
+// larger than 1, requests on the same connection may be processed and
+// answered in a different order than they have been sent. The default for
+// both is 1.
+func (s *SocketService) SetConcurrency(concurrency, maxInFlight int) error {
+	if s._status == StateRunning {
+		return errors.New("Can't set concurrency on service running")
+	}
+	if concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1, got %d", concurrency)
+	}
+	if maxInFlight < concurrency {
+		return fmt.Errorf("max in-flight requests (%d) must not be smaller than concurrency (%d)", maxInFlight, concurrency)
+	}
+
+	s._concurrency = concurrency
+	s._maxInFlight = maxInFlight
+
+	return nil
+}
+
 // GetConnsCount get connect count
 func (s *SocketService) GetConnectionsCount() int {
 	var count int
@@ -216,9 +450,9 @@ func (s *SocketService) Unicast(sid string, pkg *Package) {
 // Broadcast Broadcast to all connections
 func (s *SocketService) Broadcast(pkg *Package) {
 	s._sessions.Range(func(k, v interface{}) bool {
-		s := v.(*Session)
-		if err := s.GetConn().SendPackage(pkg); err != nil {
-			// log.Println(err)
+		session := v.(*Session)
+		if err := session.GetConn().SendPackage(pkg); err != nil {
+			level.Debug(s._logger).Log("msg", "failed to broadcast package", "connection", session.GetConn().GetName(), "err", err)
 		}
 		return true
 	})
@@ -0,0 +1,889 @@
+package tcp_server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/protobuf/proto"
+
+	"github.com/prometheus/pushgateway/compression"
+	"github.com/prometheus/pushgateway/testutil"
+)
+
+var logger = log.NewNopLogger()
+
+func startService(t *testing.T) *SocketService {
+	s, err := NewSocketService("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	return s
+}
+
+func dial(t *testing.T, s *SocketService) net.Conn {
+	c, err := net.Dial("tcp", s.GetAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+func writePackage(t *testing.T, c net.Conn, pkg *Package) {
+	data, err := Encode(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readPackage(t *testing.T, c net.Conn) *Package {
+	var size uint32
+	if err := binary.Read(c, binary.LittleEndian, &size); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c, data); err != nil {
+		t.Fatal(err)
+	}
+	pkg, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+func TestRoute(t *testing.T) {
+	s := startService(t)
+	defer s.Stop("test done")
+
+	if err := s.RegisterRoute(KindHealthy, func(*Session, *Package) ([]byte, error) {
+		return []byte("OK"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterRoute(KindReady, func(*Session, *Package) ([]byte, error) {
+		return nil, NewRequestError(ErrorResponse_UNAVAILABLE, errors.New("not ready"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterRoute(KindPush, func(*Session, *Package) ([]byte, error) {
+		return nil, errors.New("untyped")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dial(t, s)
+	defer c.Close()
+
+	req := NewPackage(KindHealthy, []byte{})
+	writePackage(t, c, req)
+	resp := readPackage(t, c)
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+	if !bytes.Equal(req.GetId(), resp.GetId()) {
+		t.Errorf("Response id %x does not match request id %x.", resp.GetId(), req.GetId())
+	}
+	if expected, got := "OK", string(resp.GetBody()); expected != got {
+		t.Errorf("Wanted body %q, got %q.", expected, got)
+	}
+
+	scenarios := []struct {
+		kind    uint32
+		typ     ErrorResponse_Type
+		message string
+	}{
+		{KindReady, ErrorResponse_UNAVAILABLE, "not ready"},
+		{KindPush, ErrorResponse_INTERNAL, "untyped"},
+		{KindStatus, ErrorResponse_NOT_FOUND, "unknown package kind 8"},
+	}
+	for _, s := range scenarios {
+		req = NewPackage(s.kind, []byte{})
+		writePackage(t, c, req)
+		resp = readPackage(t, c)
+		if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+			t.Errorf("Wanted kind %d, got %d.", expected, got)
+		}
+		if !bytes.Equal(req.GetId(), resp.GetId()) {
+			t.Errorf("Response id %x does not match request id %x.", resp.GetId(), req.GetId())
+		}
+		errResp := &ErrorResponse{}
+		if err := proto.Unmarshal(resp.GetBody(), errResp); err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := s.typ, errResp.GetType(); expected != got {
+			t.Errorf("Wanted error type %v, got %v.", expected, got)
+		}
+		if expected, got := s.message, errResp.GetMessage(); expected != got {
+			t.Errorf("Wanted error message %q, got %q.", expected, got)
+		}
+		if !bytes.Equal(req.GetId(), errResp.GetRequestId()) {
+			t.Errorf("Error request id %x does not match request id %x.", errResp.GetRequestId(), req.GetId())
+		}
+	}
+}
+
+func TestRegisterRoute(t *testing.T) {
+	s, err := NewSocketService("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s._listener.Close()
+
+	noop := func(*Session, *Package) ([]byte, error) { return nil, nil }
+	for _, kind := range []uint32{KindHeartbeat, KindResponse, KindError} {
+		if err := s.RegisterRoute(kind, noop); err == nil {
+			t.Errorf("Expected error registering reserved kind %d.", kind)
+		}
+	}
+	if err := s.RegisterRoute(KindPush, noop); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterRoute(KindPush, noop); err == nil {
+		t.Error("Expected error registering kind twice.")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	s, err := NewSocketService("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetConcurrency(0, 1); err == nil {
+		t.Error("Expected error for concurrency 0.")
+	}
+	if err := s.SetConcurrency(3, 2); err == nil {
+		t.Error("Expected error for max in-flight smaller than concurrency.")
+	}
+	if err := s.SetConcurrency(2, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	unblock := make(chan struct{})
+	if err := s.RegisterRoute(KindPush, func(_ *Session, pkg *Package) ([]byte, error) {
+		if string(pkg.GetBody()) == "slow" {
+			<-unblock
+		}
+		return pkg.GetBody(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Stop("test done")
+
+	c := dial(t, s)
+	defer c.Close()
+
+	// A slow request must not hold up the requests following it.
+	slow := NewPackage(KindPush, []byte("slow"))
+	fast := NewPackage(KindPush, []byte("fast"))
+	writePackage(t, c, slow)
+	writePackage(t, c, fast)
+	resp := readPackage(t, c)
+	if !bytes.Equal(fast.GetId(), resp.GetId()) {
+		t.Errorf("Wanted response to %x first, got response to %x.", fast.GetId(), resp.GetId())
+	}
+
+	// With two slow requests in flight, a third one is not even read.
+	slow2 := NewPackage(KindPush, []byte("slow"))
+	fast2 := NewPackage(KindPush, []byte("fast"))
+	writePackage(t, c, slow2)
+	writePackage(t, c, fast2)
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected no response while max in-flight requests are pending.")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	close(unblock)
+	got := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		resp = readPackage(t, c)
+		if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+			t.Errorf("Wanted kind %d, got %d.", expected, got)
+		}
+		got[string(resp.GetId())] = true
+	}
+	for _, req := range []*Package{slow, slow2, fast2} {
+		if !got[string(req.GetId())] {
+			t.Errorf("Missing response to %x.", req.GetId())
+		}
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp_server_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := testutil.NewCertificateAuthority("test-ca")
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	writeCertificate := func(commonName string) {
+		certPEM, keyPEM := ca.Issue(commonName)
+		if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCertificate("server")
+	if err := ioutil.WriteFile(caFile, ca.CertPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewTLSReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSocketService("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTLS(r.GetConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterRoute(KindStatus, func(session *Session, _ *Package) ([]byte, error) {
+		return []byte(session.GetClientSubject()), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Stop("test done")
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertPEM)
+	clientCertPEM, clientKeyPEM := ca.Issue("client")
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsDial := func(certs []tls.Certificate) (*tls.Conn, error) {
+		c, err := tls.Dial("tcp", s.GetAddr().String(), &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		return c, nil
+	}
+
+	c, err := tlsDial([]tls.Certificate{clientCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	writePackage(t, c, NewPackage(KindStatus, []byte{}))
+	resp := readPackage(t, c)
+	if expected, got := "CN=client", string(resp.GetBody()); expected != got {
+		t.Errorf("Wanted client subject %q, got %q.", expected, got)
+	}
+	if expected, got := "server", c.ConnectionState().PeerCertificates[0].Subject.CommonName; expected != got {
+		t.Errorf("Wanted server certificate for %q, got %q.", expected, got)
+	}
+
+	// Without a client certificate, the handshake fails. With TLS 1.3, the
+	// client only notices when reading.
+	if c, err := tlsDial(nil); err == nil {
+		defer c.Close()
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Error("Expected connection without client certificate to fail.")
+		}
+	}
+
+	writeCertificate("server-reloaded")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := tlsDial([]tls.Certificate{clientCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if expected, got := "server-reloaded", c2.ConnectionState().PeerCertificates[0].Subject.CommonName; expected != got {
+		t.Errorf("Wanted server certificate for %q, got %q.", expected, got)
+	}
+
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("Expected reloading a broken key to fail.")
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcp_server_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretsFile := filepath.Join(dir, "secrets")
+	if err := ioutil.WriteFile(secretsFile, []byte("# comment\n\njob-a:s3cr:et\njob-b:other\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := LoadAuthenticator(secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"", "no-secret\n", ":secret\n", "a:1\na:2\n"} {
+		if err := ioutil.WriteFile(secretsFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadAuthenticator(secretsFile); err == nil {
+			t.Errorf("Expected error loading secrets %q.", content)
+		}
+	}
+
+	s, err := NewSocketService("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetAuthentication(auth, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterRoute(KindStatus, func(session *Session, _ *Package) ([]byte, error) {
+		return []byte(session.GetUserID()), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Stop("test done")
+
+	request := func(c net.Conn, kind uint32, msg proto.Message) *Package {
+		var body []byte
+		if msg != nil {
+			var err error
+			if body, err = proto.Marshal(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req := NewPackage(kind, body)
+		writePackage(t, c, req)
+		resp := readPackage(t, c)
+		if !bytes.Equal(req.GetId(), resp.GetId()) {
+			t.Errorf("Response id %x does not match request id %x.", resp.GetId(), req.GetId())
+		}
+		return resp
+	}
+	expectError := func(resp *Package, typ ErrorResponse_Type) {
+		t.Helper()
+		if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+			t.Fatalf("Wanted kind %d, got %d.", expected, got)
+		}
+		errResp := &ErrorResponse{}
+		if err := proto.Unmarshal(resp.GetBody(), errResp); err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := typ, errResp.GetType(); expected != got {
+			t.Errorf("Wanted error type %s, got %s.", expected, got)
+		}
+	}
+	expectUser := func(c net.Conn, user string) {
+		t.Helper()
+		resp := request(c, KindStatus, nil)
+		if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+			t.Fatalf("Wanted kind %d, got %d.", expected, got)
+		}
+		if expected, got := user, string(resp.GetBody()); expected != got {
+			t.Errorf("Wanted user %q, got %q.", expected, got)
+		}
+	}
+
+	expectClosed := func(c net.Conn) {
+		t.Helper()
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Wanted connection to be closed, got %v.", err)
+		}
+	}
+
+	// Token. Every failed authentication closes the connection.
+	for _, req := range []*AuthRequest{
+		{User: proto.String("job-a"), Token: []byte("wrong")},
+		{User: proto.String("unknown"), Token: []byte("s3cr:et")},
+	} {
+		c := dial(t, s)
+		expectError(request(c, KindAuth, req), ErrorResponse_UNAUTHENTICATED)
+		expectClosed(c)
+		c.Close()
+	}
+	c := dial(t, s)
+	defer c.Close()
+	expectError(request(c, KindStatus, nil), ErrorResponse_UNAUTHENTICATED)
+	// Nothing is decompressed before authentication.
+	expectError(request(c, KindStatus|FlagCompressed, nil), ErrorResponse_UNAUTHENTICATED)
+	expectError(request(c, KindAuth|FlagCompressed, &AuthRequest{
+		User:  proto.String("job-a"),
+		Token: []byte("s3cr:et"),
+	}), ErrorResponse_BAD_DATA)
+	resp := request(c, KindAuth, &AuthRequest{
+		User:  proto.String("job-a"),
+		Token: []byte("s3cr:et"),
+	})
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Fatalf("Wanted kind %d, got %d.", expected, got)
+	}
+	expectUser(c, "job-a")
+	expectError(request(c, KindAuth, &AuthRequest{
+		User:  proto.String("job-b"),
+		Token: []byte("other"),
+	}), ErrorResponse_BAD_DATA)
+
+	// HMAC.
+	hmacReq := &AuthRequest{
+		User:   proto.String("job-b"),
+		Method: AuthRequest_HMAC.Enum(),
+	}
+	// Proof without challenge.
+	c2 := dial(t, s)
+	hmacReq.Proof = ComputeProof([]byte("other"), []byte{})
+	expectError(request(c2, KindAuth, hmacReq), ErrorResponse_UNAUTHENTICATED)
+	expectClosed(c2)
+	c2.Close()
+	c2 = dial(t, s)
+	defer c2.Close()
+	hmacReq.Proof = nil
+	authResp := &AuthResponse{}
+	if err := proto.Unmarshal(request(c2, KindAuth, hmacReq).GetBody(), authResp); err != nil {
+		t.Fatal(err)
+	}
+	challenge := authResp.GetChallenge()
+	if expected, got := challengeLength, len(challenge); expected != got {
+		t.Fatalf("Wanted challenge of %d bytes, got %d.", expected, got)
+	}
+	hmacReq.Proof = ComputeProof([]byte("other"), challenge)
+	if got := request(c2, KindAuth, hmacReq).GetKind(); got != KindResponse {
+		t.Fatalf("Wanted kind %d, got %d.", KindResponse, got)
+	}
+	expectUser(c2, "job-b")
+
+	// A wrong proof closes the connection as well.
+	c3 := dial(t, s)
+	defer c3.Close()
+	hmacReq.Proof = nil
+	if err := proto.Unmarshal(request(c3, KindAuth, hmacReq).GetBody(), authResp); err != nil {
+		t.Fatal(err)
+	}
+	hmacReq.Proof = ComputeProof([]byte("wrong"), authResp.GetChallenge())
+	expectError(request(c3, KindAuth, hmacReq), ErrorResponse_UNAUTHENTICATED)
+	expectClosed(c3)
+
+	// Unauthenticated connections are closed after the timeout, but not
+	// authenticated ones.
+	c4 := dial(t, s)
+	defer c4.Close()
+	expectClosed(c4)
+	expectUser(c, "job-a")
+}
+
+func TestHello(t *testing.T) {
+	s, err := NewSocketService("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetAuthentication(NewAuthenticator(map[string]string{"job": "secret"}), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Stop("test done")
+
+	c := dial(t, s)
+	defer c.Close()
+
+	hello := func(h *Hello) *Package {
+		body, err := proto.Marshal(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := NewPackage(KindHello, body)
+		writePackage(t, c, req)
+		resp := readPackage(t, c)
+		if !bytes.Equal(req.GetId(), resp.GetId()) {
+			t.Errorf("Response id %x does not match request id %x.", resp.GetId(), req.GetId())
+		}
+		return resp
+	}
+
+	scenarios := []struct {
+		name  string
+		hello *Hello
+		err   string
+	}{
+		{
+			name: "version too new",
+			hello: &Hello{
+				MinVersion: proto.Uint32(MaxProtocolVersion + 1),
+				MaxVersion: proto.Uint32(MaxProtocolVersion + 2),
+				Encodings:  []string{EncodingText},
+			},
+			err: "unsupported protocol version: client speaks 2 to 3, server speaks 1 to 1",
+		},
+		{
+			name: "invalid version range",
+			hello: &Hello{
+				MinVersion: proto.Uint32(2),
+				MaxVersion: proto.Uint32(1),
+				Encodings:  []string{EncodingText},
+			},
+			err: "invalid protocol version range 2 to 1",
+		},
+		{
+			name: "no common encoding",
+			hello: &Hello{
+				MinVersion: proto.Uint32(1),
+				MaxVersion: proto.Uint32(1),
+				Encodings:  []string{"json"},
+			},
+			err: `no common body encoding: client supports "json", server supports "proto-delimited,text"`,
+		},
+		{
+			name: "max frame size too small",
+			hello: &Hello{
+				MinVersion:   proto.Uint32(1),
+				MaxVersion:   proto.Uint32(1),
+				Encodings:    []string{EncodingText},
+				MaxFrameSize: proto.Uint32(headerLength - 1),
+			},
+			err: "max frame size must be at least 24 bytes, got 23",
+		},
+	}
+	for _, scenario := range scenarios {
+		resp := hello(scenario.hello)
+		if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+			t.Errorf("%s: Wanted kind %d, got %d.", scenario.name, expected, got)
+			continue
+		}
+		errResp := &ErrorResponse{}
+		if err := proto.Unmarshal(resp.GetBody(), errResp); err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := ErrorResponse_BAD_DATA, errResp.GetType(); expected != got {
+			t.Errorf("%s: Wanted error type %s, got %s.", scenario.name, expected, got)
+		}
+		if expected, got := scenario.err, errResp.GetMessage(); expected != got {
+			t.Errorf("%s: Wanted error %q, got %q.", scenario.name, expected, got)
+		}
+	}
+
+	// Negotiation succeeds despite authentication being required.
+	resp := hello(&Hello{
+		MinVersion:   proto.Uint32(1),
+		MaxVersion:   proto.Uint32(5),
+		Encodings:    []string{"json", EncodingText},
+		Compressions: []string{"zstd"},
+		MaxFrameSize: proto.Uint32(1024),
+	})
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Fatalf("Wanted kind %d, got %d.", expected, got)
+	}
+	negotiated := &Hello{}
+	if err := proto.Unmarshal(resp.GetBody(), negotiated); err != nil {
+		t.Fatal(err)
+	}
+	expected := &Hello{
+		MinVersion:   proto.Uint32(1),
+		MaxVersion:   proto.Uint32(1),
+		Encodings:    []string{EncodingText},
+		Compressions: []string{"zstd", CompressionNone},
+		MaxFrameSize: proto.Uint32(1024),
+	}
+	if !proto.Equal(expected, negotiated) {
+		t.Errorf("Wanted negotiated %v, got %v.", expected, negotiated)
+	}
+	var session *Session
+	s._sessions.Range(func(_, v interface{}) bool {
+		session = v.(*Session)
+		return false
+	})
+	if !proto.Equal(expected, session.GetHello()) {
+		t.Errorf("Wanted negotiated %v on session, got %v.", expected, session.GetHello())
+	}
+	if expected, got := uint32(1), session.GetProtocolVersion(); expected != got {
+		t.Errorf("Wanted protocol version %d on session, got %d.", expected, got)
+	}
+	if expected, got := CompressionZstd, session.GetCompression(); expected != got {
+		t.Errorf("Wanted compression %q on session, got %q.", expected, got)
+	}
+
+	if expected, got := uint32(KindError), hello(expected).GetKind(); expected != got {
+		t.Errorf("Wanted kind %d for second hello, got %d.", expected, got)
+	}
+}
+
+func TestCompressedFrames(t *testing.T) {
+	s, err := NewSocketService("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMaxFrameSize(1024); err != nil {
+		t.Fatal(err)
+	}
+	var compressions []string
+	if err := s.RegisterRoute(KindPush, func(_ *Session, pkg *Package) ([]byte, error) {
+		compressions = append(compressions, pkg.GetCompression())
+		return pkg.GetBody(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Stop("test done")
+
+	c := dial(t, s)
+	defer c.Close()
+
+	request := func(kind uint32, body []byte) *Package {
+		req := NewPackage(kind, body)
+		writePackage(t, c, req)
+		return readPackage(t, c)
+	}
+	errorMessage := func(resp *Package) string {
+		if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+			t.Fatalf("Wanted kind %d, got %d.", expected, got)
+		}
+		errResp := &ErrorResponse{}
+		if err := proto.Unmarshal(resp.GetBody(), errResp); err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := ErrorResponse_BAD_DATA, errResp.GetType(); expected != got {
+			t.Errorf("Wanted error type %s, got %s.", expected, got)
+		}
+		return errResp.GetMessage()
+	}
+
+	body := bytes.Repeat([]byte("some_metric 42\n"), 50)
+	compressed, err := compression.Compress(body, CompressionSnappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := request(KindPush|FlagCompressed, compressed)
+	if expected, got := "compressed frame, but no compression has been negotiated", errorMessage(resp); expected != got {
+		t.Errorf("Wanted error %q, got %q.", expected, got)
+	}
+
+	hello, err := proto.Marshal(&Hello{
+		MinVersion:   proto.Uint32(1),
+		MaxVersion:   proto.Uint32(1),
+		Encodings:    []string{EncodingProtoDelimited},
+		Compressions: []string{"br", CompressionSnappy, CompressionZstd},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = request(KindHello|FlagCompressed, hello)
+	if expected, got := "hello frames must not be compressed", errorMessage(resp); expected != got {
+		t.Errorf("Wanted error %q, got %q.", expected, got)
+	}
+	if expected, got := uint32(KindResponse), request(KindHello, hello).GetKind(); expected != got {
+		t.Fatalf("Wanted kind %d, got %d.", expected, got)
+	}
+
+	resp = request(KindPush|FlagCompressed, compressed)
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Fatalf("Wanted kind %d, got %d.", expected, got)
+	}
+	if !bytes.Equal(body, resp.GetBody()) {
+		t.Errorf("Wanted decompressed body %q, got %q.", body, resp.GetBody())
+	}
+	// Uncompressed frames are still fine.
+	resp = request(KindPush, body[:10])
+	if !bytes.Equal(body[:10], resp.GetBody()) {
+		t.Errorf("Wanted body %q, got %q.", body[:10], resp.GetBody())
+	}
+	if expected, got := []string{CompressionSnappy, CompressionNone}, compressions; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted compressions %q, got %q.", expected, got)
+	}
+
+	resp = request(KindPush|FlagCompressed, body[:10])
+	if expected, got := "failed to decompress snappy body: ", errorMessage(resp); !strings.HasPrefix(got, expected) {
+		t.Errorf("Wanted error starting with %q, got %q.", expected, got)
+	}
+	tooLarge, err := compression.Compress(make([]byte, 1025), CompressionSnappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = request(KindPush|FlagCompressed, tooLarge)
+	if expected, got := "failed to decompress snappy body: decompressed body exceeds the limit of 1024 bytes", errorMessage(resp); expected != got {
+		t.Errorf("Wanted error %q, got %q.", expected, got)
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	s, err := NewSocketService("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMaxFrameSize(headerLength - 1); err == nil {
+		t.Error("Expected error for max frame size smaller than the header.")
+	}
+	if err := s.SetMaxFrameSize(headerLength + 8); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterRoute(KindPush, func(*Session, *Package) ([]byte, error) {
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Stop("test done")
+
+	scenarios := []struct {
+		name string
+		pkg  *Package
+		err  string
+	}{
+		{
+			name: "too large",
+			pkg:  NewPackage(KindPush, make([]byte, 9)),
+			err:  "frame size 33 exceeds the maximum of 32 bytes",
+		},
+		{
+			name: "checksum mismatch",
+			pkg: func() *Package {
+				pkg := NewPackage(KindPush, []byte("body"))
+				pkg._checksum++
+				return pkg
+			}(),
+			err: "package is changed",
+		},
+	}
+	for _, scenario := range scenarios {
+		c := dial(t, s)
+
+		ok := NewPackage(KindPush, make([]byte, 8))
+		writePackage(t, c, ok)
+		if resp := readPackage(t, c); !bytes.Equal(ok.GetId(), resp.GetId()) {
+			t.Errorf("%s: Response id %x does not match request id %x.", scenario.name, resp.GetId(), ok.GetId())
+		}
+
+		writePackage(t, c, scenario.pkg)
+		resp := readPackage(t, c)
+		if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+			t.Errorf("%s: Wanted kind %d, got %d.", scenario.name, expected, got)
+		}
+		if expected, got := make([]byte, idLength), resp.GetId(); !bytes.Equal(expected, got) {
+			t.Errorf("%s: Wanted id %x, got %x.", scenario.name, expected, got)
+		}
+		errResp := &ErrorResponse{}
+		if err := proto.Unmarshal(resp.GetBody(), errResp); err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := ErrorResponse_BAD_DATA, errResp.GetType(); expected != got {
+			t.Errorf("%s: Wanted error type %s, got %s.", scenario.name, expected, got)
+		}
+		if expected, got := scenario.err, errResp.GetMessage(); expected != got {
+			t.Errorf("%s: Wanted error %q, got %q.", scenario.name, expected, got)
+		}
+		// Unread data on the server side might turn the close into a reset.
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%s: Wanted connection to be closed.", scenario.name)
+		}
+		c.Close()
+	}
+}
+
+func TestNegotiatedMaxFrameSize(t *testing.T) {
+	s, err := NewSocketService("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterRoute(KindPush, func(_ *Session, pkg *Package) ([]byte, error) {
+		if string(pkg.GetBody()) == "large" {
+			return make([]byte, 200), nil
+		}
+		return pkg.GetBody(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Stop("test done")
+
+	c := dial(t, s)
+	defer c.Close()
+
+	request := func(pkg *Package) *Package {
+		writePackage(t, c, pkg)
+		resp := readPackage(t, c)
+		if !bytes.Equal(pkg.GetId(), resp.GetId()) {
+			t.Errorf("Response id %x does not match request id %x.", resp.GetId(), pkg.GetId())
+		}
+		return resp
+	}
+	errorMessage := func(resp *Package) string {
+		if expected, got := uint32(KindError), resp.GetKind(); expected != got {
+			t.Fatalf("Wanted kind %d, got %d.", expected, got)
+		}
+		errResp := &ErrorResponse{}
+		if err := proto.Unmarshal(resp.GetBody(), errResp); err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := ErrorResponse_BAD_DATA, errResp.GetType(); expected != got {
+			t.Errorf("Wanted error type %s, got %s.", expected, got)
+		}
+		return errResp.GetMessage()
+	}
+
+	body, err := proto.Marshal(&Hello{
+		MinVersion:   proto.Uint32(1),
+		MaxVersion:   proto.Uint32(1),
+		Encodings:    []string{EncodingText},
+		MaxFrameSize: proto.Uint32(headerLength + 100),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint32(KindResponse), request(NewPackage(KindHello, body)).GetKind(); expected != got {
+		t.Fatalf("Wanted kind %d, got %d.", expected, got)
+	}
+
+	// A frame of the negotiated size and its echo pass.
+	resp := request(NewPackage(KindPush, make([]byte, 100)))
+	if expected, got := uint32(KindResponse), resp.GetKind(); expected != got {
+		t.Errorf("Wanted kind %d, got %d.", expected, got)
+	}
+
+	// A response above the negotiated size is replaced by an error.
+	resp = request(NewPackage(KindPush, []byte("large")))
+	if expected, got := "response cannot be sent: frame size 224 exceeds the maximum of 124 bytes", errorMessage(resp); expected != got {
+		t.Errorf("Wanted error %q, got %q.", expected, got)
+	}
+
+	// A frame above the negotiated size closes the connection.
+	writePackage(t, c, NewPackage(KindPush, make([]byte, 101)))
+	resp = readPackage(t, c)
+	if expected, got := make([]byte, idLength), resp.GetId(); !bytes.Equal(expected, got) {
+		t.Errorf("Wanted id %x, got %x.", expected, got)
+	}
+	if expected, got := "frame size 125 exceeds the maximum of 124 bytes", errorMessage(resp); expected != got {
+		t.Errorf("Wanted error %q, got %q.", expected, got)
+	}
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("Wanted connection to be closed.")
+	}
+}
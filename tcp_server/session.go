@@ -1,23 +1,32 @@
 package tcp_server
 
 import (
+	"crypto/x509"
+	"sync"
+
 	uuid "github.com/satori/go.uuid"
 )
 
-// Session struct
+// Session struct. Requests of a session may be handled concurrently, so all
+// methods are safe for concurrent use.
 type Session struct {
-	_id      string
-	_uid      string
-	_conn     *Connection
-	_settings map[string]interface{}
+	_id            string
+	_mtx           sync.RWMutex
+	_uid           string
+	_authenticated bool
+	_challenge     []byte
+	_hello         *Hello
+	_conn          *Connection
+	_settings      map[string]interface{}
+	_cert          *x509.Certificate
 }
 
 // NewSession create a new session
 func NewSession(conn *Connection) *Session {
 	session := &Session{
-		_id: uuid.NewV4().String(),
-		_uid: "",
-		_conn: conn,
+		_id:       uuid.NewV4().String(),
+		_uid:      "",
+		_conn:     conn,
 		_settings: make(map[string]interface{}),
 	}
 
@@ -31,14 +40,104 @@ func (s *Session) GetSessionID() string {
 
 // BindUserID bind a user ID to session
 func (s *Session) BindUserID(uid string) {
+	s._mtx.Lock()
+	defer s._mtx.Unlock()
 	s._uid = uid
 }
 
 // GetUserID get user ID
 func (s *Session) GetUserID() string {
+	s._mtx.RLock()
+	defer s._mtx.RUnlock()
 	return s._uid
 }
 
+// IsAuthenticated reports whether the session has passed authentication. The
+// authenticated user is bound as user ID.
+func (s *Session) IsAuthenticated() bool {
+	s._mtx.RLock()
+	defer s._mtx.RUnlock()
+	return s._authenticated
+}
+
+func (s *Session) authenticate(uid string) {
+	s._mtx.Lock()
+	defer s._mtx.Unlock()
+	s._uid = uid
+	s._authenticated = true
+	s._challenge = nil
+}
+
+// swapChallenge sets the pending authentication challenge and returns the
+// previous one.
+func (s *Session) swapChallenge(challenge []byte) []byte {
+	s._mtx.Lock()
+	defer s._mtx.Unlock()
+	prev := s._challenge
+	s._challenge = challenge
+	return prev
+}
+
+// GetProtocolVersion get the negotiated protocol version. Without a Hello from
+// the client, this is MinProtocolVersion.
+func (s *Session) GetProtocolVersion() uint32 {
+	s._mtx.RLock()
+	defer s._mtx.RUnlock()
+	if s._hello == nil {
+		return MinProtocolVersion
+	}
+	return s._hello.GetMaxVersion()
+}
+
+// GetHello get the result of the negotiation, or nil if the client has not
+// sent a Hello
+func (s *Session) GetHello() *Hello {
+	s._mtx.RLock()
+	defer s._mtx.RUnlock()
+	return s._hello
+}
+
+// GetCompression get the compression of frames with FlagCompressed set, which
+// is CompressionNone if no compression has been negotiated
+func (s *Session) GetCompression() string {
+	s._mtx.RLock()
+	defer s._mtx.RUnlock()
+	if s._hello == nil || len(s._hello.GetCompressions()) == 0 {
+		return CompressionNone
+	}
+	return s._hello.GetCompressions()[0]
+}
+
+// setHello records the result of the negotiation unless there is one already.
+func (s *Session) setHello(hello *Hello) bool {
+	s._mtx.Lock()
+	defer s._mtx.Unlock()
+	if s._hello != nil {
+		return false
+	}
+	s._hello = hello
+	return true
+}
+
+// GetClientCertificate get the verified certificate the client presented
+// during the TLS handshake, or nil if there is none
+func (s *Session) GetClientCertificate() *x509.Certificate {
+	return s._cert
+}
+
+// GetClientSubject get the subject of the verified client certificate, or an
+// empty string if there is none
+func (s *Session) GetClientSubject() string {
+	if s._cert == nil {
+		return ""
+	}
+	return s._cert.Subject.String()
+}
+
+func (s *Session) setClientCertificate(cert *x509.Certificate) {
+	s._cert = cert
+}
+
 // GetConn get zero.Connection pointer
 func (s *Session) GetConn() *Connection {
 	return s._conn
@@ -51,6 +150,8 @@ func (s *Session) SetConn(conn *Connection) {
 
 // GetSetting get setting
 func (s *Session) GetSetting(key string) interface{} {
+	s._mtx.RLock()
+	defer s._mtx.RUnlock()
 	if v, ok := s._settings[key]; ok {
 		return v
 	}
@@ -60,5 +161,7 @@ func (s *Session) GetSetting(key string) interface{} {
 
 // SetSetting set setting
 func (s *Session) SetSetting(key string, value interface{}) {
+	s._mtx.Lock()
+	defer s._mtx.Unlock()
 	s._settings[key] = value
 }
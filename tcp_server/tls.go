@@ -0,0 +1,82 @@
+package tcp_server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// TLSReloader serves TLS configurations loaded from files. Reload re-reads the
+// files, so that certificates can be replaced without restarting the service.
+// Connections established before a reload keep their configuration.
+type TLSReloader struct {
+	_certFile     string
+	_keyFile      string
+	_clientCAFile string
+	_mtx          sync.RWMutex
+	_config       *tls.Config
+}
+
+// NewTLSReloader create a new TLSReloader for the given server certificate and
+// key. If clientCAFile is not empty, clients have to present a certificate
+// signed by one of the CAs in that file.
+func NewTLSReloader(certFile, keyFile, clientCAFile string) (*TLSReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both a certificate and a key file are required for TLS")
+	}
+	r := &TLSReloader{
+		_certFile:     certFile,
+		_keyFile:      keyFile,
+		_clientCAFile: clientCAFile,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the certificate, key and client CA files. If any of them
+// cannot be loaded, the previous configuration stays in use.
+func (r *TLSReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r._certFile, r._keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %s", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if r._clientCAFile != "" {
+		pem, err := ioutil.ReadFile(r._clientCAFile)
+		if err != nil {
+			return fmt.Errorf("could not load client CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %q", r._clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r._mtx.Lock()
+	r._config = config
+	r._mtx.Unlock()
+	return nil
+}
+
+// GetConfig returns a configuration that always uses the most recently loaded
+// files for new connections.
+func (r *TLSReloader) GetConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r._mtx.RLock()
+			defer r._mtx.RUnlock()
+			return r._config, nil
+		},
+	}
+}